@@ -0,0 +1,137 @@
+package main
+
+import (
+	"crypto/sha512"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aliyun/aliyun-oss-go-sdk/oss"
+)
+
+// whether the chunk at key decompresses to content with the digest in its key
+func verifyChunk(bucket *oss.Bucket, key string) error {
+	body, err := chunkBucket(bucket, key).GetObject(objectKey(key))
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	memoryBudget.acquire(flateJobMemory)
+	defer memoryBudget.release(flateJobMemory)
+
+	flateRead := getFlateReader(&limitedReader{reader: body, limiter: downloadLimiter})
+	defer putFlateReader(flateRead)
+
+	hasher := sha512.New()
+	if _, err := pooledCopy(hasher, flateRead); err != nil {
+		return err
+	}
+
+	if chunkKeyPrefix+hex.EncodeToString(hasher.Sum(nil))+chunkKeySuffix != key {
+		return errChunkMismatch
+	}
+	return nil
+}
+
+/*
+ * `ossBackup adopt`, take the chunks already in the bucket into the local chunk list,
+ * like after copying a repository between buckets with ossutil.
+ * objects not named like chunks are reported and left alone, with -verify every chunk is downloaded and hashed,
+ * which needs chunks in Archive storage to be restored first.
+ */
+func runAdopt(args []string) {
+	var configFileName string
+	var verify bool
+	flags := flag.NewFlagSet("adopt", flag.ExitOnError)
+	flags.StringVar(&configFileName, "c", "", "the name of config file")
+	flags.BoolVar(&verify, "verify", false, "download every chunk and check its content matches its key")
+	flags.Parse(args)
+
+	conf := getConfig(configFileName)
+	_, bucket, err := getOSSClient(&conf)
+	checkErr(err)
+	checkErr(checkRepositoryLayout(bucket, false))
+
+	// a sync would rewrite the chunk list meanwhile
+	lock, err := acquireSyncLock(&conf, bucket, false)
+	checkErr(err)
+	defer lock.release()
+
+	applyBandwidthLimits(&conf)
+	applyMemoryBudget(&conf)
+	initCache(&conf)
+
+	fmt.Println("[Adopt] Listing chunks")
+	var keys []string
+	var malformed int
+	listOnlineChunks(bucket, func(key string) {
+		if _, ok := parseChunkDigest(key); !ok {
+			fmt.Printf("[Adopt] Not a chunk: %s\n", key)
+			malformed++
+			return
+		}
+		keys = append(keys, key)
+	})
+
+	if verify {
+		keys = verifyChunks(&conf, bucket, keys)
+	}
+
+	// the same as a full listing by refreshOnlineChunkList
+	trx, err := cacheDB.Begin()
+	checkErr(err)
+	_, err = trx.Exec("DELETE FROM online_chunks")
+	checkErr(err)
+	for _, key := range keys {
+		_, err := trx.Exec("INSERT OR IGNORE INTO online_chunks (key) VALUES (?)", key)
+		checkErr(err)
+	}
+	checkErr(setCacheMetaTx(trx, "chunkListTime", strconv.FormatInt(time.Now().UnixNano(), 10)))
+	checkErr(trx.Commit())
+
+	fmt.Printf("[Adopt] %d chunks adopted, %d objects are not chunks\n", len(keys), malformed)
+}
+
+// the keys of chunks with valid content, others are reported
+func verifyChunks(conf *userConfig, bucket *oss.Bucket, keys []string) []string {
+	var valid []string
+	var mutex sync.Mutex
+	var checked int64
+
+	queue := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < conf.Concurrency.Download; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for key := range queue {
+				err := verifyChunk(bucket, key)
+
+				mutex.Lock()
+				if err == nil {
+					valid = append(valid, key)
+				} else {
+					fmt.Printf("[Adopt] Chunk %s is not adopted: %v\n", key, err)
+				}
+				mutex.Unlock()
+
+				if done := atomic.AddInt64(&checked, 1); done%1000 == 0 {
+					fmt.Printf("[Adopt] %d / %d chunks verified\n", done, len(keys))
+				}
+			}
+		}()
+	}
+
+	for _, key := range keys {
+		queue <- key
+	}
+	close(queue)
+	wg.Wait()
+
+	return valid
+}
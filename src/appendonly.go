@@ -0,0 +1,39 @@
+package main
+
+import (
+	"errors"
+
+	"github.com/aliyun/aliyun-oss-go-sdk/oss"
+)
+
+/*
+ * in append-only mode nothing in the bucket is deleted or overwritten, so credentials stolen from the config,
+ * which can be given a policy without DeleteObject, cannot destroy backups, and buckets with a retention policy work.
+ * set by getConfig from appendOnly.
+ */
+var appendOnlyMode bool
+
+// add ForbidOverWrite in append-only mode, an object already there is an error instead of being replaced
+func appendOnlyOptions(options []oss.Option) []oss.Option {
+	if appendOnlyMode {
+		options = append(options, oss.ForbidOverWrite(true))
+	}
+	return options
+}
+
+/*
+ * whether a put failed only because the object is there already, and may not be replaced.
+ * fine for chunks and dictionaries, whose keys are digests of their content.
+ */
+func isObjectAlreadyThere(err error) bool {
+	serviceErr, ok := err.(oss.ServiceError)
+	// FileImmutable is returned by buckets with a retention policy
+	return ok && (serviceErr.Code == "FileAlreadyExists" || serviceErr.Code == "FileImmutable")
+}
+
+// stop commands which delete or overwrite objects in append-only mode
+func refuseInAppendOnlyMode(command string) {
+	if appendOnlyMode {
+		checkErr(errors.New(command + " deletes or overwrites objects in the bucket, which appendOnly forbids; run it with credentials and a config of its own"))
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+type auditEntry struct {
+	path     string
+	modTime  int64
+	size     int64
+	chunkKey string
+}
+
+// the outcome of audit-local, kept in the cache as lastAuditLocal
+type auditResult struct {
+	Time    time.Time
+	Audited int
+	Corrupt []string `json:",omitempty"`
+	Error   string   `json:",omitempty"` // set if the audit itself failed
+}
+
+/*
+ * hash again the files whose cache entries were last read from disk more than age ago, sample percent of them,
+ * and compare with the recorded chunk key. a file with the same size and mtime but other content has most likely
+ * rotted on disk: it is reported and its cache entry kept, so the next sync goes on using the intact chunk
+ * instead of uploading the corrupted content as its new version. files changed or gone since are left to the next sync.
+ */
+func auditLocalFiles(conf *userConfig, age time.Duration, sample int) auditResult {
+	result := auditResult{Time: time.Now()}
+	cutoff := time.Now().Add(-age).UnixNano()
+	rows, err := cacheDB.Query("SELECT path, modTime, size, sha512 FROM index_cache WHERE hashTime < ? AND abs(random()) % 100 < ?", cutoff, sample)
+	checkErr(err)
+	var entries []auditEntry
+	for rows.Next() {
+		var entry auditEntry
+		checkErr(rows.Scan(&entry.path, &entry.modTime, &entry.size, &entry.chunkKey))
+		entries = append(entries, entry)
+	}
+	checkErr(rows.Err())
+	rows.Close()
+
+	fmt.Printf("[Audit] Checking %d files hashed before %s\n", len(entries), time.Now().Add(-age).Format(time.RFC3339))
+	share, err := connectShare(conf)
+	checkErr(err)
+	defer share.release()
+	rootPath := sourceRootPath(conf)
+	for _, entry := range entries {
+		fullPath := filepath.Join(rootPath, filepath.FromSlash(entry.path))
+		info, err := statFileInfo(fullPath, entry.path)
+		if err != nil || info.Size != entry.size || info.ModTime != entry.modTime || entry.size == 0 {
+			continue
+		}
+
+		chunkKey, err := hashFileContent(fullPath)
+		if err != nil {
+			fmt.Printf("[Audit] %s could not be read: %v\n", entry.path, err)
+			continue
+		}
+		result.Audited++
+
+		if chunkKey != entry.chunkKey {
+			fmt.Printf("[Audit] %s changed without its size or mtime changing, it may be corrupted on disk. "+
+				"the last backed up version can be restored with -r -only %s\n", entry.path, entry.path)
+			result.Corrupt = append(result.Corrupt, entry.path)
+			continue
+		}
+
+		_, err = cacheDB.Exec("UPDATE index_cache SET hashTime = ? WHERE path = ? AND modTime = ? AND size = ?",
+			time.Now().UnixNano(), entry.path, entry.modTime, entry.size)
+		checkErr(err)
+	}
+
+	fmt.Printf("[Audit] %d files checked, %d corrupted\n", result.Audited, len(result.Corrupt))
+	return result
+}
+
+// `ossBackup audit-local`, exits with 1 if a corrupted file was found
+func runAuditLocal(args []string) {
+	var configFileName string
+	var age time.Duration
+	var sample int
+	flags := flag.NewFlagSet("audit-local", flag.ExitOnError)
+	flags.StringVar(&configFileName, "c", "", "the name of config file")
+	flags.DurationVar(&age, "age", 90*24*time.Hour, "check files whose content was last read longer ago than this")
+	flags.IntVar(&sample, "sample", 100, "check this percentage of them, picked at random")
+	flags.Parse(args)
+
+	if sample <= 0 || sample > 100 {
+		fmt.Fprintln(os.Stderr, "-sample must be between 1 and 100")
+		os.Exit(2)
+	}
+
+	conf := getConfig(configFileName)
+	initCache(&conf)
+	result := auditLocalFiles(&conf, age, sample)
+	saveVerifyResult("lastAuditLocal", result)
+	if len(result.Corrupt) > 0 {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+const cacheSchemaVersion = 5
+
+// 创建表
+const cacheSchema = `
+CREATE TABLE index_cache(
+	path TEXT NOT NULL,
+	modTime BIGINT NOT NULL,
+	size BIGINT NOT NULL,
+	sha512 TEXT NOT NULL,
+	lastSeenTime BIGINT NOT NULL,
+	inode BIGINT NOT NULL DEFAULT 0,
+	changeTime BIGINT NOT NULL DEFAULT 0,
+	quickHash TEXT NOT NULL DEFAULT '',
+	hashTime BIGINT NOT NULL DEFAULT 0
+);
+
+CREATE UNIQUE INDEX index_key_value
+on index_cache (path, modTime, size);
+
+CREATE INDEX index_quick_hash
+on index_cache (quickHash);
+
+CREATE TABLE online_chunks(
+	key TEXT PRIMARY KEY
+);
+
+CREATE TABLE cache_meta(
+	name TEXT PRIMARY KEY,
+	value TEXT NOT NULL
+);
+
+CREATE TABLE compression_stats(
+	ext TEXT PRIMARY KEY,
+	files BIGINT NOT NULL,
+	rawSize BIGINT NOT NULL,
+	compressedSize BIGINT NOT NULL
+);
+
+CREATE TABLE schema_version(
+	version INTEGER NOT NULL
+);
+`
+
+// caches from before schema_version may only have index_cache
+const legacyCacheUpgrade = `
+CREATE TABLE IF NOT EXISTS online_chunks(
+	key TEXT PRIMARY KEY
+);
+
+CREATE TABLE IF NOT EXISTS cache_meta(
+	name TEXT PRIMARY KEY,
+	value TEXT NOT NULL
+);
+
+CREATE TABLE schema_version(
+	version INTEGER NOT NULL
+);
+`
+
+// cacheMigrations[i] upgrades the schema from version i+1 to i+2
+var cacheMigrations = []string{
+	// 2: inode and ctime
+	`ALTER TABLE index_cache ADD COLUMN inode BIGINT NOT NULL DEFAULT 0;
+	ALTER TABLE index_cache ADD COLUMN changeTime BIGINT NOT NULL DEFAULT 0;`,
+	// 3: quick hash of moved files
+	`ALTER TABLE index_cache ADD COLUMN quickHash TEXT NOT NULL DEFAULT '';
+	CREATE INDEX index_quick_hash on index_cache (quickHash);`,
+	// 4: compression per file extension
+	`CREATE TABLE compression_stats(
+		ext TEXT PRIMARY KEY,
+		files BIGINT NOT NULL,
+		rawSize BIGINT NOT NULL,
+		compressedSize BIGINT NOT NULL
+	);`,
+	// 5: when the content was last read, for audit-local
+	`ALTER TABLE index_cache ADD COLUMN hashTime BIGINT NOT NULL DEFAULT 0;`,
+}
+
+// the cache was written by a newer version of this tool
+var errUnknownCacheSchema = errors.New("unknown cache schema version")
+
+/*
+ * bring the cache schema to cacheSchemaVersion.
+ * a new file gets the whole schema, files from before schema_version existed are version 1.
+ * any error here means the cache cannot be used now, see cacheIsBroken for whether it ever can.
+ */
+func migrateCacheSchema(db *sql.DB) error {
+	var tableCount int
+	if err := db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'table'").Scan(&tableCount); err != nil {
+		return err
+	}
+
+	if tableCount == 0 {
+		if _, err := db.Exec(cacheSchema); err != nil {
+			return err
+		}
+		_, err := db.Exec("INSERT INTO schema_version (version) VALUES (?)", cacheSchemaVersion)
+		return err
+	}
+
+	version := 1
+	if err := db.QueryRow("SELECT version FROM schema_version").Scan(&version); err != nil {
+		if err != sql.ErrNoRows {
+			// no version table yet, created by an older version of this tool
+			if _, err := db.Exec(legacyCacheUpgrade); err != nil {
+				return err
+			}
+		}
+		if _, err := db.Exec("INSERT INTO schema_version (version) VALUES (1)"); err != nil {
+			return err
+		}
+	}
+
+	if version > cacheSchemaVersion {
+		return fmt.Errorf("%w %d", errUnknownCacheSchema, version)
+	}
+
+	for ; version < cacheSchemaVersion; version++ {
+		fmt.Printf("Upgrading cache schema to version %d\n", version+1)
+
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(cacheMigrations[version-1]); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if _, err := tx.Exec("UPDATE schema_version SET version = ?", version+1); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+
+	// make sure the tables we need are readable
+	var count int
+	return db.QueryRow("SELECT COUNT(*) FROM index_cache WHERE rowid < 10").Scan(&count)
+}
+
+/*
+ * whether err of openCache means the file itself is unusable, being corrupted, no database or from a newer version.
+ * others, like a database locked by another process or a permission error, go away without losing the cache.
+ */
+func cacheIsBroken(err error) bool {
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) {
+		return sqliteErr.Code == sqlite3.ErrCorrupt || sqliteErr.Code == sqlite3.ErrNotADB
+	}
+	return errors.Is(err, errUnknownCacheSchema)
+}
+
+// rename an unusable cache so a new one can be created, keeping the old one for inspection
+func moveCacheAside(cachePath string) error {
+	asidePath := cachePath + ".broken-" + time.Now().Format("20060102150405")
+	if err := os.Rename(cachePath, asidePath); err != nil {
+		return err
+	}
+
+	os.Remove(cachePath + "-wal")
+	os.Remove(cachePath + "-shm")
+	fmt.Println("Old cache moved to " + asidePath)
+	return nil
+}
+
+// statements of the per-file cache queries, prepared once in initCache
+var lookupCacheStmt *sql.Stmt
+var touchCacheStmt *sql.Stmt
+var insertCacheStmt *sql.Stmt
+var findMovedCacheStmt *sql.Stmt
+var setQuickHashCacheStmt *sql.Stmt
+
+// a cache transaction with the per-file statements bound to it
+type cacheTx struct {
+	*sql.Tx
+	lookup *sql.Stmt
+	touch  *sql.Stmt
+	insert *sql.Stmt
+
+	findMoved    *sql.Stmt
+	setQuickHash *sql.Stmt
+}
+
+func prepareCacheStatements() {
+	var err error
+
+	lookupCacheStmt, err = cacheDB.Prepare("SELECT sha512, inode, changeTime, quickHash FROM index_cache WHERE path = ? AND modTime = ? AND size = ?")
+	checkErr(err)
+	touchCacheStmt, err = cacheDB.Prepare("UPDATE index_cache SET lastSeenTime = ?, inode = ?, changeTime = ? WHERE path = ? AND modTime = ? AND size = ?")
+	checkErr(err)
+	// replaces the entry of a file replaced in place, which has the same path, mtime and size
+	insertCacheStmt, err = cacheDB.Prepare("INSERT OR REPLACE INTO index_cache (path, modTime, size, sha512, lastSeenTime, inode, changeTime, quickHash, hashTime) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)")
+	checkErr(err)
+	findMovedCacheStmt, err = cacheDB.Prepare("SELECT sha512 FROM index_cache WHERE quickHash = ? AND size = ? AND modTime = ? LIMIT 1")
+	checkErr(err)
+	setQuickHashCacheStmt, err = cacheDB.Prepare("UPDATE index_cache SET quickHash = ? WHERE path = ? AND modTime = ? AND size = ?")
+	checkErr(err)
+}
+
+func beginCacheTx() (*cacheTx, error) {
+	tx, err := cacheDB.Begin()
+	if err != nil {
+		return nil, err
+	}
+
+	// statements are closed with the transaction
+	return &cacheTx{
+		Tx:     tx,
+		lookup: tx.Stmt(lookupCacheStmt),
+		touch:  tx.Stmt(touchCacheStmt),
+		insert: tx.Stmt(insertCacheStmt),
+
+		findMoved:    tx.Stmt(findMovedCacheStmt),
+		setQuickHash: tx.Stmt(setQuickHashCacheStmt),
+	}, nil
+}
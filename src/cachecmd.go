@@ -0,0 +1,105 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+)
+
+// `ossBackup cache <action>`
+func runCacheCommand(args []string) {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "Usage: ossBackup cache prune [-c config] [-age 720h]\n       ossBackup cache vacuum [-c config]")
+		os.Exit(2)
+	}
+
+	switch args[0] {
+	case "prune":
+		runCachePrune(args[1:])
+	case "vacuum":
+		runCacheVacuum(args[1:])
+	default:
+		fmt.Fprintln(os.Stderr, "Unknown cache action: "+args[0])
+		os.Exit(2)
+	}
+}
+
+func runCachePrune(args []string) {
+	var configFileName string
+	var age time.Duration
+	flags := flag.NewFlagSet("cache prune", flag.ExitOnError)
+	flags.StringVar(&configFileName, "c", "", "the name of config file")
+	flags.DurationVar(&age, "age", 0, "remove entries not seen for this long (defaults to cachePruneAge in config)")
+	flags.Parse(args)
+
+	conf := getConfig(configFileName)
+	if age == 0 {
+		age = conf.CachePruneAge
+	}
+	if age <= 0 {
+		fmt.Fprintln(os.Stderr, "Nothing to do, -age is not set")
+		os.Exit(2)
+	}
+
+	initCache(&conf)
+	pruneCache(&conf, age)
+}
+
+func runCacheVacuum(args []string) {
+	var configFileName string
+	flags := flag.NewFlagSet("cache vacuum", flag.ExitOnError)
+	flags.StringVar(&configFileName, "c", "", "the name of config file")
+	flags.Parse(args)
+
+	conf := getConfig(configFileName)
+	initCache(&conf)
+	vacuumCache(&conf)
+}
+
+/*
+ * delete cache entries of files not seen by a full scan for longer than age.
+ * the file is vacuumed afterwards if at least a fifth of all entries were deleted.
+ */
+func pruneCache(conf *userConfig, age time.Duration) int64 {
+	cutoff := time.Now().Add(-age).UnixNano()
+
+	var total int64
+	checkErr(cacheDB.QueryRow("SELECT COUNT(*) FROM index_cache").Scan(&total))
+
+	res, err := cacheDB.Exec("DELETE FROM index_cache WHERE lastSeenTime < ?", cutoff)
+	checkErr(err)
+
+	deleted, _ := res.RowsAffected()
+	fmt.Printf("Pruned %d of %d cache entries not seen for %s\n", deleted, total, age)
+
+	if deleted > 0 && deleted*5 >= total {
+		vacuumCache(conf)
+	}
+	return deleted
+}
+
+// rebuild the cache file and its indexes to give space of deleted entries back
+func vacuumCache(conf *userConfig) {
+	cachePath := cacheFilePath(conf, ".cache.dat")
+	sizeBefore := cacheFileSize(cachePath)
+
+	fmt.Print("Vacuuming cache...")
+	_, err := cacheDB.Exec("VACUUM")
+	checkErr(err)
+	_, err = cacheDB.Exec("PRAGMA wal_checkpoint(TRUNCATE)")
+	checkErr(err)
+
+	fmt.Printf("%s -> %s\n", formatFileSize(sizeBefore), formatFileSize(cacheFileSize(cachePath)))
+}
+
+// size of the cache database including its WAL file
+func cacheFileSize(cachePath string) int64 {
+	var size int64
+	for _, path := range []string{cachePath, cachePath + "-wal"} {
+		if stat, err := os.Stat(path); err == nil {
+			size += stat.Size()
+		}
+	}
+	return size
+}
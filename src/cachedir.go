@@ -0,0 +1,80 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// files starting with this are never backed up, in case cacheDir is inside fileRootPath
+const specialFilePrefix = ".__ossIndex_special_."
+
+/*
+ * the default cacheDir: the cache directory systemd made for the service, the OS cache directory of the user,
+ * or fileRootPath if there is none.
+ */
+func defaultCacheDir(conf *userConfig) string {
+	if dir := os.Getenv("CACHE_DIRECTORY"); dir != "" {
+		// several CacheDirectory= entries are separated by colons
+		return strings.Split(dir, ":")[0]
+	}
+
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return conf.FileRootPath
+	}
+	return filepath.Join(dir, "ossBackup")
+}
+
+// path of a local state file in cacheDir, named after fileRootPath so several roots can share one cacheDir
+func cacheFilePath(conf *userConfig, suffix string) string {
+	sum := sha1.Sum([]byte(absFileRootPath(conf)))
+	return filepath.Join(conf.CacheDir, specialFilePrefix+hex.EncodeToString(sum[:8])+suffix)
+}
+
+// move a cache database left inside fileRootPath by older versions to cacheDir
+func migrateLegacyCache(conf *userConfig, cachePath string) {
+	legacyPath := filepath.Join(conf.FileRootPath, specialFilePrefix+"cache.dat")
+	if _, err := os.Stat(legacyPath); err != nil {
+		return
+	}
+	if _, err := os.Stat(cachePath); err == nil {
+		return
+	}
+
+	fmt.Println("Moving cache to " + cachePath)
+	if os.Rename(legacyPath, cachePath) == nil {
+		return
+	}
+
+	// different file systems
+	if err := copyFile(legacyPath, cachePath); err != nil {
+		fmt.Printf("[Error] Cache could not be moved, starting a new one: %v\n", err)
+		os.Remove(cachePath)
+		return
+	}
+	os.Remove(legacyPath)
+}
+
+func copyFile(from string, to string) error {
+	src, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := os.OpenFile(to, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		return err
+	}
+	return dst.Close()
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/karrick/godirwalk"
+)
+
+// position in the change journal reached by the last sync, kept in cache_meta
+const changeJournalMetaName = "changeJournalCursor"
+
+// the journal was deleted, recreated or has overflowed since the saved position, returned with the current position
+var errJournalReset = errors.New("change journal has been reset")
+
+/*
+ * sync driven by the NTFS USN journal or macOS FSEvents instead of a full directory walk.
+ * the journal is read from the position saved by the last sync up to now, only directories with changes are re-scanned,
+ * the rest of the index is copied from a local copy of the last uploaded index.
+ * a nil journalSync, or one without dirtyDirs, falls back to a full scan.
+ */
+type journalSync struct {
+	conf       *userConfig
+	nextCursor string          // journal position before scanning, saved once the index is uploaded
+	dirtyDirs  map[string]bool // nil if a full scan is needed
+	keepCursor bool            // some changed directories could not be read, their changes are read again next time
+}
+
+func startJournalSync(conf *userConfig) *journalSync {
+	if !conf.ChangeJournal {
+		return nil
+	}
+
+	initCache(conf)
+	basePath, _ := filepath.Abs(conf.FileRootPath)
+	cursor := getCacheMeta(changeJournalMetaName)
+
+	changedPaths, nextCursor, err := readChangeJournal(basePath, cursor)
+	if err == errJournalReset {
+		// start over from the current position after a full scan
+		fmt.Println("[Journal] Change journal has been reset, scanning everything")
+		return &journalSync{conf: conf, nextCursor: nextCursor}
+	}
+	if err != nil {
+		fmt.Printf("[Journal] Change journal is not usable, scanning everything: %v\n", err)
+		return nil
+	}
+
+	j := &journalSync{conf: conf, nextCursor: nextCursor}
+
+	if _, err := os.Stat(cacheFilePath(conf, ".index.dat")); cursor == "" || err != nil {
+		fmt.Println("[Journal] No previous position, scanning everything")
+		return j
+	}
+
+	j.dirtyDirs = make(map[string]bool)
+	for _, fullPath := range changedPaths {
+		if !strings.HasPrefix(fullPath, basePath+string(filepath.Separator)) {
+			continue
+		}
+		markJournalChange(basePath, fullPath, j.dirtyDirs)
+	}
+
+	fmt.Printf("[Journal] %d changed paths below %s\n", len(changedPaths), basePath)
+	return j
+}
+
+func markJournalChange(basePath string, fullPath string, dirtyDirs map[string]bool) {
+	if strings.HasPrefix(filepath.Base(fullPath), specialFilePrefix) {
+		return
+	}
+
+	relativePath := relativeSlashPath(basePath, fullPath)
+	dirtyDirs[path.Dir(relativePath)] = true
+
+	stat, err := os.Stat(longPath(fullPath))
+	if err != nil {
+		// removed or renamed, entries below it must be dropped as well
+		dirtyDirs[relativePath] = true
+		return
+	}
+	if !stat.IsDir() || dirtyDirs[relativePath] {
+		return
+	}
+
+	// created or moved in, nothing below it is in the previous index
+	godirwalk.Walk(fullPath, &godirwalk.Options{
+		Callback: func(dirPath string, f *godirwalk.Dirent) error {
+			if f.IsDir() {
+				dirtyDirs[relativeSlashPath(basePath, dirPath)] = true
+			}
+			return nil
+		},
+		ErrorCallback: func(dirPath string, err error) godirwalk.ErrorAction {
+			return godirwalk.SkipNode
+		},
+	})
+}
+
+// whether only changed directories are scanned, cache entries of other files are not touched then
+func (j *journalSync) partial() bool {
+	return j != nil && j.dirtyDirs != nil
+}
+
+func (j *journalSync) makeIndex(conf *userConfig, pipeline *syncPipeline) string {
+	if !j.partial() {
+		return makeDirIndex(conf, pipeline)
+	}
+	indexPath, unreadable := makePartialDirIndex(conf, cacheFilePath(conf, ".index.dat"), j.dirtyDirs, pipeline)
+	j.keepCursor = len(unreadable) > 0
+	return indexPath
+}
+
+// keep the journal position for the next sync, the uploaded index is kept by uploadIndexFile
+func (j *journalSync) commit() {
+	if j == nil || j.keepCursor {
+		return
+	}
+
+	checkErr(setCacheMeta(changeJournalMetaName, j.nextCursor))
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsevents"
+)
+
+// events dropped or ids wrapped, the history cannot be trusted
+const fseventsResetFlags = fsevents.MustScanSubDirs | fsevents.UserDropped | fsevents.KernelDropped | fsevents.EventIDsWrapped | fsevents.RootChanged
+
+/*
+ * full paths changed below root since cursor, replayed from the FSEvents history, and the position to continue from next time.
+ * the cursor is "device uuid:event id".
+ */
+func readChangeJournal(root string, cursor string) ([]string, string, error) {
+	device, err := fsevents.DeviceForPath(root)
+	if err != nil {
+		return nil, "", err
+	}
+	deviceUUID := fsevents.GetDeviceUUID(device)
+	if deviceUUID == "" {
+		return nil, "", errors.New("volume of " + root + " has no FSEvents history")
+	}
+
+	nextCursor := fmt.Sprintf("%s:%d", deviceUUID, fsevents.LatestEventID())
+	if cursor == "" {
+		return nil, nextCursor, nil
+	}
+
+	separator := strings.LastIndex(cursor, ":")
+	if separator < 0 || cursor[:separator] != deviceUUID {
+		return nil, nextCursor, errJournalReset
+	}
+	sinceID, _ := strconv.ParseUint(cursor[separator+1:], 10, 64)
+
+	stream := &fsevents.EventStream{
+		Paths:   []string{root},
+		Latency: 100 * time.Millisecond,
+		EventID: sinceID,
+		Flags:   fsevents.FileEvents | fsevents.WatchRoot,
+	}
+	if err := stream.Start(); err != nil {
+		return nil, "", err
+	}
+	defer stream.Stop()
+
+	var changedPaths []string
+	timeout := time.After(10 * time.Minute)
+
+	for {
+		select {
+		case events := <-stream.Events:
+			for _, event := range events {
+				if event.Flags&fseventsResetFlags != 0 {
+					return nil, nextCursor, errJournalReset
+				}
+				if event.Flags&fsevents.HistoryDone != 0 {
+					return changedPaths, nextCursor, nil
+				}
+				changedPaths = append(changedPaths, "/"+strings.TrimPrefix(event.Path, "/"))
+			}
+
+		case <-timeout:
+			return nil, "", errors.New("FSEvents history could not be read in time")
+		}
+	}
+}
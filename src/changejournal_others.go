@@ -0,0 +1,10 @@
+//go:build !windows && !darwin
+// +build !windows,!darwin
+
+package main
+
+import "errors"
+
+func readChangeJournal(root string, cursor string) ([]string, string, error) {
+	return nil, "", errors.New("no change journal on this platform, use watch mode instead")
+}
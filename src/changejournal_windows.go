@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+const (
+	fsctlQueryUsnJournal = 0x000900f4
+	fsctlReadUsnJournal  = 0x000900bb
+)
+
+// USN_JOURNAL_DATA_V0
+type usnJournalData struct {
+	UsnJournalID    uint64
+	FirstUsn        int64
+	NextUsn         int64
+	LowestValidUsn  int64
+	MaxUsn          int64
+	MaximumSize     uint64
+	AllocationDelta uint64
+}
+
+// READ_USN_JOURNAL_DATA_V0
+type readUsnJournalData struct {
+	StartUsn          int64
+	ReasonMask        uint32
+	ReturnOnlyOnClose uint32
+	Timeout           uint64
+	BytesToWaitFor    uint64
+	UsnJournalID      uint64
+}
+
+// FILE_ID_DESCRIPTOR with a 64-bit file id
+type fileIDDescriptor struct {
+	Size   uint32
+	Type   uint32
+	FileID int64
+	_      int64
+}
+
+var procOpenFileByID = windows.NewLazySystemDLL("kernel32.dll").NewProc("OpenFileById")
+
+/*
+ * full paths changed on the volume of root since cursor, and the position to continue from next time.
+ * the cursor is "journal id:usn", reading the journal needs administrator rights.
+ */
+func readChangeJournal(root string, cursor string) ([]string, string, error) {
+	volumeName := filepath.VolumeName(root)
+	if volumeName == "" || strings.HasPrefix(volumeName, `\\`) {
+		return nil, "", errors.New("only local drives have a USN journal")
+	}
+
+	volumePath, _ := windows.UTF16PtrFromString(`\\.\` + volumeName)
+	volume, err := windows.CreateFile(volumePath, windows.GENERIC_READ, windows.FILE_SHARE_READ|windows.FILE_SHARE_WRITE, nil, windows.OPEN_EXISTING, 0, 0)
+	if err != nil {
+		return nil, "", err
+	}
+	defer windows.CloseHandle(volume)
+
+	var journal usnJournalData
+	var returned uint32
+	if err := windows.DeviceIoControl(volume, fsctlQueryUsnJournal, nil, 0, (*byte)(unsafe.Pointer(&journal)), uint32(unsafe.Sizeof(journal)), &returned, nil); err != nil {
+		return nil, "", err
+	}
+
+	nextCursor := fmt.Sprintf("%d:%d", journal.UsnJournalID, journal.NextUsn)
+	if cursor == "" {
+		return nil, nextCursor, nil
+	}
+
+	parts := strings.SplitN(cursor, ":", 2)
+	if len(parts) != 2 {
+		return nil, nextCursor, errJournalReset
+	}
+	journalID, _ := strconv.ParseUint(parts[0], 10, 64)
+	startUsn, _ := strconv.ParseInt(parts[1], 10, 64)
+	if journalID != journal.UsnJournalID || startUsn < journal.LowestValidUsn {
+		return nil, nextCursor, errJournalReset
+	}
+
+	// names of changed entries by the file id of their parent directory
+	changedNames := make(map[uint64][]string)
+
+	request := readUsnJournalData{
+		StartUsn:     startUsn,
+		ReasonMask:   0xFFFFFFFF,
+		UsnJournalID: journal.UsnJournalID,
+	}
+	buffer := make([]byte, 64*1024)
+
+	for request.StartUsn < journal.NextUsn {
+		err := windows.DeviceIoControl(volume, fsctlReadUsnJournal, (*byte)(unsafe.Pointer(&request)), uint32(unsafe.Sizeof(request)), &buffer[0], uint32(len(buffer)), &returned, nil)
+		if err != nil {
+			return nil, "", err
+		}
+		if returned <= 8 {
+			break
+		}
+
+		// USN_RECORD_V2 records follow the next usn
+		for offset := uint32(8); offset+60 <= returned; {
+			record := buffer[offset:returned]
+			recordLength := binary.LittleEndian.Uint32(record[0:])
+			if recordLength == 0 {
+				break
+			}
+
+			if binary.LittleEndian.Uint16(record[4:]) == 2 {
+				parentID := binary.LittleEndian.Uint64(record[16:])
+				nameLength := binary.LittleEndian.Uint16(record[56:])
+				nameOffset := binary.LittleEndian.Uint16(record[58:])
+
+				name := make([]uint16, nameLength/2)
+				for i := range name {
+					name[i] = binary.LittleEndian.Uint16(record[int(nameOffset)+i*2:])
+				}
+				changedNames[parentID] = append(changedNames[parentID], string(utf16.Decode(name)))
+			}
+
+			offset += recordLength
+		}
+
+		request.StartUsn = int64(binary.LittleEndian.Uint64(buffer[0:]))
+	}
+
+	var changedPaths []string
+	for parentID, names := range changedNames {
+		parentPath, err := pathOfFileID(volume, parentID)
+		if err != nil {
+			// the parent is gone as well, its own record marks it
+			continue
+		}
+		for _, name := range names {
+			changedPaths = append(changedPaths, filepath.Join(parentPath, name))
+		}
+	}
+
+	return changedPaths, nextCursor, nil
+}
+
+func pathOfFileID(volume windows.Handle, fileID uint64) (string, error) {
+	descriptor := fileIDDescriptor{Type: 0, FileID: int64(fileID)}
+	descriptor.Size = uint32(unsafe.Sizeof(descriptor))
+
+	r, _, err := procOpenFileByID.Call(uintptr(volume), uintptr(unsafe.Pointer(&descriptor)), 0,
+		windows.FILE_SHARE_READ|windows.FILE_SHARE_WRITE|windows.FILE_SHARE_DELETE, 0, windows.FILE_FLAG_BACKUP_SEMANTICS)
+	handle := windows.Handle(r)
+	if handle == windows.InvalidHandle {
+		return "", err
+	}
+	defer windows.CloseHandle(handle)
+
+	buffer := make([]uint16, windows.MAX_LONG_PATH)
+	n, err := windows.GetFinalPathNameByHandle(handle, &buffer[0], uint32(len(buffer)), 0)
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimPrefix(windows.UTF16ToString(buffer[:n]), `\\?\`), nil
+}
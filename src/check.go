@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"math/rand"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aliyun/aliyun-oss-go-sdk/oss"
+)
+
+// the outcome of `ossBackup check`, kept in the cache as lastCheck for the daemon and GET /api/status
+type checkResult struct {
+	Time            time.Time
+	Snapshots       int
+	BrokenSnapshots int // indexes which could not be downloaded or verified
+	Chunks          int // chunks the snapshots use
+	MissingChunks   int
+	ReadChunks      int // downloaded and hashed
+	CorruptChunks   int
+	ArchivedSkipped int    // chunks picked for reading but in Archive storage
+	Error           string `json:",omitempty"` // set if the check itself failed
+}
+
+func (r *checkResult) ok() bool {
+	return r.Error == "" && r.BrokenSnapshots == 0 && r.MissingChunks == 0 && r.CorruptChunks == 0
+}
+
+/*
+ * check the repository: every index can be downloaded and verified, and every chunk it uses is in the bucket.
+ * readDataPercent of those chunks, picked at random, are downloaded and hashed as well, finding chunks whose
+ * content was damaged in the bucket. chunks in Archive storage cannot be read without a restore and are skipped.
+ */
+func checkRepository(conf *userConfig, bucket *oss.Bucket, readDataPercent float64) checkResult {
+	result := checkResult{Time: time.Now()}
+
+	used := make(map[string]bool)
+	for _, snapshot := range listSnapshots(bucket) {
+		result.Snapshots++
+		indexPath, _, err := downloadIndex(bucket, snapshot.Key)
+		if err != nil {
+			os.Remove(indexPath)
+			fmt.Printf("[Check] Snapshot %s is broken: %v\n", snapshot.Key, err)
+			result.BrokenSnapshots++
+			continue
+		}
+		scanIndex(indexPath, "", func(line *fileInfo) {
+			if line.ChunkKey != emptyFileChunkKey {
+				used[line.ChunkKey] = true
+			}
+		})
+		os.Remove(indexPath)
+	}
+	result.Chunks = len(used)
+
+	var readable []string
+	listOnlineChunkObjects(bucket, func(key string, object oss.ObjectProperties) {
+		if !used[key] {
+			return
+		}
+		delete(used, key)
+
+		if readDataPercent <= 0 || rand.Float64()*100 >= readDataPercent {
+			return
+		}
+		if object.StorageClass == string(oss.StorageArchive) || object.StorageClass == string(oss.StorageColdArchive) {
+			result.ArchivedSkipped++
+			return
+		}
+		readable = append(readable, key)
+	})
+
+	// left over are the chunks not found in the bucket
+	for key := range used {
+		fmt.Printf("[Check] Chunk %s is missing\n", key)
+	}
+	result.MissingChunks = len(used)
+
+	if len(readable) > 0 {
+		fmt.Printf("[Check] Reading %d chunks\n", len(readable))
+		result.ReadChunks = len(readable)
+		result.CorruptChunks = readChunks(conf, bucket, readable)
+	}
+
+	fmt.Printf("[Check] %d snapshots, %d broken, %d chunks, %d missing, %d read, %d corrupted\n",
+		result.Snapshots, result.BrokenSnapshots, result.Chunks, result.MissingChunks, result.ReadChunks, result.CorruptChunks)
+	if result.ArchivedSkipped > 0 {
+		fmt.Printf("[Check] %d chunks in Archive storage were not read\n", result.ArchivedSkipped)
+	}
+	return result
+}
+
+// download and hash keys, returns how many did not match their key
+func readChunks(conf *userConfig, bucket *oss.Bucket, keys []string) int {
+	var corrupt int64
+	queue := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < conf.Concurrency.Download; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for key := range queue {
+				if err := verifyChunk(bucket, key); err != nil {
+					fmt.Printf("[Check] Chunk %s is corrupted: %v\n", key, err)
+					atomic.AddInt64(&corrupt, 1)
+				}
+			}
+		}()
+	}
+
+	for _, key := range keys {
+		queue <- key
+	}
+	close(queue)
+	wg.Wait()
+
+	return int(corrupt)
+}
+
+// keep the outcome of a check in the cache under name, like lastCheck
+func saveVerifyResult(name string, result interface{}) {
+	value, _ := json.Marshal(result)
+	checkErr(setCacheMeta(name, string(value)))
+}
+
+// `ossBackup check`, exits with 1 if a snapshot or chunk is broken
+func runCheck(args []string) {
+	var configFileName string
+	var readDataPercent float64
+	flags := flag.NewFlagSet("check", flag.ExitOnError)
+	flags.StringVar(&configFileName, "c", "", "the name of config file")
+	flags.Float64Var(&readDataPercent, "read-data-percent", 0, "download and hash this percentage of the chunks, picked at random")
+	flags.Parse(args)
+
+	if readDataPercent < 0 || readDataPercent > 100 {
+		fmt.Fprintln(os.Stderr, "-read-data-percent must be between 0 and 100")
+		os.Exit(2)
+	}
+
+	conf := getConfig(configFileName)
+	_, bucket, err := getOSSClient(&conf)
+	checkErr(err)
+	checkErr(checkRepositoryLayout(bucket, false))
+	applyBandwidthLimits(&conf)
+	initCache(&conf)
+
+	result := checkRepository(&conf, bucket, readDataPercent)
+	saveVerifyResult("lastCheck", result)
+	if !result.ok() {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aliyun/aliyun-oss-go-sdk/oss"
+)
+
+// true if onlineChunksSet comes from a full listing made just now, otherwise chunks missing in it are checked by HEAD
+var onlineChunksComplete bool
+
+/*
+ * fill onlineChunksSet according to chunkCheckMode:
+ * list: list the whole chunk prefix, unless the list cached locally is younger than chunkListMaxAge.
+ * head: never list, start from the cached list and check every missing chunk with a HEAD request.
+ * auto: like list, but use head when the last run hashed fewer than headCheckThreshold files.
+ * with trustLocalState, the cached list is used as is once the bucket has been listed at least once.
+ * between full listings only chunks uploaded or found by this machine are added to the cache.
+ * unless the list is complete, chunks of files hashed in this sync are checked by HEAD even if the cached list has them,
+ * since it does not know about chunks deleted by other hosts, lifecycle rules or by hand, see syncPipeline.submit.
+ * the cached list is never used once a prune has removed chunks after it was made,
+ * nor when it was made for another repository, see repositoryIdentity.
+ */
+func refreshOnlineChunkList(conf *userConfig, bucket *oss.Bucket) {
+	initCache(conf)
+	onlineChunksComplete = false
+
+	// chunks removed by a prune may still be in the cached list
+	useCachedList := !chunksPrunedSinceListing(bucket)
+
+	// the cache is kept by the root path, the bucket or prefix backed up to may have changed since
+	if getCacheMeta("repository") != repositoryIdentity(conf) {
+		useCachedList = false
+		checkErr(setCacheMeta("lastIndexKey", ""))
+	}
+
+	// nothing but this machine writes to the bucket, what it recorded is the whole truth
+	if useCachedList && conf.TrustLocalState && getCacheMeta("chunkListTime") != "" {
+		loadOnlineChunkListFromCache()
+		onlineChunksComplete = true
+		return
+	}
+
+	if useCachedList && conf.ChunkCheckMode == "head" {
+		loadOnlineChunkListFromCache()
+		return
+	}
+
+	if useCachedList && conf.ChunkListMaxAge > 0 {
+		listTime, _ := strconv.ParseInt(getCacheMeta("chunkListTime"), 10, 64)
+		if listTime > 0 && time.Since(time.Unix(0, listTime)) < conf.ChunkListMaxAge {
+			loadOnlineChunkListFromCache()
+			return
+		}
+	}
+
+	if useCachedList && conf.ChunkCheckMode == "auto" {
+		changedFiles, err := strconv.Atoi(getCacheMeta("lastChangedFiles"))
+		if err == nil && changedFiles < conf.HeadCheckThreshold {
+			fmt.Printf("Only %d files changed last time, checking chunks one by one\n", changedFiles)
+			loadOnlineChunkListFromCache()
+			return
+		}
+	}
+
+	fmt.Print("Update Online Chunk List...")
+	onlineChunksSet = newChunkSet()
+
+	trx, err := cacheDB.Begin()
+	checkErr(err)
+	_, err = trx.Exec("DELETE FROM online_chunks")
+	checkErr(err)
+
+	var size int64
+	listOnlineChunkObjects(bucket, func(key string, object oss.ObjectProperties) {
+		onlineChunksSet.add(key)
+		size += object.Size
+		_, err := trx.Exec("INSERT OR IGNORE INTO online_chunks (key) VALUES (?)", key)
+		checkErr(err)
+	})
+
+	checkErr(setCacheMetaTx(trx, "chunkListTime", strconv.FormatInt(time.Now().UnixNano(), 10)))
+	checkErr(setCacheMetaTx(trx, "repositorySize", strconv.FormatInt(size, 10)))
+	checkErr(setCacheMetaTx(trx, "repository", repositoryIdentity(conf)))
+	checkErr(trx.Commit())
+	onlineChunksComplete = true
+
+	fmt.Printf("%d chunks found\n", onlineChunksSet.size())
+}
+
+// the repository chunks are listed from, made of everything deciding where chunks and indexes are stored
+func repositoryIdentity(conf *userConfig) string {
+	parts := []string{conf.Oss.APIPrefix, conf.Oss.BucketName, conf.RepositoryPrefix}
+	return strings.Join(append(parts, conf.Oss.ChunkBuckets...), "\n")
+}
+
+func loadOnlineChunkListFromCache() {
+	fmt.Print("Loading Online Chunk List from cache...")
+	onlineChunksSet = newChunkSet()
+
+	rows, err := cacheDB.Query("SELECT key FROM online_chunks")
+	checkErr(err)
+	defer rows.Close()
+
+	for rows.Next() {
+		var key string
+		checkErr(rows.Scan(&key))
+		onlineChunksSet.add(key)
+	}
+	checkErr(rows.Err())
+
+	fmt.Printf("%d chunks found\n", onlineChunksSet.size())
+}
+
+// remember chunks uploaded or found by this machine, so they are known without listing next time
+func recordUploadedChunks(keys []string) {
+	if cacheDB == nil || len(keys) == 0 {
+		return
+	}
+
+	trx, err := cacheDB.Begin()
+	checkErr(err)
+
+	for _, key := range keys {
+		_, err = trx.Exec("INSERT OR IGNORE INTO online_chunks (key) VALUES (?)", key)
+		checkErr(err)
+	}
+
+	checkErr(trx.Commit())
+}
+
+func getCacheMeta(name string) string {
+	var value string
+	if err := cacheDB.QueryRow("SELECT value FROM cache_meta WHERE name = ?", name).Scan(&value); err != nil {
+		return ""
+	}
+	return value
+}
+
+func setCacheMetaTx(trx *sql.Tx, name string, value string) error {
+	_, err := trx.Exec("INSERT OR REPLACE INTO cache_meta (name, value) VALUES (?, ?)", name, value)
+	return err
+}
+
+func setCacheMeta(name string, value string) error {
+	_, err := cacheDB.Exec("INSERT OR REPLACE INTO cache_meta (name, value) VALUES (?, ?)", name, value)
+	return err
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/hex"
+	"strings"
+	"sync"
+)
+
+/*
+ * chunks are shared by all hosts using the same bucket and repositoryPrefix, each file content is stored once.
+ * hosts sync without excluding each other, which is safe as long as:
+ * - a chunk key is derived from its content, so hosts uploading the same key at the same time write identical bytes
+ *   and whichever PutObject finishes last leaves the same object behind.
+ * - PutObject is atomic, a chunk is either missing or complete, never seen half written by another host.
+ * - chunks are never changed after upload, a host trusting its local chunk list at worst uploads a chunk
+ *   another host has uploaded meanwhile.
+ * - indexes are written under indexes/<host>/ only by that host, see snapshotInfo.
+ * anything removing chunks must read the indexes of every host and must not run while any host syncs.
+ */
+const chunkKeyPrefix = "chunk/sha512/"
+const chunkKeySuffix = ".deflate"
+
+// chunk key of empty files in the index, no object is uploaded for them
+const emptyFileChunkKey = "empty"
+
+// the first 128 bits of a sha512 digest, plenty to tell chunks apart while using a quarter of the memory
+type chunkDigest [16]byte
+
+/*
+ * set of chunk keys known to exist on OSS.
+ * keys in the usual chunk/sha512/<hex>.deflate form are stored as fixed-size binary digests,
+ * anything else falls back to the full string.
+ */
+type chunkSet struct {
+	mutex   sync.RWMutex
+	digests map[chunkDigest]struct{}
+	others  map[string]struct{}
+}
+
+func newChunkSet() *chunkSet {
+	return &chunkSet{
+		digests: make(map[chunkDigest]struct{}),
+		others:  make(map[string]struct{}),
+	}
+}
+
+func parseChunkDigest(key string) (digest chunkDigest, ok bool) {
+	if !strings.HasPrefix(key, chunkKeyPrefix) || !strings.HasSuffix(key, chunkKeySuffix) {
+		return digest, false
+	}
+
+	hexValue := key[len(chunkKeyPrefix) : len(key)-len(chunkKeySuffix)]
+	if len(hexValue) != 128 {
+		return digest, false
+	}
+
+	raw, err := hex.DecodeString(hexValue)
+	if err != nil {
+		return digest, false
+	}
+
+	copy(digest[:], raw)
+	return digest, true
+}
+
+func (s *chunkSet) add(key string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if digest, ok := parseChunkDigest(key); ok {
+		s.digests[digest] = struct{}{}
+	} else {
+		s.others[key] = struct{}{}
+	}
+}
+
+func (s *chunkSet) remove(key string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if digest, ok := parseChunkDigest(key); ok {
+		delete(s.digests, digest)
+	} else {
+		delete(s.others, key)
+	}
+}
+
+func (s *chunkSet) contains(key string) bool {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	if digest, ok := parseChunkDigest(key); ok {
+		_, found := s.digests[digest]
+		return found
+	}
+
+	_, found := s.others[key]
+	return found
+}
+
+func (s *chunkSet) size() int {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	return len(s.digests) + len(s.others)
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// registered here, a completion listing the commands in the map itself would be an initialization cycle
+func init() {
+	commands["completion"] = runCompletion
+}
+
+const bashCompletion = `_{{prog}}() {
+    local cur prev config i
+    cur="${COMP_WORDS[COMP_CWORD]}"
+    prev="${COMP_WORDS[COMP_CWORD-1]}"
+    for ((i = 1; i < COMP_CWORD; i++)); do
+        if [[ "${COMP_WORDS[i]}" == "-c" ]]; then config="${COMP_WORDS[i+1]}"; fi
+    done
+
+    if [[ "$prev" == "-t" ]]; then
+        COMPREPLY=($(compgen -W "$({{prog}} completion snapshots ${config:+-c "$config"} 2>/dev/null)" -- "$cur"))
+    elif [[ $COMP_CWORD -eq 1 ]]; then
+        COMPREPLY=($(compgen -W "{{commands}}" -- "$cur"))
+    fi
+}
+complete -o default -F _{{prog}} {{prog}}
+`
+
+const zshCompletion = `#compdef {{prog}}
+_{{prog}}() {
+    local config
+    local -a candidates
+    local i=${words[(I)-c]}
+    (( i > 0 )) && config=${words[i+1]}
+
+    if [[ ${words[CURRENT-1]} == -t ]]; then
+        candidates=(${(f)"$({{prog}} completion snapshots ${config:+-c $config} 2>/dev/null)"})
+        compadd -a candidates
+    elif (( CURRENT == 2 )); then
+        compadd {{commands}}
+    else
+        _files
+    fi
+}
+compdef _{{prog}} {{prog}}
+`
+
+const fishCompletion = `function __{{prog}}_snapshots
+    set -l tokens (commandline -opc)
+    set -l config
+    if set -l i (contains -i -- -c $tokens); and test (count $tokens) -gt $i
+        set config -c $tokens[(math $i + 1)]
+    end
+    {{prog}} completion snapshots $config 2>/dev/null
+end
+complete -c {{prog}} -f -n '__fish_use_subcommand' -a '{{commands}}'
+complete -c {{prog}} -o t -x -a '(__{{prog}}_snapshots)'
+complete -c {{prog}} -o c -r -F
+`
+
+const powershellCompletion = `Register-ArgumentCompleter -Native -CommandName {{prog}} -ScriptBlock {
+    param($wordToComplete, $commandAst, $cursorPosition)
+    $words = @($commandAst.CommandElements | ForEach-Object { $_.ToString() })
+    $config = @()
+    $i = [array]::IndexOf($words, '-c')
+    if ($i -ge 0 -and $i + 1 -lt $words.Count) { $config = @('-c', $words[$i + 1]) }
+    $prev = if ($wordToComplete) { $words[-2] } else { $words[-1] }
+
+    if ($prev -eq '-t') {
+        $candidates = & {{prog}} completion snapshots @config 2>$null
+    } elseif ($words.Count -eq 1 -or ($words.Count -eq 2 -and $wordToComplete)) {
+        $candidates = '{{commands}}' -split ' '
+    } else {
+        return
+    }
+    $candidates | Where-Object { $_ -like "$wordToComplete*" } | ForEach-Object {
+        [System.Management.Automation.CompletionResult]::new($_, $_, 'ParameterValue', $_)
+    }
+}
+`
+
+var completionScripts = map[string]string{
+	"bash":       bashCompletion,
+	"zsh":        zshCompletion,
+	"fish":       fishCompletion,
+	"powershell": powershellCompletion,
+}
+
+/*
+ * `ossBackup completion bash|zsh|fish|powershell`, print a completion script, like
+ * `source <(ossBackup completion bash)`. snapshot timestamps after -t are completed by
+ * `ossBackup completion snapshots`, which lists them from the bucket of the -c config on the command line.
+ */
+func runCompletion(args []string) {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "Usage: ossBackup completion bash|zsh|fish|powershell")
+		os.Exit(2)
+	}
+
+	if args[0] == "snapshots" {
+		completeSnapshots(args[1:])
+		return
+	}
+
+	script, ok := completionScripts[args[0]]
+	if !ok {
+		fmt.Fprintln(os.Stderr, "Unknown shell: "+args[0])
+		os.Exit(2)
+	}
+
+	names := []string{"-r", "-s", "-h", "-t", "-p", "-c"}
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	prog := strings.TrimSuffix(filepath.Base(os.Args[0]), ".exe")
+	script = strings.ReplaceAll(script, "{{prog}}", prog)
+	script = strings.ReplaceAll(script, "{{commands}}", strings.Join(names, " "))
+	fmt.Print(script)
+}
+
+// print the snapshot timestamps, newest first
+func completeSnapshots(args []string) {
+	var configFileName string
+	flags := flag.NewFlagSet("completion snapshots", flag.ExitOnError)
+	flags.StringVar(&configFileName, "c", "", "the name of config file")
+	flags.Parse(args)
+
+	conf := getConfig(configFileName)
+	_, bucket, err := getOSSClient(&conf)
+	checkErr(err)
+
+	snapshots := listSnapshots(bucket)
+	for i := len(snapshots) - 1; i >= 0; i-- {
+		fmt.Println(snapshots[i].Time)
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/aliyun/aliyun-oss-go-sdk/oss"
+	"github.com/panjf2000/ants"
+)
+
+const adaptiveInterval = 10 * time.Second
+const maxThrottleRetries = 5
+
+/*
+ * resizes a worker pool by measured throughput:
+ * grow by one worker while throughput keeps increasing, halve the pool when OSS throttles or times out.
+ * all methods are safe to call on a nil controller, which means adaptive concurrency is off.
+ */
+type adaptiveController struct {
+	pool           *ants.PoolWithFunc
+	size           int
+	max            int
+	bytes          int64 // atomic, bytes transferred in the current interval
+	throttled      int32 // atomic, throttling errors in the current interval
+	lastThroughput float64
+	grew           bool
+	stop           chan struct{}
+}
+
+func startAdaptiveController(pool *ants.PoolWithFunc, initial int, max int) *adaptiveController {
+	c := &adaptiveController{
+		pool: pool,
+		size: initial,
+		max:  max,
+		stop: make(chan struct{}),
+	}
+
+	go c.run()
+	return c
+}
+
+func (c *adaptiveController) run() {
+	ticker := time.NewTicker(adaptiveInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.stop:
+			return
+		case <-ticker.C:
+			c.adjust()
+		}
+	}
+}
+
+func (c *adaptiveController) adjust() {
+	throughput := float64(atomic.SwapInt64(&c.bytes, 0)) / adaptiveInterval.Seconds()
+	throttled := atomic.SwapInt32(&c.throttled, 0)
+	size := c.size
+
+	if throttled > 0 {
+		size = size / 2
+		c.grew = false
+	} else if throughput > c.lastThroughput*1.05 {
+		size++
+		c.grew = true
+	} else if c.grew && throughput < c.lastThroughput*0.95 {
+		// the last extra worker made things worse
+		size--
+		c.grew = false
+	}
+
+	if size < 1 {
+		size = 1
+	}
+	if size > c.max {
+		size = c.max
+	}
+
+	c.lastThroughput = throughput
+	if size != c.size {
+		fmt.Printf("[Concurrency] %d -> %d workers (%s/s, %d throttled)\n", c.size, size, formatFileSize(int64(throughput)), throttled)
+		c.size = size
+		c.pool.Tune(size)
+	}
+}
+
+func (c *adaptiveController) addBytes(n int64) {
+	if c != nil {
+		atomic.AddInt64(&c.bytes, n)
+	}
+}
+
+func (c *adaptiveController) reportThrottled() {
+	if c != nil {
+		atomic.AddInt32(&c.throttled, 1)
+	}
+}
+
+func (c *adaptiveController) stopNow() {
+	if c != nil {
+		close(c.stop)
+	}
+}
+
+// errors which mean OSS or the network is overloaded, and a retry later will probably succeed
+func isThrottlingError(err error) bool {
+	var serviceErr oss.ServiceError
+	if errors.As(err, &serviceErr) {
+		return serviceErr.StatusCode == 429 || serviceErr.StatusCode == 503 || serviceErr.Code == "SlowDown" || serviceErr.Code == "RequestTimeout"
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// retry throttled uploads with backoff, reporting each throttling to the controller. storageClass "" uses the default of the bucket
+func putChunkWithRetry(bucket *oss.Bucket, controller *adaptiveController, key string, compressedFileName string, compressedData []byte, storageClass string) error {
+	var options []oss.Option
+	if storageClass != "" {
+		options = append(options, oss.ObjectStorageClass(oss.StorageClassType(storageClass)))
+	}
+
+	bucket = chunkBucket(bucket, key)
+	for attempt := 1; ; attempt++ {
+		var err error
+		if compressedData != nil {
+			err = putObjectFromBytes(bucket, objectKey(key), compressedData, options...)
+		} else {
+			err = putObjectFromFile(bucket, objectKey(key), compressedFileName, options...)
+		}
+		if err != nil && isObjectAlreadyThere(err) {
+			// uploaded by another host meanwhile, in append-only mode
+			return nil
+		}
+		if err == nil || !isThrottlingError(err) || attempt >= maxThrottleRetries {
+			return err
+		}
+
+		controller.reportThrottled()
+		time.Sleep(time.Duration(attempt*attempt) * time.Second)
+	}
+}
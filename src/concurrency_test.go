@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aliyun/aliyun-oss-go-sdk/oss"
+)
+
+/*
+ * a bucket answering PutObject like OSS does: the whole object is replaced at once,
+ * and with x-oss-forbid-overwrite an object already there is a FileAlreadyExists error.
+ */
+type fakeBucketServer struct {
+	mutex   sync.Mutex
+	objects map[string][]byte
+	puts    int // objects written, not counting refused puts
+}
+
+func (s *fakeBucketServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut {
+		w.WriteHeader(http.StatusNotImplemented)
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	// let the uploads of all hosts overlap
+	time.Sleep(20 * time.Millisecond)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	// path style, the endpoint is an IP
+	key := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)[1]
+	if _, found := s.objects[key]; found && r.Header.Get("x-oss-forbid-overwrite") == "true" {
+		w.Header().Set("Content-Type", "application/xml")
+		w.WriteHeader(http.StatusConflict)
+		w.Write([]byte(`<?xml version="1.0" encoding="UTF-8"?>
+<Error><Code>FileAlreadyExists</Code><Message>The object you specified already exists and can not be overwritten.</Message><RequestId>0</RequestId><HostId>127.0.0.1</HostId></Error>`))
+		return
+	}
+
+	s.objects[key] = body
+	s.puts++
+	w.Header().Set("ETag", `"0"`)
+	w.WriteHeader(http.StatusOK)
+}
+
+func newFakeBucket(t *testing.T) (*fakeBucketServer, *oss.Bucket) {
+	server := &fakeBucketServer{objects: make(map[string][]byte)}
+	httpServer := httptest.NewServer(server)
+	t.Cleanup(httpServer.Close)
+
+	client, err := oss.New(httpServer.URL, "key", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bucket, err := client.Bucket("backup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return server, bucket
+}
+
+// compress content the way a sync does, returning its chunk key and compressed bytes
+func compressTestChunk(t *testing.T, content []byte) (string, []byte) {
+	path := filepath.Join(t.TempDir(), "file")
+	if err := ioutil.WriteFile(path, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	data, chunkKey, err := compressFileToMemory(path, int64(len(content)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return chunkKey, data
+}
+
+// hosts uploading the same chunk at the same time all succeed and leave the same object behind
+func TestConcurrentChunkUploads(t *testing.T) {
+	for _, appendOnly := range []bool{false, true} {
+		appendOnlyMode = appendOnly
+		server, bucket := newFakeBucket(t)
+		chunkKey, data := compressTestChunk(t, bytes.Repeat([]byte("shared content of two hosts\n"), 1000))
+
+		const hosts = 8
+		errs := make(chan error, hosts)
+		var wg sync.WaitGroup
+		for i := 0; i < hosts; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				// each host compresses the file itself
+				errs <- putChunkWithRetry(bucket, nil, chunkKey, "", append([]byte(nil), data...), "")
+			}()
+		}
+		wg.Wait()
+		close(errs)
+
+		for err := range errs {
+			if err != nil {
+				t.Errorf("appendOnly=%v: upload failed: %v", appendOnly, err)
+			}
+		}
+		if stored := server.objects[objectKey(chunkKey)]; !bytes.Equal(stored, data) {
+			t.Errorf("appendOnly=%v: the stored chunk differs from what was uploaded", appendOnly)
+		}
+		if appendOnly && server.puts != 1 {
+			t.Errorf("appendOnly=%v: the chunk was written %d times, want once", appendOnly, server.puts)
+		}
+	}
+	appendOnlyMode = false
+}
+
+// the chunk key only depends on the content, hosts compressing the same file independently agree on it
+func TestChunkKeyDependsOnContentOnly(t *testing.T) {
+	content := []byte("the same file on another machine")
+	key1, data1 := compressTestChunk(t, content)
+	key2, data2 := compressTestChunk(t, content)
+
+	if key1 != key2 || !bytes.Equal(data1, data2) {
+		t.Errorf("compressing the same content twice gave %s and %s", key1, key2)
+	}
+	if _, ok := parseChunkDigest(key1); !ok {
+		t.Errorf("%s is not a chunk key", key1)
+	}
+}
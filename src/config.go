@@ -4,41 +4,411 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/spf13/viper"
 )
 
 type userConfig struct {
 	FileRootPath string
+	CacheDir     string // where the cache database and lock file are kept, defaults to the OS cache directory
+	TempDir      string // where files are compressed and downloaded to before uploading or restoring, defaults to the OS temp directory
 	Oss          ossConfig
+
+	// all objects are kept under this prefix in the bucket, so several machines or datasets can share one bucket
+	RepositoryPrefix string
+
+	Hostname string   // names snapshots and the lock object of this machine, defaults to its host name
+	Tags     []string // recorded in snapshots to find them later, like "weekly"
+	Language string   // of the messages of syncs and restores: auto, en or zh, auto follows LC_ALL, LC_MESSAGES or LANG
+
+	Daemon       daemonConfig
+	Watch        watchConfig
+	Prune        pruneConfig
+	Tiering      tieringConfig
+	Serve        serveConfig
+	Index        indexConfig
+	ChangeReport changeReportConfig
+	Report       reportConfig
+	Bandwidth    bandwidthConfig
+	Concurrency  concurrencyConfig
+	Priority     priorityConfig
+	MemoryBudget int // MB, limits buffers of compressions in flight and the Go heap, 0 means no limit
+
+	// MB, limits temp files of compressions and downloads in flight, 0 means no limit
+	TempDirBudget int
+
+	// KB, smaller files are compressed and uploaded from memory instead of a temp file, 0 always uses temp files
+	InMemoryThreshold int
+
+	// how long the chunk list cached locally is trusted before listing the bucket again, 0 means always list
+	ChunkListMaxAge time.Duration
+
+	ChunkCheckMode     string // how to know which chunks exist on OSS: auto, list or head
+	HeadCheckThreshold int    // in auto mode, use HEAD requests when fewer files than this changed last time
+	TrustLocalState    bool   // never list or HEAD chunks, only this machine uploads to the bucket
+
+	// never delete or overwrite objects, so stolen credentials cannot destroy backups, see appendOnlyMode
+	AppendOnly bool
+	// never write to the bucket at all, for restore-only machines, see readOnlyMode
+	ReadOnly bool
+
+	// a sync uploads at most this many bytes, files beyond it are left for the next sync, 0 means no limit
+	MaxUploadBytes int64
+	Quota          quotaConfig
+
+	// cache entries not seen by a full scan for this long are removed after each sync, 0 keeps them forever
+	CachePruneAge time.Duration
+
+	// before hashing a file not in the cache, look for a moved or renamed copy by a quick hash of its first and last blocks
+	QuickHash bool
+
+	// find changed directories in the NTFS USN journal or macOS FSEvents instead of walking all of fileRootPath
+	ChangeJournal bool
+
+	// back up from a VSS snapshot of the volume on Windows, so open and locked files are read consistently
+	UseSnapshot bool
+	Snapshot    snapshotConfig
+	Share       shareConfig // credentials of fileRootPath if it is a network share, see connectShare
+	Restore     restoreConfig
+
+	// storage classes of chunks by the path of the file uploading them, the first matching rule wins
+	StorageClasses []storageClassRule
+
+	// online-only files of cloud folders: record them without reading, or read them, letting the sync client download them
+	CloudPlaceholders string
+
+	Filters filtersConfig
+	Walk    walkConfig
+
+	// set while a snapshot is in use, see sourceRootPath
+	snapshotRoot string
+	// set while the network share of fileRootPath is mounted
+	shareRoot string
 }
 
 type ossConfig struct {
-	OssKey     string
-	OssSecret  string
-	BucketName string
-	APIPrefix  string
+	OssKey        string
+	OssSecret     string
+	BucketName    string
+	APIPrefix     string
+	UseLockObject bool // also keep a lock object in the bucket while syncing
+	// buckets chunks are spread over by their digest, for repositories of tens of millions of chunks, see chunkBucket
+	ChunkBuckets []string
 }
 
+type daemonConfig struct {
+	Schedule string        // cron expression, like "0 3 * * *"
+	Jitter   time.Duration // max random delay added before each scheduled run
+	Verify   []verifyJob   // checks run besides syncs
+}
+
+// a check the daemon runs on its own schedule, like a weekly check of the indexes and a monthly read of 1% of the chunks
+type verifyJob struct {
+	Schedule        string        // cron expression, like "0 4 * * 0"
+	Kind            string        // check, or audit-local
+	ReadDataPercent float64       // check: percentage of the chunks downloaded and hashed, 0 only checks that they exist
+	Age             time.Duration // audit-local: files whose content was last read longer ago, 0 is 2160h
+	Sample          int           // audit-local: percentage of them hashed again, 0 is 100
+}
+
+type bandwidthConfig struct {
+	LimitUpload   int // KB/s, 0 means unlimited
+	LimitDownload int // KB/s, 0 means unlimited
+	// file system operations per second while scanning fileRootPath, 0 means unlimited, see scanLimiter
+	LimitScanOps int
+	Schedule     []bandwidthWindow
+}
+
+// different limits during a time of day, like unlimited from 01:00 to 07:00, or 1 MB/s during business hours
+type bandwidthWindow struct {
+	From          string   // "01:00"
+	To            string   // "07:00"
+	Days          []string // weekdays the window starts on, like ["mon", "tue", "wed", "thu", "fri"], empty is every day
+	LimitUpload   int
+	LimitDownload int
+	LimitScanOps  int
+}
+
+type concurrencyConfig struct {
+	Walk      int  // directories read at the same time while scanning, 1 walks in order
+	Hash      int  // files hashed at the same time while scanning
+	Compress  int  // files compressed at the same time while syncing
+	Upload    int  // files uploaded at the same time
+	Download  int  // files downloaded at the same time when restoring
+	Adaptive  bool // adjust upload concurrency by throughput and throttling, starting from Upload
+	MaxUpload int  // upper bound of upload concurrency in adaptive mode
+
+	// chunks of at least LargeFileSize MB are uploaded by a pool of their own with LargeUpload workers,
+	// so many small uploads keep going while a few huge ones share the bandwidth. 0 uploads all chunks in one pool
+	LargeUpload   int
+	LargeFileSize int
+}
+
+type priorityConfig struct {
+	Low           bool // lower CPU and disk I/O priority of the process
+	MaxCPUWorkers int  // files hashed or compressed at the same time, 0 means no limit (1 in low priority mode)
+}
+
+// commands taking and releasing a snapshot, like LVM, btrfs or ZFS ones, files are read from MountPath meanwhile
+type snapshotConfig struct {
+	CreateCommand  string // run by the shell before scanning
+	CleanupCommand string // run by the shell after syncing, also when CreateCommand failed
+	MountPath      string // where the contents of fileRootPath can be found once the snapshot is taken
+}
+
+type restoreConfig struct {
+	// what to do with files differing only by case when restoring to a case-insensitive file system: rename or skip
+	CaseCollision string
+	Retries       int // downloads retried after a transient error before a file is given up
+	// files of at least this many MB are staged in tempDir with ranged GETs, resuming where a dropped connection stopped,
+	// smaller ones are inflated straight from the response
+	ResumeThreshold int
+}
+
+type filtersConfig struct {
+	Commands []string // filter plugins run by the shell, see filterPlugin
+}
+
+// directories never descended into while scanning, see walkLimits
+type walkConfig struct {
+	MaxDepth int      // files at most this many levels below fileRootPath are backed up, like find -maxdepth, 0 means no limit
+	SkipDirs []string // names of directories skipped wherever they are, like node_modules, or slash paths relative to fileRootPath
+}
+
+type changeReportConfig struct {
+	DeletionWarning int // percent of files deleted since the last snapshot to warn about, 0 never warns
+}
+
+type indexConfig struct {
+	FullEvery int    // a full index is uploaded every fullEvery snapshots, the others only hold changes, 1 always uploads full indexes
+	Format    string // format of uploaded indexes: jsonl, or sqlite which older versions cannot restore
+
+	// compression of uploaded indexes: deflate, or zstd with a dictionary which older versions cannot restore
+	Compression string
+
+	SigningKey        string // secret signing uploaded indexes with HMAC-SHA256
+	Ed25519PrivateKey string // base64 seed signing uploaded indexes, preferred over signingKey
+	Ed25519PublicKey  string // base64 key verifying indexes, for machines which only restore
+	RequireSignature  bool   // refuse to restore indexes without a valid signature
+}
+
+type pruneConfig struct {
+	GracePeriod time.Duration // unreferenced chunks are removed only by a prune this long after they were marked
+}
+
+type watchConfig struct {
+	Interval time.Duration // how often changed directories are synced in watch mode
+}
+
+// temp files are created here, "" for the OS temp directory
+var tempDir string
+
+// a tempDir with less free space is rejected
+const minTempDirFreeSpace = 1024 * 1024 * 1024
+
+// set by --limit-upload and --limit-download
+var limitUploadFlag int
+var limitDownloadFlag int
+
+// set by --limit-scan-ops
+var limitScanOpsFlag int
+
+// set by --concurrency-upload and --concurrency-download
+var uploadConcurrencyFlag int
+var downloadConcurrencyFlag int
+
+// set by --low-priority
+var lowPriorityFlag bool
+
+// set by --trust-local-state
+var trustLocalStateFlag bool
+
+// set by --tags, comma separated
+var tagsFlag string
+
+// set by --max-upload-bytes
+var maxUploadBytesFlag int64
+
+// set by --read-only
+var readOnlyFlag bool
+
 func checkConf(conf *userConfig) error {
-	// fileRootPath
-	stat, err := os.Stat(conf.FileRootPath)
-	if err != nil {
-		return errors.New("fileRootPath '" + conf.FileRootPath + "' is not available: " + err.Error())
+	// fileRootPath, shares are only there once connectShare has mounted them and are checked then
+	if _, _, _, ok := parseNetworkPath(conf.FileRootPath); !ok {
+		if err := checkRootDir(conf.FileRootPath); err != nil {
+			return err
+		}
 	}
-	if !stat.IsDir() {
-		return errors.New("fileRootPath '" + conf.FileRootPath + "' is not a directory")
+
+	// cacheDir
+	if conf.CacheDir == "" {
+		conf.CacheDir = defaultCacheDir(conf)
+	}
+	if err := os.MkdirAll(conf.CacheDir, 0755); err != nil {
+		return errors.New("cacheDir '" + conf.CacheDir + "' is not available: " + err.Error())
+	}
+
+	// tempDir
+	if conf.TempDir != "" {
+		if err := os.MkdirAll(conf.TempDir, 0755); err != nil {
+			return errors.New("tempDir '" + conf.TempDir + "' is not available: " + err.Error())
+		}
+		free, err := freeDiskSpace(conf.TempDir)
+		if err != nil {
+			return errors.New("free space of tempDir '" + conf.TempDir + "' is unknown: " + err.Error())
+		}
+		if free < minTempDirFreeSpace {
+			return errors.New("tempDir '" + conf.TempDir + "' has only " + formatFileSize(free) + " free, at least " + formatFileSize(minTempDirFreeSpace) + " is needed")
+		}
 	}
 
 	// oss
 	if conf.Oss.OssKey == "" || conf.Oss.OssSecret == "" || conf.Oss.BucketName == "" || conf.Oss.APIPrefix == "" {
 		return errors.New("oss config is invalid")
 	}
+	if err := checkChunkBuckets(conf.Oss.ChunkBuckets); err != nil {
+		return err
+	}
+	if conf.Quota.Size < 0 || conf.Quota.WarnPercent < 1 || conf.Quota.WarnPercent > 100 {
+		return errors.New("quota.size must not be negative, and quota.warnPercent between 1 and 100")
+	}
+	if conf.AppendOnly && conf.Oss.UseLockObject {
+		return errors.New("oss.useLockObject cannot be used with appendOnly, lock objects are removed after each sync")
+	}
+
+	// concurrency
+	if conf.Concurrency.Walk < 1 || conf.Concurrency.Hash < 1 || conf.Concurrency.Compress < 1 || conf.Concurrency.Upload < 1 || conf.Concurrency.Download < 1 {
+		return errors.New("concurrency must be at least 1")
+	}
+	if conf.Concurrency.LargeUpload < 0 || (conf.Concurrency.LargeUpload > 0 && conf.Concurrency.LargeFileSize < 1) {
+		return errors.New("concurrency.largeUpload must not be negative, and concurrency.largeFileSize at least 1 if it is set")
+	}
+	if conf.Concurrency.Adaptive && conf.Concurrency.MaxUpload < conf.Concurrency.Upload {
+		return errors.New("concurrency.maxUpload must not be less than concurrency.upload")
+	}
+
+	if conf.CloudPlaceholders != "record" && conf.CloudPlaceholders != "read" {
+		return errors.New("cloudPlaceholders '" + conf.CloudPlaceholders + "' is invalid, should be record or read")
+	}
+
+	// walk
+	if conf.Walk.MaxDepth < 0 {
+		return errors.New("walk.maxDepth must not be negative")
+	}
+	for _, dir := range conf.Walk.SkipDirs {
+		if dir == "" || path.IsAbs(dir) || path.Clean(dir) != dir || strings.HasPrefix(dir, "..") {
+			return errors.New("walk.skipDirs entry '" + dir + "' is invalid, should be a directory name or a slash path relative to fileRootPath")
+		}
+	}
+
+	// chunk check
+	if conf.ChunkCheckMode != "auto" && conf.ChunkCheckMode != "list" && conf.ChunkCheckMode != "head" {
+		return errors.New("chunkCheckMode '" + conf.ChunkCheckMode + "' is invalid, should be auto, list or head")
+	}
+
+	// restore
+	if conf.Index.Format != "sqlite" && conf.Index.Format != "jsonl" {
+		return errors.New("index.format '" + conf.Index.Format + "' is invalid, should be sqlite or jsonl")
+	}
+
+	if conf.Index.Compression != "zstd" && conf.Index.Compression != "deflate" {
+		return errors.New("index.compression '" + conf.Index.Compression + "' is invalid, should be zstd or deflate")
+	}
+
+	if _, err := loadIndexKeys(&conf.Index); err != nil {
+		return err
+	}
+
+	if _, ok := messageCatalogs[conf.Language]; !ok && conf.Language != "auto" {
+		return errors.New("language '" + conf.Language + "' is invalid, should be auto, en or zh")
+	}
+
+	if conf.Restore.CaseCollision != "rename" && conf.Restore.CaseCollision != "skip" {
+		return errors.New("restore.caseCollision '" + conf.Restore.CaseCollision + "' is invalid, should be rename or skip")
+	}
+	if conf.Restore.Retries < 0 {
+		return errors.New("restore.retries should not be negative")
+	}
+
+	// snapshot
+	if conf.Snapshot.CreateCommand != "" && conf.Snapshot.MountPath == "" {
+		return errors.New("snapshot.mountPath is required with snapshot.createCommand")
+	}
+
+	// share
+	if _, _, _, ok := parseNetworkPath(conf.FileRootPath); ok {
+		if conf.UseSnapshot || conf.Snapshot.CreateCommand != "" || conf.ChangeJournal {
+			return errors.New("snapshots and changeJournal cannot be used when fileRootPath is a network share")
+		}
+	} else if conf.Share.Username != "" {
+		return errors.New("share.username is set, but fileRootPath is no network share like //server/share or server:/export")
+	}
+
+	if err := checkStorageClassRules(conf.StorageClasses); err != nil {
+		return err
+	}
+	if err := checkTieringConfig(&conf.Tiering); err != nil {
+		return err
+	}
+
+	for _, job := range conf.Daemon.Verify {
+		if job.Kind != "check" && job.Kind != "audit-local" {
+			return errors.New("daemon verify kind '" + job.Kind + "' is invalid, should be check or audit-local")
+		}
+		if job.ReadDataPercent < 0 || job.ReadDataPercent > 100 {
+			return errors.New("daemon verify readDataPercent must be between 0 and 100")
+		}
+		if job.Sample < 0 || job.Sample > 100 {
+			return errors.New("daemon verify sample must be between 0 and 100")
+		}
+	}
+
+	// bandwidth
+	for _, window := range conf.Bandwidth.Schedule {
+		if _, err := parseTimeOfDay(window.From); err != nil {
+			return errors.New("bandwidth schedule time '" + window.From + "' is invalid, should be like 01:00")
+		}
+		if _, err := parseTimeOfDay(window.To); err != nil {
+			return errors.New("bandwidth schedule time '" + window.To + "' is invalid, should be like 07:00")
+		}
+		for _, day := range window.Days {
+			if _, ok := parseWeekday(day); !ok {
+				return errors.New("bandwidth schedule day '" + day + "' is invalid, should be like mon")
+			}
+		}
+	}
 
 	return nil
 }
 
+// viper is not safe for concurrent use, the daemon reloads the config while a sync runs
+var configMutex sync.Mutex
+
 func getConfig(configFileName string) (config userConfig) {
+	config, err := readConfig(configFileName)
+	if err != nil {
+		panic(err)
+	}
+
+	tempDir = config.TempDir
+	appendOnlyMode = config.AppendOnly
+	readOnlyMode = config.ReadOnly
+	setMessageLanguage(config.Language)
+	repositoryPrefix = normalizeRepositoryPrefix(config.RepositoryPrefix)
+	indexSigning, _ = loadIndexKeys(&config.Index)
+
+	return
+}
+
+// read and check the config without applying it to the globals a running sync uses
+func readConfig(configFileName string) (config userConfig, err error) {
+	configMutex.Lock()
+	defer configMutex.Unlock()
+
 	if configFileName == "" {
 		configFileName = "config"
 	}
@@ -47,8 +417,82 @@ func getConfig(configFileName string) (config userConfig) {
 
 	// defaults
 	viper.SetDefault("fileRootPath", "")
+	viper.SetDefault("cacheDir", "")
+	viper.SetDefault("tempDir", "")
 	viper.SetDefault("oss.ossKey", "")
 	viper.SetDefault("oss.ossSecret", "")
+	viper.SetDefault("oss.useLockObject", false)
+	viper.SetDefault("oss.chunkBuckets", []string{})
+	viper.SetDefault("repositoryPrefix", "")
+	viper.SetDefault("hostname", "")
+	viper.SetDefault("tags", []string{})
+	viper.SetDefault("language", "auto")
+	viper.SetDefault("filters.commands", []string{})
+	viper.SetDefault("cloudPlaceholders", "record")
+	viper.SetDefault("walk.maxDepth", 0)
+	viper.SetDefault("walk.skipDirs", []string{})
+	viper.SetDefault("daemon.schedule", "0 3 * * *")
+	viper.SetDefault("daemon.jitter", "0s")
+	viper.SetDefault("watch.interval", "5m")
+	viper.SetDefault("prune.gracePeriod", "48h")
+	viper.SetDefault("serve.listen", "127.0.0.1:8765")
+	viper.SetDefault("serve.grpcListen", "")
+	viper.SetDefault("serve.token", "")
+	viper.SetDefault("tiering.keepRecent", 3)
+	viper.SetDefault("tiering.class", "Archive")
+	viper.SetDefault("tiering.minAge", "720h")
+	viper.SetDefault("index.fullEvery", 10)
+	viper.SetDefault("changeReport.deletionWarning", 20)
+	viper.SetDefault("report.dir", "")
+	viper.SetDefault("report.upload", false)
+	// indexes every installed version can read, the others are opt-in
+	viper.SetDefault("index.format", "jsonl")
+	viper.SetDefault("index.compression", "deflate")
+	viper.SetDefault("index.signingKey", "")
+	viper.SetDefault("index.ed25519PrivateKey", "")
+	viper.SetDefault("index.ed25519PublicKey", "")
+	viper.SetDefault("index.requireSignature", false)
+	viper.SetDefault("bandwidth.limitUpload", 0)
+	viper.SetDefault("bandwidth.limitDownload", 0)
+	viper.SetDefault("bandwidth.limitScanOps", 0)
+	viper.SetDefault("concurrency.walk", 1)
+	viper.SetDefault("concurrency.hash", 4)
+	viper.SetDefault("concurrency.compress", 4)
+	viper.SetDefault("concurrency.upload", 12)
+	viper.SetDefault("concurrency.download", 12)
+	viper.SetDefault("concurrency.adaptive", false)
+	viper.SetDefault("concurrency.maxUpload", 32)
+	viper.SetDefault("concurrency.largeUpload", 0)
+	viper.SetDefault("concurrency.largeFileSize", 256)
+	viper.SetDefault("priority.low", false)
+	viper.SetDefault("priority.maxCPUWorkers", 0)
+	viper.SetDefault("memoryBudget", 0)
+	viper.SetDefault("tempDirBudget", 0)
+	viper.SetDefault("inMemoryThreshold", 8192)
+	viper.SetDefault("chunkListMaxAge", "0s")
+	viper.SetDefault("chunkCheckMode", "auto")
+	viper.SetDefault("headCheckThreshold", 1000)
+	viper.SetDefault("trustLocalState", false)
+	viper.SetDefault("appendOnly", false)
+	viper.SetDefault("readOnly", false)
+	viper.SetDefault("maxUploadBytes", 0)
+	viper.SetDefault("quota.size", 0)
+	viper.SetDefault("quota.warnPercent", 90)
+	viper.SetDefault("quota.refuse", false)
+	viper.SetDefault("cachePruneAge", "720h")
+	viper.SetDefault("quickHash", false)
+	viper.SetDefault("changeJournal", false)
+	viper.SetDefault("useSnapshot", false)
+	viper.SetDefault("snapshot.createCommand", "")
+	viper.SetDefault("snapshot.cleanupCommand", "")
+	viper.SetDefault("snapshot.mountPath", "")
+	viper.SetDefault("share.username", "")
+	viper.SetDefault("share.password", "")
+	viper.SetDefault("share.domain", "")
+	viper.SetDefault("share.mountOptions", "")
+	viper.SetDefault("restore.caseCollision", "rename")
+	viper.SetDefault("restore.retries", 3)
+	viper.SetDefault("restore.resumeThreshold", 64)
 
 	if err := viper.ReadInConfig(); err != nil {
 		if _, ok := err.(viper.ConfigFileNotFoundError); ok {
@@ -57,23 +501,60 @@ func getConfig(configFileName string) (config userConfig) {
 			fmt.Println("Automatically creating a blank config file")
 
 			if err := viper.WriteConfigAs("./config.yml"); err != nil {
-				panic(err)
-			} else {
-				return getConfig(configFileName)
+				return config, err
 			}
+			err = viper.ReadInConfig()
+		}
+		if err != nil {
+			return config, fmt.Errorf("Fatal error config file: \n%s", err)
 		}
-		panic(fmt.Errorf("Fatal error config file: \n%s", err))
 	}
 
 	// unmarshal to userConfig structure
 	if err := viper.Unmarshal(&config); err != nil {
-		panic(err)
+		return config, err
 	}
 
-	// check config
-	if err := checkConf(&config); err != nil {
-		panic(err)
+	// command line flags override config
+	if limitUploadFlag > 0 {
+		config.Bandwidth.LimitUpload = limitUploadFlag
+	}
+	if limitDownloadFlag > 0 {
+		config.Bandwidth.LimitDownload = limitDownloadFlag
+	}
+	if limitScanOpsFlag > 0 {
+		config.Bandwidth.LimitScanOps = limitScanOpsFlag
+	}
+	if uploadConcurrencyFlag > 0 {
+		config.Concurrency.Upload = uploadConcurrencyFlag
+	}
+	if downloadConcurrencyFlag > 0 {
+		config.Concurrency.Download = downloadConcurrencyFlag
+	}
+	if lowPriorityFlag {
+		config.Priority.Low = true
+	}
+	if tagsFlag != "" {
+		config.Tags = strings.Split(tagsFlag, ",")
+	}
+	if trustLocalStateFlag {
+		config.TrustLocalState = true
+	}
+	if maxUploadBytesFlag > 0 {
+		config.MaxUploadBytes = maxUploadBytesFlag
+	}
+	if readOnlyFlag {
+		config.ReadOnly = true
 	}
 
+	// check config
+	err = checkConf(&config)
 	return
 }
+
+// the path of the config file read last
+func configFilePath() string {
+	configMutex.Lock()
+	defer configMutex.Unlock()
+	return viper.ConfigFileUsed()
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"math/rand"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/robfig/cron/v3"
+)
+
+// 1 while a sync started by the daemon is in progress
+var daemonSyncRunning int32
+
+// how often the daemon checks whether the config file has changed
+const configPollInterval = 10 * time.Second
+
+/*
+ * stay resident and run fullSync according to daemon.schedule in config, and the checks of daemon.verify on theirs.
+ * the next run is always computed after the previous one has finished, so runs never overlap.
+ * changes of the config file are applied without a restart, see watchConfigFile.
+ */
+func runDaemon(args []string) {
+	var configFileName string
+	var workDir string
+	flags := flag.NewFlagSet("daemon", flag.ExitOnError)
+	flags.StringVar(&configFileName, "c", "", "the name of config file")
+	flags.StringVar(&workDir, "w", "", "the working directory to look for config file in")
+	flags.Parse(args)
+
+	if workDir != "" {
+		checkErr(os.Chdir(workDir))
+	}
+
+	// started by the service manager, which handles stopping by itself
+	if runAsService(func() { daemonLoop(configFileName) }) {
+		return
+	}
+
+	daemonLoop(configFileName)
+}
+
+func parseDaemonSchedule(conf *userConfig) (cron.Schedule, error) {
+	schedule, err := cron.ParseStandard(conf.Daemon.Schedule)
+	if err != nil {
+		return nil, errors.New("daemon.schedule '" + conf.Daemon.Schedule + "' is invalid: " + err.Error())
+	}
+	return schedule, nil
+}
+
+// something the daemon runs on a schedule, the sync or a check of daemon.verify
+type daemonJob struct {
+	name     string
+	schedule cron.Schedule
+	run      func()
+}
+
+// the sync and the checks of conf
+func daemonJobs(conf *userConfig, configFileName string) ([]daemonJob, error) {
+	schedule, err := parseDaemonSchedule(conf)
+	if err != nil {
+		return nil, err
+	}
+	jobs := []daemonJob{{name: "sync", schedule: schedule, run: func() { runScheduledSync(configFileName) }}}
+
+	for _, verify := range conf.Daemon.Verify {
+		verify := verify
+		schedule, err := cron.ParseStandard(verify.Schedule)
+		if err != nil {
+			return nil, errors.New("daemon verify schedule '" + verify.Schedule + "' is invalid: " + err.Error())
+		}
+		name := verify.Kind
+		if verify.Kind == "check" && verify.ReadDataPercent > 0 {
+			name = fmt.Sprintf("check reading %g%% of the chunks", verify.ReadDataPercent)
+		}
+		jobs = append(jobs, daemonJob{name: name, schedule: schedule, run: func() { runScheduledVerify(configFileName, verify) }})
+	}
+	return jobs, nil
+}
+
+func daemonLoop(configFileName string) {
+	conf := getConfig(configFileName)
+	refuseInReadOnlyMode("daemon")
+	jobs, err := daemonJobs(&conf, configFileName)
+	checkErr(err)
+
+	fmt.Printf("Daemon started, schedule: %s, jitter: %s, %d verify jobs\n", conf.Daemon.Schedule, conf.Daemon.Jitter, len(conf.Daemon.Verify))
+
+	reloaded := make(chan userConfig, 1)
+	go watchConfigFile(configFileName, reloaded)
+
+	for {
+		// the job due first, the sync if several are due at once
+		now := time.Now()
+		job, next := jobs[0], jobs[0].schedule.Next(now)
+		for _, other := range jobs[1:] {
+			if otherNext := other.schedule.Next(now); otherNext.Before(next) {
+				job, next = other, otherNext
+			}
+		}
+		if conf.Daemon.Jitter > 0 {
+			next = next.Add(time.Duration(rand.Int63n(int64(conf.Daemon.Jitter))))
+		}
+
+		fmt.Printf("Next %s at %s\n", job.name, next.Format(time.RFC3339))
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-timer.C:
+			job.run()
+		case newConf := <-reloaded:
+			// compute the next run again with the new schedules
+			timer.Stop()
+			newJobs, err := daemonJobs(&newConf, configFileName)
+			if err != nil {
+				fmt.Printf("[Daemon] %v, keeping schedule %s\n", err, conf.Daemon.Schedule)
+				newConf.Daemon = conf.Daemon
+			} else {
+				jobs = newJobs
+			}
+			conf = newConf
+		}
+	}
+}
+
+/*
+ * check the config file every configPollInterval and send the new config to reloaded when it has changed.
+ * bandwidth limits are applied at once, to a running sync too. everything else, like excludes, is read
+ * by the next sync, a sync in progress goes on with the config it started with.
+ * a config which is invalid is reported and ignored, the daemon keeps the one it has.
+ */
+func watchConfigFile(configFileName string, reloaded chan userConfig) {
+	path := configFilePath()
+	var modTime time.Time
+	if stat, err := os.Stat(path); err == nil {
+		modTime = stat.ModTime()
+	}
+
+	for range time.Tick(configPollInterval) {
+		stat, err := os.Stat(path)
+		if err != nil || stat.ModTime().Equal(modTime) {
+			continue
+		}
+		modTime = stat.ModTime()
+
+		conf, err := readConfig(configFileName)
+		if err != nil {
+			fmt.Printf("[Daemon] Config %s not reloaded: %v\n", path, err)
+			continue
+		}
+
+		fmt.Printf("[Daemon] Config %s reloaded\n", path)
+		applyBandwidthLimits(&conf)
+
+		// only the newest config matters if the daemon has not taken the previous one yet
+		select {
+		case <-reloaded:
+		default:
+		}
+		reloaded <- conf
+	}
+}
+
+// run a single sync without letting a panic kill the daemon
+func runScheduledSync(configFileName string) {
+	if !atomic.CompareAndSwapInt32(&daemonSyncRunning, 0, 1) {
+		fmt.Println("[Daemon] Previous sync is still running, skipped")
+		return
+	}
+	defer atomic.StoreInt32(&daemonSyncRunning, 0)
+
+	defer func() {
+		if err := recover(); err != nil {
+			fmt.Printf("[Daemon] Sync failed: %v\n", err)
+		}
+	}()
+
+	startTime := time.Now()
+	skipped := fullSync(configFileName, false)
+	fmt.Printf("[Daemon] Sync finished in %s, %d files skipped\n", time.Since(startTime).String(), skipped)
+}
+
+/*
+ * run a check of daemon.verify like runScheduledSync runs a sync, never at the same time as one.
+ * the outcome is kept in the cache like `ossBackup check` and `ossBackup audit-local` keep it, so GET /api/status
+ * reports it, a check which failed is kept with its error.
+ */
+func runScheduledVerify(configFileName string, job verifyJob) {
+	if !atomic.CompareAndSwapInt32(&daemonSyncRunning, 0, 1) {
+		fmt.Printf("[Daemon] A sync is still running, %s skipped\n", job.Kind)
+		return
+	}
+	defer atomic.StoreInt32(&daemonSyncRunning, 0)
+
+	startTime := time.Now()
+	defer func() {
+		if err := recover(); err != nil {
+			fmt.Printf("[Daemon] %s failed: %v\n", job.Kind, err)
+			if cacheDB == nil {
+				return
+			}
+			if job.Kind == "audit-local" {
+				saveVerifyResult("lastAuditLocal", auditResult{Time: startTime, Error: fmt.Sprint(err)})
+			} else {
+				saveVerifyResult("lastCheck", checkResult{Time: startTime, Error: fmt.Sprint(err)})
+			}
+		}
+	}()
+
+	conf := getConfig(configFileName)
+	initCache(&conf)
+
+	var outcome string
+	if job.Kind == "audit-local" {
+		age, sample := job.Age, job.Sample
+		if age == 0 {
+			age = 90 * 24 * time.Hour
+		}
+		if sample == 0 {
+			sample = 100
+		}
+
+		result := auditLocalFiles(&conf, age, sample)
+		saveVerifyResult("lastAuditLocal", result)
+		outcome = fmt.Sprintf("%d files checked, %d corrupted", result.Audited, len(result.Corrupt))
+	} else {
+		_, bucket, err := getOSSClient(&conf)
+		checkErr(err)
+		checkErr(checkRepositoryLayout(bucket, false))
+		applyBandwidthLimits(&conf)
+
+		result := checkRepository(&conf, bucket, job.ReadDataPercent)
+		saveVerifyResult("lastCheck", result)
+		outcome = "no problems found"
+		if !result.ok() {
+			outcome = fmt.Sprintf("%d broken snapshots, %d missing and %d corrupted chunks", result.BrokenSnapshots, result.MissingChunks, result.CorruptChunks)
+		}
+	}
+	fmt.Printf("[Daemon] %s finished in %s, %s\n", job.Kind, time.Since(startTime).String(), outcome)
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// samples kept for the storage usage chart of the dashboard
+const maxUsageSamples = 365
+
+// the size of fileRootPath and of the bucket after a sync
+type usageSample struct {
+	Time   time.Time
+	Files  int32
+	Size   int64 // of the files in the snapshot
+	Chunks int   // in the bucket as far as this machine knows
+}
+
+func readUsageHistory() []usageSample {
+	samples := []usageSample{}
+	if value := getCacheMeta("usageHistory"); value != "" {
+		json.Unmarshal([]byte(value), &samples)
+	}
+	return samples
+}
+
+// record the usage after a sync uploaded indexPath, kept in the cache for the dashboard
+func recordUsageSample(indexPath string) {
+	var sample usageSample
+	sample.Time = time.Now()
+	sample.Files, sample.Size = indexStats(indexPath, "")
+	checkErr(cacheDB.QueryRow("SELECT COUNT(*) FROM online_chunks").Scan(&sample.Chunks))
+
+	samples := append(readUsageHistory(), sample)
+	if len(samples) > maxUsageSamples {
+		samples = samples[len(samples)-maxUsageSamples:]
+	}
+	content, _ := json.Marshal(samples)
+	checkErr(setCacheMeta("usageHistory", string(content)))
+}
+
+// GET /api/usage, the samples recorded after each sync, oldest first
+func (s *apiServer) handleUsage(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, readUsageHistory())
+}
+
+// GET /, the dashboard, which asks for the token and keeps it in the browser
+func handleDashboard(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write([]byte(dashboardHTML))
+}
+
+const dashboardHTML = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>OssArchiveStorageBackup</title>
+<style>
+body { font-family: sans-serif; margin: 2em auto; max-width: 60em; padding: 0 1em; color: #222; }
+h2 { margin-top: 1.5em; }
+table { border-collapse: collapse; width: 100%; }
+td, th { border-bottom: 1px solid #ddd; padding: .3em .5em; text-align: left; }
+.ok { color: #2a7; } .failed { color: #c33; } .running { color: #27c; }
+#status { font-size: 1.3em; }
+input { margin: .2em 0; padding: .3em; }
+</style>
+</head>
+<body>
+<h1>Backup</h1>
+<p id="login">Token: <input id="token" type="password"> <button onclick="saveToken()">OK</button></p>
+
+<h2>Last run</h2>
+<p id="status">Loading...</p>
+<button onclick="startSync()">Back up now</button>
+
+<h2>Storage</h2>
+<svg id="chart" width="100%" height="160" viewBox="0 0 600 160" preserveAspectRatio="none"></svg>
+<p id="usage"></p>
+
+<h2>Snapshots</h2>
+<table id="snapshots"><tr><th>Host</th><th>Time</th><th>Tags</th><th></th></tr></table>
+
+<h2>Restore</h2>
+<form onsubmit="restore(); return false">
+<p>Snapshot <input id="restoreTime" size="40"></p>
+<p>Restore to <input id="restorePath" size="40"> (empty restores to the original folder)</p>
+<p>Only files below <input id="restoreOnly" size="40"> (optional)</p>
+<p><button type="submit">Restore</button></p>
+</form>
+
+<script>
+function api(method, path, body, done) {
+  var xhr = new XMLHttpRequest();
+  xhr.open(method, path);
+  xhr.setRequestHeader("Authorization", "Bearer " + (localStorage.getItem("ossBackupToken") || ""));
+  xhr.onload = function () {
+    var result = xhr.responseText ? JSON.parse(xhr.responseText) : null;
+    if (xhr.status == 401) { document.getElementById("login").style.display = ""; return; }
+    if (xhr.status >= 400) { alert(result.error); return; }
+    done(result);
+  };
+  xhr.send(body ? JSON.stringify(body) : null);
+}
+
+function saveToken() {
+  localStorage.setItem("ossBackupToken", document.getElementById("token").value);
+  refresh();
+}
+
+function formatSize(size) {
+  var units = ["B", "KB", "MB", "GB", "TB"], i = 0;
+  while (size >= 1024 && i < units.length - 1) { size /= 1024; i++; }
+  return size.toFixed(1) + " " + units[i];
+}
+
+function text(tag, value) {
+  var element = document.createElement(tag);
+  element.textContent = value;
+  return element;
+}
+
+function showStatus(status) {
+  document.getElementById("login").style.display = "none";
+  var element = document.getElementById("status");
+  var run = status.current || status.history[0];
+  if (!run) { element.textContent = "No backup has run since the server started"; element.className = ""; return; }
+  if (run.Running) {
+    element.textContent = "A " + run.Kind + " is running since " + new Date(run.Start).toLocaleString();
+    element.className = "running";
+  } else if (run.Error || run.Failed > 0) {
+    element.textContent = "The " + run.Kind + " of " + new Date(run.Start).toLocaleString() + " had problems: " + (run.Error || run.Failed + " files failed");
+    element.className = "failed";
+  } else {
+    element.textContent = "The " + run.Kind + " of " + new Date(run.Start).toLocaleString() + " succeeded";
+    element.className = "ok";
+  }
+}
+
+function showUsage(samples) {
+  var chart = document.getElementById("chart");
+  chart.innerHTML = "";
+  if (samples.length == 0) { document.getElementById("usage").textContent = "No backups recorded yet"; return; }
+  var max = Math.max.apply(null, samples.map(function (s) { return s.Size; })) || 1;
+  var points = samples.map(function (s, i) {
+    var x = samples.length == 1 ? 300 : i * 600 / (samples.length - 1);
+    return x + "," + (155 - s.Size * 150 / max);
+  });
+  var line = document.createElementNS("http://www.w3.org/2000/svg", "polyline");
+  line.setAttribute("points", points.join(" "));
+  line.setAttribute("fill", "none");
+  line.setAttribute("stroke", "#27c");
+  line.setAttribute("stroke-width", "2");
+  chart.appendChild(line);
+  var last = samples[samples.length - 1];
+  document.getElementById("usage").textContent = last.Files + " files, " + formatSize(last.Size) + " backed up on " + new Date(last.Time).toLocaleString();
+}
+
+function showSnapshots(snapshots) {
+  var table = document.getElementById("snapshots");
+  while (table.rows.length > 1) table.deleteRow(1);
+  snapshots.reverse().forEach(function (s) {
+    var row = table.insertRow();
+    row.appendChild(text("td", s.Host));
+    row.appendChild(text("td", s.Time));
+    row.appendChild(text("td", (s.Tags || []).join(", ")));
+    var pick = text("button", "Restore...");
+    pick.onclick = function () { document.getElementById("restoreTime").value = s.Time; };
+    var cell = row.insertCell();
+    cell.appendChild(pick);
+  });
+}
+
+function startSync() {
+  api("POST", "/api/sync", null, refresh);
+}
+
+function restore() {
+  var path = document.getElementById("restorePath").value;
+  var request = {
+    Time: document.getElementById("restoreTime").value,
+    Path: path,
+    Only: document.getElementById("restoreOnly").value,
+    OriginalPath: path == ""
+  };
+  if (path == "" && !confirm("Restore the files to the folder they were backed up from? Files already there are kept.")) return;
+  api("POST", "/api/restore", request, refresh);
+}
+
+function refresh() {
+  api("GET", "/api/status", null, showStatus);
+  api("GET", "/api/usage", null, showUsage);
+  api("GET", "/api/snapshots", null, showSnapshots);
+}
+
+refresh();
+setInterval(function () { api("GET", "/api/status", null, showStatus); }, 10000);
+</script>
+</body>
+</html>
+`
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// kept free on top of what a file needs, for the cache, logs and everybody else
+const diskSpaceReserve = 100 * 1024 * 1024
+
+// how long to wait for other workers to free temp space before giving up on a file
+const diskSpaceWaitTimeout = 10 * time.Minute
+
+var errDiskFull = errors.New("not enough free disk space")
+
+// limits bytes of temp files staged by all workers together, nil means no limit
+var tempBudget *byteSemaphore
+
+func applyTempBudget(conf *userConfig) {
+	tempBudget = nil
+	if conf.TempDirBudget <= 0 {
+		return
+	}
+
+	tempBudget = newByteSemaphore(int64(conf.TempDirBudget) * 1024 * 1024)
+	fmt.Printf("Temp space budget: %s\n", formatFileSize(tempBudget.total))
+}
+
+// where temp files are created
+func stagingDir() string {
+	if tempDir != "" {
+		return tempDir
+	}
+	return os.TempDir()
+}
+
+/*
+ * make sure dir has room for need bytes, waiting up to wait for space to be freed.
+ * temp files of other workers are removed once uploaded, so waiting on the temp dir usually helps.
+ */
+func waitForDiskSpace(dir string, need int64, wait time.Duration) error {
+	deadline := time.Now().Add(wait)
+	waiting := false
+
+	for {
+		free, err := freeDiskSpace(dir)
+		if err != nil {
+			// unknown, let the write itself fail if it has to
+			return nil
+		}
+		if free >= need+diskSpaceReserve {
+			return nil
+		}
+
+		if time.Now().After(deadline) {
+			return fmt.Errorf("%w in %s: %s needed, %s free", errDiskFull, dir, formatFileSize(need), formatFileSize(free))
+		}
+		if !waiting {
+			waiting = true
+			fmt.Printf("[Disk] Waiting for %s of free space in %s (%s free)\n", formatFileSize(need), dir, formatFileSize(free))
+		}
+		time.Sleep(10 * time.Second)
+	}
+}
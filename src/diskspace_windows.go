@@ -0,0 +1,17 @@
+package main
+
+import "golang.org/x/sys/windows"
+
+// bytes available to us on the volume of dir, quotas included
+func freeDiskSpace(dir string) (int64, error) {
+	dirPtr, err := windows.UTF16PtrFromString(dir)
+	if err != nil {
+		return 0, err
+	}
+
+	var available, total, totalFree uint64
+	if err := windows.GetDiskFreeSpaceEx(dirPtr, &available, &total, &totalFree); err != nil {
+		return 0, err
+	}
+	return int64(available), nil
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/aliyun/aliyun-oss-go-sdk/oss"
+)
+
+// OSS refuses requests whose time is further off than this
+const maxClockSkew = 15 * time.Minute
+
+// the outcome of one check of `ossBackup doctor`
+const (
+	doctorOK = iota
+	doctorWarning
+	doctorFailed
+)
+
+type doctorChecks struct {
+	failed int
+}
+
+// run fn as the check named name and print its outcome, a panic of fn fails the check
+func (d *doctorChecks) run(name string, fn func() (int, string)) int {
+	outcome, detail := doctorFailed, ""
+	func() {
+		defer func() {
+			if err := recover(); err != nil {
+				outcome, detail = doctorFailed, fmt.Sprint(err)
+			}
+		}()
+		outcome, detail = fn()
+	}()
+
+	mark := "[OK]  "
+	switch outcome {
+	case doctorWarning:
+		mark = "[WARN]"
+	case doctorFailed:
+		mark = "[FAIL]"
+		d.failed++
+	}
+	if detail != "" {
+		detail = ": " + detail
+	}
+	fmt.Printf("%s %s%s\n", mark, name, detail)
+	return outcome
+}
+
+func failedWith(err error) (int, string) {
+	return doctorFailed, err.Error()
+}
+
+/*
+ * `ossBackup doctor`, check the config, the credentials and the bucket, the permissions a sync needs,
+ * the clock, the temp dir and the cache before a real run finds a problem halfway through.
+ * a small object below doctor/ is written, read and deleted again. exits with 1 if a check failed.
+ */
+func runDoctor(args []string) {
+	var configFileName string
+	flags := flag.NewFlagSet("doctor", flag.ExitOnError)
+	flags.StringVar(&configFileName, "c", "", "the name of config file")
+	flags.Parse(args)
+
+	var d doctorChecks
+	var conf userConfig
+	if d.run("Config", func() (int, string) {
+		var err error
+		if conf, err = readConfig(configFileName); err != nil {
+			return failedWith(err)
+		}
+		conf = getConfig(configFileName)
+		return doctorOK, configFilePath()
+	}) == doctorFailed {
+		os.Exit(1)
+	}
+
+	var client *oss.Client
+	var bucket *oss.Bucket
+	if d.run("Credentials and bucket "+conf.Oss.BucketName, func() (int, string) {
+		var err error
+		if client, bucket, err = getOSSClient(&conf); err != nil {
+			return failedWith(err)
+		}
+		exists, err := client.IsBucketExist(conf.Oss.BucketName)
+		if err != nil {
+			return failedWith(err)
+		}
+		if !exists {
+			return doctorFailed, "the bucket does not exist"
+		}
+		return doctorOK, ""
+	}) == doctorFailed {
+		os.Exit(1)
+	}
+
+	for _, name := range conf.Oss.ChunkBuckets {
+		d.run("Chunk bucket "+name, func() (int, string) {
+			exists, err := client.IsBucketExist(name)
+			if err != nil {
+				return failedWith(err)
+			}
+			if !exists {
+				return doctorFailed, "the bucket does not exist"
+			}
+			return doctorOK, ""
+		})
+	}
+
+	d.run("ListObjects", func() (int, string) {
+		if _, err := bucket.ListObjects(oss.Prefix(objectKey("")), oss.MaxKeys(1)); err != nil {
+			return failedWith(err)
+		}
+		return doctorOK, ""
+	})
+
+	testKey := objectKey("doctor/" + snapshotHost(&conf) + "-" + strconv.FormatInt(time.Now().UnixNano(), 10))
+	content := []byte("written by ossBackup doctor, safe to delete")
+	put := doctorFailed
+	if readOnlyMode {
+		fmt.Println("[OK]   PutObject: not needed with readOnly, reading it back and the clock are not checked")
+	} else {
+		put = d.run("PutObject", func() (int, string) {
+			if err := bucket.PutObject(testKey, bytes.NewReader(content), appendOnlyOptions(nil)...); err != nil {
+				return failedWith(err)
+			}
+			return doctorOK, ""
+		})
+	}
+
+	if put != doctorFailed {
+		d.run("GetObject", func() (int, string) {
+			body, err := bucket.GetObject(testKey)
+			if err != nil {
+				return failedWith(err)
+			}
+			defer body.Close()
+			read, err := ioutil.ReadAll(body)
+			if err != nil {
+				return failedWith(err)
+			}
+			if !bytes.Equal(read, content) {
+				return doctorFailed, "the object read back differs from the one written"
+			}
+			return doctorOK, ""
+		})
+
+		d.run("Clock", func() (int, string) {
+			meta, err := bucket.GetObjectMeta(testKey)
+			if err != nil {
+				return failedWith(err)
+			}
+			serverTime, err := http.ParseTime(meta.Get("Date"))
+			if err != nil {
+				return doctorWarning, "OSS sent no usable Date header"
+			}
+			skew := time.Since(serverTime)
+			if skew < 0 {
+				skew = -skew
+			}
+			skew = skew.Round(time.Second)
+			if skew >= maxClockSkew {
+				return doctorFailed, "this machine is " + skew.String() + " off, OSS refuses requests beyond " + maxClockSkew.String()
+			}
+			if skew >= time.Minute {
+				return doctorWarning, "this machine is " + skew.String() + " off, snapshot times will be as well"
+			}
+			return doctorOK, ""
+		})
+
+		if appendOnlyMode {
+			fmt.Printf("[OK]   DeleteObject: not needed with appendOnly, %s is left in the bucket\n", testKey)
+		} else {
+			d.run("DeleteObject", func() (int, string) {
+				if err := bucket.DeleteObject(testKey); err != nil {
+					return doctorFailed, err.Error() + ", prune and lock objects need it, delete " + testKey + " by hand"
+				}
+				return doctorOK, ""
+			})
+		}
+	}
+
+	d.run("Repository layout", func() (int, string) {
+		if err := checkRepositoryLayout(bucket, false); err != nil {
+			return failedWith(err)
+		}
+		return doctorOK, "version " + strconv.Itoa(repositoryLayoutVersion)
+	})
+
+	d.run("Temp dir "+stagingDir(), func() (int, string) {
+		free, err := freeDiskSpace(stagingDir())
+		if err != nil {
+			return failedWith(err)
+		}
+		if free < minTempDirFreeSpace {
+			return doctorFailed, formatFileSize(free) + " free, at least " + formatFileSize(minTempDirFreeSpace) + " is needed"
+		}
+		return doctorOK, formatFileSize(free) + " free"
+	})
+
+	cachePath := cacheFilePath(&conf, ".cache.dat")
+	d.run("Cache "+cachePath, func() (int, string) {
+		db, err := openCache(cachePath)
+		if err != nil && cacheIsBroken(err) {
+			return doctorFailed, err.Error() + ", the next sync moves it aside and hashes every file again"
+		} else if err != nil {
+			return failedWith(err)
+		}
+		defer db.Close()
+
+		// written and rolled back, the cache is left as it is
+		trx, err := db.Begin()
+		if err != nil {
+			return failedWith(err)
+		}
+		defer trx.Rollback()
+		if _, err := trx.Exec("INSERT OR REPLACE INTO cache_meta (name, value) VALUES ('doctor', '1')"); err != nil {
+			return failedWith(errors.New("not writable: " + err.Error()))
+		}
+		return doctorOK, ""
+	})
+
+	if d.failed > 0 {
+		fmt.Printf("%d checks failed\n", d.failed)
+		os.Exit(1)
+	}
+	fmt.Println("All checks passed")
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+type dirUsage struct {
+	path  string
+	size  int64
+	files int
+}
+
+// the directory of relativePath depth levels below the base, "" for files directly in it
+func usageDir(relativePath string, depth int) string {
+	parts := strings.Split(relativePath, "/")
+	if len(parts) <= 1 {
+		return ""
+	}
+	if len(parts)-1 < depth {
+		depth = len(parts) - 1
+	}
+	return strings.Join(parts[:depth], "/")
+}
+
+/*
+ * `ossBackup du -t <snapshot> [path]`, sizes of the directories below path in a snapshot, largest first.
+ * files directly in path are summed up as "." .
+ */
+func runDu(args []string) {
+	var configFileName string
+	var snapshotTime string
+	var depth int
+	flags := flag.NewFlagSet("du", flag.ExitOnError)
+	flags.StringVar(&configFileName, "c", "", "the name of config file")
+	flags.StringVar(&snapshotTime, "t", "", "the timestamp of the snapshot (like 2019-08-02T02_44_44.7450746+08_00)")
+	flags.IntVar(&depth, "depth", 1, "how many directory levels below path to sum up separately")
+	flags.Parse(args)
+
+	if snapshotTime == "" || depth < 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	base := strings.Trim(flags.Arg(0), "/")
+
+	conf := getConfig(configFileName)
+	_, bucket, err := getOSSClient(&conf)
+	checkErr(err)
+	applyBandwidthLimits(&conf)
+
+	indexPath := fetchSnapshotIndex(&conf, bucket, snapshotTime)
+	defer os.Remove(indexPath)
+
+	usages := make(map[string]*dirUsage)
+	var total dirUsage
+
+	scanIndex(indexPath, base, func(line *fileInfo) {
+		relativePath := line.Path
+		if base != "" {
+			relativePath = strings.TrimPrefix(strings.TrimPrefix(line.Path, base), "/")
+		}
+
+		dir := usageDir(relativePath, depth)
+		usage, ok := usages[dir]
+		if !ok {
+			usage = &dirUsage{path: dir}
+			usages[dir] = usage
+		}
+		usage.size += line.Size
+		usage.files++
+		total.size += line.Size
+		total.files++
+	})
+
+	sorted := make([]*dirUsage, 0, len(usages))
+	for _, usage := range usages {
+		sorted = append(sorted, usage)
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].size > sorted[j].size })
+
+	for _, usage := range sorted {
+		name := usage.path
+		if name == "" {
+			name = "."
+		}
+		fmt.Printf("%10s %10d files  %s\n", formatFileSize(usage.size), usage.files, name)
+	}
+	fmt.Printf("%10s %10d files  total\n", formatFileSize(total.size), total.files)
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+)
+
+type duplicateGroup struct {
+	chunkKey string
+	size     int64
+	paths    []string
+}
+
+// bytes taken by all copies but one
+func (g *duplicateGroup) wasted() int64 {
+	return g.size * int64(len(g.paths)-1)
+}
+
+/*
+ * `ossBackup duplicates -t <snapshot>`, groups of identical files in a snapshot, most wasted space first.
+ * identical files share a chunk, so they are found from the index alone.
+ */
+func runDuplicates(args []string) {
+	var configFileName string
+	var snapshotTime string
+	var only string
+	var minSize int64
+	var limit int
+	flags := flag.NewFlagSet("duplicates", flag.ExitOnError)
+	flags.StringVar(&configFileName, "c", "", "the name of config file")
+	flags.StringVar(&snapshotTime, "t", "", "the timestamp of the snapshot (like 2019-08-02T02_44_44.7450746+08_00)")
+	flags.StringVar(&only, "only", "", "only look at files below this path")
+	flags.Int64Var(&minSize, "min-size", 1, "ignore files smaller than this many bytes")
+	flags.IntVar(&limit, "limit", 50, "how many groups to list, 0 lists all")
+	flags.Parse(args)
+
+	if snapshotTime == "" {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	conf := getConfig(configFileName)
+	_, bucket, err := getOSSClient(&conf)
+	checkErr(err)
+	applyBandwidthLimits(&conf)
+
+	indexPath := fetchSnapshotIndex(&conf, bucket, snapshotTime)
+	defer os.Remove(indexPath)
+
+	// first pass counts files per chunk, so only paths of duplicates are kept in memory
+	counts := make(map[string]int32)
+	scanIndex(indexPath, only, func(line *fileInfo) {
+		if line.Size >= minSize && line.ChunkKey != emptyFileChunkKey {
+			counts[line.ChunkKey]++
+		}
+	})
+
+	groups := make(map[string]*duplicateGroup)
+	scanIndex(indexPath, only, func(line *fileInfo) {
+		if counts[line.ChunkKey] < 2 || line.Size < minSize {
+			return
+		}
+
+		group, ok := groups[line.ChunkKey]
+		if !ok {
+			group = &duplicateGroup{chunkKey: line.ChunkKey, size: line.Size}
+			groups[line.ChunkKey] = group
+		}
+		group.paths = append(group.paths, line.Path)
+	})
+
+	sorted := make([]*duplicateGroup, 0, len(groups))
+	var totalWasted int64
+	for _, group := range groups {
+		sorted = append(sorted, group)
+		totalWasted += group.wasted()
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].wasted() > sorted[j].wasted() })
+
+	for i, group := range sorted {
+		if limit > 0 && i >= limit {
+			fmt.Printf("... and %d more groups\n", len(sorted)-limit)
+			break
+		}
+
+		fmt.Printf("%d copies of %s, %s wasted:\n", len(group.paths), formatFileSize(group.size), formatFileSize(group.wasted()))
+		sort.Strings(group.paths)
+		for _, path := range group.paths {
+			fmt.Printf("  %s\n", path)
+		}
+	}
+
+	fmt.Printf("%d groups of identical files, %s wasted on local disks (stored once in the bucket)\n", len(sorted), formatFileSize(totalWasted))
+}
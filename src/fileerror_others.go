@@ -0,0 +1,9 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+// file locks are advisory here, they never keep us from reading
+func isFileLockedError(err error) bool {
+	return false
+}
@@ -0,0 +1,8 @@
+package main
+
+import "os"
+
+// the file index needs the file to be opened on Windows, too expensive for every scanned file
+func getFileID(stat os.FileInfo) uint64 {
+	return 0
+}
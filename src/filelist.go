@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// set by --files and --changed-files, a file with one path per line or - for stdin
+var fileListFlag string
+var changedFileListFlag string
+
+// whether the files of this sync are listed by --files or --changed-files instead of found by walking fileRootPath
+func usesFileList() bool {
+	return fileListFlag != "" || changedFileListFlag != ""
+}
+
+/*
+ * read the paths of a file list, absolute or relative to fileRootPath, as slash paths relative to it.
+ * paths outside fileRootPath are reported and left out.
+ */
+func readFileList(conf *userConfig, source string) []string {
+	var reader io.Reader = os.Stdin
+	if source != "-" {
+		f, err := os.Open(source)
+		checkErr(err)
+		defer f.Close()
+		reader = f
+	}
+
+	rootPath, _ := filepath.Abs(conf.FileRootPath)
+	seen := make(map[string]bool)
+	var paths []string
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if line == "" {
+			continue
+		}
+
+		relativePath := filepath.Clean(line)
+		if filepath.IsAbs(line) {
+			var err error
+			if relativePath, err = filepath.Rel(rootPath, line); err != nil {
+				relativePath = ".."
+			}
+		}
+		if relativePath == ".." || strings.HasPrefix(relativePath, ".."+string(filepath.Separator)) {
+			printMsg("notBelowRoot", line, rootPath)
+			continue
+		}
+
+		if slashPath := filepath.ToSlash(relativePath); !seen[slashPath] {
+			seen[slashPath] = true
+			paths = append(paths, slashPath)
+		}
+	}
+	checkErr(scanner.Err())
+	return paths
+}
+
+// whether this sync backs up the listed files only, its snapshot has none of the others
+func listsFilesOnly() bool {
+	return fileListFlag != "" && changedFileListFlag == ""
+}
+
+// scan the file or everything below the directory at relativePath, missing ones are left out
+func scanListedPath(scanner *indexScanner, conf *userConfig, relativePath string) {
+	fullPath := filepath.Join(sourceRootPath(conf), filepath.FromSlash(relativePath))
+	stat, err := os.Stat(longPath(fullPath))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			recordSkippedFile(relativePath, err)
+		}
+		return
+	}
+
+	if !stat.IsDir() {
+		scanner.processFile(fullPath)
+		return
+	}
+	if err := walkFiles(fullPath, conf.Concurrency.Walk, newWalkLimits(conf, sourceRootPath(conf)), scanner.processFile); err != nil {
+		// reported with the files which could not be read, the other listed paths are still synced
+		recordSkippedFile(relativePath, err)
+	}
+}
+
+/*
+ * write the index of a sync with a file list instead of walking fileRootPath:
+ * with --files it holds the listed files only, for targeted backups, tagged filesSnapshotTag.
+ * it is not kept as the previous snapshot of this machine, later syncs compare with the last full one.
+ * with --changed-files it is the previous snapshot with the listed files and directories scanned again,
+ * for change detection done by another system, listed paths which do not exist anymore are dropped.
+ */
+func makeFileListIndex(conf *userConfig, pipeline *syncPipeline) (indexFilePath string) {
+	initCache(conf)
+	startTime := time.Now()
+
+	source, changedOnly := fileListFlag, false
+	prevIndexPath := cacheFilePath(conf, ".index.dat")
+	if changedFileListFlag != "" {
+		source, changedOnly = changedFileListFlag, true
+		if _, err := os.Stat(prevIndexPath); err != nil {
+			printMsg("noPreviousSnapshot")
+			return makeDirIndex(conf, pipeline)
+		}
+	}
+	paths := readFileList(conf, source)
+	printMsg("indexingListed", len(paths), sourceRootPath(conf))
+
+	indexFile, err := ioutil.TempFile(tempDir, "ossIndexTmp")
+	checkErr(err)
+	indexFilePath = indexFile.Name()
+	defer indexFile.Close()
+	writer := bufio.NewWriterSize(indexFile, 4096)
+
+	writeIndexHeader(writer, newIndexHeader(conf))
+
+	// keep the entries of the previous snapshot which are not listed
+	if changedOnly {
+		listed := make(map[string]bool)
+		for _, relativePath := range paths {
+			listed[normalizePath(relativePath)] = true
+		}
+
+		scanFileJSONLines(prevIndexPath, func(line *fileInfo) {
+			line.Path = normalizePath(line.Path)
+			// the entry itself, a listed directory above it, or "." for everything
+			for dir := line.Path; ; dir = path.Dir(dir) {
+				if listed[dir] {
+					return
+				}
+				if dir == "." || dir == "/" {
+					break
+				}
+			}
+
+			jsonRow, _ := json.Marshal(line)
+			writer.Write(jsonRow)
+			writer.WriteString("\n")
+		})
+	}
+
+	scanner := newIndexScanner(conf, writer, pipeline)
+	lastFlushTime := time.Now()
+	for _, relativePath := range paths {
+		if time.Since(lastFlushTime).Seconds() > 5 {
+			lastFlushTime = time.Now()
+			scanner.flush()
+		}
+		scanListedPath(scanner, conf, relativePath)
+	}
+	scanner.finish()
+
+	printMsg("indexingDone", time.Since(startTime).String())
+	return
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+/*
+ * a filter plugin, an external command deciding which files are backed up.
+ * it is started by the shell for each scan and gets the path of every file relative to fileRootPath,
+ * one per line on its stdin, and answers each with a line "include" or "exclude" on its stdout.
+ * OSSBACKUP_ROOT tells it fileRootPath, anything it writes to stderr is shown in the log.
+ */
+type filterPlugin struct {
+	command string
+	cmd     *exec.Cmd
+	input   *bufio.Writer
+	stdin   io.WriteCloser
+	output  *bufio.Reader
+}
+
+func startFilterPlugin(conf *userConfig, command string) (*filterPlugin, error) {
+	cmd := shellCommand(command)
+	cmd.Stderr = os.Stderr
+	rootPath, _ := filepath.Abs(conf.FileRootPath)
+	cmd.Env = append(os.Environ(), "OSSBACKUP_ROOT="+rootPath)
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	return &filterPlugin{command: command, cmd: cmd, input: bufio.NewWriter(stdin), stdin: stdin, output: bufio.NewReader(stdout)}, nil
+}
+
+func (f *filterPlugin) includes(relativePath string) (bool, error) {
+	f.input.WriteString(relativePath + "\n")
+	if err := f.input.Flush(); err != nil {
+		return false, err
+	}
+
+	answer, err := f.output.ReadString('\n')
+	if err != nil {
+		return false, err
+	}
+	switch strings.TrimSpace(answer) {
+	case "include":
+		return true, nil
+	case "exclude":
+		return false, nil
+	}
+	return false, errors.New("unexpected answer " + strings.TrimSpace(answer))
+}
+
+func (f *filterPlugin) stop() {
+	f.stdin.Close()
+	f.cmd.Wait()
+}
+
+// the filters.commands of a scan, a file is backed up only if all of them include it
+type filterPlugins []*filterPlugin
+
+func startFilterPlugins(conf *userConfig) filterPlugins {
+	var plugins filterPlugins
+	for _, command := range conf.Filters.Commands {
+		plugin, err := startFilterPlugin(conf, command)
+		if err != nil {
+			plugins.stop()
+			checkErr(errors.New("filter " + command + " could not be started: " + err.Error()))
+		}
+		plugins = append(plugins, plugin)
+	}
+	return plugins
+}
+
+// a filter failing would silently drop files from the backup, so the scan stops instead
+func (plugins filterPlugins) includes(relativePath string) bool {
+	for _, plugin := range plugins {
+		include, err := plugin.includes(relativePath)
+		if err != nil {
+			checkErr(fmt.Errorf("filter %s failed at %s: %v", plugin.command, relativePath, err))
+		}
+		if !include {
+			return false
+		}
+	}
+	return true
+}
+
+func (plugins filterPlugins) stop() {
+	for _, plugin := range plugins {
+		plugin.stop()
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+//go:generate protoc -I ../proto --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative ossbackup.proto
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"net"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// the gRPC interface of proto/ossbackup.proto, sharing runs with the HTTP API of s
+type grpcServer struct {
+	UnimplementedOssBackupServer
+	api *apiServer
+}
+
+func (r *apiRun) proto() *Run {
+	run := &Run{Id: int32(r.ID), Kind: r.Kind, StartUnixNano: r.Start.UnixNano(), Running: r.Running, Failed: int32(r.Failed), Error: r.Error}
+	if r.End != nil {
+		run.EndUnixNano = r.End.UnixNano()
+	}
+	return run
+}
+
+func (g *grpcServer) authorized(ctx context.Context) bool {
+	md, _ := metadata.FromIncomingContext(ctx)
+	values := md.Get("authorization")
+	expected := "Bearer " + g.api.conf.Serve.Token
+	return len(values) == 1 && subtle.ConstantTimeCompare([]byte(values[0]), []byte(expected)) == 1
+}
+
+// check the token before every call, errors handlers panic with are returned like any other
+func (g *grpcServer) unaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (resp interface{}, err error) {
+	defer func() {
+		if e := recover(); e != nil {
+			fmt.Printf("[Serve] %s failed: %v\n", info.FullMethod, e)
+			err = status.Error(codes.Internal, fmt.Sprint(e))
+		}
+	}()
+
+	if !g.authorized(ctx) {
+		return nil, status.Error(codes.Unauthenticated, "missing or wrong token")
+	}
+	return handler(ctx, req)
+}
+
+func (g *grpcServer) streamInterceptor(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) (err error) {
+	defer func() {
+		if e := recover(); e != nil {
+			fmt.Printf("[Serve] %s failed: %v\n", info.FullMethod, e)
+			err = status.Error(codes.Internal, fmt.Sprint(e))
+		}
+	}()
+
+	if !g.authorized(stream.Context()) {
+		return status.Error(codes.Unauthenticated, "missing or wrong token")
+	}
+	return handler(srv, stream)
+}
+
+func (g *grpcServer) StartSync(ctx context.Context, req *StartSyncRequest) (*Run, error) {
+	run, ok := g.api.start("sync", func() int { return fullSync(g.api.configFileName, false) })
+	if !ok {
+		return nil, status.Error(codes.AlreadyExists, "a sync or restore is running")
+	}
+	return run.proto(), nil
+}
+
+func (g *grpcServer) StartRestore(ctx context.Context, req *StartRestoreRequest) (*Run, error) {
+	if req.Time == "" || (req.Path == "" && !req.OriginalPath) {
+		return nil, status.Error(codes.InvalidArgument, "time and either path or original_path are required")
+	}
+
+	var mappings pathMappings
+	for _, rule := range req.Map {
+		if err := mappings.Set(rule); err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+	}
+
+	run, ok := g.api.start("restore", func() int {
+		return restoreFiles(g.api.configFileName, req.Path, req.Time, req.Only, true, mappings)
+	})
+	if !ok {
+		return nil, status.Error(codes.AlreadyExists, "a sync or restore is running")
+	}
+	return run.proto(), nil
+}
+
+func (g *grpcServer) Stop(ctx context.Context, req *StopRequest) (*Run, error) {
+	g.api.mutex.Lock()
+	defer g.api.mutex.Unlock()
+
+	if g.api.current == nil {
+		return nil, status.Error(codes.FailedPrecondition, "no sync or restore is running")
+	}
+	requestStop()
+	fmt.Printf("[Serve] Stopping %s %d after the files in progress\n", g.api.current.Kind, g.api.current.ID)
+	return g.api.current.proto(), nil
+}
+
+func (g *grpcServer) GetStatus(ctx context.Context, req *GetStatusRequest) (*Status, error) {
+	g.api.mutex.Lock()
+	defer g.api.mutex.Unlock()
+
+	result := &Status{}
+	if g.api.current != nil {
+		result.Current = g.api.current.proto()
+	}
+	for i := range g.api.history {
+		result.History = append(result.History, g.api.history[i].proto())
+	}
+	return result, nil
+}
+
+// the events of the running sync or restore, ends at once if none is running
+func (g *grpcServer) WatchProgress(req *WatchProgressRequest, stream OssBackup_WatchProgressServer) error {
+	// subscribed under the lock of the runs, so the end of the current one is not missed
+	g.api.mutex.Lock()
+	if g.api.current == nil {
+		g.api.mutex.Unlock()
+		return nil
+	}
+	events, cancel := watchProgress()
+	g.api.mutex.Unlock()
+	defer cancel()
+
+	for {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				return nil
+			}
+			err := stream.Send(&ProgressEvent{Kind: ProgressEvent_Kind(event.Kind), Path: event.Path, Size: event.Size,
+				Done: event.Done, Total: event.Total, Error: event.Error})
+			if err != nil {
+				return err
+			}
+		case <-stream.Context().Done():
+			return stream.Context().Err()
+		}
+	}
+}
+
+func (g *grpcServer) ListSnapshots(ctx context.Context, req *ListSnapshotsRequest) (*ListSnapshotsResponse, error) {
+	_, bucket, err := getOSSClient(&g.api.conf)
+	if err != nil {
+		return nil, status.Error(codes.Unavailable, err.Error())
+	}
+
+	response := &ListSnapshotsResponse{}
+	for _, snapshot := range listSnapshots(bucket) {
+		if (req.Host == "" || snapshot.Host == req.Host) && (req.Tag == "" || snapshot.hasTag(req.Tag)) {
+			response.Snapshots = append(response.Snapshots, &Snapshot{Host: snapshot.Host, Time: snapshot.Time, Tags: snapshot.Tags, Delta: snapshot.Delta})
+		}
+	}
+	return response, nil
+}
+
+// serve the gRPC interface on listen until the process ends
+func serveGRPC(api *apiServer, listen string) {
+	g := &grpcServer{api: api}
+	server := grpc.NewServer(grpc.UnaryInterceptor(g.unaryInterceptor), grpc.StreamInterceptor(g.streamInterceptor))
+	RegisterOssBackupServer(server, g)
+
+	listener, err := net.Listen("tcp", listen)
+	checkErr(err)
+	fmt.Printf("[Serve] gRPC listening on %s\n", listen)
+	checkErr(server.Serve(listener))
+}
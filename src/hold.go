@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aliyun/aliyun-oss-go-sdk/oss"
+)
+
+/*
+ * a held snapshot is never removed by prune, whatever -keep-last says, until the hold is released.
+ * holds are objects of their own at holds/<host>/<time>.json, so placing one does not rename the index.
+ */
+const holdKeyPrefix = "holds/"
+
+type snapshotHold struct {
+	Reason   string
+	Hostname string // of the machine which placed the hold
+	Time     int64  // unix nano time it was placed
+}
+
+func holdKey(snapshot snapshotInfo) string {
+	return holdKeyPrefix + snapshotID(snapshot) + ".json"
+}
+
+// the holds in the bucket, by holdKey
+func listHolds(bucket *oss.Bucket) map[string]snapshotHold {
+	holds := make(map[string]snapshotHold)
+	marker := oss.Marker("")
+
+	for {
+		lsRes, err := bucket.ListObjects(oss.Prefix(objectKey(holdKeyPrefix)), oss.MaxKeys(1000), marker)
+		checkErr(err)
+		marker = oss.Marker(lsRes.NextMarker)
+
+		for _, object := range lsRes.Objects {
+			body, err := bucket.GetObject(object.Key)
+			checkErr(err)
+			content, err := ioutil.ReadAll(body)
+			body.Close()
+			checkErr(err)
+
+			// a hold which cannot be read still holds
+			var hold snapshotHold
+			if err := json.Unmarshal(content, &hold); err != nil {
+				hold.Reason = "unreadable hold: " + err.Error()
+			}
+			holds[strings.TrimPrefix(object.Key, repositoryPrefix)] = hold
+		}
+
+		if !lsRes.IsTruncated {
+			break
+		}
+	}
+	return holds
+}
+
+func (h snapshotHold) String() string {
+	return fmt.Sprintf("%q by %s at %s", h.Reason, h.Hostname, time.Unix(0, h.Time).Format(time.RFC3339))
+}
+
+/*
+ * `ossBackup hold`, protect the snapshot taken at -t from prune with -reason, or release its hold with -release.
+ * without -t the holds are listed.
+ */
+func runHold(args []string) {
+	var configFileName string
+	var snapshotTime string
+	var reason string
+	var release bool
+	flags := flag.NewFlagSet("hold", flag.ExitOnError)
+	flags.StringVar(&configFileName, "c", "", "the name of config file")
+	flags.StringVar(&snapshotTime, "t", "", "the snapshot to hold or release (like 2019-08-02T02_44_44.7450746+08_00)")
+	flags.StringVar(&reason, "reason", "", "why the snapshot is held, like pre-migration")
+	flags.BoolVar(&release, "release", false, "release the hold of the snapshot, prune may remove it again")
+	flags.Parse(args)
+
+	conf := getConfig(configFileName)
+	_, bucket, err := getOSSClient(&conf)
+	checkErr(err)
+
+	if snapshotTime == "" {
+		holds := listHolds(bucket)
+		for _, snapshot := range listSnapshots(bucket) {
+			if hold, ok := holds[holdKey(snapshot)]; ok {
+				fmt.Printf("%-40s %-20s %s\n", snapshot.Time, snapshot.Host, hold)
+			}
+		}
+		fmt.Printf("%d snapshots held\n", len(holds))
+		return
+	}
+
+	snapshot, err := findSnapshot(bucket, &conf, snapshotTime)
+	checkErr(err)
+	key := holdKey(snapshot)
+
+	if release {
+		refuseInAppendOnlyMode("hold -release")
+		refuseInReadOnlyMode("hold -release")
+		if exists, err := bucket.IsObjectExist(objectKey(key)); err != nil || !exists {
+			checkErr(err)
+			fmt.Fprintln(os.Stderr, "Snapshot "+snapshotTime+" is not held")
+			os.Exit(1)
+		}
+		checkErr(bucket.DeleteObject(objectKey(key)))
+		fmt.Printf("[Hold] Released snapshot %s %s\n", snapshot.Host, snapshot.Time)
+		return
+	}
+
+	refuseInReadOnlyMode("hold")
+	if reason == "" {
+		fmt.Fprintln(os.Stderr, "-reason is required, so others know why the snapshot is kept")
+		os.Exit(2)
+	}
+	hostname, _ := os.Hostname()
+	content, _ := json.Marshal(snapshotHold{Reason: reason, Hostname: hostname, Time: time.Now().UnixNano()})
+	err = bucket.PutObject(objectKey(key), bytes.NewReader(content), appendOnlyOptions(nil)...)
+	if isObjectAlreadyThere(err) {
+		fmt.Fprintln(os.Stderr, "Snapshot "+snapshotTime+" is held already")
+		os.Exit(1)
+	}
+	checkErr(err)
+	fmt.Printf("[Hold] Snapshot %s %s is held: %s\n", snapshot.Host, snapshot.Time, reason)
+}
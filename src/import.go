@@ -0,0 +1,244 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/aliyun/aliyun-oss-go-sdk/oss"
+)
+
+/*
+ * `ossBackup import`, copy a snapshot of a restic or Borg repository into this repository,
+ * without reading the original disks again. the other tool streams the snapshot as a tar archive,
+ * each regular file in it becomes a chunk and an entry of a new snapshot tagged "imported".
+ * passwords are passed to the tools as usual, like RESTIC_PASSWORD or BORG_PASSPHRASE.
+ */
+func runImport(args []string) {
+	var configFileName string
+	var from string
+	var repo string
+	var snapshot string
+	var strip string
+	var forceUnlock bool
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	flags.StringVar(&configFileName, "c", "", "the name of config file")
+	flags.StringVar(&from, "from", "", "the tool the repository belongs to: restic or borg")
+	flags.StringVar(&repo, "repo", "", "the repository to import from")
+	flags.StringVar(&snapshot, "snapshot", "latest", "the restic snapshot id or Borg archive name to import")
+	flags.StringVar(&strip, "strip", "", "only import files below this path, which is removed from their paths")
+	flags.BoolVar(&forceUnlock, "force-unlock", false, "remove locks left by another sync before importing")
+	flags.Parse(args)
+
+	if repo == "" || (from != "restic" && from != "borg") {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	conf := getConfig(configFileName)
+	refuseInReadOnlyMode("import")
+	_, bucket, err := getOSSClient(&conf)
+	checkErr(err)
+
+	lock, err := acquireSyncLock(&conf, bucket, forceUnlock)
+	checkErr(err)
+	defer lock.release()
+	checkErr(checkRepositoryLayout(bucket, true))
+
+	applyBandwidthLimits(&conf)
+	applyMemoryBudget(&conf)
+	applyTempBudget(&conf)
+	refreshOnlineChunkList(&conf, bucket)
+
+	cmd, err := importCommand(from, repo, snapshot)
+	checkErr(err)
+	cmd.Stderr = os.Stderr
+	stdout, err := cmd.StdoutPipe()
+	checkErr(err)
+	checkErr(cmd.Start())
+
+	header := newIndexHeader(&conf)
+	header.Tags = append(header.Tags, "imported")
+	header.RootPath = from + ":" + repo
+
+	indexPath, err := importTarStream(&conf, bucket, stdout, header, strings.Trim(strip, "/"))
+	if waitErr := cmd.Wait(); err == nil && waitErr != nil {
+		err = errors.New(from + " failed: " + waitErr.Error())
+	}
+	if err != nil {
+		os.Remove(indexPath)
+		checkErr(err)
+	}
+	defer os.Remove(indexPath)
+
+	// not a delta of, nor the base for, the indexes of fileRootPath
+	checkErr(lock.check())
+	putIndexObject(&conf, bucket, indexPath)
+}
+
+// the command streaming the snapshot as a tar archive to its stdout
+func importCommand(from string, repo string, snapshot string) (*exec.Cmd, error) {
+	if from == "restic" {
+		return exec.Command("restic", "-r", repo, "dump", snapshot, "/", "--archive", "tar"), nil
+	}
+
+	archive := snapshot
+	if archive == "latest" {
+		output, err := exec.Command("borg", "list", "--last", "1", "--short", repo).Output()
+		if err != nil {
+			return nil, errors.New("latest Borg archive could not be found: " + err.Error())
+		}
+		if archive = strings.TrimSpace(string(output)); archive == "" {
+			return nil, errors.New("Borg repository has no archives")
+		}
+	}
+	return exec.Command("borg", "export-tar", repo+"::"+archive, "-"), nil
+}
+
+type importedChunk struct {
+	key        string
+	path       string // of the file in the new snapshot
+	tmpPath    string
+	sourceSize int64
+}
+
+// turn every regular file in the tar stream into a chunk, returning an index of them
+func importTarStream(conf *userConfig, bucket *oss.Bucket, stream io.Reader, header indexHeader, strip string) (indexPath string, err error) {
+	indexFile, err := ioutil.TempFile(tempDir, "ossIndexTmp")
+	if err != nil {
+		return "", err
+	}
+	defer indexFile.Close()
+	indexPath = indexFile.Name()
+	writer := bufio.NewWriterSize(indexFile, 4096)
+	writeIndexHeader(writer, header)
+
+	var failed int32
+	var uploadedKeys []string
+	var uploadedMutex sync.Mutex
+	uploads := make(chan importedChunk)
+	var wg sync.WaitGroup
+
+	for i := 0; i < conf.Concurrency.Upload; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for chunk := range uploads {
+				if err := putChunkWithRetry(bucket, nil, chunk.key, chunk.tmpPath, nil, storageClassFor(conf, chunk.path)); err != nil {
+					fmt.Printf("[Import] Chunk %s could not be uploaded: %v\n", chunk.key, err)
+					atomic.AddInt32(&failed, 1)
+				} else {
+					uploadedMutex.Lock()
+					uploadedKeys = append(uploadedKeys, chunk.key)
+					uploadedMutex.Unlock()
+				}
+				os.Remove(chunk.tmpPath)
+				tempBudget.release(chunk.sourceSize)
+			}
+		}()
+	}
+
+	var count int
+	var totalSize int64
+	reader := tar.NewReader(stream)
+	for {
+		entry, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			close(uploads)
+			wg.Wait()
+			return indexPath, err
+		}
+		if entry.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		path := normalizePath(strings.TrimPrefix(strings.TrimPrefix(entry.Name, "./"), "/"))
+		if strip != "" {
+			if !hasPathPrefix(path, strip) || path == strip {
+				continue
+			}
+			path = strings.TrimPrefix(path, strip+"/")
+		}
+
+		line := fileInfo{Path: path, Size: entry.Size, ModTime: entry.ModTime.UnixNano(), ChunkKey: emptyFileChunkKey}
+		if entry.Size > 0 {
+			chunk, err := compressImportedFile(reader, entry.Size)
+			if err != nil {
+				close(uploads)
+				wg.Wait()
+				return indexPath, err
+			}
+			line.ChunkKey = chunk.key
+			chunk.path = path
+
+			exists := onlineChunksSet.contains(chunk.key)
+			if !exists && !onlineChunksComplete {
+				exists, _ = chunkBucket(bucket, chunk.key).IsObjectExist(objectKey(chunk.key))
+			}
+			if exists {
+				os.Remove(chunk.tmpPath)
+				tempBudget.release(chunk.sourceSize)
+			} else {
+				// identical files share one chunk, upload it only once
+				onlineChunksSet.add(chunk.key)
+				uploads <- chunk
+			}
+		}
+
+		writeIndexLine(writer, &line)
+		count++
+		totalSize += entry.Size
+		if count%1000 == 0 {
+			fmt.Printf("[Import] %d files (%s)\n", count, formatFileSize(totalSize))
+		}
+	}
+
+	close(uploads)
+	wg.Wait()
+	recordUploadedChunks(uploadedKeys)
+
+	if failed > 0 {
+		return indexPath, fmt.Errorf("%d chunks could not be uploaded, no snapshot is made", failed)
+	}
+
+	fmt.Printf("[Import] %d files (%s) imported, %d chunks uploaded\n", count, formatFileSize(totalSize), len(uploadedKeys))
+	return indexPath, writer.Flush()
+}
+
+func compressImportedFile(reader io.Reader, size int64) (importedChunk, error) {
+	if err := waitForDiskSpace(stagingDir(), size, diskSpaceWaitTimeout); err != nil {
+		return importedChunk{}, err
+	}
+	tempBudget.acquire(size)
+
+	tmpFile, err := ioutil.TempFile(tempDir, "ossTmp")
+	if err != nil {
+		tempBudget.release(size)
+		return importedChunk{}, err
+	}
+	defer tmpFile.Close()
+
+	memoryBudget.acquire(flateJobMemory)
+	key, err := compressInto(tmpFile, reader)
+	memoryBudget.release(flateJobMemory)
+	if err != nil {
+		tmpFile.Close()
+		os.Remove(tmpFile.Name())
+		tempBudget.release(size)
+		return importedChunk{}, err
+	}
+
+	return importedChunk{key: key, tmpPath: tmpFile.Name(), sourceSize: size}, nil
+}
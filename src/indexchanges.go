@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/cespare/xxhash/v2"
+)
+
+// paths listed per kind of change, the rest are only counted
+const maxListedChanges = 20
+
+type indexChanges struct {
+	added, modified, deleted []string
+	addedCount               int
+	modifiedCount            int
+	deletedCount             int
+	total                    int // entries in the new index
+}
+
+func recordChange(paths *[]string, count *int, path string) {
+	*count++
+	if len(*paths) < maxListedChanges {
+		*paths = append(*paths, path)
+	}
+}
+
+// compare the index at indexPath with the one at prevPath, entries are matched by path
+func compareIndexes(prevPath string, indexPath string) *indexChanges {
+	changes := &indexChanges{}
+	prevEntries := indexEntryHashes(prevPath)
+
+	scanFileJSONLines(indexPath, func(line *fileInfo) {
+		changes.total++
+		jsonRow, _ := json.Marshal(line)
+
+		hash, ok := prevEntries[line.Path]
+		delete(prevEntries, line.Path)
+		if !ok {
+			recordChange(&changes.added, &changes.addedCount, line.Path)
+		} else if hash != xxhash.Sum64(jsonRow) {
+			recordChange(&changes.modified, &changes.modifiedCount, line.Path)
+		}
+	})
+
+	for path := range prevEntries {
+		recordChange(&changes.deleted, &changes.deletedCount, path)
+	}
+	return changes
+}
+
+func printChangedPaths(kind string, paths []string, count int) {
+	for _, path := range paths {
+		fmt.Printf("  %s %s\n", kind, path)
+	}
+	if count > len(paths) {
+		printMsg("moreChanges", count-len(paths))
+	}
+}
+
+/*
+ * print what changed since the last uploaded snapshot, before uploading indexPath.
+ * a warning is printed if more than changeReport.deletionWarning percent of the files were deleted,
+ * mass deletions like those of ransomware should not go unnoticed.
+ * returns the changes for the report, nil if there is no last snapshot to compare with.
+ */
+func reportIndexChanges(conf *userConfig, indexPath string) *indexChanges {
+	initCache(conf)
+	prevPath := cacheFilePath(conf, ".index.dat")
+	if _, err := os.Stat(prevPath); err != nil {
+		return nil
+	}
+
+	changes := compareIndexes(prevPath, indexPath)
+	printMsg("changes", changes.addedCount, changes.modifiedCount, changes.deletedCount)
+	printChangedPaths("+", changes.added, changes.addedCount)
+	printChangedPaths("~", changes.modified, changes.modifiedCount)
+	printChangedPaths("-", changes.deleted, changes.deletedCount)
+
+	prevTotal := changes.total - changes.addedCount + changes.deletedCount
+	if conf.ChangeReport.DeletionWarning > 0 && prevTotal > 0 && changes.deletedCount*100 >= prevTotal*conf.ChangeReport.DeletionWarning {
+		printMsg("deletionWarning",
+			changes.deletedCount, prevTotal, changes.deletedCount*100/prevTotal, conf.FileRootPath)
+	}
+	return changes
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/aliyun/aliyun-oss-go-sdk/oss"
+)
+
+// `ossBackup index <action>`
+func runIndexCommand(args []string) {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "Usage: ossBackup index fetch [-c config] -t timestamp -o file [-format jsonl|sqlite]\n       ossBackup index dump [-c config] -t timestamp [-only path] [-format text|json]\n       ossBackup index export [-c config] -t timestamp -o file [-only path] [-format csv|json]")
+		os.Exit(2)
+	}
+
+	switch args[0] {
+	case "fetch":
+		runIndexFetch(args[1:])
+	case "dump":
+		runIndexDump(args[1:])
+	case "export":
+		runIndexExport(args[1:])
+	default:
+		fmt.Fprintln(os.Stderr, "Unknown index action: "+args[0])
+		os.Exit(2)
+	}
+}
+
+// download the full index of the snapshot taken at snapshotTime, the caller removes the returned file
+func fetchSnapshotIndex(conf *userConfig, bucket *oss.Bucket, snapshotTime string) string {
+	snapshot, err := findSnapshot(bucket, conf, snapshotTime)
+	checkErr(err)
+
+	indexPath, _, err := downloadIndex(bucket, snapshot.Key)
+	if err != nil {
+		os.Remove(indexPath)
+		checkErr(err)
+	}
+	return indexPath
+}
+
+// the index at path as JSON lines in a temp file, whatever format it was uploaded in
+func convertToJSONLinesIndex(path string) (jsonPath string, err error) {
+	jsonFile, err := ioutil.TempFile(tempDir, "ossIndexTmp")
+	if err != nil {
+		return "", err
+	}
+	defer jsonFile.Close()
+
+	writer := bufio.NewWriterSize(jsonFile, 4096)
+	if header, ok := readIndexHeader(path); ok {
+		writeIndexHeader(writer, header)
+	}
+	scanIndex(path, "", func(line *fileInfo) {
+		writeIndexLine(writer, line)
+	})
+
+	return jsonFile.Name(), writer.Flush()
+}
+
+func runIndexFetch(args []string) {
+	var configFileName string
+	var snapshotTime string
+	var output string
+	var format string
+	flags := flag.NewFlagSet("index fetch", flag.ExitOnError)
+	flags.StringVar(&configFileName, "c", "", "the name of config file")
+	flags.StringVar(&snapshotTime, "t", "", "the timestamp of the snapshot (like 2019-08-02T02_44_44.7450746+08_00)")
+	flags.StringVar(&output, "o", "", "the file to write the index to")
+	flags.StringVar(&format, "format", "jsonl", "the format to write: jsonl or sqlite")
+	flags.Parse(args)
+
+	if snapshotTime == "" || output == "" {
+		flags.Usage()
+		os.Exit(2)
+	}
+	if format != "jsonl" && format != "sqlite" {
+		checkErr(errors.New("-format should be jsonl or sqlite"))
+	}
+
+	conf := getConfig(configFileName)
+	_, bucket, err := getOSSClient(&conf)
+	checkErr(err)
+	applyBandwidthLimits(&conf)
+
+	indexPath := fetchSnapshotIndex(&conf, bucket, snapshotTime)
+	defer os.Remove(indexPath)
+
+	// whatever the uploaded format, a JSON lines copy is the common ground
+	jsonPath, err := convertToJSONLinesIndex(indexPath)
+	checkErr(err)
+	defer os.Remove(jsonPath)
+
+	resultPath := jsonPath
+	if format == "sqlite" {
+		resultPath, err = writeSQLiteIndex(jsonPath)
+		checkErr(err)
+		defer os.Remove(resultPath)
+	}
+
+	checkErr(copyFile(resultPath, output))
+	fmt.Printf("Index of %s written to %s\n", snapshotTime, output)
+}
+
+func runIndexDump(args []string) {
+	var configFileName string
+	var snapshotTime string
+	var only string
+	var format string
+	flags := flag.NewFlagSet("index dump", flag.ExitOnError)
+	flags.StringVar(&configFileName, "c", "", "the name of config file")
+	flags.StringVar(&snapshotTime, "t", "", "the timestamp of the snapshot (like 2019-08-02T02_44_44.7450746+08_00)")
+	flags.StringVar(&only, "only", "", "only print entries below this path")
+	flags.StringVar(&format, "format", "text", "the format to print: text or json")
+	flags.Parse(args)
+
+	if snapshotTime == "" {
+		flags.Usage()
+		os.Exit(2)
+	}
+	if format != "text" && format != "json" {
+		checkErr(errors.New("-format should be text or json"))
+	}
+
+	conf := getConfig(configFileName)
+	_, bucket, err := getOSSClient(&conf)
+	checkErr(err)
+	applyBandwidthLimits(&conf)
+
+	indexPath := fetchSnapshotIndex(&conf, bucket, snapshotTime)
+	defer os.Remove(indexPath)
+
+	writer := bufio.NewWriter(os.Stdout)
+	defer writer.Flush()
+
+	scanIndex(indexPath, only, func(line *fileInfo) {
+		if format == "json" {
+			jsonRow, _ := json.Marshal(line)
+			writer.Write(jsonRow)
+			writer.WriteString("\n")
+			return
+		}
+
+		fmt.Fprintf(writer, "%10s  %s  %s  %s\n", formatFileSize(line.Size), time.Unix(0, line.ModTime).Format(time.RFC3339), line.Path, line.ChunkKey)
+	})
+}
+
+// report entry of index export -format json
+type exportedFile struct {
+	Path         string
+	Size         int64
+	ModTime      string
+	CreationTime string `json:",omitempty"`
+	ChunkKey     string
+}
+
+func formatExportTime(t int64) string {
+	if t == 0 {
+		return ""
+	}
+	return time.Unix(0, t).UTC().Format(time.RFC3339Nano)
+}
+
+// write the entries below only as CSV, one row per file after a header row
+func exportIndexCSV(indexPath string, only string, writer io.Writer) error {
+	csvWriter := csv.NewWriter(writer)
+	csvWriter.Write([]string{"path", "size", "modTime", "creationTime", "chunkKey"})
+
+	scanIndex(indexPath, only, func(line *fileInfo) {
+		csvWriter.Write([]string{line.Path, strconv.FormatInt(line.Size, 10), formatExportTime(line.ModTime), formatExportTime(line.CreationTime), line.ChunkKey})
+	})
+
+	csvWriter.Flush()
+	return csvWriter.Error()
+}
+
+// write the snapshot and the entries below only as one JSON document, streamed so large indexes fit in memory
+func exportIndexJSON(indexPath string, only string, writer io.Writer) error {
+	header, _ := readIndexHeader(indexPath)
+	count, size := indexStats(indexPath, only)
+
+	headerJSON, _ := json.Marshal(header)
+	fmt.Fprintf(writer, "{\"Snapshot\":%s,\"TotalFiles\":%d,\"TotalSize\":%d,\"Files\":[", headerJSON, count, size)
+
+	first := true
+	var err error
+	scanIndex(indexPath, only, func(line *fileInfo) {
+		jsonRow, _ := json.Marshal(exportedFile{
+			Path:         line.Path,
+			Size:         line.Size,
+			ModTime:      formatExportTime(line.ModTime),
+			CreationTime: formatExportTime(line.CreationTime),
+			ChunkKey:     line.ChunkKey,
+		})
+		separator := ",\n"
+		if first {
+			separator = "\n"
+			first = false
+		}
+		writer.Write([]byte(separator))
+		if _, writeErr := writer.Write(jsonRow); writeErr != nil && err == nil {
+			err = writeErr
+		}
+	})
+
+	if _, writeErr := writer.Write([]byte("\n]}\n")); writeErr != nil && err == nil {
+		err = writeErr
+	}
+	return err
+}
+
+// `ossBackup index export`, a report of what a snapshot holds for auditors and spreadsheets
+func runIndexExport(args []string) {
+	var configFileName string
+	var snapshotTime string
+	var output string
+	var only string
+	var format string
+	flags := flag.NewFlagSet("index export", flag.ExitOnError)
+	flags.StringVar(&configFileName, "c", "", "the name of config file")
+	flags.StringVar(&snapshotTime, "t", "", "the timestamp of the snapshot (like 2019-08-02T02_44_44.7450746+08_00)")
+	flags.StringVar(&output, "o", "", "the file to write the report to")
+	flags.StringVar(&only, "only", "", "only report files below this path")
+	flags.StringVar(&format, "format", "csv", "the format of the report: csv or json")
+	flags.Parse(args)
+
+	if snapshotTime == "" || output == "" {
+		flags.Usage()
+		os.Exit(2)
+	}
+	if format != "csv" && format != "json" {
+		checkErr(errors.New("-format should be csv or json"))
+	}
+
+	conf := getConfig(configFileName)
+	_, bucket, err := getOSSClient(&conf)
+	checkErr(err)
+	applyBandwidthLimits(&conf)
+
+	indexPath := fetchSnapshotIndex(&conf, bucket, snapshotTime)
+	defer os.Remove(indexPath)
+
+	f, err := os.Create(output)
+	checkErr(err)
+	defer f.Close()
+	writer := bufio.NewWriter(f)
+
+	if format == "csv" {
+		err = exportIndexCSV(indexPath, only, writer)
+	} else {
+		err = exportIndexJSON(indexPath, only, writer)
+	}
+	checkErr(err)
+	checkErr(writer.Flush())
+
+	fmt.Printf("Report of %s written to %s\n", snapshotTime, output)
+}
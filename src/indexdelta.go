@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+
+	"github.com/aliyun/aliyun-oss-go-sdk/oss"
+	"github.com/cespare/xxhash/v2"
+)
+
+/*
+ * most runs upload a delta instead of the full index: entries added or changed since the last uploaded index,
+ * and entries with Removed set for files gone since. the header names the snapshot it is based on,
+ * which may be a delta itself. every index.fullEvery snapshots a full index is uploaded again.
+ * the last uploaded index is kept in the cache dir to compute the next delta from.
+ */
+const deltaIndexSuffix = ".delta"
+
+// the delta to upload instead of indexPath and the length of its chain, "" if the full index should be uploaded
+func deltaForUpload(conf *userConfig, bucket *oss.Bucket, indexPath string) (deltaPath string, chain int) {
+	if conf.Index.FullEvery <= 1 {
+		return "", 0
+	}
+
+	initCache(conf)
+	baseKey := getCacheMeta("lastIndexKey")
+	chain, _ = strconv.Atoi(getCacheMeta("lastIndexChain"))
+	basePath := cacheFilePath(conf, ".index.dat")
+
+	if baseKey == "" || chain+1 >= conf.Index.FullEvery {
+		return "", 0
+	}
+	if _, err := os.Stat(basePath); err != nil {
+		return "", 0
+	}
+	// the base may have been removed by a prune
+	if exists, err := bucket.IsObjectExist(objectKey(baseKey)); err != nil || !exists {
+		return "", 0
+	}
+
+	deltaPath, changed, total := makeDeltaIndex(indexPath, basePath, baseKey)
+
+	// a delta of most entries saves little and makes every restore slower
+	if changed*2 > total {
+		os.Remove(deltaPath)
+		return "", 0
+	}
+	return deltaPath, chain + 1
+}
+
+// keep the index just uploaded as key, the next delta is based on it
+func keepUploadedIndex(conf *userConfig, indexPath string, key string, chain int) {
+	initCache(conf)
+	savedIndexPath := cacheFilePath(conf, ".index.dat")
+	os.Remove(savedIndexPath)
+
+	if err := copyFile(indexPath, savedIndexPath); err != nil {
+		fmt.Printf("[Error] Uploaded index could not be kept: %v\n", err)
+		os.Remove(savedIndexPath)
+		checkErr(setCacheMeta("lastIndexKey", ""))
+		return
+	}
+
+	checkErr(setCacheMeta("lastIndexKey", key))
+	checkErr(setCacheMeta("lastIndexChain", strconv.Itoa(chain)))
+}
+
+// entries of the index at path, each as a hash of its JSON line
+func indexEntryHashes(path string) map[string]uint64 {
+	entries := make(map[string]uint64)
+	scanFileJSONLines(path, func(line *fileInfo) {
+		jsonRow, _ := json.Marshal(line)
+		entries[line.Path] = xxhash.Sum64(jsonRow)
+	})
+	return entries
+}
+
+func writeIndexLine(writer *bufio.Writer, line *fileInfo) {
+	jsonRow, _ := json.Marshal(line)
+	writer.Write(jsonRow)
+	writer.WriteString("\n")
+}
+
+// write the entries of indexPath differing from basePath into a temp file, total is the number of entries in indexPath
+func makeDeltaIndex(indexPath string, basePath string, baseKey string) (deltaPath string, changed int, total int) {
+	header, _ := readIndexHeader(indexPath)
+	header.Base = baseKey
+
+	baseEntries := indexEntryHashes(basePath)
+
+	deltaFile, err := ioutil.TempFile(tempDir, "ossIndexTmp")
+	checkErr(err)
+	defer deltaFile.Close()
+	writer := bufio.NewWriterSize(deltaFile, 4096)
+	writeIndexHeader(writer, header)
+
+	scanFileJSONLines(indexPath, func(line *fileInfo) {
+		total++
+		jsonRow, _ := json.Marshal(line)
+
+		hash, ok := baseEntries[line.Path]
+		delete(baseEntries, line.Path)
+		if ok && hash == xxhash.Sum64(jsonRow) {
+			return
+		}
+
+		changed++
+		writer.Write(jsonRow)
+		writer.WriteString("\n")
+	})
+
+	for path := range baseEntries {
+		changed++
+		writeIndexLine(writer, &fileInfo{Path: path, Removed: true})
+	}
+
+	checkErr(writer.Flush())
+	return deltaFile.Name(), changed, total
+}
+
+// apply the delta at deltaPath onto the full index at basePath, writing a full index into a temp file
+func mergeDeltaIndex(deltaPath string, basePath string) (mergedPath string) {
+	header, _ := readIndexHeader(deltaPath)
+	header.Base = ""
+
+	changes := make(map[string]*fileInfo)
+	scanIndex(deltaPath, "", func(line *fileInfo) {
+		changes[line.Path] = line
+	})
+
+	mergedFile, err := ioutil.TempFile(tempDir, "ossIndexTmp")
+	checkErr(err)
+	defer mergedFile.Close()
+	writer := bufio.NewWriterSize(mergedFile, 4096)
+	writeIndexHeader(writer, header)
+
+	scanIndex(basePath, "", func(line *fileInfo) {
+		if change, ok := changes[line.Path]; ok {
+			delete(changes, line.Path)
+			line = change
+		}
+		if !line.Removed {
+			writeIndexLine(writer, line)
+		}
+	})
+
+	// added since the base
+	for _, change := range changes {
+		if !change.Removed {
+			writeIndexLine(writer, change)
+		}
+	}
+
+	checkErr(writer.Flush())
+	return mergedFile.Name()
+}
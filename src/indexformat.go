@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+/*
+ * indexes are built locally as JSON lines, one fileInfo per line after the header line.
+ * with index.format sqlite they are uploaded as SQLite databases instead, entries keyed by path,
+ * so a restore can count and select a subtree without parsing the whole index.
+ * readers tell both formats apart by the SQLite file magic.
+ */
+const sqliteFileMagic = "SQLite format 3\x00"
+
+const sqliteIndexSchema = `
+CREATE TABLE header(
+	value TEXT NOT NULL
+);
+
+CREATE TABLE entries(
+	path TEXT PRIMARY KEY,
+	chunkKey TEXT NOT NULL,
+	size BIGINT NOT NULL,
+	modTime BIGINT NOT NULL,
+	creationTime BIGINT NOT NULL,
+	removed INTEGER NOT NULL DEFAULT 0
+) WITHOUT ROWID;
+
+-- special files only, indexes of older versions do not have it
+CREATE TABLE special(
+	path TEXT PRIMARY KEY,
+	type TEXT NOT NULL,
+	device BIGINT NOT NULL
+) WITHOUT ROWID;
+`
+
+func isSQLiteIndex(path string) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	magic := make([]byte, len(sqliteFileMagic))
+	n, _ := f.Read(magic)
+	return n == len(magic) && bytes.Equal(magic, []byte(sqliteFileMagic))
+}
+
+func openSQLiteIndex(path string) (*sql.DB, error) {
+	return sql.Open("sqlite3", "file:"+path+"?mode=ro&immutable=1")
+}
+
+// convert the JSON lines index at jsonPath into a SQLite index in a temp file
+func writeSQLiteIndex(jsonPath string) (dbPath string, err error) {
+	dbFile, err := ioutil.TempFile(tempDir, "ossIndexTmp")
+	if err != nil {
+		return "", err
+	}
+	dbPath = dbFile.Name()
+	dbFile.Close()
+
+	db, err := sql.Open("sqlite3", "file:"+dbPath+"?_journal_mode=OFF&_synchronous=OFF")
+	if err != nil {
+		os.Remove(dbPath)
+		return "", err
+	}
+	defer db.Close()
+
+	if _, err := db.Exec(sqliteIndexSchema); err != nil {
+		os.Remove(dbPath)
+		return "", err
+	}
+
+	trx, err := db.Begin()
+	if err != nil {
+		os.Remove(dbPath)
+		return "", err
+	}
+
+	if header, ok := readIndexHeader(jsonPath); ok {
+		headerJSON, _ := json.Marshal(header)
+		_, err = trx.Exec("INSERT INTO header (value) VALUES (?)", string(headerJSON))
+		checkErr(err)
+	}
+
+	insert, err := trx.Prepare("INSERT OR REPLACE INTO entries (path, chunkKey, size, modTime, creationTime, removed) VALUES (?, ?, ?, ?, ?, ?)")
+	checkErr(err)
+	insertSpecial, err := trx.Prepare("INSERT OR REPLACE INTO special (path, type, device) VALUES (?, ?, ?)")
+	checkErr(err)
+	scanFileJSONLines(jsonPath, func(line *fileInfo) {
+		_, err := insert.Exec(line.Path, line.ChunkKey, line.Size, line.ModTime, line.CreationTime, line.Removed)
+		checkErr(err)
+		if line.Type != "" {
+			_, err = insertSpecial.Exec(line.Path, line.Type, int64(line.Device))
+			checkErr(err)
+		}
+	})
+	insert.Close()
+	insertSpecial.Close()
+
+	if err := trx.Commit(); err != nil {
+		os.Remove(dbPath)
+		return "", err
+	}
+	return dbPath, nil
+}
+
+// whether path is prefix or below it, an empty prefix matches everything
+func hasPathPrefix(path string, prefix string) bool {
+	return prefix == "" || path == prefix || strings.HasPrefix(path, prefix+"/")
+}
+
+// SQL condition selecting the entries below prefix, "0" sorts right after "/"
+func pathPrefixCondition(prefix string) (string, []interface{}) {
+	if prefix == "" {
+		return "1", nil
+	}
+	return "(path = ? OR (path >= ? AND path < ?))", []interface{}{prefix, prefix + "/", prefix + "0"}
+}
+
+// call fn for every entry of the index at path below prefix, in either format
+func scanIndex(path string, prefix string, fn func(line *fileInfo)) {
+	prefix = strings.Trim(prefix, "/")
+
+	if !isSQLiteIndex(path) {
+		scanFileJSONLines(path, func(line *fileInfo) {
+			if hasPathPrefix(line.Path, prefix) {
+				fn(line)
+			}
+		})
+		return
+	}
+
+	db, err := openSQLiteIndex(path)
+	checkErr(err)
+	defer db.Close()
+
+	condition, args := pathPrefixCondition(prefix)
+	query := "SELECT path, chunkKey, size, modTime, creationTime, removed, '', 0 FROM entries WHERE " + condition + " ORDER BY path"
+	var special int
+	checkErr(db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'special'").Scan(&special))
+	if special > 0 {
+		query = "SELECT path, chunkKey, size, modTime, creationTime, removed, COALESCE(type, ''), COALESCE(device, 0) FROM entries LEFT JOIN special USING (path) WHERE " + condition + " ORDER BY path"
+	}
+	rows, err := db.Query(query, args...)
+	checkErr(err)
+	defer rows.Close()
+
+	for rows.Next() {
+		var line fileInfo
+		var device int64
+		checkErr(rows.Scan(&line.Path, &line.ChunkKey, &line.Size, &line.ModTime, &line.CreationTime, &line.Removed, &line.Type, &device))
+		line.Device = uint64(device)
+		fn(&line)
+	}
+	checkErr(rows.Err())
+}
+
+// number and total size of the entries below prefix
+func indexStats(path string, prefix string) (count int32, size int64) {
+	prefix = strings.Trim(prefix, "/")
+
+	if !isSQLiteIndex(path) {
+		scanIndex(path, prefix, func(line *fileInfo) {
+			count++
+			size += line.Size
+		})
+		return
+	}
+
+	db, err := openSQLiteIndex(path)
+	checkErr(err)
+	defer db.Close()
+
+	condition, args := pathPrefixCondition(prefix)
+	checkErr(db.QueryRow("SELECT COUNT(*), COALESCE(SUM(size), 0) FROM entries WHERE "+condition, args...).Scan(&count, &size))
+	return
+}
+
+func readSQLiteIndexHeader(path string) (header indexHeader, ok bool) {
+	db, err := openSQLiteIndex(path)
+	if err != nil {
+		return indexHeader{}, false
+	}
+	defer db.Close()
+
+	var headerJSON string
+	if db.QueryRow("SELECT value FROM header").Scan(&headerJSON) != nil {
+		return indexHeader{}, false
+	}
+	if json.Unmarshal([]byte(headerJSON), &header) != nil {
+		return indexHeader{}, false
+	}
+	return header, true
+}
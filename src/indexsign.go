@@ -0,0 +1,161 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/aliyun/aliyun-oss-go-sdk/oss"
+)
+
+/*
+ * every uploaded index carries the sha256 of its uncompressed content in its object metadata,
+ * restore refuses an index not matching it, like a truncated upload.
+ * with index.signingKey (HMAC) or index.ed25519PrivateKey the checksum and the index key are signed as well,
+ * so an index replaced by someone able to write to the bucket is refused.
+ */
+const (
+	indexChecksumMeta  = "Index-Sha256"
+	indexSignatureMeta = "Index-Signature"
+)
+
+// keys from index config, set by getConfig
+type indexKeys struct {
+	hmacKey          []byte
+	privateKey       ed25519.PrivateKey // nil if indexes are not signed with ed25519
+	publicKey        ed25519.PublicKey  // nil if ed25519 signatures are not verified
+	requireSignature bool
+}
+
+var indexSigning indexKeys
+
+func loadIndexKeys(conf *indexConfig) (keys indexKeys, err error) {
+	keys.requireSignature = conf.RequireSignature
+	if conf.SigningKey != "" {
+		keys.hmacKey = []byte(conf.SigningKey)
+	}
+
+	if conf.Ed25519PrivateKey != "" {
+		seed, err := base64.StdEncoding.DecodeString(conf.Ed25519PrivateKey)
+		if err != nil || len(seed) != ed25519.SeedSize {
+			return keys, errors.New("index.ed25519PrivateKey should be a base64 encoded 32 byte seed")
+		}
+		keys.privateKey = ed25519.NewKeyFromSeed(seed)
+		keys.publicKey = keys.privateKey.Public().(ed25519.PublicKey)
+	}
+
+	if conf.Ed25519PublicKey != "" {
+		publicKey, err := base64.StdEncoding.DecodeString(conf.Ed25519PublicKey)
+		if err != nil || len(publicKey) != ed25519.PublicKeySize {
+			return keys, errors.New("index.ed25519PublicKey should be a base64 encoded 32 byte key")
+		}
+		keys.publicKey = publicKey
+	}
+
+	if keys.requireSignature && keys.hmacKey == nil && keys.publicKey == nil {
+		return keys, errors.New("index.requireSignature needs index.signingKey or an ed25519 key")
+	}
+	return keys, nil
+}
+
+func fileSha256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+// what is signed, the key keeps a signed index from being passed off as another snapshot
+func signedIndexMessage(key string, checksum string) []byte {
+	return []byte(key + "\n" + checksum)
+}
+
+// metadata options for uploading the index at path as key
+func indexIntegrityOptions(key string, path string) ([]oss.Option, error) {
+	checksum, err := fileSha256(path)
+	if err != nil {
+		return nil, err
+	}
+
+	options := []oss.Option{oss.Meta(indexChecksumMeta, checksum)}
+	message := signedIndexMessage(key, checksum)
+
+	if indexSigning.privateKey != nil {
+		signature := ed25519.Sign(indexSigning.privateKey, message)
+		options = append(options, oss.Meta(indexSignatureMeta, "ed25519:"+base64.StdEncoding.EncodeToString(signature)))
+	} else if indexSigning.hmacKey != nil {
+		mac := hmac.New(sha256.New, indexSigning.hmacKey)
+		mac.Write(message)
+		options = append(options, oss.Meta(indexSignatureMeta, "hmac-sha256:"+hex.EncodeToString(mac.Sum(nil))))
+	}
+	return options, nil
+}
+
+func verifyIndexSignature(key string, checksum string, signature string) error {
+	message := signedIndexMessage(key, checksum)
+
+	switch {
+	case strings.HasPrefix(signature, "ed25519:") && indexSigning.publicKey != nil:
+		value, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(signature, "ed25519:"))
+		if err != nil || !ed25519.Verify(indexSigning.publicKey, message, value) {
+			return errors.New("signature of index " + key + " is invalid")
+		}
+		return nil
+
+	case strings.HasPrefix(signature, "hmac-sha256:") && indexSigning.hmacKey != nil:
+		value, err := hex.DecodeString(strings.TrimPrefix(signature, "hmac-sha256:"))
+		mac := hmac.New(sha256.New, indexSigning.hmacKey)
+		mac.Write(message)
+		if err != nil || !hmac.Equal(value, mac.Sum(nil)) {
+			return errors.New("signature of index " + key + " is invalid")
+		}
+		return nil
+	}
+
+	if indexSigning.requireSignature {
+		return errors.New("index " + key + " has no signature verifiable with the configured keys")
+	}
+	return nil
+}
+
+/*
+ * check the index downloaded from key to path against the checksum and signature uploaded with it.
+ * indexes uploaded by older versions have neither and are accepted, unless index.requireSignature is set.
+ */
+func verifyIndex(bucket *oss.Bucket, key string, path string) error {
+	meta, err := bucket.GetObjectDetailedMeta(objectKey(key))
+	if err != nil {
+		return err
+	}
+
+	expected := meta.Get("X-Oss-Meta-" + indexChecksumMeta)
+	if expected == "" {
+		if indexSigning.requireSignature {
+			return errors.New("index " + key + " is not signed")
+		}
+		return nil
+	}
+
+	checksum, err := fileSha256(path)
+	if err != nil {
+		return err
+	}
+	if checksum != strings.ToLower(expected) {
+		return errors.New("index " + key + " is damaged, its checksum does not match")
+	}
+
+	return verifyIndexSignature(key, expected, meta.Get("X-Oss-Meta-"+indexSignatureMeta))
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aliyun/aliyun-oss-go-sdk/oss"
+	"github.com/klauspost/compress/zstd"
+)
+
+/*
+ * with index.compression zstd, indexes are compressed with a dictionary trained from the first index a host uploads.
+ * the dictionary is uploaded to dictionaries/<id>.dict, the id is in the header of every zstd frame using it,
+ * so any machine can read the index. the dictionary is kept in the cache dir and reused afterwards.
+ */
+const indexDictionaryPrefix = "dictionaries/"
+
+// samples taken from an index to train its dictionary
+const (
+	dictionarySampleSize    = 4096
+	dictionaryMaxSamples    = 2048
+	dictionaryHistoryLength = 110 * 1024
+)
+
+// suffix of index objects by index.compression
+var indexKeySuffixes = map[string]string{
+	"deflate": ".dat.deflate",
+	"zstd":    ".dat.zst",
+}
+
+func indexDictionaryKey(id uint32) string {
+	return indexDictionaryPrefix + strconv.FormatUint(uint64(id), 10) + ".dict"
+}
+
+// train a dictionary from blocks spread over the file at path
+func trainIndexDictionary(path string) ([]byte, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	step := len(content) / dictionarySampleSize / dictionaryMaxSamples
+	if step < 1 {
+		step = 1
+	}
+
+	var samples [][]byte
+	var history []byte
+	for i := 0; i*dictionarySampleSize < len(content); i += step {
+		end := (i + 1) * dictionarySampleSize
+		if end > len(content) {
+			end = len(content)
+		}
+		sample := content[i*dictionarySampleSize : end]
+		samples = append(samples, sample)
+
+		if len(history)+len(sample) <= dictionaryHistoryLength {
+			history = append(history, sample...)
+		}
+	}
+	if len(samples) < 8 {
+		return nil, errors.New("index is too small to train a dictionary")
+	}
+
+	// ids below 32768 are reserved
+	id := uint32(32768 + rand.New(rand.NewSource(time.Now().UnixNano())).Int31n(1<<30))
+	return zstd.BuildDict(zstd.BuildDictOptions{
+		ID:       id,
+		Contents: samples,
+		History:  history,
+		Offsets:  [3]int{1, 4, 8},
+		Level:    zstd.SpeedBestCompression,
+	})
+}
+
+// the dictionary of this host, trained from indexPath and uploaded the first time, nil if there is none
+func indexDictionary(conf *userConfig, bucket *oss.Bucket, indexPath string) []byte {
+	initCache(conf)
+	dictPath := cacheFilePath(conf, ".index."+conf.Index.Format+".dict")
+	if dict, err := ioutil.ReadFile(dictPath); err == nil && len(dict) > 0 {
+		return dict
+	}
+
+	dict, err := trainIndexDictionary(indexPath)
+	if err != nil {
+		fmt.Printf("[Index] No dictionary is used: %v\n", err)
+		return nil
+	}
+
+	err = bucket.PutObject(objectKey(indexDictionaryKey(dictionaryID(dict))), bytes.NewReader(dict), appendOnlyOptions(nil)...)
+	if err != nil && !isObjectAlreadyThere(err) {
+		fmt.Printf("[Index] Dictionary could not be uploaded, no dictionary is used: %v\n", err)
+		return nil
+	}
+
+	if err := ioutil.WriteFile(dictPath, dict, 0644); err != nil {
+		fmt.Printf("[Error] Dictionary could not be kept: %v\n", err)
+	}
+	return dict
+}
+
+// the id in a dictionary, after its 4 byte magic
+func dictionaryID(dict []byte) uint32 {
+	if len(dict) < 8 {
+		return 0
+	}
+	return uint32(dict[4]) | uint32(dict[5])<<8 | uint32(dict[6])<<16 | uint32(dict[7])<<24
+}
+
+// compress the index at path with zstd into a temp file
+func compressIndexZstd(conf *userConfig, bucket *oss.Bucket, path string) (tmpPath string, size int64, err error) {
+	src, err := os.Open(path)
+	if err != nil {
+		return "", 0, err
+	}
+	defer src.Close()
+
+	tmpFile, err := ioutil.TempFile(tempDir, "ossTmp")
+	if err != nil {
+		return "", 0, err
+	}
+	defer tmpFile.Close()
+
+	options := []zstd.EOption{zstd.WithEncoderLevel(zstd.SpeedBestCompression)}
+	if dict := indexDictionary(conf, bucket, path); dict != nil {
+		options = append(options, zstd.WithEncoderDict(dict))
+	}
+
+	encoder, err := zstd.NewWriter(tmpFile, options...)
+	if err == nil {
+		_, err = io.Copy(encoder, src)
+		if closeErr := encoder.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if err != nil {
+		tmpFile.Close()
+		os.Remove(tmpFile.Name())
+		return "", 0, err
+	}
+
+	size, _ = tmpFile.Seek(0, 1)
+	return tmpFile.Name(), size, nil
+}
+
+// dictionaries fetched from the bucket by id, prune reads many indexes using the same one
+var indexDictionaries = make(map[uint32][]byte)
+var indexDictionariesMutex sync.Mutex
+
+func fetchIndexDictionary(bucket *oss.Bucket, id uint32) ([]byte, error) {
+	indexDictionariesMutex.Lock()
+	defer indexDictionariesMutex.Unlock()
+
+	if dict, ok := indexDictionaries[id]; ok {
+		return dict, nil
+	}
+
+	body, err := bucket.GetObject(objectKey(indexDictionaryKey(id)))
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	dict, err := ioutil.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+	indexDictionaries[id] = dict
+	return dict, nil
+}
+
+// download the zstd index at key and decompress it to localPath
+func downloadZstdIndex(bucket *oss.Bucket, key string, localPath string) (size int64, err error) {
+	tmpFile, err := ioutil.TempFile(tempDir, "ossDownTmp")
+	if err != nil {
+		return 0, err
+	}
+	tmpFileName := tmpFile.Name()
+	tmpFile.Close()
+	defer os.Remove(tmpFileName)
+
+	if err := getObjectToFile(bucket, objectKey(key), tmpFileName); err != nil {
+		return 0, err
+	}
+
+	src, err := os.Open(tmpFileName)
+	if err != nil {
+		return 0, err
+	}
+	defer src.Close()
+
+	var options []zstd.DOption
+	frameStart := make([]byte, 18)
+	n, _ := io.ReadFull(src, frameStart)
+	var header zstd.Header
+	if err := header.Decode(frameStart[:n]); err == nil && header.DictionaryID != 0 {
+		dict, err := fetchIndexDictionary(bucket, header.DictionaryID)
+		if err != nil {
+			return 0, errors.New("dictionary of index could not be read: " + err.Error())
+		}
+		options = append(options, zstd.WithDecoderDicts(dict))
+	}
+	if _, err := src.Seek(0, 0); err != nil {
+		return 0, err
+	}
+
+	decoder, err := zstd.NewReader(src, options...)
+	if err != nil {
+		return 0, err
+	}
+	defer decoder.Close()
+
+	localFile, err := os.OpenFile(localPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return 0, err
+	}
+	defer localFile.Close()
+
+	if size, err = io.Copy(localFile, decoder); err != nil {
+		localFile.Close()
+		os.Remove(localPath)
+		return 0, err
+	}
+	return size, nil
+}
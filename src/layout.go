@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+
+	"github.com/aliyun/aliyun-oss-go-sdk/oss"
+)
+
+/*
+ * version of the object layout in the bucket.
+ * 1: chunks at chunk/<hash>/<hex digest>.<compression>, indexes at indexes/[<host>/]<time>[~<tag>...].dat.deflate
+ * 2: indexes may be SQLite databases instead of JSON lines
+ * 3: indexes may be compressed with zstd as indexes/...dat.zst, dictionaries at dictionaries/<id>.dict
+ * 4: chunks may be kept in the buckets recorded in the layout object, see chunkBucket
+ */
+const repositoryLayoutVersion = 4
+
+const layoutObjectKey = "layout.json"
+
+// stored in layoutObjectKey, repositories without it are layout 1 unless they are empty
+type repositoryLayout struct {
+	Version     int
+	Hash        string // hash of chunk keys
+	Compression string // format of chunk objects
+	// buckets chunks are spread over, none keeps them in the bucket of the layout object
+	ChunkBuckets []string `json:",omitempty"`
+}
+
+func currentRepositoryLayout() repositoryLayout {
+	return repositoryLayout{Version: repositoryLayoutVersion, Hash: "sha512", Compression: "deflate", ChunkBuckets: chunkBucketNames}
+}
+
+type layoutMigration struct {
+	// the migration renames or rewrites nothing, so any sync may apply it, see checkRepositoryLayout
+	inPlace bool
+	migrate func(bucket *oss.Bucket) error
+}
+
+// layoutMigrations[i] moves a repository from layout i+1 to i+2, renaming objects and rewriting indexes as needed
+var layoutMigrations = []layoutMigration{
+	// 2: JSON lines indexes stay readable, only versions unable to read SQLite indexes must be kept out
+	{inPlace: true, migrate: func(bucket *oss.Bucket) error { return nil }},
+	// 3: deflate indexes stay readable as well
+	{inPlace: true, migrate: func(bucket *oss.Bucket) error { return nil }},
+	// 4: chunks stay where they are, sharding them is only possible before there are any
+	{inPlace: true, migrate: func(bucket *oss.Bucket) error {
+		if len(chunkBucketNames) == 0 {
+			return nil
+		}
+		lsRes, err := bucket.ListObjects(oss.Prefix(objectKey(chunkKeyPrefix)), oss.MaxKeys(1))
+		if err != nil {
+			return err
+		}
+		if len(lsRes.Objects) > 0 {
+			return errors.New("the repository has chunks already, they cannot be moved to oss.chunkBuckets")
+		}
+		return nil
+	}},
+}
+
+func readRepositoryLayout(bucket *oss.Bucket) (repositoryLayout, error) {
+	body, err := bucket.GetObject(objectKey(layoutObjectKey))
+	if err != nil {
+		if serviceErr, ok := err.(oss.ServiceError); ok && serviceErr.Code == "NoSuchKey" {
+			empty, err := repositoryIsEmpty(bucket)
+			if err != nil || empty {
+				// a new repository, the first sync writes the layout object
+				return currentRepositoryLayout(), err
+			}
+			// created before layouts were versioned
+			return repositoryLayout{Version: 1, Hash: "sha512", Compression: "deflate"}, nil
+		}
+		return repositoryLayout{}, err
+	}
+	defer body.Close()
+
+	content, err := ioutil.ReadAll(body)
+	if err != nil {
+		return repositoryLayout{}, err
+	}
+
+	var layout repositoryLayout
+	if err := json.Unmarshal(content, &layout); err != nil {
+		return repositoryLayout{}, errors.New("layout object is invalid: " + err.Error())
+	}
+	return layout, nil
+}
+
+// whether the repository has neither chunks nor indexes, lock and gc objects do not count
+func repositoryIsEmpty(bucket *oss.Bucket) (bool, error) {
+	for _, prefix := range []string{chunkKeyPrefix, indexKeyPrefix} {
+		lsRes, err := bucket.ListObjects(oss.Prefix(objectKey(prefix)), oss.MaxKeys(1))
+		if err != nil {
+			return false, err
+		}
+		if len(lsRes.Objects) > 0 {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// whether every migration from layout version on renames or rewrites nothing
+func inPlaceMigrations(version int) bool {
+	for ; version < repositoryLayoutVersion; version++ {
+		if !layoutMigrations[version-1].inPlace {
+			return false
+		}
+	}
+	return true
+}
+
+func writeRepositoryLayout(bucket *oss.Bucket, layout repositoryLayout) error {
+	content, _ := json.Marshal(layout)
+	return bucket.PutObject(objectKey(layoutObjectKey), bytes.NewReader(content), appendOnlyOptions(nil)...)
+}
+
+/*
+ * refuse to touch a repository of another layout, writing the layout object of new repositories.
+ * older layouts whose migrations change no objects are upgraded by writable commands and read as they are by others,
+ * the rest need `ossBackup migrate-layout`.
+ */
+func checkRepositoryLayout(bucket *oss.Bucket, writable bool) error {
+	layout, err := readRepositoryLayout(bucket)
+	if err != nil {
+		return err
+	}
+
+	if layout.Version > repositoryLayoutVersion {
+		return errors.New("repository layout " + strconv.Itoa(layout.Version) + " is newer than this version supports, please upgrade")
+	}
+	if layout.Version < repositoryLayoutVersion {
+		if !inPlaceMigrations(layout.Version) {
+			return errors.New("repository layout " + strconv.Itoa(layout.Version) + " is outdated, run `ossBackup migrate-layout` first")
+		}
+		if !writable {
+			return sameChunkBuckets(layout)
+		}
+		if appendOnlyMode {
+			// the layout object cannot be replaced
+			return errors.New("repository layout " + strconv.Itoa(layout.Version) + " is outdated, run `ossBackup migrate-layout` with a config without appendOnly first")
+		}
+
+		for version := layout.Version; version < repositoryLayoutVersion; version++ {
+			if err := layoutMigrations[version-1].migrate(bucket); err != nil {
+				return err
+			}
+		}
+		fmt.Printf("Repository layout upgraded from version %d to %d\n", layout.Version, repositoryLayoutVersion)
+		return writeRepositoryLayout(bucket, currentRepositoryLayout())
+	}
+	if err := sameChunkBuckets(layout); err != nil {
+		return err
+	}
+
+	if writable {
+		if exists, err := bucket.IsObjectExist(objectKey(layoutObjectKey)); err == nil && !exists {
+			return writeRepositoryLayout(bucket, currentRepositoryLayout())
+		}
+	}
+	return nil
+}
+
+// `ossBackup migrate-layout`, bring the repository to the layout of this version
+func runMigrateLayout(args []string) {
+	var configFileName string
+	var forceUnlock bool
+	flags := flag.NewFlagSet("migrate-layout", flag.ExitOnError)
+	flags.StringVar(&configFileName, "c", "", "the name of config file")
+	flags.BoolVar(&forceUnlock, "force-unlock", false, "remove locks left by another sync before migrating")
+	flags.Parse(args)
+
+	conf := getConfig(configFileName)
+	refuseInAppendOnlyMode("migrate-layout")
+	refuseInReadOnlyMode("migrate-layout")
+	_, bucket, err := getOSSClient(&conf)
+	checkErr(err)
+
+	lock, err := acquireSyncLock(&conf, bucket, forceUnlock)
+	checkErr(err)
+	defer lock.release()
+
+	// objects are renamed below other hosts as well, syncs starting from now on see the lease and stop
+	lease, _, err := takeLease(bucket, objectKey(gcSweepLockKey), "migrate-layout")
+	checkErr(err)
+	defer lease.release()
+	others, err := otherHostLocks(&conf, bucket)
+	checkErr(err)
+	if len(others) > 0 && !forceUnlock {
+		checkErr(errors.New("other hosts are syncing (" + strings.Join(others, ", ") + "), stop them or use --force-unlock"))
+	}
+
+	layout, err := readRepositoryLayout(bucket)
+	checkErr(err)
+
+	if layout.Version > repositoryLayoutVersion {
+		checkErr(errors.New("repository layout " + strconv.Itoa(layout.Version) + " is newer than this version supports"))
+	}
+
+	for version := layout.Version; version < repositoryLayoutVersion; version++ {
+		fmt.Printf("Migrating repository layout to version %d\n", version+1)
+		checkErr(lease.check())
+		checkErr(layoutMigrations[version-1].migrate(bucket))
+
+		// written after each step, so an interrupted migration continues where it stopped
+		layout = currentRepositoryLayout()
+		layout.Version = version + 1
+		checkErr(writeRepositoryLayout(bucket, layout))
+	}
+
+	checkErr(writeRepositoryLayout(bucket, currentRepositoryLayout()))
+	fmt.Printf("Repository layout is version %d\n", repositoryLayoutVersion)
+}
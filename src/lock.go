@@ -0,0 +1,366 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/aliyun/aliyun-oss-go-sdk/oss"
+)
+
+/*
+ * lock objects are kept per host at locks/<host>.lock.
+ * hosts sharing a bucket only write their own indexes and content addressed chunks, so they may sync at the same time,
+ * see chunkKeyPrefix for why concurrent uploads of the same chunk are safe.
+ */
+const remoteLockPrefix = "locks/"
+
+func remoteLockKey(conf *userConfig) string {
+	return remoteLockPrefix + snapshotHost(conf) + ".lock"
+}
+
+type lockInfo struct {
+	Hostname  string
+	PID       int
+	Time      int64
+	Operation string `json:",omitempty"` // sync, prune or migrate-layout
+	Expires   int64  `json:",omitempty"` // unix nano time the lease ends unless renewed, 0 for locks of older versions
+	BootTime  int64  `json:",omitempty"` // unix time the machine booted, so a PID of an earlier boot is not taken for a live one
+}
+
+type syncLock struct {
+	localPath string
+	lease     *lockLease // nil if no lock object is used
+}
+
+func (l lockInfo) String() string {
+	description := fmt.Sprintf("%s (pid %d) since %s", l.Hostname, l.PID, time.Unix(0, l.Time).Format(time.RFC3339))
+	if l.Operation != "" {
+		description = l.Operation + " of " + description
+	}
+	return description
+}
+
+func newLockInfo(operation string) lockInfo {
+	hostname, _ := os.Hostname()
+	now := time.Now()
+	return lockInfo{
+		Hostname:  hostname,
+		PID:       os.Getpid(),
+		Time:      now.UnixNano(),
+		Operation: operation,
+		Expires:   now.Add(lockLeaseDuration).UnixNano(),
+		BootTime:  bootTime(),
+	}
+}
+
+/*
+ * whether the local lock with content was left by a process of this machine which is gone, like a crashed sync.
+ * locks which cannot be read, or of older versions without a PID, are never taken for stale.
+ */
+func localLockStale(content []byte) bool {
+	var info lockInfo
+	if err := json.Unmarshal(content, &info); err != nil || info.PID == 0 {
+		return false
+	}
+	if hostname, _ := os.Hostname(); info.Hostname != hostname {
+		// cacheDir on a shared disk
+		return false
+	}
+
+	// boot times are computed from the uptime on some systems, a few seconds apart are the same boot
+	if now := bootTime(); info.BootTime != 0 && now != 0 && (info.BootTime-now > 60 || now-info.BootTime > 60) {
+		return true
+	}
+	return !processAlive(info.PID)
+}
+
+func describeLock(content []byte) string {
+	var info lockInfo
+	if err := json.Unmarshal(content, &info); err != nil {
+		return "unknown owner"
+	}
+	return info.String()
+}
+
+/*
+ * take the sync lock before touching the cache or the bucket.
+ * a local lock file is always used, a lease object in the bucket is used as well if oss.useLockObject is set,
+ * except in read-only mode, which writes nothing to the bucket.
+ * if forceUnlock is true, existing locks are removed first.
+ */
+func acquireSyncLock(conf *userConfig, bucket *oss.Bucket, forceUnlock bool) (*syncLock, error) {
+	lock := &syncLock{localPath: cacheFilePath(conf, ".lock.dat")}
+	remoteKey := objectKey(remoteLockKey(conf))
+
+	if forceUnlock {
+		fmt.Println("Removing existing locks")
+		os.Remove(lock.localPath)
+		if conf.Oss.UseLockObject && !readOnlyMode {
+			bucket.DeleteObject(remoteKey)
+			bucket.DeleteObject(objectKey(gcSweepLockKey))
+		}
+	}
+
+	f, err := os.OpenFile(lock.localPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if os.IsExist(err) {
+		holder, _ := ioutil.ReadFile(lock.localPath)
+		if !localLockStale(holder) {
+			return nil, errors.New("another sync is running on this machine: " + describeLock(holder) + ", use --force-unlock if it is not")
+		}
+		fmt.Printf("[Lock] Taking over the lock of %s, its process is gone\n", describeLock(holder))
+		// unless another sync took it over first
+		if current, _ := ioutil.ReadFile(lock.localPath); bytes.Equal(current, holder) {
+			os.Remove(lock.localPath)
+		}
+		f, err = os.OpenFile(lock.localPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	}
+	if err != nil {
+		if os.IsExist(err) {
+			return nil, errors.New("another sync took the lock of this machine at the same time")
+		}
+		return nil, err
+	}
+	content, _ := json.Marshal(newLockInfo("sync"))
+	f.Write(content)
+	f.Close()
+
+	if conf.Oss.UseLockObject && !readOnlyMode {
+		lease, holder, err := takeLease(bucket, remoteKey, "sync")
+		if err != nil {
+			os.Remove(lock.localPath)
+			if holder != nil {
+				return nil, errors.New("another sync of this host is running on this bucket: " + holder.String() + ", use --force-unlock if it is not")
+			}
+			return nil, err
+		}
+		lock.lease = lease
+
+		// a prune removing chunks checks for lock objects after taking its own, one of both always sees the other
+		maintenance, err := activeLease(bucket, objectKey(gcSweepLockKey))
+		if err != nil || maintenance != nil {
+			lock.release()
+			if err != nil {
+				return nil, err
+			}
+			return nil, errors.New("the repository is being maintained by " + maintenance.String() + ", try again later")
+		}
+	}
+
+	return lock, nil
+}
+
+// an error if the lock object of the sync was lost, see lockLease.check
+func (l *syncLock) check() error {
+	if l.lease == nil {
+		return nil
+	}
+	return l.lease.check()
+}
+
+func (l *syncLock) release() {
+	if l.lease != nil {
+		l.lease.release()
+	}
+	os.Remove(l.localPath)
+}
+
+// lock objects of other hosts syncing to the bucket, only known if they use lock objects as well. stale leases are left out
+func otherHostLocks(conf *userConfig, bucket *oss.Bucket) ([]string, error) {
+	lsRes, err := bucket.ListObjects(oss.Prefix(objectKey(remoteLockPrefix)), oss.MaxKeys(1000))
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []string
+	for _, object := range lsRes.Objects {
+		if object.Key == objectKey(remoteLockKey(conf)) {
+			continue
+		}
+		holder, err := activeLease(bucket, object.Key)
+		if err != nil {
+			return nil, err
+		}
+		if holder != nil {
+			keys = append(keys, object.Key)
+		}
+	}
+	return keys, nil
+}
+
+/*
+ * lock objects are leases: they end lockLeaseDuration after they were last renewed, and the holder renews them
+ * every lockLeaseDuration/3 while it runs. a lease not renewed for maxClockSkew longer than that is stale, its holder
+ * crashed or lost its connection, and is taken over instead of blocking every host until --force-unlock.
+ * the margin keeps hosts whose clocks are off from taking over leases which are still held.
+ */
+const lockLeaseDuration = 5 * time.Minute
+
+// a lock object held by this process
+type lockLease struct {
+	bucket *oss.Bucket
+	key    string
+	info   lockInfo
+	stop   chan struct{}
+	done   chan struct{}
+	lost   int32 // atomic, 1 once another host took the lock object over
+}
+
+func (l lockInfo) stale() bool {
+	return l.Expires != 0 && time.Now().After(time.Unix(0, l.Expires).Add(maxClockSkew))
+}
+
+// the holder of the lock object at key, nil if there is none
+func readLockObject(bucket *oss.Bucket, key string) (*lockInfo, error) {
+	body, err := bucket.GetObject(key)
+	if err != nil {
+		if serviceErr, ok := err.(oss.ServiceError); ok && serviceErr.Code == "NoSuchKey" {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer body.Close()
+
+	content, err := ioutil.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+	var info lockInfo
+	if err := json.Unmarshal(content, &info); err != nil {
+		info = lockInfo{Hostname: "unknown owner"}
+	}
+	return &info, nil
+}
+
+// the holder of the lock object at key, nil if there is none or its lease is stale
+func activeLease(bucket *oss.Bucket, key string) (*lockInfo, error) {
+	holder, err := readLockObject(bucket, key)
+	if err != nil || holder == nil {
+		return nil, err
+	}
+	if holder.stale() {
+		fmt.Printf("[Lock] %s is a stale lease of %s, ignored\n", key, holder)
+		return nil, nil
+	}
+	return holder, nil
+}
+
+/*
+ * create the lock object at key for operation and keep renewing it until release.
+ * if it exists and its lease is stale it is taken over, otherwise its holder is returned with the error.
+ * two hosts taking over the same stale lease at once may both succeed, as deleting it is not conditional,
+ * the lock object is read back after writing it, and check before changing anything catches what that misses.
+ */
+func takeLease(bucket *oss.Bucket, key string, operation string) (*lockLease, *lockInfo, error) {
+	for attempt := 0; ; attempt++ {
+		info := newLockInfo(operation)
+		content, _ := json.Marshal(info)
+		// ForbidOverWrite makes creating the lock object atomic
+		err := bucket.PutObject(key, bytes.NewReader(content), oss.ForbidOverWrite(true))
+		if err == nil {
+			lease := &lockLease{bucket: bucket, key: key, info: info, stop: make(chan struct{}), done: make(chan struct{})}
+			holder, readErr := readLockObject(bucket, key)
+			if readErr != nil {
+				return nil, nil, readErr
+			}
+			if !lease.owns(holder) {
+				return nil, holder, errors.New(key + " was taken over by another host at the same time")
+			}
+			go lease.renew()
+			return lease, nil, nil
+		}
+
+		serviceErr, ok := err.(oss.ServiceError)
+		if !ok || serviceErr.Code != "FileAlreadyExists" || attempt > 0 {
+			return nil, nil, err
+		}
+
+		holder, readErr := readLockObject(bucket, key)
+		if readErr != nil {
+			return nil, nil, readErr
+		}
+		if holder != nil && !holder.stale() {
+			return nil, holder, errors.New(key + " is held by " + holder.String())
+		}
+		if holder != nil {
+			fmt.Printf("[Lock] %s is a stale lease of %s, expired at %s, taking it over\n",
+				key, holder, time.Unix(0, holder.Expires).Format(time.RFC3339))
+			if err := bucket.DeleteObject(key); err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+}
+
+// extend the lease every lockLeaseDuration/3, until release or until another host has taken it over
+func (l *lockLease) renew() {
+	defer close(l.done)
+	ticker := time.NewTicker(lockLeaseDuration / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-ticker.C:
+		}
+
+		holder, err := readLockObject(l.bucket, l.key)
+		if err == nil && !l.owns(holder) {
+			fmt.Printf("[Warning] Lease %s was removed or taken over by another host, it is not renewed anymore\n", l.key)
+			atomic.StoreInt32(&l.lost, 1)
+			return
+		}
+
+		l.info.Expires = time.Now().Add(lockLeaseDuration).UnixNano()
+		content, _ := json.Marshal(l.info)
+		if err := l.bucket.PutObject(l.key, bytes.NewReader(content)); err != nil {
+			fmt.Printf("[Warning] Lease %s could not be renewed: %v\n", l.key, err)
+		}
+	}
+}
+
+// whether holder, read from the lock object, is this lease
+func (l *lockLease) owns(holder *lockInfo) bool {
+	return holder != nil && holder.Hostname == l.info.Hostname && holder.PID == l.info.PID && holder.Time == l.info.Time
+}
+
+/*
+ * an error unless the lock object is still this lease, read again each time.
+ * called before uploading an index or deleting objects, which must stop once another host holds the lock.
+ */
+func (l *lockLease) check() error {
+	if atomic.LoadInt32(&l.lost) == 0 {
+		holder, err := readLockObject(l.bucket, l.key)
+		if err != nil {
+			return err
+		}
+		if l.owns(holder) {
+			return nil
+		}
+		atomic.StoreInt32(&l.lost, 1)
+	}
+	return errors.New("lock object " + l.key + " was removed or taken over by another host, stopping")
+}
+
+// stop renewing and remove the lock object, unless another host holds it by now
+func (l *lockLease) release() {
+	close(l.stop)
+	<-l.done
+	if atomic.LoadInt32(&l.lost) == 1 {
+		return
+	}
+
+	holder, err := readLockObject(l.bucket, l.key)
+	if err == nil && !l.owns(holder) {
+		return
+	}
+	if err := l.bucket.DeleteObject(l.key); err != nil {
+		fmt.Printf("[Error] Lock object could not be removed: %v\n", err)
+	}
+}
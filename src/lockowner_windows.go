@@ -0,0 +1,30 @@
+package main
+
+import (
+	"time"
+
+	"golang.org/x/sys/windows"
+)
+
+// exit code GetExitCodeProcess reports for processes still running
+const stillActive = 259
+
+func processAlive(pid int) bool {
+	process, err := windows.OpenProcess(windows.PROCESS_QUERY_LIMITED_INFORMATION, false, uint32(pid))
+	if err != nil {
+		// access denied means it exists
+		return err == windows.ERROR_ACCESS_DENIED
+	}
+	defer windows.CloseHandle(process)
+
+	var exitCode uint32
+	if err := windows.GetExitCodeProcess(process, &exitCode); err != nil {
+		return true
+	}
+	return exitCode == stillActive
+}
+
+// unix time this machine booted
+func bootTime() int64 {
+	return time.Now().Add(-windows.DurationSinceBoot()).Unix()
+}
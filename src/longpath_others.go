@@ -0,0 +1,9 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+// paths have no length limit worth working around here
+func longPath(path string) string {
+	return path
+}
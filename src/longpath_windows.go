@@ -0,0 +1,28 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+/*
+ * extended-length form of a path for opening, creating and stat'ing files, so paths over MAX_PATH (260 characters) work.
+ * the os package only does this for some absolute paths, restore paths given on the command line are often relative.
+ * never store the result, index entries and relative paths are computed from the plain form.
+ */
+func longPath(path string) string {
+	if strings.HasPrefix(path, `\\?\`) {
+		return path
+	}
+
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return path
+	}
+
+	if strings.HasPrefix(absPath, `\\`) {
+		// \\server\share\... -> \\?\UNC\server\share\...
+		return `\\?\UNC\` + absPath[2:]
+	}
+	return `\\?\` + absPath
+}
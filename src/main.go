@@ -7,16 +7,16 @@ package main
 
 import (
 	"bufio"
-	"compress/flate"
+	"bytes"
 	"crypto/sha512"
 	"database/sql"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
 	"os"
 	"path/filepath"
 	"strconv"
@@ -26,19 +26,21 @@ import (
 	"time"
 
 	"github.com/aliyun/aliyun-oss-go-sdk/oss"
-	"github.com/karrick/godirwalk"
 	_ "github.com/mattn/go-sqlite3"
 	"github.com/panjf2000/ants"
 	"gopkg.in/djherbis/times.v1"
 )
 
-const version string = "v0.1"
+// set when building, like go build -ldflags "-X main.version=v0.2.0 -X main.gitCommit=$(git rev-parse --short HEAD) -X main.buildDate=$(date -u +%Y-%m-%d)"
+var version = "v0.1"
+var gitCommit = "unknown"
+var buildDate = "unknown"
 
 var fileCounter int
-var onlineChunksSet map[string]bool
+var onlineChunksSet *chunkSet
 var logLevel int8 = 1 // 0: verbose 1:info 2: none
 var cacheDB *sql.DB
-var sizeToUpload int64
+var cacheDBPath string // the file cacheDB was opened from
 
 type fileInfo struct {
 	Path         string
@@ -46,6 +48,23 @@ type fileInfo struct {
 	Size         int64
 	ModTime      int64
 	CreationTime int64
+
+	// only in delta indexes, the file is gone since the base
+	Removed bool `json:",omitempty"`
+
+	// fifo, socket, chardev or blockdev for special files, see specialFileType, placeholder for online-only
+	// cloud files recorded without content, see recordCloudPlaceholders, "" for regular files
+	Type   string `json:",omitempty"`
+	Device uint64 `json:",omitempty"` // of chardev and blockdev entries
+
+	// only kept in the cache, not in the index
+	inode      uint64
+	changeTime int64
+	quickHash  string // only with quickHash enabled
+	localPath  string // full path on disk, only set if the name on disk is not NFC
+	hashTime   int64  // when the content was read to compute ChunkKey, 0 if it was taken from another entry
+	// online-only in a cloud folder, reading it would download it, see isCloudPlaceholder
+	placeholder bool
 }
 
 func checkErr(err error) {
@@ -54,174 +73,356 @@ func checkErr(err error) {
 	}
 }
 
-func initCache(basepath string) {
-	// 打开数据库，如果不存在，则创建
-	db, err := sql.Open("sqlite3", "file:"+filepath.Join(basepath, ".__ossIndex_special_.cache.dat?cache=shared"))
-	cacheDB = db
+/*
+ * call fn and return what it panics with as its error.
+ * workers handle the errors of one file this way, a panic would end the process or leave the run waiting for them.
+ */
+func catchPanic(fn func() error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			if e, ok := r.(error); ok {
+				err = e
+			} else {
+				err = fmt.Errorf("%v", r)
+			}
+		}
+	}()
+	return fn()
+}
+
+/*
+ * open the cache of conf, once per process unless its path changes.
+ * a daemon reload changing fileRootPath or cacheDir switches to the cache of the new config before the next run.
+ */
+func initCache(conf *userConfig) {
+	cachePath := cacheFilePath(conf, ".cache.dat")
+	if cacheDB != nil && cachePath == cacheDBPath {
+		return
+	}
+	if cacheDB != nil {
+		printMsg("cacheMoved", cacheDBPath, cachePath)
+		// the prepared statements are closed with it
+		cacheDB.Close()
+		cacheDB = nil
+	}
+
+	migrateLegacyCache(conf, cachePath)
+
+	db, err := openCache(cachePath)
+	if err != nil && cacheIsBroken(err) {
+		// corrupted, or written by a newer version, hashing everything again is the safe way out
+		printMsg("cacheUnusable", err)
+		checkErr(moveCacheAside(cachePath))
+
+		db, err = openCache(cachePath)
+	}
 	checkErr(err)
+
+	cacheDB, cacheDBPath = db, cachePath
+	prepareCacheStatements()
+}
+
+func openCache(cachePath string) (*sql.DB, error) {
+	// 打开数据库，如果不存在，则创建
+	// WAL keeps commits cheap while scanning, the busy timeout covers short waits for other connections
+	db, err := sql.Open("sqlite3", "file:"+cachePath+"?cache=shared&_journal_mode=WAL&_synchronous=NORMAL&_busy_timeout=10000")
+	if err != nil {
+		return nil, err
+	}
 	db.SetMaxOpenConns(1)
 
-	// 创建表（如果已经创建则忽略错误）
-	sqlTable := `
-	CREATE TABLE IF NOT EXISTS index_cache(
-		path TEXT NOT NULL,
-		modTime BIGINT NOT NULL,
-		size BIGINT NOT NULL,
-		sha512 TEXT NOT NULL,
-		lastSeenTime BIGINT NOT NULL
-	);
-
-	CREATE UNIQUE INDEX IF NOT EXISTS index_key_value 
-	on index_cache (path, modTime, size);
-	`
-
-	_, err = cacheDB.Exec(sqlTable)
-	checkErr(err)
+	if err := migrateCacheSchema(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return db, nil
 }
 
 /*
  * generate hash information of a file
  * if fastMode is true, sha512 cache will be used according to file last-modified-time and file path.
  */
-func getFileHashInfo(file string, relativePath string, fastMode bool, tx *sql.Tx) (fileInfo, bool, error) {
-	stat, err := os.Stat(file)
+func getFileHashInfo(file string, relativePath string, fastMode bool, tx *cacheTx) (fileInfo, bool, error) {
+	resInfo, err := statFileInfo(file, relativePath)
 	if err != nil {
 		return fileInfo{}, false, err
 	}
 
-	fileTime := times.Get(stat)
+	if fastMode && lookupHashCache(&resInfo, tx) {
+		return resInfo, true, nil
+	}
+
+	resInfo.ChunkKey, err = hashFileContent(file)
+	if err != nil {
+		return fileInfo{}, false, err
+	}
+	return resInfo, false, nil
+}
+
+// fileInfo without ChunkKey
+func statFileInfo(file string, relativePath string) (fileInfo, error) {
+	stat, err := os.Stat(longPath(file))
+	if err != nil {
+		return fileInfo{}, err
+	}
+
 	resInfo := fileInfo{
-		Path:         relativePath,
-		Size:         stat.Size(),
-		ModTime:      stat.ModTime().UnixNano(),
-		CreationTime: fileTime.BirthTime().UnixNano(),
+		Path:    relativePath,
+		Size:    stat.Size(),
+		ModTime: stat.ModTime().UnixNano(),
+		inode:   getFileID(stat),
+		Type:    specialFileType(stat.Mode()),
+	}
+	if resInfo.Type == specialFileCharDev || resInfo.Type == specialFileBlockDev {
+		resInfo.Device = getDeviceNumber(stat)
+	}
+	if resInfo.Type == "" {
+		resInfo.placeholder = isCloudPlaceholder(stat)
 	}
 
-	if fastMode {
-		var shaVal string
+	fileTime := times.Get(stat)
+	if fileTime.HasBirthTime() {
+		resInfo.CreationTime = fileTime.BirthTime().UnixNano()
+	}
+	if fileTime.HasChangeTime() {
+		resInfo.changeTime = fileTime.ChangeTime().UnixNano()
+	}
 
-		row := tx.QueryRow("SELECT sha512 FROM index_cache WHERE path = ? AND modTime = ? AND size = ?", relativePath, resInfo.ModTime, resInfo.Size)
+	return resInfo, nil
+}
 
-		if row != nil && row.Scan(&shaVal) == nil {
-			resInfo.ChunkKey = shaVal
+/*
+ * fill ChunkKey from cache by path, last-modified-time and size, returns false if not cached.
+ * inode and ctime must match as well where known, catching files replaced in place or edited with mtime preserved.
+ */
+func lookupHashCache(info *fileInfo, tx *cacheTx) bool {
+	var shaVal, quickHash string
+	var inode, changeTime int64
 
-			_, err = tx.Exec("UPDATE index_cache SET lastSeenTime = ? WHERE path = ? AND modTime = ? AND size = ?", time.Now().UnixNano(), relativePath, resInfo.ModTime, resInfo.Size)
-			checkErr(err)
+	row := tx.lookup.QueryRow(info.Path, info.ModTime, info.Size)
 
-			// fmt.Println("Found cache: " + shaVal + ";" + strconv.FormatInt(lastSeenTime, 10))
-			return resInfo, true, nil
+	if row != nil && row.Scan(&shaVal, &inode, &changeTime, &quickHash) == nil {
+		// 0 means unknown, on this platform or in entries from older versions
+		if inode != 0 && info.inode != 0 && inode != int64(info.inode) {
+			return false
 		}
+		if changeTime != 0 && info.changeTime != 0 && changeTime != info.changeTime {
+			return false
+		}
+
+		info.ChunkKey = shaVal
+		info.quickHash = quickHash
+
+		_, err := tx.touch.Exec(time.Now().UnixNano(), int64(info.inode), info.changeTime, info.Path, info.ModTime, info.Size)
+		checkErr(err)
+
+		// fmt.Println("Found cache: " + shaVal + ";" + strconv.FormatInt(lastSeenTime, 10))
+		return true
 	}
 
-	f, err := os.Open(file)
+	return false
+}
+
+// chunk key of a file, computed by sha512 of its content
+func hashFileContent(file string) (string, error) {
+	waitScanOp()
+	f, err := os.Open(longPath(file))
 	if err != nil {
-		return fileInfo{}, false, err
+		return "", err
 	}
 	defer f.Close()
 
+	acquireCPUSlot()
+	defer releaseCPUSlot()
+
 	hasher := sha512.New()
 
-	if _, err := io.Copy(hasher, f); err != nil {
-		return fileInfo{}, false, err
+	if _, err := pooledCopy(hasher, &scanLimitedReader{reader: f}); err != nil {
+		return "", err
 	}
 
 	sha512 := hex.EncodeToString(hasher.Sum(nil))
-	resInfo.ChunkKey = "chunk/sha512/" + sha512 + ".deflate"
-	return resInfo, false, nil
+	return chunkKeyPrefix + sha512 + chunkKeySuffix, nil
 }
 
 func getOSSClient(conf *userConfig) (client *oss.Client, bucket *oss.Bucket, err error) {
-	client, err = oss.New(conf.Oss.APIPrefix, conf.Oss.OssKey, conf.Oss.OssSecret) // oss-cn-hangzhou.aliyuncs.com
+	var options []oss.ClientOption
+	if conf.ReadOnly {
+		options = append(options, oss.HTTPClient(readOnlyHTTPClient()))
+	}
+	client, err = oss.New(conf.Oss.APIPrefix, conf.Oss.OssKey, conf.Oss.OssSecret, options...) // oss-cn-hangzhou.aliyuncs.com
 	if err != nil {
 		return
 	}
 
 	bucket, err = client.Bucket(conf.Oss.BucketName) // cloudstorage
+	if err != nil {
+		return
+	}
+
+	err = openChunkBuckets(client, conf.Oss.ChunkBuckets)
 	return
 }
 
-func updateOnlineChunkList(bucket *oss.Bucket) error {
-	fmt.Print("Update Online Chunk List...")
+// call fn for every object under the chunk prefix, with the key as in the index
+func listOnlineChunks(bucket *oss.Bucket, fn func(key string)) {
+	listOnlineChunkObjects(bucket, func(key string, object oss.ObjectProperties) {
+		fn(key)
+	})
+}
+
+// like listOnlineChunks, with the size and storage class of each chunk
+func listOnlineChunkObjects(bucket *oss.Bucket, fn func(key string, object oss.ObjectProperties)) {
+	if len(chunkBuckets) > 0 {
+		listShardedChunkObjects(fn)
+		return
+	}
+
 	marker := oss.Marker("")
-	onlineChunksSet = make(map[string]bool)
 
 	for {
-		lsRes, err := bucket.ListObjects(oss.Prefix("chunk/sha512/"), oss.MaxKeys(1000), marker)
+		lsRes, err := bucket.ListObjects(oss.Prefix(objectKey(chunkKeyPrefix)), oss.MaxKeys(1000), marker)
 		checkErr(err)
 		marker = oss.Marker(lsRes.NextMarker)
 
 		for _, object := range lsRes.Objects {
-			onlineChunksSet[object.Key] = true
+			fn(strings.TrimPrefix(object.Key, repositoryPrefix), object)
 		}
 
 		if !lsRes.IsTruncated {
 			break
 		}
 	}
-
-	fmt.Printf("%d chunks found\n", len(onlineChunksSet))
-	return nil
 }
 
-func uploadFileToOSS(p *uploadFileParams) {
-	fullPath := filepath.Join(p.basepath, p.fileHashInfo.Path)
+// compress a file into a temp file, chunkKey is computed from the content actually read
+func compressFile(filepath string) (tmpPath string, compressedSize int64, chunkKey string, err error) {
+	memoryBudget.acquire(flateJobMemory)
+	defer memoryBudget.release(flateJobMemory)
 
-	// compress
-	compressedFileName, compressedSize := compressFile(fullPath)
-	defer os.Remove(compressedFileName)
+	// 打开待压缩文件
+	f, err := os.Open(longPath(filepath))
+	if err != nil {
+		return "", 0, "", err
+	}
+	defer f.Close()
 
-	// upload
-	var compressionRatio float64
+	// 创建临时文件
+	tmpFile, err := ioutil.TempFile(tempDir, "ossCompTmp")
+	if err != nil {
+		return "", 0, "", err
+	}
+	defer tmpFile.Close()
 
-	if p.fileHashInfo.Size > 0 {
-		compressionRatio = float64(p.fileHashInfo.Size-compressedSize) / float64(p.fileHashInfo.Size) * 100
+	chunkKey, err = compressInto(tmpFile, f)
+	if err != nil {
+		os.Remove(tmpFile.Name())
+		return "", 0, "", err
 	}
 
-	err := p.bucket.PutObjectFromFile(p.fileHashInfo.ChunkKey, compressedFileName)
-	checkErr(err)
+	stat, err := tmpFile.Stat()
+	if err != nil {
+		os.Remove(tmpFile.Name())
+		return "", 0, "", err
+	}
+	compressedSize = stat.Size()
 
-	fmt.Printf("[%d / %d] %s (%s)\n(%.1f%s Compressed) Uploaded\n", p.position, p.totalCount, p.fileHashInfo.Path, formatFileSize(p.fileHashInfo.Size), compressionRatio, "%")
+	return tmpFile.Name(), compressedSize, chunkKey, nil
 }
 
-func compressFile(filepath string) (tmpPath string, compressedSize int64) {
-	// 打开待压缩文件
-	f, err := os.Open(filepath)
-	checkErr(err)
+// compress a small file into memory, the caller accounts for the memory used
+func compressFileToMemory(filepath string, size int64) (data []byte, chunkKey string, err error) {
+	f, err := os.Open(longPath(filepath))
+	if err != nil {
+		return nil, "", err
+	}
 	defer f.Close()
 
-	// 创建临时文件
-	tmpFile, err := ioutil.TempFile("", "ossCompTmp")
-	checkErr(err)
+	buffer := bytes.NewBuffer(make([]byte, 0, size/2+512))
+	chunkKey, err = compressInto(buffer, f)
+	if err != nil {
+		return nil, "", err
+	}
+	return buffer.Bytes(), chunkKey, nil
+}
 
+// deflate src into dst, chunkKey is computed from the content actually read
+func compressInto(dst io.Writer, src io.Reader) (chunkKey string, err error) {
 	// 创建一个flate.Writer，压缩级别为 3 （偏重速度）
-	flateWrite, err := flate.NewWriter(tmpFile, 3) // -2 ~ 9
-	checkErr(err)
-	defer flateWrite.Close()
+	flateWrite := getFlateWriter(dst)
+	defer putFlateWriter(flateWrite)
 
-	io.Copy(flateWrite, f)
-	flateWrite.Flush()
+	hasher := sha512.New()
+	if _, err := pooledCopy(flateWrite, io.TeeReader(src, hasher)); err != nil {
+		return "", err
+	}
+	if err := flateWrite.Close(); err != nil {
+		return "", err
+	}
 
-	stat, err := tmpFile.Stat()
-	checkErr(err)
-	compressedSize = stat.Size()
+	return chunkKeyPrefix + hex.EncodeToString(hasher.Sum(nil)) + chunkKeySuffix, nil
+}
+
+// upload the index at indexFilePath, or only its changes since the last uploaded one
+func uploadIndexFile(conf *userConfig, indexFilePath string, bucket *oss.Bucket) {
+	// some files only, neither the base of deltas nor what later syncs compare with
+	if header, _ := readIndexHeader(indexFilePath); header.hasTag(filesSnapshotTag) {
+		putIndexObject(conf, bucket, indexFilePath)
+		return
+	}
 
-	return tmpFile.Name(), compressedSize
+	uploadPath := indexFilePath
+	deltaPath, chain := deltaForUpload(conf, bucket, indexFilePath)
+	if deltaPath != "" {
+		defer os.Remove(deltaPath)
+		uploadPath = deltaPath
+		printMsg("uploadingDelta")
+	}
+
+	indexKey := putIndexObject(conf, bucket, uploadPath)
+	keepUploadedIndex(conf, indexFilePath, indexKey, chain)
 }
 
-func uploadIndexFile(indexFilePath string, bucket *oss.Bucket) {
-	fmt.Printf("Compressing Index...")
+// compress, sign and upload the index at uploadPath as is, returning its key
+func putIndexObject(conf *userConfig, bucket *oss.Bucket, uploadPath string) string {
+	header, ok := readIndexHeader(uploadPath)
+	if !ok {
+		checkErr(errors.New("index has no header: " + uploadPath))
+	}
 
-	compressedFileName, size := compressFile(indexFilePath)
+	if conf.Index.Format == "sqlite" {
+		dbPath, err := writeSQLiteIndex(uploadPath)
+		checkErr(err)
+		defer os.Remove(dbPath)
+		uploadPath = dbPath
+	}
+
+	printMsg("compressingIndex")
+
+	var compressedFileName string
+	var size int64
+	var err error
+	if conf.Index.Compression == "zstd" {
+		compressedFileName, size, err = compressIndexZstd(conf, bucket, uploadPath)
+	} else {
+		compressedFileName, size, _, err = compressFile(uploadPath)
+	}
+	checkErr(err)
 	defer os.Remove(compressedFileName)
 
-	fmt.Printf("(%s)...Uploading...", formatFileSize(size))
+	printMsg("uploadingIndex", formatFileSize(size))
 
-	err := bucket.PutObjectFromFile("indexes/"+strings.Replace(time.Now().Format("2006-01-02T15_04_05.999999999Z07:00"), ":", "_", 1)+".dat.deflate", compressedFileName)
+	indexKey := header.objectName(conf.Index.Compression)
+	options, err := indexIntegrityOptions(indexKey, uploadPath)
+	checkErr(err)
+	err = putObjectFromFile(bucket, objectKey(indexKey), compressedFileName, options...)
 	if err != nil {
 		checkErr(err)
 	}
 
-	fmt.Println("Done")
+	printMsg("done")
+	return indexKey
 }
 
 func formatFileSize(size int64) string {
@@ -238,54 +439,19 @@ func formatFileSize(size int64) string {
 	return strconv.FormatFloat(float64(size)/1024/1024/1024, 'f', 1, 64) + " GB"
 }
 
-func processSingleFileScan(conf *userConfig, fullPath string, trx *sql.Tx, writer *bufio.Writer) {
-	fileName := filepath.Base(fullPath)
-
-	// ignore index file
-	if strings.HasPrefix(fileName, ".__ossIndex_special_.") && strings.HasSuffix(fileName, ".dat") {
-		return
-	}
-
-	relativePath, _ := filepath.Rel(conf.FileRootPath, fullPath)
-	relativePath = filepath.ToSlash(relativePath)
-
-	// get hash
-	fileCounter++
-
-	hashInfo, fromCache, err := getFileHashInfo(fullPath, relativePath, true, trx)
-
-	if logLevel == 0 || !fromCache || err != nil || fileCounter%500 == 0 {
-		fmt.Printf("[%d] %s\n", fileCounter, relativePath)
-	}
-	if err != nil {
-		// if some file could not be processed, just ignore it :)
-		fmt.Printf("[Error] File could not be processed: ")
-		fmt.Println(err)
-
-		return
-	}
-
-	jsonRow, _ := json.Marshal(hashInfo)
-	writer.Write(jsonRow)
-	writer.WriteString("\n")
-
-	// add to cache
-	if !fromCache {
-		_, err = trx.Exec("INSERT INTO index_cache (path, modTime, size, sha512, lastSeenTime) VALUES (?, ?, ?, ?, ?)", relativePath, hashInfo.ModTime, hashInfo.Size, hashInfo.ChunkKey, time.Now().UnixNano())
-		checkErr(err)
-	}
-}
-
-func makeDirIndex(conf *userConfig, bucket *oss.Bucket) (indexFilePath string) {
-	path := conf.FileRootPath
-	initCache(path)
-	basePath, _ := filepath.Abs(path)
+/*
+ * walk fileRootPath and write an index of all files.
+ * if pipeline is not nil, every hashed file is submitted to it during the walk.
+ */
+func makeDirIndex(conf *userConfig, pipeline *syncPipeline) (indexFilePath string) {
+	initCache(conf)
+	basePath := sourceRootPath(conf)
 	startTime := time.Now()
 
-	fmt.Println("Indexing: " + basePath)
+	printMsg("indexing", basePath)
 
 	// 创建临时索引文件
-	indexFile, err := ioutil.TempFile("", "ossIndexTmp")
+	indexFile, err := ioutil.TempFile(tempDir, "ossIndexTmp")
 	checkErr(err)
 	indexFilePath = indexFile.Name()
 
@@ -294,226 +460,428 @@ func makeDirIndex(conf *userConfig, bucket *oss.Bucket) (indexFilePath string) {
 	defer file.Close()
 	writer := bufio.NewWriterSize(file, 4096)
 
-	if err != nil {
-		log.Fatal(err)
-	}
+	writeIndexHeader(writer, newIndexHeader(conf))
 
-	trx, _ := cacheDB.Begin()
-	defer trx.Commit()
+	scanner := newIndexScanner(conf, writer, pipeline)
 	lastFlushTime := time.Now()
 
-	flushFunc := func() {
-		flushStartTime := time.Now()
-		writer.Flush()
-		trx.Commit()
-		trx, err = cacheDB.Begin()
-		checkErr(err)
-
-		// fmt.Println("[Flush] " + time.Since(flushStartTime).String())
-		lastFlushTime = flushStartTime
-	}
-
-	err = godirwalk.Walk(basePath, &godirwalk.Options{
-		Callback: func(fullPath string, f *godirwalk.Dirent) error {
-			if time.Since(lastFlushTime).Seconds() > 5 {
-				flushFunc()
-			}
-
-			if !f.IsDir() {
-				processSingleFileScan(conf, fullPath, trx, writer)
-			}
+	limits := newWalkLimits(conf, basePath)
+	err = walkFiles(basePath, conf.Concurrency.Walk, limits, func(fullPath string) {
+		if time.Since(lastFlushTime).Seconds() > 5 {
+			lastFlushTime = time.Now()
+			scanner.flush()
+		}
 
-			return nil
-		},
+		scanner.processFile(fullPath)
 	})
+	checkErr(err)
+	limits.report()
 
-	flushFunc()
-	fmt.Println("Finish indexing in " + time.Since(startTime).String())
+	scanner.finish()
+	printMsg("indexingDone", time.Since(startTime).String())
 	return
 }
 
-type uploadFileParams struct {
-	position     int
-	basepath     string
-	fileHashInfo *fileInfo
-	bucket       *oss.Bucket
-	totalCount   int
-}
-
-func uploadChangedFiles(basePath string, indexPath string, bucket *oss.Bucket) {
-	i := 0
+// returns the number of files skipped since they could not be read
+func fullSync(configPath string, forceUnlock bool) (skipped int) {
+	startTime := time.Now()
+	conf := getConfig(configPath)
+	refuseInReadOnlyMode("sync")
+	if snapshotNameFlag != "" {
+		checkErr(checkSnapshotName(snapshotNameFlag))
+	}
+	// "F:\\kindle伴侣同步" // "D:\\NAS-HOME"
+	_, bucket, err := getOSSClient(&conf)
+	checkErr(err)
 
-	var wg sync.WaitGroup
+	lock, err := acquireSyncLock(&conf, bucket, forceUnlock)
+	checkErr(err)
+	defer lock.release()
+	checkErr(checkRepositoryLayout(bucket, true))
+
+	applyBandwidthLimits(&conf)
+	applyPriority(&conf)
+	applyMemoryBudget(&conf)
+	applyTempBudget(&conf)
+	lastSweep := waitForSweep(bucket)
+	refreshOnlineChunkList(&conf, bucket)
+
+	// journal position first, changes made after it are read next time
+	var journal *journalSync
+	if !usesFileList() {
+		journal = startJournalSync(&conf)
+	}
+	share, err := connectShare(&conf)
+	checkErr(err)
+	defer share.release()
+	snapshot, err := createSnapshot(&conf)
+	checkErr(err)
+	defer snapshot.release()
 
-	pool, _ := ants.NewPoolWithFunc(12, func(payload interface{}) {
-		params, ok := payload.(*uploadFileParams)
-		if !ok {
-			return
-		}
-		uploadFileToOSS(params)
-		wg.Done()
-	})
-	defer pool.Release()
+	checkQuota(&conf)
+	pipeline := newSyncPipeline(&conf, bucket)
+	if conf.MaxUploadBytes > 0 {
+		pipeline.limitUploads(conf.MaxUploadBytes, "--max-upload-bytes")
+	}
+	if remaining, ok := quotaRemaining(&conf); ok {
+		pipeline.limitUploads(remaining, "quota.refuse")
+	}
+	var indexPath string
+	if usesFileList() {
+		indexPath = makeFileListIndex(&conf, pipeline)
+	} else {
+		indexPath = journal.makeIndex(&conf, pipeline)
+	}
+	scanEnd := time.Now()
+	defer os.Remove(indexPath)
+	pipeline.wait()
+	if size, ok := repositorySize(); ok && pipeline.uploadedBytes > 0 {
+		setRepositorySize(size + pipeline.uploadedBytes)
+		checkQuota(&conf)
+	}
+	if stopping() {
+		printMsg("syncStopped", pipeline.uploaded)
+		return pipeline.skipped
+	}
 
-	// stats
-	countToUpload := 0
-	sizeToUpload = int64(0)
+	pipeline.restoreDeferredEntries(indexPath)
+	failedFiles := pipeline.dropFailedEntries(indexPath)
+	if pipeline.deferred > 0 {
+		checkErr(addIndexTag(indexPath, partialSnapshotTag))
+	}
+	if listsFilesOnly() {
+		checkErr(addIndexTag(indexPath, filesSnapshotTag))
+	}
+	run := newSnapshotRun(&conf, pipeline, indexPath, startTime, scanEnd)
+	checkErr(updateIndexHeader(indexPath, func(header *indexHeader) {
+		header.Run = run
+	}))
+
+	// upload the index only after all its chunks exist
+	var changes *indexChanges
+	if !listsFilesOnly() {
+		changes = reportIndexChanges(&conf, indexPath)
+	}
+	checkErr(lock.check())
+	uploadIndexFile(&conf, indexPath, bucket)
+	failedFiles = append(failedFiles, recheckChunksAfterSweep(&conf, bucket, indexPath, lastSweep)...)
+	header, _ := readIndexHeader(indexPath)
+	if header.Name != "" {
+		recordSnapshotName(bucket, header)
+	}
+	uploadSnapshotStats(bucket, header, newSnapshotStats(indexPath, run))
+	// the changes of deferred files and files not uploaded are read from the journal again next time
+	if pipeline.deferred == 0 && len(failedFiles) == 0 {
+		journal.commit()
+	}
+	if !listsFilesOnly() {
+		recordUsageSample(indexPath)
+	}
 
-	scanFileJSONLines(indexPath, func(line *fileInfo) {
-		// check exsitance on OSS
-		if !onlineChunksSet[line.ChunkKey] {
-			countToUpload++
-			sizeToUpload += line.Size
-		}
-	})
+	report := &syncReport{Start: startTime, End: time.Now(), Uploaded: pipeline.uploaded, UploadedBytes: pipeline.uploadedBytes,
+		Deferred: pipeline.deferred, DeferredBytes: pipeline.deferredBytes, Changes: changes, Skipped: pipeline.skippedFiles}
+	report.Header = header
+	report.Files, report.Size = run.Files, run.Size
+	writeSyncReport(&conf, bucket, report)
 
-	scanFileJSONLines(indexPath, func(line *fileInfo) {
-		// check exsitance on OSS
-		if !onlineChunksSet[line.ChunkKey] {
-			i++
-			wg.Add(1)
-			pool.Invoke(&uploadFileParams{
-				position:     i,
-				basepath:     basePath,
-				fileHashInfo: line,
-				bucket:       bucket,
-				totalCount:   countToUpload,
-			})
-		}
-	})
+	// every file still there has just been seen, the rest belong to renamed or deleted files,
+	// unless some could not be read, like the files below a directory which could not be listed
+	if conf.CachePruneAge > 0 && !journal.partial() && !usesFileList() && pipeline.skipped == 0 {
+		pruneCache(&conf, conf.CachePruneAge)
+	}
 
-	wg.Wait()
+	return pipeline.skipped
 }
 
-func fullSync(configPath string) {
-	conf := getConfig(configPath)
-	// "F:\\kindle伴侣同步" // "D:\\NAS-HOME"
-	_, bucket, err := getOSSClient(&conf)
-	checkErr(err)
+// suffix of files being restored
+const partFileSuffix = ".part"
 
-	updateOnlineChunkList(bucket)
+// the content of a chunk was damaged in storage or on the way
+var errChunkMismatch = errors.New("content does not match its key")
 
-	indexPath := makeDirIndex(&conf, bucket)
-	defer os.Remove(indexPath)
+func downloadCompressedFile(p *downloadFileParams) (localLocation string, size int64, err error) {
+	os.MkdirAll(longPath(filepath.Dir(p.localLocation)), 755)
 
-	uploadIndexFile(indexPath, bucket)
-	uploadChangedFiles(conf.FileRootPath, indexPath, bucket)
-}
+	// empty files have no chunk
+	if p.key == emptyFileChunkKey {
+		localFile, err := os.OpenFile(longPath(p.localLocation), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if err != nil {
+			return "", 0, err
+		}
+		return p.localLocation, 0, localFile.Close()
+	}
 
-func downloadCompressedFile(p *downloadFileParams) (string, int64, error) {
-	os.MkdirAll(filepath.Dir(p.localLocation), 755)
+	if err := waitForDiskSpace(filepath.Dir(p.localLocation), p.size, 0); err != nil {
+		return "", 0, err
+	}
 
-	localFile, err := os.OpenFile(p.localLocation, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644) // O_EXCL 代表文件必须不存在，存在则报错
+	// existing files are never overwritten
+	if _, err := os.Lstat(longPath(p.localLocation)); err == nil {
+		return "", 0, &os.PathError{Op: "restore", Path: p.localLocation, Err: os.ErrExist}
+	}
+
+	// written next to the file and renamed once complete, an interrupted restore never leaves a truncated file behind
+	partPath := p.localLocation + partFileSuffix
+	localFile, err := os.OpenFile(longPath(partPath), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
 	if err != nil {
 		return "", 0, err
 	}
 	defer localFile.Close()
 
-	// 创建临时文件
-	tmpFile, err := ioutil.TempFile("", "ossDownTmp")
-	checkErr(err)
-	tmpFileName := tmpFile.Name()
-	tmpFile.Close()
-	defer os.Remove(tmpFileName)
+	defer func() {
+		if err != nil {
+			localFile.Close()
+			os.Remove(longPath(partPath))
+		}
+	}()
 
-	// 下载到该文件
-	if err := p.bucket.GetObjectToFile(p.key, tmpFileName); err != nil {
-		checkErr(err)
+	var compressed io.Reader
+	if p.resumable {
+		// the compressed chunk is never larger than the file by much
+		if err := waitForDiskSpace(stagingDir(), p.size, diskSpaceWaitTimeout); err != nil {
+			return "", 0, err
+		}
+		tempBudget.acquire(p.size)
+		defer tempBudget.release(p.size)
+
+		// kept when the download fails, the next attempt continues it
+		defer lockResume(p.key)()
+		tmpFileName := resumeFilePath(p.key)
+		if err := getObjectResumable(chunkBucketOfKey(p.bucket, p.key), objectKey(p.key), tmpFileName); err != nil {
+			return "", 0, err
+		}
+		defer os.Remove(tmpFileName)
+
+		tmpFile, err := os.Open(tmpFileName)
+		if err != nil {
+			return "", 0, err
+		}
+		defer tmpFile.Close()
+		compressed = tmpFile
+	} else {
+		// inflated straight from the response, without staging the compressed chunk
+		// indexes are downloaded here as well, they are always in the main bucket
+		body, err := chunkBucketOfKey(p.bucket, p.key).GetObject(objectKey(p.key))
+		if err != nil {
+			return "", 0, err
+		}
+		defer body.Close()
+		compressed = &limitedReader{reader: body, limiter: downloadLimiter}
 	}
 
-	// 解压文件
-	tmpFile, err = os.Open(tmpFileName)
-	checkErr(err)
-	defer tmpFile.Close()
+	memoryBudget.acquire(flateJobMemory)
+	defer memoryBudget.release(flateJobMemory)
 
-	flateRead := flate.NewReader(tmpFile)
-	writer := bufio.NewWriter(localFile)
+	flateRead := getFlateReader(compressed)
+	defer putFlateReader(flateRead)
 
-	defer flateRead.Close()
-	io.Copy(writer, flateRead)
-	writer.Flush()
+	// a damaged chunk is never restored as a complete file, the restore retries it.
+	// indexes are downloaded here as well, their keys are no digests, see indexIntegrityOptions
+	hasher := sha512.New()
+	if _, err := pooledCopy(io.MultiWriter(localFile, hasher), flateRead); err != nil {
+		return "", 0, err
+	}
+	if strings.HasPrefix(p.key, chunkKeyPrefix) && chunkKeyPrefix+hex.EncodeToString(hasher.Sum(nil))+chunkKeySuffix != p.key {
+		return "", 0, errChunkMismatch
+	}
 
-	size, _ := localFile.Seek(0, 1)
+	size, _ = localFile.Seek(0, 1)
+
+	if err := localFile.Close(); err != nil {
+		return "", 0, err
+	}
+	if err := os.Rename(longPath(partPath), longPath(p.localLocation)); err != nil {
+		return "", 0, err
+	}
 
 	return p.localLocation, size, nil
 }
 
 func usage() {
-	fmt.Fprintf(os.Stderr, `Usage: ossBackup [-r] [-s] [-h] [-t timestamp] [-p restorePath]
+	fmt.Fprintf(os.Stderr, `Usage: ossBackup [-r] [-s] [-h] [-t timestamp] [-p restorePath] [-y] [-map old=new] [-only path]
+       ossBackup <command> [options]
+
+Commands:
+  daemon             stay resident and sync files on the schedule in config
+  watch              keep watching files and sync changed directories continuously
+  install-service    register the daemon as a systemd unit or Windows service
+  uninstall-service  remove the registered service
+  cache prune        remove cache entries of files not seen recently
+  cache vacuum       compact the cache database
+  migrate-layout     convert the objects in the bucket to the layout of this version
+  snapshots          list snapshots of all hosts, filtered by -host and -tag, -stats shows their sizes and errors
+  hold               keep a snapshot from being pruned with -t and -reason, -release releases it, alone lists holds
+  prune              remove old snapshots with -keep-last and chunks no snapshot uses, -dry-run only reports
+  index fetch        download the index of a snapshot as JSON lines or SQLite
+  index dump         print the entries of a snapshot
+  index export       write a CSV or JSON report of the files in a snapshot
+  adopt              record the chunks already in the bucket locally, checking them with -verify
+  import             copy a snapshot of a restic or Borg repository into a new snapshot
+  du                 sizes of the directories in a snapshot, like du -t <timestamp> [path]
+  duplicates         groups of identical files in a snapshot and the space they waste
+  stats              compression per file extension, and dedup of a snapshot with -t <timestamp>
+  warmup             restore the Archive chunks of a snapshot in OSS before downloading them
+  tier               move chunks only old snapshots use to Archive storage, -dry-run only reports
+  versions list      older versions of the objects in a versioned bucket, -deleted only of deleted ones
+  versions restore   bring back deleted indexes and chunks from a versioned bucket
+  serve              web dashboard and HTTP API to start syncs and restores, list snapshots and query status
+  completion         print a shell completion script for bash, zsh, fish or powershell
+  version            print the version, build and supported formats, with -json for scripts
+  check              check every snapshot index and that its chunks exist, reading some with -read-data-percent
+  doctor             check config, credentials, bucket permissions, clock, temp dir and cache before a first run
+  audit-local        hash files cached long ago again and report those whose content changed silently on disk
+  scan               index files and refresh the cache without contacting OSS, printing how much changed
 
 Options:
 `)
 	flag.PrintDefaults()
+	fmt.Fprintf(os.Stderr, "\nA sync exits with status %d if some files could not be read, a restore if some files could not be restored.\n", exitFilesSkipped)
 }
 
-func restoreFiles(configFileName string, path string, time string) {
+// restore the snapshot taken at time into path, only entries below prefix if it is not empty, returns the number of files which failed
+func restoreFiles(configFileName string, path string, time string, prefix string, assumeYes bool, rules pathMappings) int {
 	conf := getConfig(configFileName)
 	_, bucket, err := getOSSClient(&conf)
 	checkErr(err)
+	checkErr(checkRepositoryLayout(bucket, false))
 
-	fmt.Print("Downloading index...")
+	applyBandwidthLimits(&conf)
+	applyMemoryBudget(&conf)
+	applyTempBudget(&conf)
 
-	indexFile, err := ioutil.TempFile("", "ossIndexTmp")
+	snapshot, err := findSnapshot(bucket, &conf, time)
 	checkErr(err)
-	indexPath := indexFile.Name()
-	indexFile.Close()
-	os.Remove(indexPath)
-	defer os.Remove(indexPath)
 
-	_, indexSize, err := downloadCompressedFile(&downloadFileParams{
-		bucket:        bucket,
-		key:           "indexes/" + time + ".dat.deflate",
-		localLocation: indexPath,
-	})
+	printMsg("downloadingIndex")
+
+	indexPath, indexSize, err := downloadIndex(bucket, snapshot.Key)
 	checkErr(err)
+	defer os.Remove(indexPath)
+
+	printMsg("downloadedIndex", formatFileSize(indexSize))
+
+	var mappings *restoreMappings
+	if len(rules) > 0 {
+		header, ok := readIndexHeader(indexPath)
+		if !ok || header.RootPath == "" {
+			checkErr(errors.New("the snapshot does not record the path it was taken of, -map cannot be used"))
+		}
+		mappings = &restoreMappings{rootPath: header.RootPath, rules: rules}
+	}
+	if header, _ := readIndexHeader(indexPath); header.Run != nil {
+		printMsg("restoreSnapshot", header.Run)
+	}
 
-	fmt.Printf("Done (%s)\n", formatFileSize(indexSize))
+	// files no rule matches are not restored if the original path is not on this machine
+	if path == "" && (mappings == nil || filepath.IsAbs(mappings.rootPath)) {
+		path = originalRootPath(indexPath, assumeYes)
+	}
 
-	downloadAllOSSFilesInIndex(&conf, path, bucket, indexPath)
+	return downloadAllOSSFilesInIndex(&conf, path, bucket, indexPath, prefix, mappings)
+}
+
+/*
+ * the fileRootPath the snapshot was taken of, for restoring without -p, unless assumeYes the user has to confirm it.
+ * files there are never overwritten: those with the content of the snapshot are left as they are, others fail.
+ */
+func originalRootPath(indexPath string, assumeYes bool) string {
+	header, ok := readIndexHeader(indexPath)
+	if !ok || !filepath.IsAbs(header.RootPath) {
+		// older snapshots and imported ones
+		checkErr(errors.New("the snapshot does not record a local path it was taken of, restore it with -p"))
+	}
+
+	printMsg("restoreOriginalPath", header.RootPath)
+	if !assumeYes && !confirm(msg("continue")) {
+		printMsg("restoreCancelled")
+		os.Exit(1)
+	}
+	return header.RootPath
+}
+
+// ask a yes or no question on the terminal, anything but yes is no
+func confirm(question string) bool {
+	fmt.Printf("%s [y/N] ", question)
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
 }
 
 type downloadFileParams struct {
 	bucket        *oss.Bucket
 	key           string
 	localLocation string
+	size          int64 // size of the restored file, 0 if unknown
+	resumable     bool  // download with ranged GETs, see getObjectResumable
 }
 
 type downloadFileTask struct {
 	downloadParams *downloadFileParams
 	info           *fileInfo
+	displayPath    string
 }
 
-func downloadAllOSSFilesInIndex(conf *userConfig, restoreToPath string, bucket *oss.Bucket, indexPath string) {
+// restore the entries below prefix into restoreToPath, or where mappings put them, returns the number of files which failed
+func downloadAllOSSFilesInIndex(conf *userConfig, restoreToPath string, bucket *oss.Bucket, indexPath string, prefix string, mappings *restoreMappings) int {
+	if restoreToPath != "" {
+		restoreToPath, _ = filepath.Abs(restoreToPath)
+	}
+
 	// 第一遍扫描，确定需要下载的文件数量和总大小
 	var totalCount int32
 	var totalSize int64
 	var downloadedCount int64
+	var doneCount int32 // files restored or failed
+	var unchangedCount int32
 
-	scanFileJSONLines(indexPath, func(line *fileInfo) {
-		totalCount++
-		totalSize += line.Size
-	})
+	collisions := newCaseCollisions(conf, restoreToPath)
+
+	if collisions.disabled {
+		totalCount, totalSize = indexStats(indexPath, prefix)
+	} else {
+		scanIndex(indexPath, prefix, func(line *fileInfo) {
+			totalCount++
+			totalSize += line.Size
+			collisions.add(line)
+		})
+	}
 
-	fmt.Printf("Starting downloading %v files (%v)\n", totalCount, formatFileSize(totalSize))
+	printMsg("startDownloading", totalCount, formatFileSize(totalSize))
 
 	var wg sync.WaitGroup
+	failures := &restoreFailures{}
 
-	pool, _ := ants.NewPoolWithFunc(12, func(payload interface{}) {
+	pool, _ := ants.NewPoolWithFunc(conf.Concurrency.Download, func(payload interface{}) {
 		params, ok := payload.(*downloadFileTask)
 		if !ok {
 			return
 		}
 
-		_, size, err := downloadCompressedFile(params.downloadParams)
+		var size int64
+		var unchanged bool
+		err := catchPanic(func() (err error) {
+			if unchanged = alreadyRestored(params.downloadParams.localLocation, params.info); unchanged {
+				return nil
+			}
+			_, size, err = downloadWithRetry(params.downloadParams, conf.Restore.Retries)
+			return
+		})
 
 		atomic.AddInt64(&downloadedCount, params.info.Size)
-		relativePath, _ := filepath.Rel(restoreToPath, params.downloadParams.localLocation)
-
-		if err == nil {
-			os.Chtimes(params.downloadParams.localLocation, time.Unix(0, params.info.ModTime), time.Unix(0, params.info.ModTime))
-			fmt.Printf("(%s / %s) Downloaded %s (%s)\n", formatFileSize(downloadedCount), formatFileSize(totalSize), relativePath, formatFileSize(size))
+		relativePath := params.displayPath
+
+		done := atomic.AddInt32(&doneCount, 1)
+		if unchanged {
+			atomic.AddInt32(&unchangedCount, 1)
+			publishProgress(progressEvent{Kind: progressFileRestored, Path: relativePath, Size: params.info.Size, Done: done, Total: totalCount})
+		} else if err == nil {
+			os.Chtimes(longPath(params.downloadParams.localLocation), time.Unix(0, params.info.ModTime), time.Unix(0, params.info.ModTime))
+			printMsg("downloaded", formatFileSize(downloadedCount), formatFileSize(totalSize), relativePath, formatFileSize(size))
+			publishProgress(progressEvent{Kind: progressFileRestored, Path: relativePath, Size: size, Done: done, Total: totalCount})
 		} else {
-			fmt.Printf("(%s / %s) Ignored %s: %v\n", formatFileSize(downloadedCount), formatFileSize(totalSize), relativePath, err)
+			printMsg("downloadFailed", formatFileSize(downloadedCount), formatFileSize(totalSize), relativePath, err)
+			failures.add(relativePath, err)
+			publishProgress(progressEvent{Kind: progressFileFailed, Path: relativePath, Done: done, Total: totalCount, Error: err.Error()})
 		}
 
 		wg.Done()
@@ -521,19 +889,71 @@ func downloadAllOSSFilesInIndex(conf *userConfig, restoreToPath string, bucket *
 	defer pool.Release()
 
 	// 第二遍扫描，开始下载
-	scanFileJSONLines(indexPath, func(line *fileInfo) {
-		fullPath := filepath.Join(restoreToPath, filepath.FromSlash(line.Path))
+	scanIndex(indexPath, prefix, func(line *fileInfo) {
+		// the downloads started already are finished
+		if stopping() {
+			return
+		}
+		restorePath, ok := collisions.resolve(line)
+		if !ok {
+			return
+		}
+		fullPath, mapped := mappings.destination(restorePath)
+		displayPath := fullPath
+		if !mapped {
+			if restoreToPath == "" {
+				mappings.skipped++
+				return
+			}
+			fullPath = filepath.Join(restoreToPath, filepath.FromSlash(restorePath))
+			displayPath = filepath.FromSlash(restorePath)
+		}
+
+		// nothing to download, created right here
+		if line.Type != "" {
+			if err := restoreSpecialFile(fullPath, line); errors.Is(err, errSpecialFileSkipped) && line.Type == specialFilePlaceholder {
+				printMsg("placeholderSkipped", displayPath)
+			} else if errors.Is(err, errSpecialFileSkipped) {
+				printMsg("specialFileSkipped", line.Type, displayPath)
+			} else if err != nil {
+				printMsg("downloadFailed", formatFileSize(atomic.LoadInt64(&downloadedCount)), formatFileSize(totalSize), displayPath, err)
+				failures.add(displayPath, err)
+				publishProgress(progressEvent{Kind: progressFileFailed, Path: displayPath, Done: atomic.AddInt32(&doneCount, 1), Total: totalCount, Error: err.Error()})
+			}
+			return
+		}
 
 		wg.Add(1)
 		pool.Invoke(&downloadFileTask{
 			downloadParams: &downloadFileParams{
-				bucket, line.ChunkKey, fullPath,
+				bucket, line.ChunkKey, fullPath, line.Size,
+				conf.Restore.ResumeThreshold > 0 && line.Size >= int64(conf.Restore.ResumeThreshold)*1024*1024,
 			},
-			info: line,
+			info:        line,
+			displayPath: displayPath,
 		})
 	})
 
 	wg.Wait()
+	if unchangedCount > 0 {
+		printMsg("alreadyRestored", unchangedCount)
+	}
+	collisions.report()
+	mappings.report()
+	return failures.report()
+}
+
+// whether localLocation already holds the content of info, like after restoring to the original path
+func alreadyRestored(localLocation string, info *fileInfo) bool {
+	stat, err := os.Lstat(longPath(localLocation))
+	if err != nil || !stat.Mode().IsRegular() || stat.Size() != info.Size {
+		return false
+	}
+	if info.Size == 0 {
+		return true
+	}
+	chunkKey, err := hashFileContent(localLocation)
+	return err == nil && chunkKey == info.ChunkKey
 }
 
 func scanFileJSONLines(path string, processer func(line *fileInfo)) {
@@ -555,6 +975,11 @@ func scanFileJSONLines(path string, processer func(line *fileInfo)) {
 			panic(err)
 		}
 
+		// the header line has no path
+		if line.Path == "" {
+			continue
+		}
+
 		processer(&line)
 	}
 
@@ -563,35 +988,103 @@ func scanFileJSONLines(path string, processer func(line *fileInfo)) {
 	}
 }
 
+// subcommands, like `ossBackup daemon`
+var commands = map[string]func(args []string){
+	"daemon":            runDaemon,
+	"watch":             runWatch,
+	"install-service":   runInstallService,
+	"uninstall-service": runUninstallService,
+	"cache":             runCacheCommand,
+	"migrate-layout":    runMigrateLayout,
+	"snapshots":         runSnapshots,
+	"prune":             runPrune,
+	"index":             runIndexCommand,
+	"adopt":             runAdopt,
+	"import":            runImport,
+	"du":                runDu,
+	"duplicates":        runDuplicates,
+	"stats":             runStats,
+	"warmup":            runWarmup,
+	"tier":              runTier,
+	"serve":             runServe,
+	"version":           runVersion,
+	"doctor":            runDoctor,
+	"audit-local":       runAuditLocal,
+	"scan":              runScan,
+	"check":             runCheck,
+	"hold":              runHold,
+	"versions":          runVersionsCommand,
+}
+
 func parseCmd() {
+	if len(os.Args) > 1 {
+		if command, ok := commands[os.Args[1]]; ok {
+			command(os.Args[2:])
+			return
+		}
+	}
+
 	var restore bool
 	var sync bool
 	var help bool
 	var time string
+	var before string
 	var path string
 	var configFileName string
+	var forceUnlock bool
+	var only string
+	var assumeYes bool
+	var mappings pathMappings
 	flag.BoolVar(&restore, "r", false, "restore files from OSS")
 	flag.BoolVar(&sync, "s", false, "sync files to OSS")
 	flag.BoolVar(&help, "h", false, "show help and exit")
-	flag.StringVar(&time, "t", "", "the timestamp for restoring files (like 2019-08-02T02_44_44.7450746+08_00)")
-	flag.StringVar(&path, "p", "", "the path for restoring files (required for restoring)")
+	flag.StringVar(&time, "t", "", "the timestamp for restoring files (like 2019-08-02T02_44_44.7450746+08_00), or a date like 2019-08-02 for the last snapshot of that day")
+	flag.StringVar(&before, "before", "", "restore the newest snapshot taken at or before this time, RFC 3339 like 2019-08-02T18:00:00+08:00")
+	flag.StringVar(&path, "p", "", "the path for restoring files (defaults to the path the snapshot was taken of)")
+	flag.BoolVar(&assumeYes, "y", false, "restore to the original path without asking")
+	flag.Var(&mappings, "map", "restore files originally below one path below another, like /old/prefix=/new/prefix (repeatable)")
+	flag.StringVar(&only, "only", "", "only restore files below this path in the snapshot")
 	flag.StringVar(&configFileName, "c", "", "the name of config file")
+	flag.BoolVar(&forceUnlock, "force-unlock", false, "remove locks left by another sync before syncing")
+	flag.IntVar(&limitUploadFlag, "limit-upload", 0, "max upload speed in KB/s (overrides config)")
+	flag.IntVar(&limitDownloadFlag, "limit-download", 0, "max download speed in KB/s (overrides config)")
+	flag.IntVar(&limitScanOpsFlag, "limit-scan-ops", 0, "max file system operations per second while scanning, to spare a file server (overrides config)")
+	flag.BoolVar(&trustLocalStateFlag, "trust-local-state", false, "use chunks recorded locally instead of listing the bucket")
+	flag.BoolVar(&lowPriorityFlag, "low-priority", false, "run with low CPU and disk I/O priority")
+	flag.IntVar(&uploadConcurrencyFlag, "concurrency-upload", 0, "number of files uploaded at the same time (overrides config)")
+	flag.IntVar(&downloadConcurrencyFlag, "concurrency-download", 0, "number of files downloaded at the same time (overrides config)")
+	flag.StringVar(&tagsFlag, "tags", "", "comma separated tags recorded in the snapshot (overrides config)")
+	flag.StringVar(&fileListFlag, "files", "", "sync only the files listed one per line in this file, - reads them from stdin, the snapshot is tagged files")
+	flag.StringVar(&changedFileListFlag, "changed-files", "", "like -files, but keep the rest of the previous snapshot, for external change detection")
+	flag.Int64Var(&maxUploadBytesFlag, "max-upload-bytes", 0, "stop uploading new files after this many bytes, the snapshot is tagged partial (overrides config)")
+	flag.StringVar(&snapshotNameFlag, "name", "", "name the snapshot, so -t takes the name instead of its time, like weekly-full")
+	flag.BoolVar(&readOnlyFlag, "read-only", false, "never write to or delete from the bucket, for restores (overrides config)")
 
 	// 改变默认的 Usage
 	flag.Usage = usage
 
 	flag.Parse() // Scans the arg list and sets up flags
 
+	// a moment instead of a snapshot time, findSnapshot picks the nearest snapshot for both
+	if before != "" {
+		time = before
+	}
+
 	if sync {
-		fullSync(configFileName)
-	} else if restore && path != "" && time != "" {
-		restoreFiles(configFileName, path, time)
+		if fullSync(configFileName, forceUnlock) > 0 {
+			os.Exit(exitFilesSkipped)
+		}
+	} else if restore && time != "" {
+		if restoreFiles(configFileName, path, time, only, assumeYes, mappings) > 0 {
+			os.Exit(exitFilesSkipped)
+		}
 	} else {
 		flag.Usage()
 	}
 }
 
 func main() {
-	fmt.Println("OssArchiveStorageBackup " + version)
+	// on stderr, so the output of commands like index dump can be piped
+	fmt.Fprintln(os.Stderr, "OssArchiveStorageBackup "+version)
 	parseCmd()
 }
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"compress/flate"
+	"fmt"
+	"io"
+	"runtime/debug"
+	"sync"
+)
+
+const copyBufferSize = 256 * 1024
+
+// rough memory used by one compression or decompression in flight, buffers included
+const flateJobMemory = 2 * 1024 * 1024
+
+var copyBufferPool = sync.Pool{
+	New: func() interface{} {
+		buffer := make([]byte, copyBufferSize)
+		return &buffer
+	},
+}
+
+// flate writers allocate about 1 MB each, reuse them instead
+var flateWriterPool = sync.Pool{
+	New: func() interface{} {
+		// 压缩级别为 3 （偏重速度）
+		writer, _ := flate.NewWriter(nil, 3) // -2 ~ 9
+		return writer
+	},
+}
+
+var flateReaderPool = sync.Pool{
+	New: func() interface{} {
+		return flate.NewReader(nil)
+	},
+}
+
+// io.Copy with a pooled buffer
+func pooledCopy(dst io.Writer, src io.Reader) (int64, error) {
+	buffer := copyBufferPool.Get().(*[]byte)
+	defer copyBufferPool.Put(buffer)
+
+	return io.CopyBuffer(dst, src, *buffer)
+}
+
+func getFlateWriter(w io.Writer) *flate.Writer {
+	writer := flateWriterPool.Get().(*flate.Writer)
+	writer.Reset(w)
+	return writer
+}
+
+func putFlateWriter(writer *flate.Writer) {
+	flateWriterPool.Put(writer)
+}
+
+func getFlateReader(r io.Reader) io.ReadCloser {
+	reader := flateReaderPool.Get().(io.ReadCloser)
+	reader.(flate.Resetter).Reset(r, nil)
+	return reader
+}
+
+func putFlateReader(reader io.ReadCloser) {
+	flateReaderPool.Put(reader)
+}
+
+// blocks until n units of a shared budget are free, a nil semaphore never blocks
+type byteSemaphore struct {
+	mutex sync.Mutex
+	cond  *sync.Cond
+	total int64
+	used  int64
+}
+
+func newByteSemaphore(total int64) *byteSemaphore {
+	s := &byteSemaphore{total: total}
+	s.cond = sync.NewCond(&s.mutex)
+	return s
+}
+
+func (s *byteSemaphore) acquire(n int64) {
+	if s == nil {
+		return
+	}
+
+	// a single request larger than the budget waits until it is alone
+	if n > s.total {
+		n = s.total
+	}
+
+	s.mutex.Lock()
+	for s.used+n > s.total {
+		s.cond.Wait()
+	}
+	s.used += n
+	s.mutex.Unlock()
+}
+
+func (s *byteSemaphore) release(n int64) {
+	if s == nil {
+		return
+	}
+
+	if n > s.total {
+		n = s.total
+	}
+
+	s.mutex.Lock()
+	s.used -= n
+	s.mutex.Unlock()
+	s.cond.Broadcast()
+}
+
+// limits memory of compressions and decompressions in flight, nil means no limit
+var memoryBudget *byteSemaphore
+
+func applyMemoryBudget(conf *userConfig) {
+	memoryBudget = nil
+	if conf.MemoryBudget <= 0 {
+		return
+	}
+
+	budget := int64(conf.MemoryBudget) * 1024 * 1024
+	memoryBudget = newByteSemaphore(budget)
+
+	// make the GC work harder before going over the budget
+	debug.SetMemoryLimit(budget)
+	fmt.Printf("Memory budget: %s\n", formatFileSize(budget))
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+/*
+ * messages of syncs, watch and restores by language, selected by the language config or the locale.
+ * other commands, like prune, gc, check or serve, print English only.
+ * keys missing in a catalog fall back to English. tags like [Warning] stay English in every language,
+ * so logs can be searched the same way everywhere.
+ */
+var messageCatalogs = map[string]map[string]string{
+	"en": {
+		"cacheUnusable":       "[Error] Cache is unusable (%v), moving it aside and rebuilding\n",
+		"indexing":            "Indexing: %s\n",
+		"indexingDone":        "Finish indexing in %s\n",
+		"uploadingDelta":      "Uploading changes only, ",
+		"compressingIndex":    "Compressing Index...",
+		"uploadingIndex":      "(%s)...Uploading...",
+		"done":                "Done\n",
+		"chunksUploaded":      "%d chunks uploaded\n",
+		"uploaded":            "[%d / %d] %s (%s)\n(%.1f%% Compressed) Uploaded\n",
+		"filesSkipped":        "[Warning] %d files could not be read and were skipped:\n",
+		"unstableFiles":       "[Warning] %d files kept changing while being read and may not be backed up consistently, they are read again next time:\n",
+		"changes":             "[Changes] %d added, %d modified, %d deleted since the last snapshot\n",
+		"moreChanges":         "  ... and %d more\n",
+		"deletionWarning":     "[Warning] %d of %d files (%d%%) were deleted since the last snapshot, check nothing is wrong with %s\n",
+		"downloadingIndex":    "Downloading index...",
+		"downloadedIndex":     "Done (%s)\n",
+		"restoreOriginalPath": "Files will be restored to their original path %s, files already there are kept, those with other content are reported as failed.\n",
+		"continue":            "Continue?",
+		"restoreCancelled":    "Restore cancelled\n",
+		"startDownloading":    "Starting downloading %v files (%v)\n",
+		"downloaded":          "(%s / %s) Downloaded %s (%s)\n",
+		"downloadFailed":      "(%s / %s) Failed %s: %v\n",
+		"specialFileSkipped":  "[Warning] %s %s is not recreated on this system, left out\n",
+		"placeholderSkipped":  "[Warning] %s was online-only in a cloud folder and never backed up, left out\n",
+		"placeholdersFound":   "[Warning] %d online-only cloud files were recorded without their content, download them or set cloudPlaceholders to read to back them up\n",
+		"retryingDownload":    "[Restore] Retrying %s after error: %v\n",
+		"filesNotRestored":    "[Warning] %d files could not be restored:\n",
+		"unmappedFiles":       "[Warning] %d files were not restored, no -map rule matches their original path below %s\n",
+		"cacheMoved":          "[Cache] The cache moved from %s to %s with the config\n",
+		"syncStopped":         "[Sync] Stopped, %d chunks were uploaded but no snapshot was made\n",
+		"uploadFailed":        "[Error] Uploading %s failed: %v\n",
+		"uploadsDeferred":     "[Warning] %d files (%s) were left out of this snapshot to upload at most %s by %s, the next sync uploads them, this snapshot is tagged %s\n",
+		"deferredKept":        "[Warning] %d of the files left out keep their previous version in this snapshot\n",
+		"uploadsFailed":       "[Warning] The chunks of %d files could not be uploaded, %d of them keep their previous version in this snapshot and %d are left out, the next sync tries again\n",
+		"watching":            "Watching %s, syncing changes every %s\n",
+		"indexingChanged":     "Indexing %d changed directories in %s\n",
+		"indexingListed":      "[Files] Indexing %d listed paths in %s\n",
+		"notBelowRoot":        "[Files] %s is not below %s, left out\n",
+		"noPreviousSnapshot":  "[Files] No previous snapshot is kept on this machine, scanning everything\n",
+		"restoreSnapshot":     "[Restore] Snapshot %s\n",
+		"resumingDownload":    "[Restore] Resuming %s at %s of %s\n",
+		"downloadInterrupted": "[Restore] Download of %s interrupted at %s of %s, resuming: %v\n",
+		"caseRenamed":         "[Warning] %d files differ from another file only by case and were restored under another name:\n",
+		"caseSkipped":         "[Warning] %d files differ from another file only by case and were skipped:\n",
+		"alreadyRestored":     "[Restore] %d files were already there with the same content and are left as they are\n",
+	},
+	"zh": {
+		"cacheUnusable":       "[Error] 缓存无法使用（%v），已移到一旁并重新建立\n",
+		"indexing":            "正在建立索引：%s\n",
+		"indexingDone":        "索引完成，用时 %s\n",
+		"uploadingDelta":      "只上传变化部分，",
+		"compressingIndex":    "正在压缩索引...",
+		"uploadingIndex":      "（%s）...正在上传...",
+		"done":                "完成\n",
+		"chunksUploaded":      "已上传 %d 个数据块\n",
+		"uploaded":            "[%d / %d] %s（%s）\n（压缩 %.1f%%）已上传\n",
+		"filesSkipped":        "[Warning] %d 个文件无法读取，已跳过：\n",
+		"unstableFiles":       "[Warning] %d 个文件在读取时一直在变化，备份可能不一致，下次会重新读取：\n",
+		"changes":             "[Changes] 自上次快照以来新增 %d 个，修改 %d 个，删除 %d 个\n",
+		"moreChanges":         "  ... 还有 %d 个\n",
+		"deletionWarning":     "[Warning] 自上次快照以来 %[2]d 个文件中有 %[1]d 个（%[3]d%%）被删除，请检查 %[4]s 是否正常\n",
+		"downloadingIndex":    "正在下载索引...",
+		"downloadedIndex":     "完成（%s）\n",
+		"restoreOriginalPath": "文件将恢复到原来的路径 %s，已存在的文件会保留，内容不同的报告为失败。\n",
+		"continue":            "是否继续？",
+		"restoreCancelled":    "已取消恢复\n",
+		"startDownloading":    "开始下载 %v 个文件（%v）\n",
+		"downloaded":          "（%s / %s）已下载 %s（%s）\n",
+		"downloadFailed":      "（%s / %s）失败 %s：%v\n",
+		"specialFileSkipped":  "[Warning] 无法在此系统上重建 %s %s，已跳过\n",
+		"placeholderSkipped":  "[Warning] %s 是云同步文件夹中的仅在线文件，从未备份，已跳过\n",
+		"placeholdersFound":   "[Warning] %d 个仅在线的云文件只记录了文件信息而没有内容，请先下载它们或将 cloudPlaceholders 设为 read 以备份\n",
+		"retryingDownload":    "[Restore] 出错后重试 %s：%v\n",
+		"filesNotRestored":    "[Warning] %d 个文件无法恢复：\n",
+		"unmappedFiles":       "[Warning] %d 个文件未恢复，没有 -map 规则匹配它们在 %s 下的原始路径\n",
+		"cacheMoved":          "[Cache] 缓存随配置从 %s 移到了 %s\n",
+		"syncStopped":         "[Sync] 已停止，上传了 %d 个数据块，但没有生成快照\n",
+		"uploadFailed":        "[Error] 上传 %s 失败：%v\n",
+		"uploadsDeferred":     "[Warning] 为了最多上传 %[3]s（%[4]s），%[1]d 个文件（%[2]s）未放入此快照，下次同步时上传，此快照标记为 %[5]s\n",
+		"deferredKept":        "[Warning] 未放入的文件中有 %d 个在此快照中保留之前的版本\n",
+		"uploadsFailed":       "[Warning] %d 个文件的数据块无法上传，其中 %d 个在此快照中保留之前的版本，%d 个未放入，下次同步时重试\n",
+		"watching":            "正在监视 %s，每隔 %s 同步变化\n",
+		"indexingChanged":     "正在为 %[2]s 中 %[1]d 个有变化的目录建立索引\n",
+		"indexingListed":      "[Files] 正在为 %[2]s 中列出的 %[1]d 个路径建立索引\n",
+		"notBelowRoot":        "[Files] %s 不在 %s 之下，已跳过\n",
+		"noPreviousSnapshot":  "[Files] 本机没有保存上一个快照，扫描全部文件\n",
+		"restoreSnapshot":     "[Restore] 快照 %s\n",
+		"resumingDownload":    "[Restore] 从 %[2]s / %[3]s 处继续下载 %[1]s\n",
+		"downloadInterrupted": "[Restore] %[1]s 的下载在 %[2]s / %[3]s 处中断，继续下载：%[4]v\n",
+		"caseRenamed":         "[Warning] %d 个文件与另一个文件只有大小写不同，已改名恢复：\n",
+		"caseSkipped":         "[Warning] %d 个文件与另一个文件只有大小写不同，已跳过：\n",
+		"alreadyRestored":     "[Restore] %d 个文件已存在且内容相同，保持不变\n",
+	},
+}
+
+// picked from the locale until getConfig applies the language config
+var messageLanguage = localeLanguage()
+
+// the language of LC_ALL, LC_MESSAGES or LANG, like zh_CN.UTF-8
+func localeLanguage() string {
+	for _, name := range []string{"LC_ALL", "LC_MESSAGES", "LANG"} {
+		if value := os.Getenv(name); value != "" {
+			if strings.HasPrefix(strings.ToLower(value), "zh") {
+				return "zh"
+			}
+			return "en"
+		}
+	}
+	return "en"
+}
+
+// language is auto, en or zh
+func setMessageLanguage(language string) {
+	if language == "auto" {
+		language = localeLanguage()
+	}
+	messageLanguage = language
+}
+
+// the message key in the current language, formatted with args
+func msg(key string, args ...interface{}) string {
+	format, ok := messageCatalogs[messageLanguage][key]
+	if !ok {
+		format = messageCatalogs["en"][key]
+	}
+	return fmt.Sprintf(format, args...)
+}
+
+// print the message key in the current language
+func printMsg(key string, args ...interface{}) {
+	fmt.Print(msg(key, args...))
+}
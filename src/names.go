@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"path"
+	"strings"
+
+	"github.com/aliyun/aliyun-oss-go-sdk/oss"
+)
+
+/*
+ * snapshots named by -name when they are taken can be referred to by their name wherever -t is taken.
+ * the name is recorded in the index header, and as an empty object at names/<name>/<host>/<time>,
+ * so snapshots are found by name with a listing instead of downloading every index.
+ * a name may be given to many snapshots, like weekly-full, and then refers to the newest of them.
+ */
+const snapshotNameKeyPrefix = "names/"
+
+// set by --name
+var snapshotNameFlag string
+
+// host and time of a snapshot, which identify it whatever its tags
+func snapshotID(snapshot snapshotInfo) string {
+	return path.Join(snapshot.Host, snapshot.Time)
+}
+
+// a name must be usable in object keys, and never be taken for a date or a snapshot time by -t
+func checkSnapshotName(name string) error {
+	if name != sanitizeSnapshotName(name) || strings.Contains(name, "/") {
+		return errors.New("snapshot name '" + name + "' is invalid, only letters, digits, '.', '_' and '-' are allowed")
+	}
+	if _, ok := parseSnapshotMoment(name); ok {
+		return errors.New("snapshot name '" + name + "' would be taken for a time")
+	}
+	if _, err := parseSnapshotTime(name); err == nil {
+		return errors.New("snapshot name '" + name + "' would be taken for a time")
+	}
+	return nil
+}
+
+// record the name of the snapshot with header, once its index is uploaded
+func recordSnapshotName(bucket *oss.Bucket, header indexHeader) {
+	key := snapshotNameKeyPrefix + header.Name + "/" + snapshotID(snapshotInfo{Host: header.Host, Time: header.Time})
+	checkErr(bucket.PutObject(objectKey(key), bytes.NewReader(nil), appendOnlyOptions(nil)...))
+}
+
+// the names of snapshots by snapshotID, only of snapshots named name unless it is ""
+func listSnapshotNames(bucket *oss.Bucket, name string) map[string][]string {
+	prefix := snapshotNameKeyPrefix
+	if name != "" {
+		prefix += name + "/"
+	}
+
+	names := make(map[string][]string)
+	marker := oss.Marker("")
+	for {
+		lsRes, err := bucket.ListObjects(oss.Prefix(objectKey(prefix)), oss.MaxKeys(1000), marker)
+		checkErr(err)
+		marker = oss.Marker(lsRes.NextMarker)
+
+		for _, object := range lsRes.Objects {
+			// <name>/<host>/<time>, or <name>/<time> for snapshots without host
+			rest := strings.TrimPrefix(object.Key, objectKey(snapshotNameKeyPrefix))
+			if i := strings.Index(rest, "/"); i > 0 {
+				id := rest[i+1:]
+				names[id] = append(names[id], rest[:i])
+			}
+		}
+
+		if !lsRes.IsTruncated {
+			break
+		}
+	}
+	return names
+}
+
+func isNamed(names map[string][]string, snapshot snapshotInfo, name string) bool {
+	for _, snapshotName := range names[snapshotID(snapshot)] {
+		if snapshotName == name {
+			return true
+		}
+	}
+	return false
+}
+
+// the newest snapshot named name, of this host if it has one. ok is false if no snapshot has the name
+func namedSnapshot(bucket *oss.Bucket, conf *userConfig, snapshots []snapshotInfo, name string) (snapshot snapshotInfo, ok bool) {
+	if checkSnapshotName(name) != nil {
+		return snapshotInfo{}, false
+	}
+	names := listSnapshotNames(bucket, name)
+	if len(names) == 0 {
+		return snapshotInfo{}, false
+	}
+
+	host := snapshotHost(conf)
+	var newestOfHost *snapshotInfo
+	// listed oldest first
+	for i := range snapshots {
+		if _, named := names[snapshotID(snapshots[i])]; !named {
+			continue
+		}
+		snapshot, ok = snapshots[i], true
+		if snapshots[i].Host == host {
+			newestOfHost = &snapshots[i]
+		}
+	}
+	if newestOfHost != nil {
+		return *newestOfHost, true
+	}
+	return snapshot, ok
+}
+
+// remove the names of snapshots which were removed
+func deleteSnapshotNames(bucket *oss.Bucket, snapshot snapshotInfo, names map[string][]string) {
+	var keys []string
+	for _, name := range names[snapshotID(snapshot)] {
+		keys = append(keys, snapshotNameKeyPrefix+name+"/"+snapshotID(snapshot))
+	}
+	deleteObjects(bucket, keys, nil)
+}
@@ -0,0 +1,828 @@
+// gRPC control interface of ossBackup, served by `ossBackup serve` on serve.grpcListen.
+// every call needs the metadata "authorization: Bearer <serve.token>", like the HTTP API.
+//
+// the Go code in src/ is generated from this file, see the go:generate line in src/grpcserver.go.
+
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.36.11
+// 	protoc        (unknown)
+// source: ossbackup.proto
+
+package main
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	reflect "reflect"
+	sync "sync"
+	unsafe "unsafe"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+type ProgressEvent_Kind int32
+
+const (
+	ProgressEvent_KIND_UNSPECIFIED ProgressEvent_Kind = 0
+	ProgressEvent_FILE_UPLOADED    ProgressEvent_Kind = 1
+	ProgressEvent_FILE_RESTORED    ProgressEvent_Kind = 2
+	ProgressEvent_FILE_FAILED      ProgressEvent_Kind = 3
+	ProgressEvent_RUN_FINISHED     ProgressEvent_Kind = 4
+)
+
+// Enum value maps for ProgressEvent_Kind.
+var (
+	ProgressEvent_Kind_name = map[int32]string{
+		0: "KIND_UNSPECIFIED",
+		1: "FILE_UPLOADED",
+		2: "FILE_RESTORED",
+		3: "FILE_FAILED",
+		4: "RUN_FINISHED",
+	}
+	ProgressEvent_Kind_value = map[string]int32{
+		"KIND_UNSPECIFIED": 0,
+		"FILE_UPLOADED":    1,
+		"FILE_RESTORED":    2,
+		"FILE_FAILED":      3,
+		"RUN_FINISHED":     4,
+	}
+)
+
+func (x ProgressEvent_Kind) Enum() *ProgressEvent_Kind {
+	p := new(ProgressEvent_Kind)
+	*p = x
+	return p
+}
+
+func (x ProgressEvent_Kind) String() string {
+	return protoimpl.X.EnumStringOf(x.Descriptor(), protoreflect.EnumNumber(x))
+}
+
+func (ProgressEvent_Kind) Descriptor() protoreflect.EnumDescriptor {
+	return file_ossbackup_proto_enumTypes[0].Descriptor()
+}
+
+func (ProgressEvent_Kind) Type() protoreflect.EnumType {
+	return &file_ossbackup_proto_enumTypes[0]
+}
+
+func (x ProgressEvent_Kind) Number() protoreflect.EnumNumber {
+	return protoreflect.EnumNumber(x)
+}
+
+// Deprecated: Use ProgressEvent_Kind.Descriptor instead.
+func (ProgressEvent_Kind) EnumDescriptor() ([]byte, []int) {
+	return file_ossbackup_proto_rawDescGZIP(), []int{6, 0}
+}
+
+type StartSyncRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *StartSyncRequest) Reset() {
+	*x = StartSyncRequest{}
+	mi := &file_ossbackup_proto_msgTypes[0]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *StartSyncRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*StartSyncRequest) ProtoMessage() {}
+
+func (x *StartSyncRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_ossbackup_proto_msgTypes[0]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use StartSyncRequest.ProtoReflect.Descriptor instead.
+func (*StartSyncRequest) Descriptor() ([]byte, []int) {
+	return file_ossbackup_proto_rawDescGZIP(), []int{0}
+}
+
+type StopRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *StopRequest) Reset() {
+	*x = StopRequest{}
+	mi := &file_ossbackup_proto_msgTypes[1]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *StopRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*StopRequest) ProtoMessage() {}
+
+func (x *StopRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_ossbackup_proto_msgTypes[1]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use StopRequest.ProtoReflect.Descriptor instead.
+func (*StopRequest) Descriptor() ([]byte, []int) {
+	return file_ossbackup_proto_rawDescGZIP(), []int{1}
+}
+
+type GetStatusRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *GetStatusRequest) Reset() {
+	*x = GetStatusRequest{}
+	mi := &file_ossbackup_proto_msgTypes[2]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *GetStatusRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*GetStatusRequest) ProtoMessage() {}
+
+func (x *GetStatusRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_ossbackup_proto_msgTypes[2]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use GetStatusRequest.ProtoReflect.Descriptor instead.
+func (*GetStatusRequest) Descriptor() ([]byte, []int) {
+	return file_ossbackup_proto_rawDescGZIP(), []int{2}
+}
+
+type WatchProgressRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *WatchProgressRequest) Reset() {
+	*x = WatchProgressRequest{}
+	mi := &file_ossbackup_proto_msgTypes[3]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *WatchProgressRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*WatchProgressRequest) ProtoMessage() {}
+
+func (x *WatchProgressRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_ossbackup_proto_msgTypes[3]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use WatchProgressRequest.ProtoReflect.Descriptor instead.
+func (*WatchProgressRequest) Descriptor() ([]byte, []int) {
+	return file_ossbackup_proto_rawDescGZIP(), []int{3}
+}
+
+type Run struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Id            int32                  `protobuf:"varint,1,opt,name=id,proto3" json:"id,omitempty"`
+	Kind          string                 `protobuf:"bytes,2,opt,name=kind,proto3" json:"kind,omitempty"` // sync or restore
+	StartUnixNano int64                  `protobuf:"varint,3,opt,name=start_unix_nano,json=startUnixNano,proto3" json:"start_unix_nano,omitempty"`
+	EndUnixNano   int64                  `protobuf:"varint,4,opt,name=end_unix_nano,json=endUnixNano,proto3" json:"end_unix_nano,omitempty"` // 0 while running
+	Running       bool                   `protobuf:"varint,5,opt,name=running,proto3" json:"running,omitempty"`
+	Failed        int32                  `protobuf:"varint,6,opt,name=failed,proto3" json:"failed,omitempty"` // files which could not be read or restored
+	Error         string                 `protobuf:"bytes,7,opt,name=error,proto3" json:"error,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Run) Reset() {
+	*x = Run{}
+	mi := &file_ossbackup_proto_msgTypes[4]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Run) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Run) ProtoMessage() {}
+
+func (x *Run) ProtoReflect() protoreflect.Message {
+	mi := &file_ossbackup_proto_msgTypes[4]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Run.ProtoReflect.Descriptor instead.
+func (*Run) Descriptor() ([]byte, []int) {
+	return file_ossbackup_proto_rawDescGZIP(), []int{4}
+}
+
+func (x *Run) GetId() int32 {
+	if x != nil {
+		return x.Id
+	}
+	return 0
+}
+
+func (x *Run) GetKind() string {
+	if x != nil {
+		return x.Kind
+	}
+	return ""
+}
+
+func (x *Run) GetStartUnixNano() int64 {
+	if x != nil {
+		return x.StartUnixNano
+	}
+	return 0
+}
+
+func (x *Run) GetEndUnixNano() int64 {
+	if x != nil {
+		return x.EndUnixNano
+	}
+	return 0
+}
+
+func (x *Run) GetRunning() bool {
+	if x != nil {
+		return x.Running
+	}
+	return false
+}
+
+func (x *Run) GetFailed() int32 {
+	if x != nil {
+		return x.Failed
+	}
+	return 0
+}
+
+func (x *Run) GetError() string {
+	if x != nil {
+		return x.Error
+	}
+	return ""
+}
+
+type Status struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Current       *Run                   `protobuf:"bytes,1,opt,name=current,proto3" json:"current,omitempty"`
+	History       []*Run                 `protobuf:"bytes,2,rep,name=history,proto3" json:"history,omitempty"` // newest first
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Status) Reset() {
+	*x = Status{}
+	mi := &file_ossbackup_proto_msgTypes[5]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Status) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Status) ProtoMessage() {}
+
+func (x *Status) ProtoReflect() protoreflect.Message {
+	mi := &file_ossbackup_proto_msgTypes[5]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Status.ProtoReflect.Descriptor instead.
+func (*Status) Descriptor() ([]byte, []int) {
+	return file_ossbackup_proto_rawDescGZIP(), []int{5}
+}
+
+func (x *Status) GetCurrent() *Run {
+	if x != nil {
+		return x.Current
+	}
+	return nil
+}
+
+func (x *Status) GetHistory() []*Run {
+	if x != nil {
+		return x.History
+	}
+	return nil
+}
+
+type ProgressEvent struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Kind          ProgressEvent_Kind     `protobuf:"varint,1,opt,name=kind,proto3,enum=ossbackup.ProgressEvent_Kind" json:"kind,omitempty"`
+	Path          string                 `protobuf:"bytes,2,opt,name=path,proto3" json:"path,omitempty"`
+	Size          int64                  `protobuf:"varint,3,opt,name=size,proto3" json:"size,omitempty"`
+	Done          int32                  `protobuf:"varint,4,opt,name=done,proto3" json:"done,omitempty"`   // files so far
+	Total         int32                  `protobuf:"varint,5,opt,name=total,proto3" json:"total,omitempty"` // files of the run, 0 if not known yet
+	Error         string                 `protobuf:"bytes,6,opt,name=error,proto3" json:"error,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ProgressEvent) Reset() {
+	*x = ProgressEvent{}
+	mi := &file_ossbackup_proto_msgTypes[6]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ProgressEvent) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ProgressEvent) ProtoMessage() {}
+
+func (x *ProgressEvent) ProtoReflect() protoreflect.Message {
+	mi := &file_ossbackup_proto_msgTypes[6]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ProgressEvent.ProtoReflect.Descriptor instead.
+func (*ProgressEvent) Descriptor() ([]byte, []int) {
+	return file_ossbackup_proto_rawDescGZIP(), []int{6}
+}
+
+func (x *ProgressEvent) GetKind() ProgressEvent_Kind {
+	if x != nil {
+		return x.Kind
+	}
+	return ProgressEvent_KIND_UNSPECIFIED
+}
+
+func (x *ProgressEvent) GetPath() string {
+	if x != nil {
+		return x.Path
+	}
+	return ""
+}
+
+func (x *ProgressEvent) GetSize() int64 {
+	if x != nil {
+		return x.Size
+	}
+	return 0
+}
+
+func (x *ProgressEvent) GetDone() int32 {
+	if x != nil {
+		return x.Done
+	}
+	return 0
+}
+
+func (x *ProgressEvent) GetTotal() int32 {
+	if x != nil {
+		return x.Total
+	}
+	return 0
+}
+
+func (x *ProgressEvent) GetError() string {
+	if x != nil {
+		return x.Error
+	}
+	return ""
+}
+
+type ListSnapshotsRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Host          string                 `protobuf:"bytes,1,opt,name=host,proto3" json:"host,omitempty"` // "" lists all hosts
+	Tag           string                 `protobuf:"bytes,2,opt,name=tag,proto3" json:"tag,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ListSnapshotsRequest) Reset() {
+	*x = ListSnapshotsRequest{}
+	mi := &file_ossbackup_proto_msgTypes[7]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ListSnapshotsRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ListSnapshotsRequest) ProtoMessage() {}
+
+func (x *ListSnapshotsRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_ossbackup_proto_msgTypes[7]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ListSnapshotsRequest.ProtoReflect.Descriptor instead.
+func (*ListSnapshotsRequest) Descriptor() ([]byte, []int) {
+	return file_ossbackup_proto_rawDescGZIP(), []int{7}
+}
+
+func (x *ListSnapshotsRequest) GetHost() string {
+	if x != nil {
+		return x.Host
+	}
+	return ""
+}
+
+func (x *ListSnapshotsRequest) GetTag() string {
+	if x != nil {
+		return x.Tag
+	}
+	return ""
+}
+
+type Snapshot struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Host          string                 `protobuf:"bytes,1,opt,name=host,proto3" json:"host,omitempty"`
+	Time          string                 `protobuf:"bytes,2,opt,name=time,proto3" json:"time,omitempty"` // what -t takes
+	Tags          []string               `protobuf:"bytes,3,rep,name=tags,proto3" json:"tags,omitempty"`
+	Delta         bool                   `protobuf:"varint,4,opt,name=delta,proto3" json:"delta,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Snapshot) Reset() {
+	*x = Snapshot{}
+	mi := &file_ossbackup_proto_msgTypes[8]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Snapshot) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Snapshot) ProtoMessage() {}
+
+func (x *Snapshot) ProtoReflect() protoreflect.Message {
+	mi := &file_ossbackup_proto_msgTypes[8]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Snapshot.ProtoReflect.Descriptor instead.
+func (*Snapshot) Descriptor() ([]byte, []int) {
+	return file_ossbackup_proto_rawDescGZIP(), []int{8}
+}
+
+func (x *Snapshot) GetHost() string {
+	if x != nil {
+		return x.Host
+	}
+	return ""
+}
+
+func (x *Snapshot) GetTime() string {
+	if x != nil {
+		return x.Time
+	}
+	return ""
+}
+
+func (x *Snapshot) GetTags() []string {
+	if x != nil {
+		return x.Tags
+	}
+	return nil
+}
+
+func (x *Snapshot) GetDelta() bool {
+	if x != nil {
+		return x.Delta
+	}
+	return false
+}
+
+type ListSnapshotsResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Snapshots     []*Snapshot            `protobuf:"bytes,1,rep,name=snapshots,proto3" json:"snapshots,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ListSnapshotsResponse) Reset() {
+	*x = ListSnapshotsResponse{}
+	mi := &file_ossbackup_proto_msgTypes[9]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ListSnapshotsResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ListSnapshotsResponse) ProtoMessage() {}
+
+func (x *ListSnapshotsResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_ossbackup_proto_msgTypes[9]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ListSnapshotsResponse.ProtoReflect.Descriptor instead.
+func (*ListSnapshotsResponse) Descriptor() ([]byte, []int) {
+	return file_ossbackup_proto_rawDescGZIP(), []int{9}
+}
+
+func (x *ListSnapshotsResponse) GetSnapshots() []*Snapshot {
+	if x != nil {
+		return x.Snapshots
+	}
+	return nil
+}
+
+type StartRestoreRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Time          string                 `protobuf:"bytes,1,opt,name=time,proto3" json:"time,omitempty"`
+	Path          string                 `protobuf:"bytes,2,opt,name=path,proto3" json:"path,omitempty"` // "" restores to the path the snapshot was taken of, which original_path has to confirm
+	Only          string                 `protobuf:"bytes,3,opt,name=only,proto3" json:"only,omitempty"`
+	Map           []string               `protobuf:"bytes,4,rep,name=map,proto3" json:"map,omitempty"` // like -map /old/prefix=/new/prefix
+	OriginalPath  bool                   `protobuf:"varint,5,opt,name=original_path,json=originalPath,proto3" json:"original_path,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *StartRestoreRequest) Reset() {
+	*x = StartRestoreRequest{}
+	mi := &file_ossbackup_proto_msgTypes[10]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *StartRestoreRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*StartRestoreRequest) ProtoMessage() {}
+
+func (x *StartRestoreRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_ossbackup_proto_msgTypes[10]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use StartRestoreRequest.ProtoReflect.Descriptor instead.
+func (*StartRestoreRequest) Descriptor() ([]byte, []int) {
+	return file_ossbackup_proto_rawDescGZIP(), []int{10}
+}
+
+func (x *StartRestoreRequest) GetTime() string {
+	if x != nil {
+		return x.Time
+	}
+	return ""
+}
+
+func (x *StartRestoreRequest) GetPath() string {
+	if x != nil {
+		return x.Path
+	}
+	return ""
+}
+
+func (x *StartRestoreRequest) GetOnly() string {
+	if x != nil {
+		return x.Only
+	}
+	return ""
+}
+
+func (x *StartRestoreRequest) GetMap() []string {
+	if x != nil {
+		return x.Map
+	}
+	return nil
+}
+
+func (x *StartRestoreRequest) GetOriginalPath() bool {
+	if x != nil {
+		return x.OriginalPath
+	}
+	return false
+}
+
+var File_ossbackup_proto protoreflect.FileDescriptor
+
+const file_ossbackup_proto_rawDesc = "" +
+	"\n" +
+	"\x0fossbackup.proto\x12\tossbackup\"\x12\n" +
+	"\x10StartSyncRequest\"\r\n" +
+	"\vStopRequest\"\x12\n" +
+	"\x10GetStatusRequest\"\x16\n" +
+	"\x14WatchProgressRequest\"\xbd\x01\n" +
+	"\x03Run\x12\x0e\n" +
+	"\x02id\x18\x01 \x01(\x05R\x02id\x12\x12\n" +
+	"\x04kind\x18\x02 \x01(\tR\x04kind\x12&\n" +
+	"\x0fstart_unix_nano\x18\x03 \x01(\x03R\rstartUnixNano\x12\"\n" +
+	"\rend_unix_nano\x18\x04 \x01(\x03R\vendUnixNano\x12\x18\n" +
+	"\arunning\x18\x05 \x01(\bR\arunning\x12\x16\n" +
+	"\x06failed\x18\x06 \x01(\x05R\x06failed\x12\x14\n" +
+	"\x05error\x18\a \x01(\tR\x05error\"\\\n" +
+	"\x06Status\x12(\n" +
+	"\acurrent\x18\x01 \x01(\v2\x0e.ossbackup.RunR\acurrent\x12(\n" +
+	"\ahistory\x18\x02 \x03(\v2\x0e.ossbackup.RunR\ahistory\"\x91\x02\n" +
+	"\rProgressEvent\x121\n" +
+	"\x04kind\x18\x01 \x01(\x0e2\x1d.ossbackup.ProgressEvent.KindR\x04kind\x12\x12\n" +
+	"\x04path\x18\x02 \x01(\tR\x04path\x12\x12\n" +
+	"\x04size\x18\x03 \x01(\x03R\x04size\x12\x12\n" +
+	"\x04done\x18\x04 \x01(\x05R\x04done\x12\x14\n" +
+	"\x05total\x18\x05 \x01(\x05R\x05total\x12\x14\n" +
+	"\x05error\x18\x06 \x01(\tR\x05error\"e\n" +
+	"\x04Kind\x12\x14\n" +
+	"\x10KIND_UNSPECIFIED\x10\x00\x12\x11\n" +
+	"\rFILE_UPLOADED\x10\x01\x12\x11\n" +
+	"\rFILE_RESTORED\x10\x02\x12\x0f\n" +
+	"\vFILE_FAILED\x10\x03\x12\x10\n" +
+	"\fRUN_FINISHED\x10\x04\"<\n" +
+	"\x14ListSnapshotsRequest\x12\x12\n" +
+	"\x04host\x18\x01 \x01(\tR\x04host\x12\x10\n" +
+	"\x03tag\x18\x02 \x01(\tR\x03tag\"\\\n" +
+	"\bSnapshot\x12\x12\n" +
+	"\x04host\x18\x01 \x01(\tR\x04host\x12\x12\n" +
+	"\x04time\x18\x02 \x01(\tR\x04time\x12\x12\n" +
+	"\x04tags\x18\x03 \x03(\tR\x04tags\x12\x14\n" +
+	"\x05delta\x18\x04 \x01(\bR\x05delta\"J\n" +
+	"\x15ListSnapshotsResponse\x121\n" +
+	"\tsnapshots\x18\x01 \x03(\v2\x13.ossbackup.SnapshotR\tsnapshots\"\x88\x01\n" +
+	"\x13StartRestoreRequest\x12\x12\n" +
+	"\x04time\x18\x01 \x01(\tR\x04time\x12\x12\n" +
+	"\x04path\x18\x02 \x01(\tR\x04path\x12\x12\n" +
+	"\x04only\x18\x03 \x01(\tR\x04only\x12\x10\n" +
+	"\x03map\x18\x04 \x03(\tR\x03map\x12#\n" +
+	"\roriginal_path\x18\x05 \x01(\bR\foriginalPath2\x94\x03\n" +
+	"\tOssBackup\x128\n" +
+	"\tStartSync\x12\x1b.ossbackup.StartSyncRequest\x1a\x0e.ossbackup.Run\x12.\n" +
+	"\x04Stop\x12\x16.ossbackup.StopRequest\x1a\x0e.ossbackup.Run\x12;\n" +
+	"\tGetStatus\x12\x1b.ossbackup.GetStatusRequest\x1a\x11.ossbackup.Status\x12L\n" +
+	"\rWatchProgress\x12\x1f.ossbackup.WatchProgressRequest\x1a\x18.ossbackup.ProgressEvent0\x01\x12R\n" +
+	"\rListSnapshots\x12\x1f.ossbackup.ListSnapshotsRequest\x1a .ossbackup.ListSnapshotsResponse\x12>\n" +
+	"\fStartRestore\x12\x1e.ossbackup.StartRestoreRequest\x1a\x0e.ossbackup.RunB\x14Z\x12ossbackup/src;mainb\x06proto3"
+
+var (
+	file_ossbackup_proto_rawDescOnce sync.Once
+	file_ossbackup_proto_rawDescData []byte
+)
+
+func file_ossbackup_proto_rawDescGZIP() []byte {
+	file_ossbackup_proto_rawDescOnce.Do(func() {
+		file_ossbackup_proto_rawDescData = protoimpl.X.CompressGZIP(unsafe.Slice(unsafe.StringData(file_ossbackup_proto_rawDesc), len(file_ossbackup_proto_rawDesc)))
+	})
+	return file_ossbackup_proto_rawDescData
+}
+
+var file_ossbackup_proto_enumTypes = make([]protoimpl.EnumInfo, 1)
+var file_ossbackup_proto_msgTypes = make([]protoimpl.MessageInfo, 11)
+var file_ossbackup_proto_goTypes = []any{
+	(ProgressEvent_Kind)(0),       // 0: ossbackup.ProgressEvent.Kind
+	(*StartSyncRequest)(nil),      // 1: ossbackup.StartSyncRequest
+	(*StopRequest)(nil),           // 2: ossbackup.StopRequest
+	(*GetStatusRequest)(nil),      // 3: ossbackup.GetStatusRequest
+	(*WatchProgressRequest)(nil),  // 4: ossbackup.WatchProgressRequest
+	(*Run)(nil),                   // 5: ossbackup.Run
+	(*Status)(nil),                // 6: ossbackup.Status
+	(*ProgressEvent)(nil),         // 7: ossbackup.ProgressEvent
+	(*ListSnapshotsRequest)(nil),  // 8: ossbackup.ListSnapshotsRequest
+	(*Snapshot)(nil),              // 9: ossbackup.Snapshot
+	(*ListSnapshotsResponse)(nil), // 10: ossbackup.ListSnapshotsResponse
+	(*StartRestoreRequest)(nil),   // 11: ossbackup.StartRestoreRequest
+}
+var file_ossbackup_proto_depIdxs = []int32{
+	5,  // 0: ossbackup.Status.current:type_name -> ossbackup.Run
+	5,  // 1: ossbackup.Status.history:type_name -> ossbackup.Run
+	0,  // 2: ossbackup.ProgressEvent.kind:type_name -> ossbackup.ProgressEvent.Kind
+	9,  // 3: ossbackup.ListSnapshotsResponse.snapshots:type_name -> ossbackup.Snapshot
+	1,  // 4: ossbackup.OssBackup.StartSync:input_type -> ossbackup.StartSyncRequest
+	2,  // 5: ossbackup.OssBackup.Stop:input_type -> ossbackup.StopRequest
+	3,  // 6: ossbackup.OssBackup.GetStatus:input_type -> ossbackup.GetStatusRequest
+	4,  // 7: ossbackup.OssBackup.WatchProgress:input_type -> ossbackup.WatchProgressRequest
+	8,  // 8: ossbackup.OssBackup.ListSnapshots:input_type -> ossbackup.ListSnapshotsRequest
+	11, // 9: ossbackup.OssBackup.StartRestore:input_type -> ossbackup.StartRestoreRequest
+	5,  // 10: ossbackup.OssBackup.StartSync:output_type -> ossbackup.Run
+	5,  // 11: ossbackup.OssBackup.Stop:output_type -> ossbackup.Run
+	6,  // 12: ossbackup.OssBackup.GetStatus:output_type -> ossbackup.Status
+	7,  // 13: ossbackup.OssBackup.WatchProgress:output_type -> ossbackup.ProgressEvent
+	10, // 14: ossbackup.OssBackup.ListSnapshots:output_type -> ossbackup.ListSnapshotsResponse
+	5,  // 15: ossbackup.OssBackup.StartRestore:output_type -> ossbackup.Run
+	10, // [10:16] is the sub-list for method output_type
+	4,  // [4:10] is the sub-list for method input_type
+	4,  // [4:4] is the sub-list for extension type_name
+	4,  // [4:4] is the sub-list for extension extendee
+	0,  // [0:4] is the sub-list for field type_name
+}
+
+func init() { file_ossbackup_proto_init() }
+func file_ossbackup_proto_init() {
+	if File_ossbackup_proto != nil {
+		return
+	}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: unsafe.Slice(unsafe.StringData(file_ossbackup_proto_rawDesc), len(file_ossbackup_proto_rawDesc)),
+			NumEnums:      1,
+			NumMessages:   11,
+			NumExtensions: 0,
+			NumServices:   1,
+		},
+		GoTypes:           file_ossbackup_proto_goTypes,
+		DependencyIndexes: file_ossbackup_proto_depIdxs,
+		EnumInfos:         file_ossbackup_proto_enumTypes,
+		MessageInfos:      file_ossbackup_proto_msgTypes,
+	}.Build()
+	File_ossbackup_proto = out.File
+	file_ossbackup_proto_goTypes = nil
+	file_ossbackup_proto_depIdxs = nil
+}
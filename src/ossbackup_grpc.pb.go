@@ -0,0 +1,328 @@
+// gRPC control interface of ossBackup, served by `ossBackup serve` on serve.grpcListen.
+// every call needs the metadata "authorization: Bearer <serve.token>", like the HTTP API.
+//
+// the Go code in src/ is generated from this file, see the go:generate line in src/grpcserver.go.
+
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.6.2
+// - protoc             (unknown)
+// source: ossbackup.proto
+
+package main
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.64.0 or later.
+const _ = grpc.SupportPackageIsVersion9
+
+const (
+	OssBackup_StartSync_FullMethodName     = "/ossbackup.OssBackup/StartSync"
+	OssBackup_Stop_FullMethodName          = "/ossbackup.OssBackup/Stop"
+	OssBackup_GetStatus_FullMethodName     = "/ossbackup.OssBackup/GetStatus"
+	OssBackup_WatchProgress_FullMethodName = "/ossbackup.OssBackup/WatchProgress"
+	OssBackup_ListSnapshots_FullMethodName = "/ossbackup.OssBackup/ListSnapshots"
+	OssBackup_StartRestore_FullMethodName  = "/ossbackup.OssBackup/StartRestore"
+)
+
+// OssBackupClient is the client API for OssBackup service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type OssBackupClient interface {
+	// start a sync, fails with ALREADY_EXISTS while a sync or restore is running
+	StartSync(ctx context.Context, in *StartSyncRequest, opts ...grpc.CallOption) (*Run, error)
+	// ask the running sync or restore to stop after the files in progress
+	Stop(ctx context.Context, in *StopRequest, opts ...grpc.CallOption) (*Run, error)
+	// the running sync or restore and the ones before it
+	GetStatus(ctx context.Context, in *GetStatusRequest, opts ...grpc.CallOption) (*Status, error)
+	// events of the running sync or restore until it ends
+	WatchProgress(ctx context.Context, in *WatchProgressRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[ProgressEvent], error)
+	ListSnapshots(ctx context.Context, in *ListSnapshotsRequest, opts ...grpc.CallOption) (*ListSnapshotsResponse, error)
+	StartRestore(ctx context.Context, in *StartRestoreRequest, opts ...grpc.CallOption) (*Run, error)
+}
+
+type ossBackupClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewOssBackupClient(cc grpc.ClientConnInterface) OssBackupClient {
+	return &ossBackupClient{cc}
+}
+
+func (c *ossBackupClient) StartSync(ctx context.Context, in *StartSyncRequest, opts ...grpc.CallOption) (*Run, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(Run)
+	err := c.cc.Invoke(ctx, OssBackup_StartSync_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *ossBackupClient) Stop(ctx context.Context, in *StopRequest, opts ...grpc.CallOption) (*Run, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(Run)
+	err := c.cc.Invoke(ctx, OssBackup_Stop_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *ossBackupClient) GetStatus(ctx context.Context, in *GetStatusRequest, opts ...grpc.CallOption) (*Status, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(Status)
+	err := c.cc.Invoke(ctx, OssBackup_GetStatus_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *ossBackupClient) WatchProgress(ctx context.Context, in *WatchProgressRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[ProgressEvent], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &OssBackup_ServiceDesc.Streams[0], OssBackup_WatchProgress_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[WatchProgressRequest, ProgressEvent]{ClientStream: stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type OssBackup_WatchProgressClient = grpc.ServerStreamingClient[ProgressEvent]
+
+func (c *ossBackupClient) ListSnapshots(ctx context.Context, in *ListSnapshotsRequest, opts ...grpc.CallOption) (*ListSnapshotsResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(ListSnapshotsResponse)
+	err := c.cc.Invoke(ctx, OssBackup_ListSnapshots_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *ossBackupClient) StartRestore(ctx context.Context, in *StartRestoreRequest, opts ...grpc.CallOption) (*Run, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(Run)
+	err := c.cc.Invoke(ctx, OssBackup_StartRestore_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// OssBackupServer is the server API for OssBackup service.
+// All implementations must embed UnimplementedOssBackupServer
+// for forward compatibility.
+type OssBackupServer interface {
+	// start a sync, fails with ALREADY_EXISTS while a sync or restore is running
+	StartSync(context.Context, *StartSyncRequest) (*Run, error)
+	// ask the running sync or restore to stop after the files in progress
+	Stop(context.Context, *StopRequest) (*Run, error)
+	// the running sync or restore and the ones before it
+	GetStatus(context.Context, *GetStatusRequest) (*Status, error)
+	// events of the running sync or restore until it ends
+	WatchProgress(*WatchProgressRequest, grpc.ServerStreamingServer[ProgressEvent]) error
+	ListSnapshots(context.Context, *ListSnapshotsRequest) (*ListSnapshotsResponse, error)
+	StartRestore(context.Context, *StartRestoreRequest) (*Run, error)
+	mustEmbedUnimplementedOssBackupServer()
+}
+
+// UnimplementedOssBackupServer must be embedded to have
+// forward compatible implementations.
+//
+// NOTE: this should be embedded by value instead of pointer to avoid a nil
+// pointer dereference when methods are called.
+type UnimplementedOssBackupServer struct{}
+
+func (UnimplementedOssBackupServer) StartSync(context.Context, *StartSyncRequest) (*Run, error) {
+	return nil, status.Error(codes.Unimplemented, "method StartSync not implemented")
+}
+func (UnimplementedOssBackupServer) Stop(context.Context, *StopRequest) (*Run, error) {
+	return nil, status.Error(codes.Unimplemented, "method Stop not implemented")
+}
+func (UnimplementedOssBackupServer) GetStatus(context.Context, *GetStatusRequest) (*Status, error) {
+	return nil, status.Error(codes.Unimplemented, "method GetStatus not implemented")
+}
+func (UnimplementedOssBackupServer) WatchProgress(*WatchProgressRequest, grpc.ServerStreamingServer[ProgressEvent]) error {
+	return status.Error(codes.Unimplemented, "method WatchProgress not implemented")
+}
+func (UnimplementedOssBackupServer) ListSnapshots(context.Context, *ListSnapshotsRequest) (*ListSnapshotsResponse, error) {
+	return nil, status.Error(codes.Unimplemented, "method ListSnapshots not implemented")
+}
+func (UnimplementedOssBackupServer) StartRestore(context.Context, *StartRestoreRequest) (*Run, error) {
+	return nil, status.Error(codes.Unimplemented, "method StartRestore not implemented")
+}
+func (UnimplementedOssBackupServer) mustEmbedUnimplementedOssBackupServer() {}
+func (UnimplementedOssBackupServer) testEmbeddedByValue()                   {}
+
+// UnsafeOssBackupServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to OssBackupServer will
+// result in compilation errors.
+type UnsafeOssBackupServer interface {
+	mustEmbedUnimplementedOssBackupServer()
+}
+
+func RegisterOssBackupServer(s grpc.ServiceRegistrar, srv OssBackupServer) {
+	// If the following call panics, it indicates UnimplementedOssBackupServer was
+	// embedded by pointer and is nil.  This will cause panics if an
+	// unimplemented method is ever invoked, so we test this at initialization
+	// time to prevent it from happening at runtime later due to I/O.
+	if t, ok := srv.(interface{ testEmbeddedByValue() }); ok {
+		t.testEmbeddedByValue()
+	}
+	s.RegisterService(&OssBackup_ServiceDesc, srv)
+}
+
+func _OssBackup_StartSync_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(StartSyncRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(OssBackupServer).StartSync(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: OssBackup_StartSync_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(OssBackupServer).StartSync(ctx, req.(*StartSyncRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _OssBackup_Stop_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(StopRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(OssBackupServer).Stop(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: OssBackup_Stop_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(OssBackupServer).Stop(ctx, req.(*StopRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _OssBackup_GetStatus_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetStatusRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(OssBackupServer).GetStatus(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: OssBackup_GetStatus_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(OssBackupServer).GetStatus(ctx, req.(*GetStatusRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _OssBackup_WatchProgress_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(WatchProgressRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(OssBackupServer).WatchProgress(m, &grpc.GenericServerStream[WatchProgressRequest, ProgressEvent]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type OssBackup_WatchProgressServer = grpc.ServerStreamingServer[ProgressEvent]
+
+func _OssBackup_ListSnapshots_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListSnapshotsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(OssBackupServer).ListSnapshots(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: OssBackup_ListSnapshots_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(OssBackupServer).ListSnapshots(ctx, req.(*ListSnapshotsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _OssBackup_StartRestore_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(StartRestoreRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(OssBackupServer).StartRestore(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: OssBackup_StartRestore_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(OssBackupServer).StartRestore(ctx, req.(*StartRestoreRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// OssBackup_ServiceDesc is the grpc.ServiceDesc for OssBackup service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var OssBackup_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "ossbackup.OssBackup",
+	HandlerType: (*OssBackupServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "StartSync",
+			Handler:    _OssBackup_StartSync_Handler,
+		},
+		{
+			MethodName: "Stop",
+			Handler:    _OssBackup_Stop_Handler,
+		},
+		{
+			MethodName: "GetStatus",
+			Handler:    _OssBackup_GetStatus_Handler,
+		},
+		{
+			MethodName: "ListSnapshots",
+			Handler:    _OssBackup_ListSnapshots_Handler,
+		},
+		{
+			MethodName: "StartRestore",
+			Handler:    _OssBackup_StartRestore_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "WatchProgress",
+			Handler:       _OssBackup_WatchProgress_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "ossbackup.proto",
+}
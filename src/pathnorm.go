@@ -0,0 +1,13 @@
+package main
+
+import "golang.org/x/text/unicode/norm"
+
+/*
+ * paths in the index and the cache are NFC.
+ * macOS and some Samba shares hand out NFD names, without this the same file would look new, and be hashed
+ * and uploaded again, each time it is backed up from another system.
+ * files are still opened by their name on disk, see fileInfo.localPath.
+ */
+func normalizePath(path string) string {
+	return norm.NFC.String(path)
+}
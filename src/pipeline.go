@@ -0,0 +1,455 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aliyun/aliyun-oss-go-sdk/oss"
+	"github.com/panjf2000/ants"
+)
+
+/*
+ * sync pipeline: scan/hash -> compress -> upload
+ * the scan goroutine submits every hashed file, files whose chunk is missing on OSS flow into
+ * the compression workers and then into the upload pool, so hashing, compressing and uploading overlap.
+ * blocking channels and the upload pool keep at most (compress + upload) compressed temp files around.
+ * with concurrency.largeUpload, large chunks go to largeUploadPool instead, which adaptive concurrency leaves alone.
+ */
+type syncPipeline struct {
+	conf          *userConfig
+	bucket        *oss.Bucket
+	compressQueue chan *fileInfo
+	compressWg    sync.WaitGroup
+	uploadPool    *ants.PoolWithFunc
+	uploadWg      sync.WaitGroup
+	largeUploads  *ants.PoolWithFunc // nil unless concurrency.largeUpload is set
+	controller    *adaptiveController
+	queued        int32    // atomic
+	uploaded      int32    // atomic
+	uploadedKeys  []string // uploaded, or found on OSS by HEAD
+	failedKeys    []string // could not be compressed or uploaded
+	uploadedMutex sync.Mutex
+	failedChunks  map[string]bool     // failedKeys not uploaded for another file either, known after wait
+	compression   compressionStats    // of uploaded chunks
+	skipped       int                 // files which could not be read, known after wait
+	skippedFiles  map[string][]string // their paths by reason, for the report
+
+	// files of new chunks beyond maxUploadBytes are left out of the index, see admits
+	uploadsLimited bool
+	maxUploadBytes int64
+	uploadLimitBy  string // the option which set maxUploadBytes, for the warning
+	submittedBytes int64  // of the files of submitted chunks, only used by the scan goroutine
+	uploadedBytes  int64  // atomic, compressed
+	deferred       int
+	deferredBytes  int64
+	deferredPaths  []string
+
+	// chunks of files hashed in this sync found in a cached chunk list, checked by HEAD once, see submit
+	checkedChunks map[string]bool
+}
+
+func newSyncPipeline(conf *userConfig, bucket *oss.Bucket) *syncPipeline {
+	p := &syncPipeline{
+		conf:          conf,
+		bucket:        bucket,
+		compressQueue: make(chan *fileInfo, conf.Concurrency.Compress),
+		checkedChunks: make(map[string]bool),
+	}
+
+	upload := func(payload interface{}) {
+		params, ok := payload.(*uploadFileParams)
+		if !ok {
+			return
+		}
+		defer p.uploadWg.Done()
+		if err := catchPanic(func() error { return uploadFileToOSS(params) }); err != nil {
+			p.recordFailed(params.fileHashInfo.ChunkKey)
+			recordSkippedFile(params.fileHashInfo.Path, err)
+		}
+	}
+	p.uploadPool, _ = ants.NewPoolWithFunc(conf.Concurrency.Upload, upload)
+	if conf.Concurrency.LargeUpload > 0 {
+		p.largeUploads, _ = ants.NewPoolWithFunc(conf.Concurrency.LargeUpload, upload)
+	}
+
+	if conf.Concurrency.Adaptive {
+		p.controller = startAdaptiveController(p.uploadPool, conf.Concurrency.Upload, conf.Concurrency.MaxUpload)
+	}
+
+	for i := 0; i < conf.Concurrency.Compress; i++ {
+		p.compressWg.Add(1)
+		go p.compressWorker()
+	}
+
+	return p
+}
+
+func (p *syncPipeline) compressWorker() {
+	defer p.compressWg.Done()
+
+	for info := range p.compressQueue {
+		if !onlineChunksComplete {
+			if exists, err := chunkBucket(p.bucket, info.ChunkKey).IsObjectExist(objectKey(info.ChunkKey)); err == nil && exists {
+				atomic.AddInt32(&p.queued, -1)
+				p.recordUploaded(info.ChunkKey)
+				continue
+			}
+		}
+
+		var params *uploadFileParams
+		err := catchPanic(func() (err error) {
+			params, err = p.compressChunk(info)
+			return
+		})
+		if err != nil {
+			atomic.AddInt32(&p.queued, -1)
+			p.recordFailed(info.ChunkKey)
+			if err == errFileChanged {
+				recordUnstableFile(info.Path)
+			} else {
+				recordSkippedFile(info.Path, err)
+			}
+			continue
+		}
+
+		p.uploadWg.Add(1)
+		if p.largeUploads != nil && params.compressedSize >= int64(p.conf.Concurrency.LargeFileSize)*1024*1024 {
+			p.largeUploads.Invoke(params)
+		} else {
+			p.uploadPool.Invoke(params)
+		}
+	}
+}
+
+// the content of a file never matched its chunk key, since it was changed after hashing
+var errFileChanged = errors.New("file changed after hashing")
+
+/*
+ * compress a file for uploading, files smaller than inMemoryThreshold are kept in memory, others in a temp file.
+ * the memory or temp space used is accounted until the upload releases it.
+ */
+func (p *syncPipeline) compressChunk(info *fileInfo) (*uploadFileParams, error) {
+	fullPath := info.localPath
+	if fullPath == "" {
+		fullPath = filepath.Join(sourceRootPath(p.conf), filepath.FromSlash(info.Path))
+	}
+
+	params := &uploadFileParams{
+		pipeline:     p,
+		fileHashInfo: info,
+		inMemory:     info.Size < int64(p.conf.InMemoryThreshold)*1024,
+	}
+
+	// never more than the whole memory budget at once
+	if memoryBudget != nil && info.Size+flateJobMemory > memoryBudget.total {
+		params.inMemory = false
+	}
+
+	if params.inMemory {
+		// one acquire for the flate buffers and the data, waiting with a part of it held could dead lock
+		memoryBudget.acquire(info.Size + flateJobMemory)
+		defer memoryBudget.release(flateJobMemory)
+	} else {
+		if err := waitForDiskSpace(stagingDir(), info.Size, diskSpaceWaitTimeout); err != nil {
+			return nil, err
+		}
+		// a compressed file is hardly ever larger than the original
+		tempBudget.acquire(info.Size)
+	}
+
+	for attempt := 0; ; attempt++ {
+		var chunkKey string
+		var err error
+
+		acquireCPUSlot()
+		if params.inMemory {
+			params.compressedData, chunkKey, err = compressFileToMemory(fullPath, info.Size)
+			params.compressedSize = int64(len(params.compressedData))
+		} else {
+			params.compressedFileName, params.compressedSize, chunkKey, err = compressFile(fullPath)
+		}
+		releaseCPUSlot()
+
+		if err != nil {
+			params.release()
+			return nil, err
+		}
+		if chunkKey == info.ChunkKey {
+			return params, nil
+		}
+
+		// a chunk must never be uploaded under the key of other content
+		os.Remove(params.compressedFileName)
+		params.compressedFileName = ""
+		if attempt >= maxReadRetries {
+			params.release()
+			return nil, errFileChanged
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+// upload at most limit bytes in this sync, the lowest of several limits applies
+func (p *syncPipeline) limitUploads(limit int64, by string) {
+	if limit < 0 {
+		limit = 0
+	}
+	if !p.uploadsLimited || limit < p.maxUploadBytes {
+		p.uploadsLimited, p.maxUploadBytes, p.uploadLimitBy = true, limit, by
+	}
+}
+
+/*
+ * whether the file goes into this snapshot, false once uploading its chunk would exceed maxUploadBytes.
+ * files are counted by their size before compression, so the upload stays within the limit.
+ * only called from the scan goroutine.
+ */
+func (p *syncPipeline) admits(info *fileInfo) bool {
+	if !p.uploadsLimited || info.ChunkKey == emptyFileChunkKey || onlineChunksSet.contains(info.ChunkKey) {
+		return true
+	}
+	if p.submittedBytes+info.Size <= p.maxUploadBytes {
+		return true
+	}
+
+	p.deferred++
+	p.deferredBytes += info.Size
+	p.deferredPaths = append(p.deferredPaths, info.Path)
+	return false
+}
+
+/*
+ * add the entries of the last uploaded index for the files left out by admits, only called after wait.
+ * modified files keep their previous version in the snapshot instead of missing from it until the next sync.
+ */
+func (p *syncPipeline) restoreDeferredEntries(indexPath string) {
+	if len(p.deferredPaths) == 0 {
+		return
+	}
+	prevIndexPath := cacheFilePath(p.conf, ".index.dat")
+	if _, err := os.Stat(prevIndexPath); err != nil {
+		return
+	}
+
+	deferred := make(map[string]bool, len(p.deferredPaths))
+	for _, path := range p.deferredPaths {
+		deferred[path] = true
+	}
+
+	out, err := os.OpenFile(indexPath, os.O_APPEND|os.O_WRONLY, 0644)
+	checkErr(err)
+	writer := bufio.NewWriter(out)
+	restored := 0
+	scanFileJSONLines(prevIndexPath, func(line *fileInfo) {
+		line.Path = normalizePath(line.Path)
+		if deferred[line.Path] {
+			writeIndexLine(writer, line)
+			restored++
+		}
+	})
+	checkErr(writer.Flush())
+	checkErr(out.Close())
+
+	if restored > 0 {
+		printMsg("deferredKept", restored)
+	}
+}
+
+/*
+ * queue the chunk of a hashed file for uploading if OSS does not have it yet, only called from the scan goroutine.
+ * a file hashed in this sync whose chunk is only known from a cached chunk list goes to the compression workers
+ * as well, which check it by HEAD first, so a chunk deleted behind our back is uploaded again.
+ */
+func (p *syncPipeline) submit(info *fileInfo, fromCache bool) {
+	if info.ChunkKey == emptyFileChunkKey {
+		return
+	}
+	if onlineChunksSet.contains(info.ChunkKey) {
+		if fromCache || onlineChunksComplete || p.checkedChunks[info.ChunkKey] {
+			return
+		}
+		p.checkedChunks[info.ChunkKey] = true
+		atomic.AddInt32(&p.queued, 1)
+		queued := *info
+		p.compressQueue <- &queued
+		return
+	}
+	p.submittedBytes += info.Size
+
+	// identical files share one chunk, upload it only once
+	onlineChunksSet.add(info.ChunkKey)
+	atomic.AddInt32(&p.queued, 1)
+
+	queued := *info
+	p.compressQueue <- &queued
+}
+
+// wait for all submitted chunks to be uploaded
+func (p *syncPipeline) wait() {
+	close(p.compressQueue)
+	p.compressWg.Wait()
+	p.uploadWg.Wait()
+
+	p.controller.stopNow()
+	p.uploadPool.Release()
+	if p.largeUploads != nil {
+		p.largeUploads.Release()
+	}
+	recordUploadedChunks(p.uploadedKeys)
+	p.compression.save()
+
+	// files with the same content were indexed with the chunk, and it must not count as online anymore
+	p.failedChunks = make(map[string]bool)
+	for _, key := range p.failedKeys {
+		p.failedChunks[key] = true
+	}
+	for _, key := range p.uploadedKeys {
+		delete(p.failedChunks, key)
+	}
+	for key := range p.failedChunks {
+		onlineChunksSet.remove(key)
+	}
+
+	if p.queued > 0 {
+		printMsg("chunksUploaded", p.uploaded)
+	}
+	reportUnstableFiles()
+	p.skipped, p.skippedFiles = reportSkippedFiles()
+
+	if p.deferred > 0 {
+		printMsg("uploadsDeferred", p.deferred, formatFileSize(p.deferredBytes), formatFileSize(p.maxUploadBytes), p.uploadLimitBy, partialSnapshotTag)
+	}
+}
+
+func (p *syncPipeline) recordUploaded(key string) {
+	p.uploadedMutex.Lock()
+	p.uploadedKeys = append(p.uploadedKeys, key)
+	p.uploadedMutex.Unlock()
+}
+
+func (p *syncPipeline) recordFailed(key string) {
+	p.uploadedMutex.Lock()
+	p.failedKeys = append(p.failedKeys, key)
+	p.uploadedMutex.Unlock()
+}
+
+/*
+ * rewrite the index at indexPath without chunks which could not be uploaded, only called after wait.
+ * the files of such chunks keep their entry of the last uploaded index if its chunk is fine, others are left out.
+ * returns the paths of the files whose entry changed, the next sync has to scan them again.
+ */
+func (p *syncPipeline) dropFailedEntries(indexPath string) (affected []string) {
+	if len(p.failedChunks) == 0 {
+		return nil
+	}
+
+	affectedPaths := make(map[string]bool)
+	scanFileJSONLines(indexPath, func(line *fileInfo) {
+		if p.failedChunks[line.ChunkKey] {
+			affectedPaths[line.Path] = true
+		}
+	})
+	if len(affectedPaths) == 0 {
+		return nil
+	}
+
+	previous := make(map[string]fileInfo)
+	prevIndexPath := cacheFilePath(p.conf, ".index.dat")
+	if _, err := os.Stat(prevIndexPath); err == nil {
+		scanFileJSONLines(prevIndexPath, func(line *fileInfo) {
+			line.Path = normalizePath(line.Path)
+			if affectedPaths[line.Path] && !p.failedChunks[line.ChunkKey] {
+				previous[line.Path] = *line
+			}
+		})
+	}
+
+	header, _ := readIndexHeader(indexPath)
+	tmpPath := indexPath + ".tmp"
+	out, err := os.Create(tmpPath)
+	checkErr(err)
+	writer := bufio.NewWriter(out)
+	writeIndexHeader(writer, header)
+
+	dropped := 0
+	scanFileJSONLines(indexPath, func(line *fileInfo) {
+		if !affectedPaths[line.Path] {
+			writeIndexLine(writer, line)
+			return
+		}
+
+		affected = append(affected, line.Path)
+		if prev, ok := previous[line.Path]; ok {
+			writeIndexLine(writer, &prev)
+		} else {
+			dropped++
+		}
+	})
+	checkErr(writer.Flush())
+	checkErr(out.Close())
+	checkErr(os.Rename(tmpPath, indexPath))
+
+	printMsg("uploadsFailed", len(affected), len(affected)-dropped, dropped)
+	return affected
+}
+
+type uploadFileParams struct {
+	pipeline           *syncPipeline
+	fileHashInfo       *fileInfo
+	inMemory           bool
+	compressedFileName string // "" if in memory
+	compressedData     []byte // nil if in a temp file
+	compressedSize     int64
+}
+
+// free the memory or temp space of the compressed chunk
+func (p *uploadFileParams) release() {
+	if p.inMemory {
+		p.compressedData = nil
+		memoryBudget.release(p.fileHashInfo.Size)
+		return
+	}
+
+	if p.compressedFileName != "" {
+		os.Remove(p.compressedFileName)
+	}
+	tempBudget.release(p.fileHashInfo.Size)
+}
+
+// a chunk could not be uploaded even after retrying
+var errUploadFailed = errors.New("upload failed")
+
+// runs in the upload pools, errors are returned so the file is reported and the run goes on
+func uploadFileToOSS(p *uploadFileParams) error {
+	defer p.release()
+
+	var compressionRatio float64
+
+	if p.fileHashInfo.Size > 0 {
+		compressionRatio = float64(p.fileHashInfo.Size-p.compressedSize) / float64(p.fileHashInfo.Size) * 100
+	}
+
+	storageClass := storageClassFor(p.pipeline.conf, p.fileHashInfo.Path)
+	err := putChunkWithRetry(p.pipeline.bucket, p.pipeline.controller, p.fileHashInfo.ChunkKey, p.compressedFileName, p.compressedData, storageClass)
+	if err != nil {
+		printMsg("uploadFailed", p.fileHashInfo.Path, err)
+		return fmt.Errorf("%w: %v", errUploadFailed, err)
+	}
+	p.pipeline.controller.addBytes(p.compressedSize)
+	atomic.AddInt64(&p.pipeline.uploadedBytes, p.compressedSize)
+
+	p.pipeline.recordUploaded(p.fileHashInfo.ChunkKey)
+	p.pipeline.compression.add(p.fileHashInfo.Path, p.fileHashInfo.Size, p.compressedSize)
+
+	position := atomic.AddInt32(&p.pipeline.uploaded, 1)
+	printMsg("uploaded", position, atomic.LoadInt32(&p.pipeline.queued), p.fileHashInfo.Path, formatFileSize(p.fileHashInfo.Size), compressionRatio)
+	publishProgress(progressEvent{Kind: progressFileUploaded, Path: p.fileHashInfo.Path, Size: p.fileHashInfo.Size,
+		Done: position, Total: atomic.LoadInt32(&p.pipeline.queued)})
+	return nil
+}
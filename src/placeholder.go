@@ -0,0 +1,14 @@
+package main
+
+/*
+ * online-only files of OneDrive, Dropbox or iCloud look like any other file, but reading them makes the sync client
+ * download them first, terabytes of them for a large cloud folder. with cloudPlaceholders "record", the default,
+ * they are never read: a placeholder still in the cache with the same size and mtime keeps its backed up content,
+ * others are recorded with Type placeholder and no content, and left out by restore.
+ */
+const specialFilePlaceholder = "placeholder"
+
+// whether placeholders are recorded instead of read, which would download them
+func recordCloudPlaceholders(conf *userConfig) bool {
+	return conf.CloudPlaceholders == "record"
+}
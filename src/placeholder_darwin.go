@@ -0,0 +1,16 @@
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// SF_DATALESS, set on files of File Provider domains like iCloud Drive whose content is not downloaded
+const sfDataless = 0x40000000
+
+func isCloudPlaceholder(stat os.FileInfo) bool {
+	if sys, ok := stat.Sys().(*syscall.Stat_t); ok {
+		return sys.Flags&sfDataless != 0
+	}
+	return false
+}
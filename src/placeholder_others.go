@@ -0,0 +1,11 @@
+//go:build !windows && !darwin
+// +build !windows,!darwin
+
+package main
+
+import "os"
+
+// placeholders of FUSE based sync clients cannot be told apart from other files
+func isCloudPlaceholder(stat os.FileInfo) bool {
+	return false
+}
@@ -0,0 +1,20 @@
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// attributes of Cloud Files placeholders, and of files moved to offline storage by HSM
+const (
+	fileAttributeOffline            = 0x1000
+	fileAttributeRecallOnOpen       = 0x40000
+	fileAttributeRecallOnDataAccess = 0x400000
+)
+
+func isCloudPlaceholder(stat os.FileInfo) bool {
+	if sys, ok := stat.Sys().(*syscall.Win32FileAttributeData); ok {
+		return sys.FileAttributes&(fileAttributeOffline|fileAttributeRecallOnOpen|fileAttributeRecallOnDataAccess) != 0
+	}
+	return false
+}
@@ -0,0 +1,39 @@
+package main
+
+import "fmt"
+
+// limits how many files are hashed or compressed at the same time, nil means no limit
+var cpuSlots chan struct{}
+
+func applyPriority(conf *userConfig) {
+	limit := conf.Priority.MaxCPUWorkers
+
+	if conf.Priority.Low {
+		if limit == 0 {
+			limit = 1
+		}
+
+		if err := setLowProcessPriority(); err != nil {
+			fmt.Printf("[Priority] Could not lower process priority: %v\n", err)
+		} else {
+			fmt.Println("Running with low CPU and disk I/O priority")
+		}
+	}
+
+	cpuSlots = nil
+	if limit > 0 {
+		cpuSlots = make(chan struct{}, limit)
+	}
+}
+
+func acquireCPUSlot() {
+	if cpuSlots != nil {
+		cpuSlots <- struct{}{}
+	}
+}
+
+func releaseCPUSlot() {
+	if cpuSlots != nil {
+		<-cpuSlots
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"io/ioutil"
+	"strconv"
+	"syscall"
+)
+
+const ioprioClassIdle = 3
+const ioprioClassShift = 13
+const ioprioWhoProcess = 1
+
+/*
+ * nice 19 and idle I/O scheduling class.
+ * on linux both are per thread, so every existing thread of the process is changed, new threads inherit it.
+ */
+func setLowProcessPriority() error {
+	tasks, err := ioutil.ReadDir("/proc/self/task")
+	if err != nil {
+		return err
+	}
+
+	for _, task := range tasks {
+		tid, err := strconv.Atoi(task.Name())
+		if err != nil {
+			continue
+		}
+
+		if err := syscall.Setpriority(syscall.PRIO_PROCESS, tid, 19); err != nil {
+			return err
+		}
+
+		_, _, errno := syscall.Syscall(syscall.SYS_IOPRIO_SET, ioprioWhoProcess, uintptr(tid), ioprioClassIdle<<ioprioClassShift)
+		if errno != 0 {
+			return errno
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,10 @@
+//go:build !linux && !windows
+// +build !linux,!windows
+
+package main
+
+import "syscall"
+
+func setLowProcessPriority() error {
+	return syscall.Setpriority(syscall.PRIO_PROCESS, 0, 19)
+}
@@ -0,0 +1,10 @@
+package main
+
+import "golang.org/x/sys/windows"
+
+// lowers CPU, I/O and memory priority of the whole process
+const processModeBackgroundBegin = 0x00100000
+
+func setLowProcessPriority() error {
+	return windows.SetPriorityClass(windows.CurrentProcess(), processModeBackgroundBegin)
+}
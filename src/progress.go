@@ -0,0 +1,84 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// the values of ProgressEvent.Kind in proto/ossbackup.proto
+type progressKind int
+
+const (
+	progressFileUploaded progressKind = iota + 1
+	progressFileRestored
+	progressFileFailed
+	progressRunFinished
+)
+
+// something a sync or restore did, for WatchProgress of the gRPC interface
+type progressEvent struct {
+	Kind  progressKind
+	Path  string
+	Size  int64
+	Done  int32 // files so far
+	Total int32 // files of the run, 0 if not known yet
+	Error string
+}
+
+// events are dropped for watchers not keeping up, rather than slowing down the run
+const progressBuffer = 256
+
+var progressWatchers = make(map[chan progressEvent]bool)
+var progressMutex sync.Mutex
+
+// receive the events of the running sync or restore, the channel is closed when it ends or cancel is called
+func watchProgress() (events chan progressEvent, cancel func()) {
+	events = make(chan progressEvent, progressBuffer)
+	progressMutex.Lock()
+	progressWatchers[events] = true
+	progressMutex.Unlock()
+
+	return events, func() {
+		progressMutex.Lock()
+		defer progressMutex.Unlock()
+		if progressWatchers[events] {
+			delete(progressWatchers, events)
+			close(events)
+		}
+	}
+}
+
+func publishProgress(event progressEvent) {
+	progressMutex.Lock()
+	defer progressMutex.Unlock()
+
+	for events := range progressWatchers {
+		select {
+		case events <- event:
+		default:
+		}
+	}
+}
+
+// publish the end of the run and close the channels of all watchers
+func finishProgress(runErr string) {
+	publishProgress(progressEvent{Kind: progressRunFinished, Error: runErr})
+
+	progressMutex.Lock()
+	defer progressMutex.Unlock()
+	for events := range progressWatchers {
+		delete(progressWatchers, events)
+		close(events)
+	}
+}
+
+// set by Stop of the gRPC interface, the running sync or restore starts no more files
+var stopRequested int32
+
+func requestStop() {
+	atomic.StoreInt32(&stopRequested, 1)
+}
+
+func stopping() bool {
+	return atomic.LoadInt32(&stopRequested) == 1
+}
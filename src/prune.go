@@ -0,0 +1,409 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aliyun/aliyun-oss-go-sdk/oss"
+)
+
+const gcStateKey = "gc/state.json"
+
+// lease held while a prune removes chunks or migrate-layout renames objects, syncs refuse to start meanwhile
+const gcSweepLockKey = "gc/sweep.lock"
+
+/*
+ * chunks are removed in two phases, so a chunk another host starts using again is never lost:
+ * mark: chunks referenced by no index of any host are recorded in Pending.
+ * sweep: a prune at least prune.gracePeriod later takes gcSweepLockKey, re-reads all indexes
+ * and removes the pending chunks still unreferenced.
+ * hosts with oss.useLockObject are excluded by the locks during the sweep, other hosts check the chunks of
+ * their index again if a sweep started while they synced, see recheckChunksAfterSweep.
+ */
+type gcState struct {
+	MarkTime  int64    // unix nano time Pending was computed
+	Pending   []string // chunk keys unreferenced at MarkTime
+	LastSweep int64    // unix nano time chunks were last removed, chunk lists cached before it are stale
+}
+
+func readGCState(bucket *oss.Bucket) (gcState, error) {
+	body, err := bucket.GetObject(objectKey(gcStateKey))
+	if err != nil {
+		if serviceErr, ok := err.(oss.ServiceError); ok && serviceErr.Code == "NoSuchKey" {
+			return gcState{}, nil
+		}
+		return gcState{}, err
+	}
+	defer body.Close()
+
+	content, err := ioutil.ReadAll(body)
+	if err != nil {
+		return gcState{}, err
+	}
+
+	var state gcState
+	if err := json.Unmarshal(content, &state); err != nil {
+		return gcState{}, errors.New("gc state is invalid: " + err.Error())
+	}
+	return state, nil
+}
+
+func writeGCState(bucket *oss.Bucket, state gcState) error {
+	content, _ := json.Marshal(state)
+	return bucket.PutObject(objectKey(gcStateKey), bytes.NewReader(content))
+}
+
+// whether chunks were removed after the chunk list in the cache was made
+func chunksPrunedSinceListing(bucket *oss.Bucket) bool {
+	state, err := readGCState(bucket)
+	checkErr(err)
+
+	listTime, _ := strconv.ParseInt(getCacheMeta("chunkListTime"), 10, 64)
+	return state.LastSweep > 0 && state.LastSweep > listTime
+}
+
+// chunks used by any of snapshots
+func referencedChunks(bucket *oss.Bucket, snapshots []snapshotInfo) *chunkSet {
+	referenced := newChunkSet()
+
+	for _, snapshot := range snapshots {
+		indexPath, _, err := downloadIndex(bucket, snapshot.Key)
+		if err != nil {
+			os.Remove(indexPath)
+			// without every index, any chunk could still be in use
+			checkErr(errors.New("index " + snapshot.Key + " could not be read: " + err.Error()))
+		}
+
+		scanIndex(indexPath, "", func(line *fileInfo) {
+			referenced.add(line.ChunkKey)
+		})
+		os.Remove(indexPath)
+	}
+
+	return referenced
+}
+
+/*
+ * remove all but the newest keepLast snapshots of each host, returning the ones left.
+ * held snapshots, see runHold, and snapshots a kept delta is based on are kept as well. with dryRun nothing is removed.
+ */
+func forgetSnapshots(bucket *oss.Bucket, snapshots []snapshotInfo, keepLast int, dryRun bool) []snapshotInfo {
+	needed := make(map[string]bool)
+	var deltas []string
+
+	holds := listHolds(bucket)
+	names := listSnapshotNames(bucket, "")
+	for _, snapshot := range snapshots {
+		if hold, ok := holds[holdKey(snapshot)]; ok {
+			fmt.Printf("[Prune] Keeping snapshot %s %s, held %s\n", snapshot.Host, snapshot.Time, hold)
+			needed[snapshot.Key] = true
+			if snapshot.Delta {
+				deltas = append(deltas, snapshot.Key)
+			}
+		}
+	}
+
+	// listed oldest first. partial snapshots and those of --files lack files, they are kept among the newest but not counted
+	keptOfHost := make(map[string]int)
+	for i := len(snapshots) - 1; i >= 0; i-- {
+		snapshot := snapshots[i]
+		if keptOfHost[snapshot.Host] < keepLast {
+			if !snapshot.hasTag(partialSnapshotTag) && !snapshot.hasTag(filesSnapshotTag) {
+				keptOfHost[snapshot.Host]++
+			}
+			if needed[snapshot.Key] {
+				continue
+			}
+			needed[snapshot.Key] = true
+			if snapshot.Delta {
+				deltas = append(deltas, snapshot.Key)
+			}
+		}
+	}
+
+	for len(deltas) > 0 {
+		key := deltas[len(deltas)-1]
+		deltas = deltas[:len(deltas)-1]
+
+		base, err := indexBase(bucket, key)
+		checkErr(err)
+		if base == "" || needed[base] {
+			continue
+		}
+
+		needed[base] = true
+		if baseSnapshot, ok := parseSnapshotKey(base); ok && baseSnapshot.Delta {
+			deltas = append(deltas, base)
+		}
+	}
+
+	var kept []snapshotInfo
+	for _, snapshot := range snapshots {
+		if needed[snapshot.Key] {
+			kept = append(kept, snapshot)
+			continue
+		}
+
+		if dryRun {
+			fmt.Printf("[Prune] Would remove snapshot %s %s\n", snapshot.Host, snapshot.Time)
+			continue
+		}
+		fmt.Printf("[Prune] Removing snapshot %s %s\n", snapshot.Host, snapshot.Time)
+		checkErr(bucket.DeleteObject(objectKey(snapshot.Key)))
+		deleteSnapshotNames(bucket, snapshot, names)
+		checkErr(bucket.DeleteObject(objectKey(snapshotStatsKey(snapshot))))
+	}
+
+	return kept
+}
+
+func deleteChunks(bucket *oss.Bucket, keys []string, lease *lockLease) {
+	if len(chunkBuckets) > 0 {
+		keysOfBucket := make(map[*oss.Bucket][]string)
+		for _, key := range keys {
+			shard := chunkBucket(bucket, key)
+			keysOfBucket[shard] = append(keysOfBucket[shard], key)
+		}
+		for _, shard := range chunkBuckets {
+			deleteObjects(shard, keysOfBucket[shard], lease)
+		}
+		return
+	}
+	deleteObjects(bucket, keys, lease)
+}
+
+// delete the objects of keys, 1000 at a time, stopping if lease is not nil and was lost
+func deleteObjects(bucket *oss.Bucket, keys []string, lease *lockLease) {
+	for start := 0; start < len(keys); start += 1000 {
+		if lease != nil {
+			checkErr(lease.check())
+		}
+
+		end := start + 1000
+		if end > len(keys) {
+			end = len(keys)
+		}
+
+		batch := make([]string, 0, end-start)
+		for _, key := range keys[start:end] {
+			batch = append(batch, objectKey(key))
+		}
+		_, err := bucket.DeleteObjects(batch, oss.DeleteObjectsQuiet(true))
+		checkErr(err)
+	}
+}
+
+/*
+ * remove the pending chunks still unreferenced, unless another host is syncing.
+ * returns the chunks referenced now, nil if nothing was removed.
+ */
+func sweepChunks(conf *userConfig, bucket *oss.Bucket, state *gcState) *chunkSet {
+	lease, _, err := takeLease(bucket, objectKey(gcSweepLockKey), "prune")
+	if err != nil {
+		fmt.Printf("[Prune] Chunks are not removed, another prune seems to be running: %v\n", err)
+		return nil
+	}
+	defer lease.release()
+
+	// syncs taking their lock from now on see the sweep lock and stop, see acquireSyncLock
+	others, err := otherHostLocks(conf, bucket)
+	checkErr(err)
+	if len(others) > 0 {
+		fmt.Printf("[Prune] Other hosts are syncing (%s), removing chunks is postponed\n", strings.Join(others, ", "))
+		return nil
+	}
+
+	// written before reading the indexes, so syncs of hosts without lock objects uploading theirs meanwhile
+	// stop trusting their cached chunk lists and check their chunks again
+	state.LastSweep = time.Now().UnixNano()
+	checkErr(writeGCState(bucket, *state))
+
+	// indexes uploaded since the mark may use pending chunks again
+	referenced := referencedChunks(bucket, listSnapshots(bucket))
+
+	var unused []string
+	for _, key := range state.Pending {
+		if !referenced.contains(key) {
+			unused = append(unused, key)
+		}
+	}
+
+	deleteChunks(bucket, unused, lease)
+	fmt.Printf("[Prune] %d chunks removed, %d pending chunks are used again\n", len(unused), len(state.Pending)-len(unused))
+
+	state.Pending = nil
+	checkErr(writeGCState(bucket, *state))
+	return referenced
+}
+
+/*
+ * wait for a running sweep to end and return the time of the last one, read when a sync starts.
+ * the state is read before the sweep lock, so a sweep starting later always changes LastSweep.
+ */
+func waitForSweep(bucket *oss.Bucket) int64 {
+	for announced := false; ; announced = true {
+		state, err := readGCState(bucket)
+		checkErr(err)
+		holder, err := activeLease(bucket, objectKey(gcSweepLockKey))
+		checkErr(err)
+		if holder == nil {
+			return state.LastSweep
+		}
+
+		if !announced {
+			fmt.Printf("[Prune] Waiting for %s to finish removing chunks\n", holder)
+		}
+		time.Sleep(10 * time.Second)
+	}
+}
+
+/*
+ * after the index at indexPath was uploaded, check whether a sweep started since waitForSweep returned lastSweep.
+ * a sweep reading the indexes before ours was uploaded may have removed chunks the sync found in its chunk list,
+ * so once it is over every chunk of the index is checked by HEAD and uploaded again if missing.
+ * files whose chunk cannot be uploaded are left out and the index is uploaded again, their paths are returned.
+ */
+func recheckChunksAfterSweep(conf *userConfig, bucket *oss.Bucket, indexPath string, lastSweep int64) (failedFiles []string) {
+	state, err := readGCState(bucket)
+	checkErr(err)
+	if state.LastSweep == lastSweep {
+		return nil
+	}
+
+	waitForSweep(bucket)
+	fmt.Println("[Prune] Chunks were removed during this sync, checking the chunks of its index")
+
+	onlineChunksComplete = false
+	pipeline := newSyncPipeline(conf, bucket)
+	scanFileJSONLines(indexPath, func(line *fileInfo) {
+		pipeline.submit(line, false)
+	})
+	pipeline.wait()
+
+	failedFiles = pipeline.dropFailedEntries(indexPath)
+	if failedFiles == nil {
+		return nil
+	}
+	if appendOnlyMode {
+		fmt.Println("[Error] The snapshot just uploaded uses removed chunks and cannot be replaced in append-only mode, the next sync uploads them")
+	} else {
+		uploadIndexFile(conf, indexPath, bucket)
+	}
+	return failedFiles
+}
+
+// `ossBackup prune`, remove old snapshots and chunks no snapshot uses
+func runPrune(args []string) {
+	var configFileName string
+	var forceUnlock bool
+	var keepLast int
+	var dryRun bool
+	flags := flag.NewFlagSet("prune", flag.ExitOnError)
+	flags.StringVar(&configFileName, "c", "", "the name of config file")
+	flags.BoolVar(&forceUnlock, "force-unlock", false, "remove locks left by another sync before pruning")
+	flags.IntVar(&keepLast, "keep-last", 0, "keep only this many newest snapshots of each host, not counting partial ones or those of --files, 0 keeps all")
+	flags.BoolVar(&dryRun, "dry-run", false, "only report which snapshots and how many chunks would be removed")
+	flags.Parse(args)
+
+	conf := getConfig(configFileName)
+	_, bucket, err := getOSSClient(&conf)
+	checkErr(err)
+
+	if dryRun {
+		checkErr(checkRepositoryLayout(bucket, false))
+		applyBandwidthLimits(&conf)
+		applyTempBudget(&conf)
+		pruneDryRun(bucket, keepLast)
+		return
+	}
+	refuseInAppendOnlyMode("prune")
+	refuseInReadOnlyMode("prune")
+
+	lock, err := acquireSyncLock(&conf, bucket, forceUnlock)
+	checkErr(err)
+	defer lock.release()
+	checkErr(checkRepositoryLayout(bucket, true))
+
+	applyBandwidthLimits(&conf)
+	applyTempBudget(&conf)
+
+	snapshots := listSnapshots(bucket)
+	if keepLast > 0 {
+		checkErr(lock.check())
+		snapshots = forgetSnapshots(bucket, snapshots, keepLast, false)
+	}
+
+	state, err := readGCState(bucket)
+	checkErr(err)
+
+	var referenced *chunkSet
+	if len(state.Pending) > 0 {
+		sweepTime := time.Unix(0, state.MarkTime).Add(conf.Prune.GracePeriod)
+		if time.Now().Before(sweepTime) {
+			fmt.Printf("[Prune] %d unreferenced chunks are removed by a prune after %s\n", len(state.Pending), sweepTime.Format(time.RFC3339))
+			return
+		}
+
+		if referenced = sweepChunks(&conf, bucket, &state); referenced == nil {
+			return
+		}
+	}
+
+	// mark
+	if referenced == nil {
+		referenced = referencedChunks(bucket, snapshots)
+	}
+
+	state.Pending = nil
+	listOnlineChunks(bucket, func(key string) {
+		if !referenced.contains(key) {
+			state.Pending = append(state.Pending, key)
+		}
+	})
+	state.MarkTime = time.Now().UnixNano()
+	checkErr(writeGCState(bucket, state))
+
+	fmt.Printf("[Prune] %d unreferenced chunks marked, a prune after %s removes them\n", len(state.Pending), conf.Prune.GracePeriod)
+}
+
+/*
+ * report what a prune with keepLast would remove, without the lock and without changing anything.
+ * chunks in Archive storage are counted separately, removing them early is charged for.
+ * the chunks are only removed by a second prune after prune.gracePeriod, see gcState.
+ */
+func pruneDryRun(bucket *oss.Bucket, keepLast int) {
+	snapshots := listSnapshots(bucket)
+	kept := snapshots
+	if keepLast > 0 {
+		kept = forgetSnapshots(bucket, snapshots, keepLast, true)
+	}
+	referenced := referencedChunks(bucket, kept)
+
+	var count, archived int
+	var size, archivedSize int64
+	listOnlineChunkObjects(bucket, func(key string, object oss.ObjectProperties) {
+		if referenced.contains(key) {
+			return
+		}
+		count++
+		size += object.Size
+		if object.StorageClass == string(oss.StorageArchive) || object.StorageClass == string(oss.StorageColdArchive) {
+			archived++
+			archivedSize += object.Size
+		}
+	})
+
+	fmt.Printf("[Prune] %d of %d snapshots would be removed, %d chunks (%s) would no longer be used\n",
+		len(snapshots)-len(kept), len(snapshots), count, formatFileSize(size))
+	if archived > 0 {
+		fmt.Printf("[Prune] %d of these chunks (%s) are in Archive storage, removing them early may be charged for\n", archived, formatFileSize(archivedSize))
+	}
+}
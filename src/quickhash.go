@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"os"
+
+	"github.com/cespare/xxhash/v2"
+)
+
+// bytes read from the head and the tail of a file for its quick hash
+const quickHashBlockSize = 64 * 1024
+
+/*
+ * xxhash of the first and last blocks of a file, cheap enough to compute for every cache miss.
+ * it is only used to find the cache entry of a file that was moved or renamed, together with size and mtime,
+ * so a renamed directory does not have to be hashed again in full.
+ */
+func quickHashFile(file string, size int64) (string, error) {
+	// the open and its two small reads take one token of scanLimiter
+	waitScanOp()
+	f, err := os.Open(longPath(file))
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	hasher := xxhash.New()
+	buffer := make([]byte, quickHashBlockSize)
+
+	n, err := io.ReadFull(f, buffer)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return "", err
+	}
+	hasher.Write(buffer[:n])
+
+	if size > 2*quickHashBlockSize {
+		n, err = f.ReadAt(buffer, size-quickHashBlockSize)
+		if err != nil && err != io.EOF {
+			return "", err
+		}
+		hasher.Write(buffer[:n])
+	} else if size > quickHashBlockSize {
+		// the rest of a small file
+		n, err = io.ReadFull(f, buffer)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return "", err
+		}
+		hasher.Write(buffer[:n])
+	}
+
+	sum := make([]byte, 8)
+	binary.BigEndian.PutUint64(sum, hasher.Sum64())
+	return hex.EncodeToString(sum), nil
+}
+
+/*
+ * fill ChunkKey from the cache entry of another path with the same quick hash, size and mtime, returns false if none.
+ * the quick hash is stored in info either way, so it is written to the cache with the full hash later.
+ */
+func lookupMovedFile(info *fileInfo, fullPath string, tx *cacheTx) bool {
+	quickHash, err := quickHashFile(fullPath, info.Size)
+	if err != nil {
+		return false
+	}
+	info.quickHash = quickHash
+
+	var shaVal string
+	if tx.findMoved.QueryRow(quickHash, info.Size, info.ModTime).Scan(&shaVal) != nil {
+		return false
+	}
+
+	info.ChunkKey = shaVal
+	return true
+}
+
+// entries hashed before quickHash was enabled get their quick hash on the next scan, so they can be found once moved
+func fillMissingQuickHash(info *fileInfo, fullPath string, tx *cacheTx) {
+	if info.quickHash != "" {
+		return
+	}
+
+	quickHash, err := quickHashFile(fullPath, info.Size)
+	if err != nil {
+		return
+	}
+	info.quickHash = quickHash
+
+	_, err = tx.setQuickHash.Exec(quickHash, info.Path, info.ModTime, info.Size)
+	checkErr(err)
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+)
+
+type quotaConfig struct {
+	Size        int  // GB, soft quota of the chunks in the repository, 0 means none
+	WarnPercent int  // warn once the repository reaches this percentage of Size
+	Refuse      bool // stop uploading new chunks at Size, the snapshot is tagged partial
+}
+
+/*
+ * size of all chunks in the repository as far as this machine knows: measured by the last full listing of the
+ * bucket, plus what this machine uploaded since. chunks of other hosts are counted from the next listing on.
+ */
+func repositorySize() (int64, bool) {
+	value := getCacheMeta("repositorySize")
+	if value == "" {
+		return 0, false
+	}
+	size, err := strconv.ParseInt(value, 10, 64)
+	return size, err == nil
+}
+
+func setRepositorySize(size int64) {
+	checkErr(setCacheMeta("repositorySize", strconv.FormatInt(size, 10)))
+}
+
+func quotaBytes(conf *quotaConfig) int64 {
+	return int64(conf.Size) * 1024 * 1024 * 1024
+}
+
+// warn if the repository has reached quota.warnPercent of quota.size, after the cache is opened
+func checkQuota(conf *userConfig) {
+	if conf.Quota.Size <= 0 {
+		return
+	}
+	size, ok := repositorySize()
+	if !ok {
+		return
+	}
+
+	quota := quotaBytes(&conf.Quota)
+	if size >= quota {
+		fmt.Printf("[Quota] The repository holds %s, over its quota of %s, check nothing was backed up by accident\n", formatFileSize(size), formatFileSize(quota))
+	} else if size*100 >= quota*int64(conf.Quota.WarnPercent) {
+		fmt.Printf("[Quota] The repository holds %s, %d%% of its quota of %s\n", formatFileSize(size), size*100/quota, formatFileSize(quota))
+	}
+}
+
+// bytes a sync may still upload with quota.refuse, ok is false if there is no such limit
+func quotaRemaining(conf *userConfig) (int64, bool) {
+	if conf.Quota.Size <= 0 || !conf.Quota.Refuse {
+		return 0, false
+	}
+	size, ok := repositorySize()
+	if !ok {
+		return 0, false
+	}
+	return quotaBytes(&conf.Quota) - size, true
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aliyun/aliyun-oss-go-sdk/oss"
+	"golang.org/x/time/rate"
+)
+
+// token buckets shared by all workers, unlimited until applyBandwidthLimits is called
+var uploadLimiter = rate.NewLimiter(rate.Inf, 0)
+var downloadLimiter = rate.NewLimiter(rate.Inf, 0)
+
+/*
+ * stat, directory reads, opens and reads of up to copyBufferSize of files while scanning each take one token,
+ * so a walk over SMB or NFS leaves the file server usable for everyone else.
+ */
+var scanLimiter = rate.NewLimiter(rate.Inf, 0)
+
+// the bandwidth config currently in effect, the schedule goroutine reads it every minute
+var bandwidthConf bandwidthConfig
+var bandwidthMutex sync.Mutex
+var bandwidthScheduleOnce sync.Once
+
+func setLimiterRate(limiter *rate.Limiter, kbPerSecond int) {
+	if kbPerSecond <= 0 {
+		limiter.SetLimit(rate.Inf)
+		return
+	}
+
+	// allow a burst of one second
+	bytesPerSecond := kbPerSecond * 1024
+	limiter.SetBurst(bytesPerSecond)
+	limiter.SetLimit(rate.Limit(bytesPerSecond))
+}
+
+func setScanLimiterRate(opsPerSecond int) {
+	if opsPerSecond <= 0 {
+		scanLimiter.SetLimit(rate.Inf)
+		return
+	}
+	scanLimiter.SetBurst(opsPerSecond)
+	scanLimiter.SetLimit(rate.Limit(opsPerSecond))
+}
+
+// wait for a token of scanLimiter before touching the file system while scanning
+func waitScanOp() {
+	if scanLimiter.Limit() != rate.Inf {
+		scanLimiter.Wait(context.Background())
+	}
+}
+
+func applyBandwidthLimits(conf *userConfig) {
+	bandwidthMutex.Lock()
+	bandwidthConf = conf.Bandwidth
+	bandwidthMutex.Unlock()
+
+	updateBandwidthLimits(time.Now())
+
+	// adjust limits on the fly when a time window starts or ends
+	if len(conf.Bandwidth.Schedule) > 0 {
+		bandwidthScheduleOnce.Do(func() {
+			go func() {
+				for now := range time.Tick(time.Minute) {
+					updateBandwidthLimits(now)
+				}
+			}()
+		})
+	}
+}
+
+var currentUploadLimit = -1
+var currentDownloadLimit = -1
+var currentScanOpsLimit = -1
+
+// pick the limits of the first schedule window containing now, or the defaults
+func updateBandwidthLimits(now time.Time) {
+	bandwidthMutex.Lock()
+	defer bandwidthMutex.Unlock()
+
+	upload, download, scanOps := bandwidthConf.LimitUpload, bandwidthConf.LimitDownload, bandwidthConf.LimitScanOps
+	for _, window := range bandwidthConf.Schedule {
+		if window.contains(now) {
+			upload, download, scanOps = window.LimitUpload, window.LimitDownload, window.LimitScanOps
+			break
+		}
+	}
+
+	if upload == currentUploadLimit && download == currentDownloadLimit && scanOps == currentScanOpsLimit {
+		return
+	}
+	currentUploadLimit, currentDownloadLimit, currentScanOpsLimit = upload, download, scanOps
+
+	setLimiterRate(uploadLimiter, upload)
+	setLimiterRate(downloadLimiter, download)
+	setScanLimiterRate(scanOps)
+
+	if upload > 0 || download > 0 {
+		fmt.Printf("[Bandwidth] Upload limit: %s, download limit: %s\n", formatBandwidthLimit(upload), formatBandwidthLimit(download))
+	}
+	if scanOps > 0 {
+		fmt.Printf("[Bandwidth] Scanning limited to %d file system operations per second\n", scanOps)
+	}
+}
+
+func formatBandwidthLimit(kbPerSecond int) string {
+	if kbPerSecond <= 0 {
+		return "unlimited"
+	}
+	return formatFileSize(int64(kbPerSecond)*1024) + "/s"
+}
+
+// minutes since midnight of a "15:04" time
+func parseTimeOfDay(value string) (int, error) {
+	t, err := time.Parse("15:04", value)
+	if err != nil {
+		return 0, err
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+var weekdayNames = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+// a weekday like "mon" or "Monday"
+func parseWeekday(value string) (time.Weekday, bool) {
+	value = strings.ToLower(value)
+	for i, name := range weekdayNames {
+		if value == name || value == strings.ToLower(time.Weekday(i).String()) {
+			return time.Weekday(i), true
+		}
+	}
+	return 0, false
+}
+
+// whether the window starts on day, every day if it has no days
+func (w bandwidthWindow) startsOn(day time.Weekday) bool {
+	if len(w.Days) == 0 {
+		return true
+	}
+	for _, value := range w.Days {
+		if weekday, ok := parseWeekday(value); ok && weekday == day {
+			return true
+		}
+	}
+	return false
+}
+
+// windows may wrap around midnight, like 23:00 - 06:00, the part after midnight belongs to the day before
+func (w bandwidthWindow) contains(now time.Time) bool {
+	from, err := parseTimeOfDay(w.From)
+	if err != nil {
+		return false
+	}
+	to, err := parseTimeOfDay(w.To)
+	if err != nil {
+		return false
+	}
+
+	minute := now.Hour()*60 + now.Minute()
+	if from <= to {
+		return minute >= from && minute < to && w.startsOn(now.Weekday())
+	}
+	if minute >= from {
+		return w.startsOn(now.Weekday())
+	}
+	return minute < to && w.startsOn(now.AddDate(0, 0, -1).Weekday())
+}
+
+// a file read while scanning, each Read takes a token of scanLimiter
+type scanLimitedReader struct {
+	reader io.Reader
+}
+
+func (r *scanLimitedReader) Read(p []byte) (int, error) {
+	waitScanOp()
+	return r.reader.Read(p)
+}
+
+type limitedReader struct {
+	reader  io.Reader
+	limiter *rate.Limiter
+}
+
+func (r *limitedReader) Read(p []byte) (int, error) {
+	if r.limiter.Limit() == rate.Inf {
+		return r.reader.Read(p)
+	}
+
+	// never ask for more tokens than the bucket can hold
+	if len(p) > r.limiter.Burst() {
+		p = p[:r.limiter.Burst()]
+	}
+
+	n, err := r.reader.Read(p)
+	if n > 0 {
+		r.limiter.WaitN(context.Background(), n)
+	}
+	return n, err
+}
+
+// same as bucket.PutObjectFromFile, but limited by uploadLimiter
+func putObjectFromFile(bucket *oss.Bucket, key string, filePath string, options ...oss.Option) error {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	stat, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	options = append(appendOnlyOptions(options), oss.ContentLength(stat.Size()))
+	return bucket.PutObject(key, &limitedReader{reader: f, limiter: uploadLimiter}, options...)
+}
+
+// upload a small object held in memory, limited by uploadLimiter
+func putObjectFromBytes(bucket *oss.Bucket, key string, data []byte, options ...oss.Option) error {
+	options = append(appendOnlyOptions(options), oss.ContentLength(int64(len(data))))
+	return bucket.PutObject(key, &limitedReader{reader: bytes.NewReader(data), limiter: uploadLimiter}, options...)
+}
+
+// same as bucket.GetObjectToFile, but limited by downloadLimiter
+func getObjectToFile(bucket *oss.Bucket, key string, filePath string, options ...oss.Option) error {
+	body, err := bucket.GetObject(key, options...)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	f, err := os.OpenFile(filePath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = pooledCopy(f, &limitedReader{reader: body, limiter: downloadLimiter})
+	return err
+}
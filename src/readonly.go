@@ -0,0 +1,48 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+)
+
+/*
+ * in read-only mode nothing in the bucket is written or deleted, for machines with restore-only credentials
+ * and to be sure a restore workstation can never damage the repository.
+ * commands which write refuse to start, and requests which could change the bucket are refused before they are sent.
+ * set by getConfig from readOnly or --read-only.
+ */
+var readOnlyMode bool
+
+var errReadOnly = errors.New("the bucket may not be changed in read-only mode")
+
+// stop commands which write to the bucket in read-only mode
+func refuseInReadOnlyMode(command string) {
+	if readOnlyMode {
+		checkErr(errors.New(command + " writes to the bucket, which readOnly forbids"))
+	}
+}
+
+/*
+ * lets only requests through which read: GET and HEAD, and the POST restoring Archive objects,
+ * which warmup needs and which changes no content. everything else, put, copy, delete and multipart uploads, fails.
+ */
+type readOnlyTransport struct {
+	base http.RoundTripper
+}
+
+func (t readOnlyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead:
+	case http.MethodPost:
+		if _, ok := req.URL.Query()["restore"]; !ok {
+			return nil, errReadOnly
+		}
+	default:
+		return nil, errReadOnly
+	}
+	return t.base.RoundTrip(req)
+}
+
+func readOnlyHTTPClient() *http.Client {
+	return &http.Client{Transport: readOnlyTransport{base: http.DefaultTransport}}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/aliyun/aliyun-oss-go-sdk/oss"
+)
+
+// reports of syncs uploaded with report.upload, as reports/<host>/<snapshot time>.html
+const reportKeyPrefix = "reports/"
+
+type reportConfig struct {
+	Dir    string // directory HTML reports of syncs are written to, "" writes none
+	Upload bool   // upload them to reports/ in the bucket as well
+}
+
+// what a sync did, rendered by writeSyncReport
+type syncReport struct {
+	Header        indexHeader
+	Start         time.Time
+	End           time.Time
+	Files         int32
+	Size          int64
+	Uploaded      int32
+	UploadedBytes int64
+	Deferred      int
+	DeferredBytes int64
+	Changes       *indexChanges // nil for the first snapshot of this machine
+	Skipped       map[string][]string
+}
+
+// the paths of one kind of change for the template, More of them are only counted
+type reportChangeList struct {
+	Title string
+	Paths []string
+	More  int
+}
+
+type reportSkippedReason struct {
+	Reason string
+	Paths  []string
+}
+
+/*
+ * render report as a self-contained HTML page, into report.dir and/or reports/ in the bucket.
+ * a report which cannot be written is only warned about, the snapshot is uploaded already.
+ */
+func writeSyncReport(conf *userConfig, bucket *oss.Bucket, report *syncReport) {
+	if conf.Report.Dir == "" && !conf.Report.Upload {
+		return
+	}
+
+	var page bytes.Buffer
+	if err := syncReportTemplate.Execute(&page, reportTemplateData(report)); err != nil {
+		fmt.Printf("[Report] Could not render the report: %v\n", err)
+		return
+	}
+
+	name := report.Header.Time + ".html"
+	if conf.Report.Dir != "" {
+		reportPath := filepath.Join(conf.Report.Dir, name)
+		err := os.MkdirAll(conf.Report.Dir, 0755)
+		if err == nil {
+			err = ioutil.WriteFile(reportPath, page.Bytes(), 0644)
+		}
+		if err != nil {
+			fmt.Printf("[Report] Could not write %s: %v\n", reportPath, err)
+		} else {
+			fmt.Printf("[Report] Written to %s\n", reportPath)
+		}
+	}
+
+	if conf.Report.Upload {
+		key := reportKeyPrefix + report.Header.Host + "/" + name
+		if err := bucket.PutObject(objectKey(key), bytes.NewReader(page.Bytes()), appendOnlyOptions([]oss.Option{oss.ContentType("text/html; charset=utf-8")})...); err != nil {
+			fmt.Printf("[Report] Could not upload %s: %v\n", key, err)
+		} else {
+			fmt.Printf("[Report] Uploaded to %s\n", key)
+		}
+	}
+}
+
+func reportTemplateData(report *syncReport) map[string]interface{} {
+	var changes []reportChangeList
+	if c := report.Changes; c != nil {
+		changes = []reportChangeList{
+			{"Added", c.added, c.addedCount - len(c.added)},
+			{"Modified", c.modified, c.modifiedCount - len(c.modified)},
+			{"Deleted", c.deleted, c.deletedCount - len(c.deleted)},
+		}
+	}
+
+	var skipped []reportSkippedReason
+	var skippedCount int
+	for reason, paths := range report.Skipped {
+		sort.Strings(paths)
+		skipped = append(skipped, reportSkippedReason{reason, paths})
+		skippedCount += len(paths)
+	}
+	sort.Slice(skipped, func(i, j int) bool { return skipped[i].Reason < skipped[j].Reason })
+
+	return map[string]interface{}{
+		"Report":        report,
+		"Duration":      report.End.Sub(report.Start).Round(time.Second).String(),
+		"Size":          formatFileSize(report.Size),
+		"UploadedBytes": formatFileSize(report.UploadedBytes),
+		"DeferredBytes": formatFileSize(report.DeferredBytes),
+		"Changes":       changes,
+		"Skipped":       skipped,
+		"SkippedCount":  skippedCount,
+	}
+}
+
+var syncReportTemplate = template.Must(template.New("report").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Backup of {{.Report.Header.Host}} at {{.Report.Start.Format "2006-01-02 15:04"}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em auto; max-width: 60em; color: #222; }
+h1 { font-size: 1.5em; }
+h2 { font-size: 1.2em; margin-top: 2em; }
+table { border-collapse: collapse; }
+td { padding: 0.2em 1em 0.2em 0; }
+.ok { color: #1a7f37; }
+.problem { color: #cf222e; }
+ul { font-family: monospace; }
+</style>
+</head>
+<body>
+<h1>Backup of {{.Report.Header.Host}}</h1>
+{{if .SkippedCount}}<p class="problem">{{.SkippedCount}} files could not be backed up, see below.</p>
+{{else}}<p class="ok">All files were backed up.</p>
+{{end}}{{if .Report.Deferred}}<p class="problem">{{.Report.Deferred}} files ({{.DeferredBytes}}) were left for the next backup because of the upload limit.</p>
+{{end}}
+<h2>Summary</h2>
+<table>
+<tr><td>Folder</td><td>{{.Report.Header.RootPath}}</td></tr>
+<tr><td>Snapshot</td><td>{{.Report.Header.Time}}{{range .Report.Header.Tags}} #{{.}}{{end}}</td></tr>
+<tr><td>Started</td><td>{{.Report.Start.Format "2006-01-02 15:04:05"}}</td></tr>
+<tr><td>Took</td><td>{{.Duration}}</td></tr>
+<tr><td>Files</td><td>{{.Report.Files}} ({{.Size}})</td></tr>
+<tr><td>Uploaded</td><td>{{.Report.Uploaded}} chunks ({{.UploadedBytes}} compressed)</td></tr>
+</table>
+
+<h2>Changes</h2>
+{{if .Changes}}{{range .Changes}}<h3>{{.Title}}</h3>
+{{if .Paths}}<ul>
+{{range .Paths}}<li>{{.}}</li>
+{{end}}</ul>
+{{if .More}}<p>and {{.More}} more</p>
+{{end}}{{else}}<p>none</p>
+{{end}}{{end}}{{else}}<p>This is the first backup of this folder on this machine.</p>
+{{end}}
+{{if .Skipped}}<h2>Errors</h2>
+{{range .Skipped}}<h3>{{.Reason}} ({{len .Paths}})</h3>
+<ul>
+{{range .Paths}}<li>{{.}}</li>
+{{end}}</ul>
+{{end}}{{end}}
+</body>
+</html>
+`))
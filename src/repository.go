@@ -0,0 +1,23 @@
+package main
+
+import "strings"
+
+// prepended to every object key, "" or ending with "/", like "backups/office-nas/"
+var repositoryPrefix string
+
+// clean up repositoryPrefix from config: no leading slash, one trailing slash
+func normalizeRepositoryPrefix(prefix string) string {
+	prefix = strings.Trim(prefix, "/")
+	if prefix == "" {
+		return ""
+	}
+	return prefix + "/"
+}
+
+/*
+ * object key in the bucket of a key used by this tool, like a chunk key in the index.
+ * keys in the index and the cache never include the prefix, so a repository can be moved by renaming objects.
+ */
+func objectKey(key string) string {
+	return repositoryPrefix + key
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// whether dir is on a case-insensitive file system, like NTFS or APFS by default
+func isCaseInsensitiveDir(dir string) bool {
+	if err := os.MkdirAll(longPath(dir), 0755); err != nil {
+		return false
+	}
+
+	probe, err := ioutil.TempFile(longPath(dir), specialFilePrefix+"case")
+	if err != nil {
+		return false
+	}
+	probe.Close()
+	defer os.Remove(probe.Name())
+
+	upperName := filepath.Join(filepath.Dir(probe.Name()), strings.ToUpper(filepath.Base(probe.Name())))
+	_, err = os.Stat(upperName)
+	return err == nil
+}
+
+/*
+ * index entries which would land on the same file of a case-insensitive file system, like "a.txt" and "A.txt".
+ * the first one keeps its name, the others are renamed or skipped according to restore.caseCollision.
+ */
+type caseCollisions struct {
+	policy   string
+	counts   map[string]int  // lower case path -> entries
+	taken    map[string]bool // lower case paths already restored
+	renamed  []string
+	skipped  []string
+	disabled bool
+}
+
+func newCaseCollisions(conf *userConfig, restoreToPath string) *caseCollisions {
+	c := &caseCollisions{
+		policy: conf.Restore.CaseCollision,
+		counts: make(map[string]int),
+		taken:  make(map[string]bool),
+	}
+	c.disabled = !isCaseInsensitiveDir(restoreToPath)
+	return c
+}
+
+// first pass over the index
+func (c *caseCollisions) add(line *fileInfo) {
+	if c.disabled {
+		return
+	}
+	c.counts[strings.ToLower(line.Path)]++
+}
+
+// second pass: the path to restore an entry to, ok is false if it should be skipped
+func (c *caseCollisions) resolve(line *fileInfo) (restorePath string, ok bool) {
+	lowerPath := strings.ToLower(line.Path)
+	if c.disabled || c.counts[lowerPath] < 2 {
+		return line.Path, true
+	}
+
+	if !c.taken[lowerPath] {
+		c.taken[lowerPath] = true
+		return line.Path, true
+	}
+
+	if c.policy == "skip" {
+		c.skipped = append(c.skipped, line.Path)
+		return "", false
+	}
+
+	// "name (2).ext", a number no other entry uses
+	ext := path.Ext(line.Path)
+	base := strings.TrimSuffix(line.Path, ext)
+	for i := 2; ; i++ {
+		restorePath = base + " (" + strconv.Itoa(i) + ")" + ext
+		lowerRestorePath := strings.ToLower(restorePath)
+		if c.counts[lowerRestorePath] == 0 && !c.taken[lowerRestorePath] {
+			c.taken[lowerRestorePath] = true
+			c.renamed = append(c.renamed, line.Path+" -> "+restorePath)
+			return restorePath, true
+		}
+	}
+}
+
+func (c *caseCollisions) report() {
+	if len(c.renamed) > 0 {
+		printMsg("caseRenamed", len(c.renamed))
+		for _, line := range c.renamed {
+			fmt.Println("  " + line)
+		}
+	}
+	if len(c.skipped) > 0 {
+		printMsg("caseSkipped", len(c.skipped))
+		for _, line := range c.skipped {
+			fmt.Println("  " + line)
+		}
+	}
+}
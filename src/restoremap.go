@@ -0,0 +1,93 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"strings"
+)
+
+// a -map rule, files whose original path is below from are restored below to
+type pathMapping struct {
+	from string // with forward slashes and no trailing one
+	to   string
+}
+
+/*
+ * the -map rules of a restore, like -map 'D:\NAS-HOME=/mnt/tank/home'.
+ * original paths are the fileRootPath recorded in the snapshot joined with the path of an entry,
+ * rules are tried in the order given and the first one matching wins.
+ */
+type pathMappings []pathMapping
+
+func (m *pathMappings) String() string {
+	var rules []string
+	for _, rule := range *m {
+		rules = append(rules, rule.from+"="+rule.to)
+	}
+	return strings.Join(rules, ",")
+}
+
+func (m *pathMappings) Set(value string) error {
+	i := strings.Index(value, "=")
+	if i <= 0 || i == len(value)-1 {
+		return errors.New("a mapping looks like /old/prefix=/new/prefix")
+	}
+
+	from := strings.TrimRight(strings.ReplaceAll(value[:i], "\\", "/"), "/")
+	if from == "" {
+		// the file system root
+		from = "/"
+	}
+	*m = append(*m, pathMapping{from: from, to: value[i+1:]})
+	return nil
+}
+
+// windows paths, like those recorded on another machine, are compared case-insensitively
+func isWindowsPath(path string) bool {
+	return (len(path) >= 2 && path[1] == ':') || strings.HasPrefix(path, "//")
+}
+
+// the original path of an entry, with forward slashes
+func originalPath(rootPath string, entryPath string) string {
+	return strings.TrimRight(strings.ReplaceAll(rootPath, "\\", "/"), "/") + "/" + entryPath
+}
+
+// the local path an entry is restored to, ok is false if no rule matches
+func (m pathMappings) destination(rootPath string, entryPath string) (string, bool) {
+	original := originalPath(rootPath, entryPath)
+
+	for _, rule := range m {
+		if rule.from == "/" {
+			return filepath.Join(rule.to, filepath.FromSlash(original)), true
+		}
+		if len(original) < len(rule.from) || (len(original) > len(rule.from) && original[len(rule.from)] != '/') {
+			continue
+		}
+
+		prefix := original[:len(rule.from)]
+		if prefix == rule.from || (isWindowsPath(rule.from) && strings.EqualFold(prefix, rule.from)) {
+			return filepath.Join(rule.to, filepath.FromSlash(original[len(rule.from):])), true
+		}
+	}
+	return "", false
+}
+
+// the rules of a restore and the fileRootPath of the snapshot they apply to
+type restoreMappings struct {
+	rootPath string
+	rules    pathMappings
+	skipped  int // entries no rule matched, when there is nowhere else to restore them
+}
+
+func (m *restoreMappings) destination(entryPath string) (string, bool) {
+	if m == nil {
+		return "", false
+	}
+	return m.rules.destination(m.rootPath, entryPath)
+}
+
+func (m *restoreMappings) report() {
+	if m != nil && m.skipped > 0 {
+		printMsg("unmappedFiles", m.skipped, m.rootPath)
+	}
+}
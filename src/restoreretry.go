@@ -0,0 +1,96 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/aliyun/aliyun-oss-go-sdk/oss"
+)
+
+/*
+ * whether a failed download may succeed when tried again.
+ * errors of local files, like a file which already exists, and answers of OSS like a missing chunk
+ * or one in Archive storage which is not restored yet, do not change by retrying.
+ */
+func isTransientDownloadError(err error) bool {
+	var pathErr *os.PathError
+	if errors.As(err, &pathErr) || errors.Is(err, errDiskFull) {
+		return false
+	}
+
+	var serviceErr oss.ServiceError
+	if errors.As(err, &serviceErr) {
+		return serviceErr.StatusCode >= 500 || isThrottlingError(err)
+	}
+
+	// network errors, and chunks cut short on the way
+	return true
+}
+
+// restore a file, retrying transient errors up to retries times with backoff
+func downloadWithRetry(p *downloadFileParams, retries int) (localLocation string, size int64, err error) {
+	for attempt := 0; ; attempt++ {
+		localLocation, size, err = downloadCompressedFile(p)
+		if err == nil || attempt >= retries || !isTransientDownloadError(err) {
+			return localLocation, size, err
+		}
+
+		printMsg("retryingDownload", p.localLocation, err)
+		time.Sleep(time.Duration((attempt+1)*(attempt+1)) * time.Second)
+	}
+}
+
+// files a restore gave up on, by reason
+type restoreFailures struct {
+	mutex    sync.Mutex
+	byReason map[string][]string
+}
+
+func (f *restoreFailures) add(path string, err error) {
+	reason := err.Error()
+	if os.IsExist(err) {
+		reason = "file already exists"
+	} else if os.IsPermission(err) {
+		reason = "permission denied"
+	}
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.byReason == nil {
+		f.byReason = make(map[string][]string)
+	}
+	f.byReason[reason] = append(f.byReason[reason], path)
+}
+
+// list the failed files grouped by reason, and return how many there were
+func (f *restoreFailures) report() int {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	count := 0
+	reasons := make([]string, 0, len(f.byReason))
+	for reason, paths := range f.byReason {
+		reasons = append(reasons, reason)
+		count += len(paths)
+	}
+	if count == 0 {
+		return 0
+	}
+	sort.Strings(reasons)
+
+	printMsg("filesNotRestored", count)
+	for _, reason := range reasons {
+		paths := f.byReason[reason]
+		sort.Strings(paths)
+
+		fmt.Printf("  %s (%d):\n", reason, len(paths))
+		for _, path := range paths {
+			fmt.Printf("    %s\n", path)
+		}
+	}
+	return count
+}
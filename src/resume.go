@@ -0,0 +1,107 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/aliyun/aliyun-oss-go-sdk/oss"
+)
+
+// connections dropped without receiving anything before a resumable download gives up
+const maxResumeStalls = 3
+
+// one download per chunk at a time, identical files of a restore share the partial file
+var resumeLocks sync.Map
+
+/*
+ * where the partly downloaded chunk at key is kept between attempts, also across restores.
+ * chunks never change, so whatever is in the file is a valid beginning of the chunk.
+ */
+func resumeFilePath(key string) string {
+	name := strings.ReplaceAll(key, "/", "_")
+	if digest, ok := parseChunkDigest(key); ok {
+		name = fmt.Sprintf("%x", digest[:16])
+	}
+	return filepath.Join(stagingDir(), "ossDownResume-"+name)
+}
+
+func lockResume(key string) func() {
+	value, _ := resumeLocks.LoadOrStore(key, &sync.Mutex{})
+	mutex := value.(*sync.Mutex)
+	mutex.Lock()
+	return mutex.Unlock
+}
+
+func objectSize(bucket *oss.Bucket, key string) (int64, error) {
+	meta, err := bucket.GetObjectMeta(key)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(meta.Get("Content-Length"), 10, 64)
+}
+
+/*
+ * download the object at key into filePath with ranged GETs, continuing after what the file already holds.
+ * a dropped connection resumes at the byte it stopped at, so a large chunk is not fetched from the start again.
+ */
+func getObjectResumable(bucket *oss.Bucket, key string, filePath string) error {
+	size, err := objectSize(bucket, key)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(filePath, os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	offset, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	if offset > size {
+		// not of this object
+		if err := f.Truncate(0); err != nil {
+			return err
+		}
+		if offset, err = f.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+	}
+	if offset > 0 {
+		printMsg("resumingDownload", key, formatFileSize(offset), formatFileSize(size))
+	}
+
+	stalls := 0
+	for offset < size {
+		body, err := bucket.GetObject(key, oss.Range(offset, size-1))
+		if err != nil {
+			return err
+		}
+
+		n, err := pooledCopy(f, &limitedReader{reader: body, limiter: downloadLimiter})
+		body.Close()
+		offset += n
+
+		if err == nil && offset < size {
+			err = errors.New("connection closed early")
+		}
+		if err != nil {
+			if n == 0 {
+				stalls++
+			}
+			if stalls >= maxResumeStalls {
+				return err
+			}
+			printMsg("downloadInterrupted", key, formatFileSize(offset), formatFileSize(size), err)
+		}
+	}
+	return nil
+}
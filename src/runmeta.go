@@ -0,0 +1,75 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"runtime"
+	"strconv"
+	"time"
+)
+
+// how and by what a snapshot was taken, recorded in its index header before it is uploaded
+type snapshotRun struct {
+	Version    string // of ossBackup
+	Hostname   string // of the machine, Host of the snapshot may be set by hostname in config
+	Platform   string // like linux/amd64
+	ConfigHash string // sha256 of the config in effect with secrets left out, equal for snapshots taken alike
+
+	Started      time.Time
+	ScanDuration time.Duration // walking and hashing
+	Duration     time.Duration // until all chunks were uploaded
+
+	Files         int32
+	Size          int64
+	Hashed        int   // files read since they were not in the cache
+	Uploaded      int32 // chunks
+	UploadedBytes int64 // compressed
+	Deferred      int   // files left for the next sync by maxUploadBytes
+	Skipped       int   // files which could not be read
+}
+
+/*
+ * hash of the config in effect, including flags overriding it. secrets are left out,
+ * so the hash can be kept with the snapshot without telling anything about them.
+ */
+func configHash(conf *userConfig) string {
+	c := *conf
+	c.Oss.OssKey, c.Oss.OssSecret = "", ""
+	c.Index.SigningKey, c.Index.Ed25519PrivateKey = "", ""
+	c.Serve.Token = ""
+	c.Share.Password = ""
+
+	content, _ := json.Marshal(c)
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
+
+// the run of a sync which started at startTime and scanned until scanEnd, with the index at indexPath
+func newSnapshotRun(conf *userConfig, pipeline *syncPipeline, indexPath string, startTime time.Time, scanEnd time.Time) *snapshotRun {
+	hostname, _ := os.Hostname()
+	hashed, _ := strconv.Atoi(getCacheMeta("lastChangedFiles"))
+	run := &snapshotRun{
+		Version:       version,
+		Hostname:      hostname,
+		Platform:      runtime.GOOS + "/" + runtime.GOARCH,
+		ConfigHash:    configHash(conf),
+		Started:       startTime,
+		ScanDuration:  scanEnd.Sub(startTime),
+		Duration:      time.Since(startTime),
+		Hashed:        hashed,
+		Uploaded:      pipeline.uploaded,
+		UploadedBytes: pipeline.uploadedBytes,
+		Deferred:      pipeline.deferred,
+		Skipped:       pipeline.skipped,
+	}
+	run.Files, run.Size = indexStats(indexPath, "")
+	return run
+}
+
+func (r *snapshotRun) String() string {
+	return fmt.Sprintf("taken by ossBackup %s on %s (%s) at %s in %s, config %s",
+		r.Version, r.Hostname, r.Platform, r.Started.Format(time.RFC3339), r.Duration.Round(time.Second), r.ConfigHash[:12])
+}
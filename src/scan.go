@@ -0,0 +1,296 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type hashJob struct {
+	fullPath string
+	info     fileInfo
+	unstable bool // changed while being hashed, not cached
+	err      error
+	group    *localCopies // nil for files too small to look for local copies, or without quickHash
+}
+
+// cache misses at least this large are grouped with local copies, smaller ones are hashed right away
+const minLocalCopySize = 16 * 1024 * 1024
+
+/*
+ * cache misses with the same size, mtime and quick hash, like hard links and copies made with their mtime kept.
+ * only the first one is read in full, the others take its chunk key, with the same trust as moved files in lookupMovedFile,
+ * so like them only with quickHash enabled.
+ */
+type localCopies struct {
+	waiting  []*hashJob // copies found while the first one is being hashed
+	chunkKey string     // once the first one is hashed
+}
+
+/*
+ * writes index entries and cache rows for scanned files.
+ * cache lookups, cache writes and the index writer are only touched by the goroutine calling processFile,
+ * cache misses are hashed by a pool of workers and their results are written back by that same goroutine.
+ */
+type indexScanner struct {
+	conf        *userConfig
+	basePath    string // absolute fileRootPath, or inside the snapshot
+	trx         *cacheTx
+	writer      *bufio.Writer
+	pipeline    *syncPipeline
+	hashJobs    chan *hashJob
+	hashResults chan *hashJob
+	pending     int // hash jobs not written yet
+	hashed      int // files not found in cache
+	placeholder int // cloud placeholders recorded without content
+	filters     filterPlugins
+	copies      map[string]*localCopies
+}
+
+func newIndexScanner(conf *userConfig, writer *bufio.Writer, pipeline *syncPipeline) *indexScanner {
+	trx, err := beginCacheTx()
+	checkErr(err)
+
+	basePath := sourceRootPath(conf)
+
+	s := &indexScanner{
+		conf:        conf,
+		basePath:    basePath,
+		trx:         trx,
+		writer:      writer,
+		pipeline:    pipeline,
+		hashJobs:    make(chan *hashJob),
+		hashResults: make(chan *hashJob, conf.Concurrency.Hash),
+		filters:     startFilterPlugins(conf),
+		copies:      make(map[string]*localCopies),
+	}
+
+	for i := 0; i < conf.Concurrency.Hash; i++ {
+		go s.hashWorker()
+	}
+
+	return s
+}
+
+func (s *indexScanner) hashWorker() {
+	for job := range s.hashJobs {
+		var stable bool
+		job.err = catchPanic(func() (err error) {
+			job.info.ChunkKey, stable, err = hashStableFile(job.fullPath, &job.info)
+			return
+		})
+		job.info.hashTime = time.Now().UnixNano()
+		job.unstable = job.err == nil && !stable
+		s.hashResults <- job
+	}
+}
+
+func (s *indexScanner) processFile(fullPath string) {
+	// the files found so far are uploaded, but no snapshot is made
+	if stopping() {
+		return
+	}
+
+	fileName := filepath.Base(fullPath)
+
+	// ignore cache and lock files, including sqlite journals
+	if strings.HasPrefix(fileName, specialFilePrefix) {
+		return
+	}
+
+	diskPath := relativeSlashPath(s.basePath, fullPath)
+	relativePath := normalizePath(diskPath)
+
+	if !s.filters.includes(relativePath) {
+		return
+	}
+
+	waitScanOp()
+	info, err := statFileInfo(fullPath, relativePath)
+	if err != nil {
+		s.writeEntry(&fileInfo{Path: relativePath}, false, err)
+		return
+	}
+	if diskPath != relativePath {
+		info.localPath = fullPath
+	}
+
+	// nothing to hash, cache or upload, special files are never read
+	if info.Size == 0 || info.Type != "" {
+		info.ChunkKey = emptyFileChunkKey
+		s.writeEntry(&info, true, nil)
+		return
+	}
+
+	// the content was backed up while it was on disk, or is never read
+	if info.placeholder && recordCloudPlaceholders(s.conf) {
+		if !lookupHashCache(&info, s.trx) {
+			info.Type = specialFilePlaceholder
+			info.ChunkKey = emptyFileChunkKey
+			s.placeholder++
+		}
+		s.writeEntry(&info, true, nil)
+		return
+	}
+
+	if lookupHashCache(&info, s.trx) {
+		if s.conf.QuickHash {
+			fillMissingQuickHash(&info, fullPath, s.trx)
+		}
+		s.writeEntry(&info, true, nil)
+		return
+	}
+
+	// moved or renamed, known under another path
+	if s.conf.QuickHash && lookupMovedFile(&info, fullPath, s.trx) {
+		s.writeEntry(&info, false, nil)
+		return
+	}
+
+	job := &hashJob{fullPath: fullPath, info: info}
+	if s.conf.QuickHash && info.Size >= minLocalCopySize {
+		if group := s.localCopiesOf(job); group != nil {
+			if group.chunkKey != "" {
+				job.info.ChunkKey = group.chunkKey
+				s.writeEntry(&job.info, false, nil)
+			} else {
+				group.waiting = append(group.waiting, job)
+			}
+			return
+		}
+	}
+	s.dispatch(job)
+}
+
+/*
+ * the group of local copies job belongs to, nil if it is the first of its group, which then becomes job.group.
+ * files whose quick hash cannot be read are hashed on their own.
+ */
+func (s *indexScanner) localCopiesOf(job *hashJob) *localCopies {
+	if job.info.quickHash == "" {
+		quickHash, err := quickHashFile(job.fullPath, job.info.Size)
+		if err != nil {
+			return nil
+		}
+		job.info.quickHash = quickHash
+	}
+
+	key := strconv.FormatInt(job.info.Size, 10) + " " + strconv.FormatInt(job.info.ModTime, 10) + " " + job.info.quickHash
+	if group, ok := s.copies[key]; ok {
+		return group
+	}
+	job.group = &localCopies{}
+	s.copies[key] = job.group
+	return nil
+}
+
+// hand over to hash workers, writing finished results while waiting for a free one
+func (s *indexScanner) dispatch(job *hashJob) {
+	s.pending++
+
+	for {
+		select {
+		case s.hashJobs <- job:
+			return
+		case result := <-s.hashResults:
+			s.writeResult(result)
+		}
+	}
+}
+
+func (s *indexScanner) writeResult(result *hashJob) {
+	s.pending--
+	s.hashed++
+
+	if result.unstable {
+		recordUnstableFile(result.info.Path)
+	}
+
+	// unstable files are written without a cache entry, so they are hashed again next time
+	s.writeEntry(&result.info, result.unstable, result.err)
+
+	if group := result.group; group != nil {
+		waiting := group.waiting
+		group.waiting = nil
+		if result.err == nil && !result.unstable {
+			group.chunkKey = result.info.ChunkKey
+		}
+
+		for _, job := range waiting {
+			if group.chunkKey != "" {
+				job.info.ChunkKey = group.chunkKey
+				s.writeEntry(&job.info, false, nil)
+			} else {
+				// the first copy could not be read or kept changing, the others are read on their own
+				s.dispatch(job)
+			}
+		}
+	}
+}
+
+func (s *indexScanner) writeEntry(hashInfo *fileInfo, fromCache bool, err error) {
+	fileCounter++
+
+	if err != nil {
+		// if some file could not be processed, just ignore it :)
+		// they are listed together at the end of the sync
+		recordSkippedFile(hashInfo.Path, err)
+		return
+	}
+
+	if logLevel == 0 || !fromCache || fileCounter%500 == 0 {
+		fmt.Printf("[%d] %s\n", fileCounter, hashInfo.Path)
+	}
+
+	// left out when the upload limit of the sync is reached, still cached so it is not hashed again.
+	// its previous version is added back after the scan, see restoreDeferredEntries
+	if s.pipeline == nil || s.pipeline.admits(hashInfo) {
+		jsonRow, _ := json.Marshal(hashInfo)
+		s.writer.Write(jsonRow)
+		s.writer.WriteString("\n")
+
+		if s.pipeline != nil {
+			s.pipeline.submit(hashInfo, fromCache)
+		}
+	}
+
+	// add to cache
+	if !fromCache {
+		_, err = s.trx.insert.Exec(hashInfo.Path, hashInfo.ModTime, hashInfo.Size, hashInfo.ChunkKey, time.Now().UnixNano(), int64(hashInfo.inode), hashInfo.changeTime, hashInfo.quickHash, hashInfo.hashTime)
+		checkErr(err)
+	}
+}
+
+// write buffered entries and commit the cache, so an interrupted scan keeps its progress
+func (s *indexScanner) flush() {
+	s.writer.Flush()
+	checkErr(s.trx.Commit())
+
+	var err error
+	s.trx, err = beginCacheTx()
+	checkErr(err)
+}
+
+// wait for all hash jobs and commit everything
+func (s *indexScanner) finish() {
+	// copies of a file which failed are still dispatched while results are written
+	for s.pending > 0 {
+		s.writeResult(<-s.hashResults)
+	}
+	close(s.hashJobs)
+	s.filters.stop()
+
+	s.writer.Flush()
+	checkErr(s.trx.Commit())
+
+	if s.placeholder > 0 {
+		printMsg("placeholdersFound", s.placeholder)
+	}
+
+	// used to guess how much will change next time
+	checkErr(setCacheMeta("lastChangedFiles", strconv.Itoa(s.hashed)))
+}
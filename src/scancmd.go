@@ -0,0 +1,75 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+)
+
+/*
+ * `ossBackup scan`, index fileRootPath like a sync does, refreshing the cache, without contacting OSS at all.
+ * it prints what changed since the last snapshot of this machine and how much of the data would be uploaded,
+ * judged by the chunk list cached by the last sync and the chunks of the last snapshot. nothing is kept but the cache,
+ * so a sync afterwards only hashes files changed since the scan.
+ */
+func runScan(args []string) {
+	var configFileName string
+	flags := flag.NewFlagSet("scan", flag.ExitOnError)
+	flags.StringVar(&configFileName, "c", "", "the name of config file")
+	flags.IntVar(&limitScanOpsFlag, "limit-scan-ops", 0, "max file system operations per second while scanning, to spare a file server (overrides config)")
+	flags.BoolVar(&lowPriorityFlag, "low-priority", false, "run with low CPU and disk I/O priority")
+	flags.Parse(args)
+
+	conf := getConfig(configFileName)
+	initCache(&conf)
+	applyBandwidthLimits(&conf)
+	applyPriority(&conf)
+
+	// only the local lock, the bucket is never touched
+	localConf := conf
+	localConf.Oss.UseLockObject = false
+	lock, err := acquireSyncLock(&localConf, nil, false)
+	checkErr(err)
+	defer lock.release()
+
+	share, err := connectShare(&conf)
+	checkErr(err)
+	defer share.release()
+
+	indexPath := makeDirIndex(&conf, nil)
+	defer os.Remove(indexPath)
+	reportIndexChanges(&conf, indexPath)
+
+	// chunks known to be in the bucket already
+	prevPath := cacheFilePath(&conf, ".index.dat")
+	known := newChunkSet()
+	if getCacheMeta("chunkListTime") != "" {
+		loadOnlineChunkListFromCache()
+		known = onlineChunksSet
+	}
+	if _, err := os.Stat(prevPath); err == nil {
+		scanFileJSONLines(prevPath, func(line *fileInfo) {
+			known.add(line.ChunkKey)
+		})
+	}
+
+	var files, newFiles int
+	var size, newSize int64
+	scanFileJSONLines(indexPath, func(line *fileInfo) {
+		files++
+		size += line.Size
+		if line.ChunkKey == emptyFileChunkKey || known.contains(line.ChunkKey) {
+			return
+		}
+		// copies of a new file are uploaded once
+		known.add(line.ChunkKey)
+		newFiles++
+		newSize += line.Size
+	})
+
+	fmt.Printf("[Scan] %d files (%s), %d of them with content not backed up yet (%s before compression)\n",
+		files, formatFileSize(size), newFiles, formatFileSize(newSize))
+	if skipped, _ := reportSkippedFiles(); skipped > 0 {
+		os.Exit(exitFilesSkipped)
+	}
+}
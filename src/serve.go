@@ -0,0 +1,259 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// runs kept for GET /api/status
+const maxAPIRunHistory = 50
+
+type serveConfig struct {
+	Listen     string // address of the API server, like 127.0.0.1:8765
+	GrpcListen string // address of the gRPC interface, see proto/ossbackup.proto, "" serves none
+	Token      string // required as "Authorization: Bearer <token>" by every request
+}
+
+// a sync or restore started by the API
+type apiRun struct {
+	ID      int
+	Kind    string // sync or restore
+	Start   time.Time
+	End     *time.Time `json:",omitempty"`
+	Running bool
+	Failed  int    // files which could not be read or restored
+	Error   string `json:",omitempty"`
+}
+
+type apiServer struct {
+	configFileName string
+	conf           userConfig
+
+	mutex   sync.Mutex
+	nextID  int
+	current *apiRun
+	history []apiRun // newest first
+}
+
+/*
+ * start fn in the background unless a sync or restore is running already, which shares daemonSyncRunning with the daemon.
+ * a panic of fn ends the run with its error instead of the server.
+ */
+func (s *apiServer) start(kind string, fn func() int) (*apiRun, bool) {
+	if !atomic.CompareAndSwapInt32(&daemonSyncRunning, 0, 1) {
+		return nil, false
+	}
+	atomic.StoreInt32(&stopRequested, 0)
+
+	s.mutex.Lock()
+	s.nextID++
+	run := &apiRun{ID: s.nextID, Kind: kind, Start: time.Now(), Running: true}
+	s.current = run
+	started := *run
+	s.mutex.Unlock()
+
+	go func() {
+		defer atomic.StoreInt32(&daemonSyncRunning, 0)
+
+		var failed int
+		var runErr string
+		func() {
+			defer func() {
+				if err := recover(); err != nil {
+					runErr = fmt.Sprint(err)
+					fmt.Printf("[Serve] %s %d failed: %v\n", kind, run.ID, err)
+				}
+			}()
+			failed = fn()
+		}()
+		if runErr == "" && stopping() {
+			runErr = "stopped"
+		}
+
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		end := time.Now()
+		run.End, run.Running, run.Failed, run.Error = &end, false, failed, runErr
+		s.current = nil
+		finishProgress(runErr)
+		s.history = append([]apiRun{*run}, s.history...)
+		if len(s.history) > maxAPIRunHistory {
+			s.history = s.history[:maxAPIRunHistory]
+		}
+	}()
+
+	return &started, true
+}
+
+func writeJSON(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(value)
+}
+
+func writeAPIError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
+
+func (s *apiServer) authorized(r *http.Request) bool {
+	expected := "Bearer " + s.conf.Serve.Token
+	return subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte(expected)) == 1
+}
+
+// check the token and the method before handler, errors it panics with are answered like any other
+func (s *apiServer) handle(method string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			if err := recover(); err != nil {
+				fmt.Printf("[Serve] %s %s failed: %v\n", r.Method, r.URL.Path, err)
+				writeAPIError(w, http.StatusInternalServerError, fmt.Sprint(err))
+			}
+		}()
+
+		if !s.authorized(r) {
+			writeAPIError(w, http.StatusUnauthorized, "missing or wrong token")
+			return
+		}
+		if r.Method != method {
+			writeAPIError(w, http.StatusMethodNotAllowed, "use "+method)
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// GET /api/status, the running sync or restore and the ones before it, and the last checks
+func (s *apiServer) handleStatus(w http.ResponseWriter, r *http.Request) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var current *apiRun
+	if s.current != nil {
+		running := *s.current
+		current = &running
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"current": current, "history": s.history, "verify": verifyResults()})
+}
+
+// the outcomes of the last check and audit-local kept in the cache, by whoever ran them
+func verifyResults() map[string]json.RawMessage {
+	results := make(map[string]json.RawMessage)
+	for _, name := range []string{"lastCheck", "lastAuditLocal"} {
+		if value := getCacheMeta(name); value != "" {
+			results[name] = json.RawMessage(value)
+		}
+	}
+	return results
+}
+
+// POST /api/sync
+func (s *apiServer) handleSync(w http.ResponseWriter, r *http.Request) {
+	run, ok := s.start("sync", func() int { return fullSync(s.configFileName, false) })
+	if !ok {
+		writeAPIError(w, http.StatusConflict, "a sync or restore is running")
+		return
+	}
+	writeJSON(w, http.StatusAccepted, run)
+}
+
+// GET /api/snapshots, filtered by ?host= and ?tag=
+func (s *apiServer) handleSnapshots(w http.ResponseWriter, r *http.Request) {
+	_, bucket, err := getOSSClient(&s.conf)
+	if err != nil {
+		writeAPIError(w, http.StatusBadGateway, err.Error())
+		return
+	}
+
+	host, tag := r.URL.Query().Get("host"), r.URL.Query().Get("tag")
+	snapshots := []snapshotInfo{}
+	for _, snapshot := range listSnapshots(bucket) {
+		if (host == "" || snapshot.Host == host) && (tag == "" || snapshot.hasTag(tag)) {
+			snapshots = append(snapshots, snapshot)
+		}
+	}
+	writeJSON(w, http.StatusOK, snapshots)
+}
+
+// the body of POST /api/restore, like the options of a restore on the command line
+type apiRestoreRequest struct {
+	Time string   // -t
+	Path string   // -p, "" restores to the original path, which OriginalPath has to confirm
+	Only string   // -only
+	Map  []string // -map
+	// restore to the path the snapshot was taken of, overwriting nothing but needing no -p
+	OriginalPath bool
+}
+
+// POST /api/restore
+func (s *apiServer) handleRestore(w http.ResponseWriter, r *http.Request) {
+	var request apiRestoreRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		writeAPIError(w, http.StatusBadRequest, "invalid request: "+err.Error())
+		return
+	}
+	if request.Time == "" || (request.Path == "" && !request.OriginalPath) {
+		writeAPIError(w, http.StatusBadRequest, "Time and either Path or OriginalPath are required")
+		return
+	}
+
+	var mappings pathMappings
+	for _, rule := range request.Map {
+		if err := mappings.Set(rule); err != nil {
+			writeAPIError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+
+	run, ok := s.start("restore", func() int {
+		return restoreFiles(s.configFileName, request.Path, request.Time, request.Only, true, mappings)
+	})
+	if !ok {
+		writeAPIError(w, http.StatusConflict, "a sync or restore is running")
+		return
+	}
+	writeJSON(w, http.StatusAccepted, run)
+}
+
+/*
+ * `ossBackup serve`, a dashboard at / and an HTTP API for NAS web interfaces and home automation:
+ * GET /api/status, POST /api/sync, GET /api/snapshots, POST /api/restore and GET /api/usage.
+ * with serve.grpcListen the same operations, Stop and WatchProgress are served over gRPC as well.
+ * one sync or restore runs at a time, every API request needs serve.token.
+ */
+func runServe(args []string) {
+	var configFileName string
+	flags := flag.NewFlagSet("serve", flag.ExitOnError)
+	flags.StringVar(&configFileName, "c", "", "the name of config file")
+	flags.Parse(args)
+
+	conf := getConfig(configFileName)
+	if conf.Serve.Token == "" {
+		checkErr(errors.New("serve.token is required, anyone reaching serve.listen could restore files otherwise"))
+	}
+
+	// opened once here, initCache is not safe to call from handlers while a sync runs
+	initCache(&conf)
+
+	server := &apiServer{configFileName: configFileName, conf: conf}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/status", server.handle(http.MethodGet, server.handleStatus))
+	mux.HandleFunc("/api/sync", server.handle(http.MethodPost, server.handleSync))
+	mux.HandleFunc("/api/snapshots", server.handle(http.MethodGet, server.handleSnapshots))
+	mux.HandleFunc("/api/restore", server.handle(http.MethodPost, server.handleRestore))
+	mux.HandleFunc("/api/usage", server.handle(http.MethodGet, server.handleUsage))
+	mux.HandleFunc("/", handleDashboard)
+
+	if conf.Serve.GrpcListen != "" {
+		go serveGRPC(server, conf.Serve.GrpcListen)
+	}
+
+	fmt.Printf("[Serve] Listening on %s\n", conf.Serve.Listen)
+	checkErr(http.ListenAndServe(conf.Serve.Listen, mux))
+}
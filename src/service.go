@@ -0,0 +1,47 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+)
+
+const serviceName = "ossBackup"
+
+type serviceOptions struct {
+	exePath        string
+	configFileName string
+	workDir        string
+	user           string
+}
+
+// register `ossBackup daemon` as a system service and start it
+func runInstallService(args []string) {
+	var opts serviceOptions
+	flags := flag.NewFlagSet("install-service", flag.ExitOnError)
+	flags.StringVar(&opts.configFileName, "c", "", "the name of config file")
+	flags.StringVar(&opts.user, "u", defaultServiceUser, "the account to run the service as")
+	flags.Parse(args)
+
+	// make sure the config is usable before registering anything
+	getConfig(opts.configFileName)
+
+	var err error
+	opts.exePath, err = os.Executable()
+	checkErr(err)
+
+	// config is looked up in the working directory, so the service keeps using the current one
+	opts.workDir, err = os.Getwd()
+	checkErr(err)
+
+	checkErr(installService(&opts))
+	fmt.Printf("Service %s installed and started (running as %s)\n", serviceName, opts.user)
+}
+
+func runUninstallService(args []string) {
+	flags := flag.NewFlagSet("uninstall-service", flag.ExitOnError)
+	flags.Parse(args)
+
+	checkErr(uninstallService())
+	fmt.Printf("Service %s uninstalled\n", serviceName)
+}
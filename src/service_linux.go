@@ -0,0 +1,88 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strconv"
+)
+
+const defaultServiceUser = "ossbackup"
+const systemdUnitPath = "/etc/systemd/system/ossbackup.service"
+
+const systemdUnitTemplate = `[Unit]
+Description=Backup files to Aliyun OSS
+Wants=network-online.target
+After=network-online.target
+
+[Service]
+Type=simple
+User=%s
+WorkingDirectory=%s
+ExecStart=%s
+# /var/cache/ossbackup, owned by the service user, which has no home, see defaultCacheDir
+CacheDirectory=ossbackup
+CacheDirectoryMode=0700
+Restart=on-failure
+RestartSec=30
+
+[Install]
+WantedBy=multi-user.target
+`
+
+func installService(opts *serviceOptions) error {
+	if _, err := os.Stat(systemdUnitPath); err == nil {
+		return errors.New("service is already installed: " + systemdUnitPath)
+	}
+
+	// create the dedicated system account if needed
+	if exec.Command("id", "-u", opts.user).Run() != nil {
+		if err := runServiceCommand("useradd", "--system", "--no-create-home", "--shell", "/usr/sbin/nologin", opts.user); err != nil {
+			return err
+		}
+	}
+
+	execStart := strconv.Quote(opts.exePath) + " daemon"
+	if opts.configFileName != "" {
+		execStart += " -c " + strconv.Quote(opts.configFileName)
+	}
+
+	unit := fmt.Sprintf(systemdUnitTemplate, opts.user, opts.workDir, execStart)
+	if err := ioutil.WriteFile(systemdUnitPath, []byte(unit), 0644); err != nil {
+		return err
+	}
+
+	if err := runServiceCommand("systemctl", "daemon-reload"); err != nil {
+		return err
+	}
+	return runServiceCommand("systemctl", "enable", "--now", "ossbackup.service")
+}
+
+func uninstallService() error {
+	if _, err := os.Stat(systemdUnitPath); err != nil {
+		return errors.New("service is not installed")
+	}
+
+	if err := runServiceCommand("systemctl", "disable", "--now", "ossbackup.service"); err != nil {
+		return err
+	}
+	if err := os.Remove(systemdUnitPath); err != nil {
+		return err
+	}
+	return runServiceCommand("systemctl", "daemon-reload")
+}
+
+func runServiceCommand(name string, args ...string) error {
+	output, err := exec.Command(name, args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s failed: %v\n%s", name, err, output)
+	}
+	return nil
+}
+
+func runAsService(run func()) bool {
+	// systemd runs the daemon as a plain process
+	return false
+}
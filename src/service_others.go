@@ -0,0 +1,20 @@
+//go:build !linux && !windows
+// +build !linux,!windows
+
+package main
+
+import "errors"
+
+const defaultServiceUser = ""
+
+func installService(opts *serviceOptions) error {
+	return errors.New("services are not supported on this platform")
+}
+
+func uninstallService() error {
+	return errors.New("services are not supported on this platform")
+}
+
+func runAsService(run func()) bool {
+	return false
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"errors"
+	"time"
+
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+// virtual account only used by this service
+const defaultServiceUser = `NT SERVICE\` + serviceName
+
+func installService(opts *serviceOptions) error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+
+	if s, err := m.OpenService(serviceName); err == nil {
+		s.Close()
+		return errors.New("service " + serviceName + " is already installed")
+	}
+
+	args := []string{"daemon", "-w", opts.workDir}
+	if opts.configFileName != "" {
+		args = append(args, "-c", opts.configFileName)
+	}
+
+	s, err := m.CreateService(serviceName, opts.exePath, mgr.Config{
+		DisplayName:      "OSS Backup",
+		Description:      "Backup files to Aliyun OSS on schedule",
+		StartType:        mgr.StartAutomatic,
+		ServiceStartName: opts.user,
+	}, args...)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	// restart on failure, the failure counter is reset after one day
+	err = s.SetRecoveryActions([]mgr.RecoveryAction{
+		{Type: mgr.ServiceRestart, Delay: 30 * time.Second},
+		{Type: mgr.ServiceRestart, Delay: 5 * time.Minute},
+		{Type: mgr.ServiceRestart, Delay: 30 * time.Minute},
+	}, 24*60*60)
+	if err != nil {
+		return err
+	}
+
+	return s.Start()
+}
+
+func uninstallService() error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+
+	s, err := m.OpenService(serviceName)
+	if err != nil {
+		return errors.New("service " + serviceName + " is not installed")
+	}
+	defer s.Close()
+
+	// it may already be stopped
+	s.Control(svc.Stop)
+
+	return s.Delete()
+}
+
+type daemonService struct {
+	run func()
+}
+
+func (d *daemonService) Execute(args []string, r <-chan svc.ChangeRequest, s chan<- svc.Status) (bool, uint32) {
+	s <- svc.Status{State: svc.StartPending}
+	go d.run()
+	s <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+
+	for c := range r {
+		switch c.Cmd {
+		case svc.Interrogate:
+			s <- c.CurrentStatus
+		case svc.Stop, svc.Shutdown:
+			s <- svc.Status{State: svc.StopPending}
+			return false, 0
+		}
+	}
+
+	return false, 0
+}
+
+// run as a Windows service if started by the service control manager
+func runAsService(run func()) bool {
+	isService, err := svc.IsWindowsService()
+	if err != nil || !isService {
+		return false
+	}
+
+	checkErr(svc.Run(serviceName, &daemonService{run: run}))
+	return true
+}
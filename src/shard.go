@@ -0,0 +1,124 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/aliyun/aliyun-oss-go-sdk/oss"
+)
+
+/*
+ * chunks may be spread over several buckets, oss.chunkBuckets, by the first two hex characters of their digest,
+ * so no bucket holds more than its share of tens of millions of chunks and listings of them run side by side.
+ * the bucket of oss.bucketName keeps everything else: indexes, locks and the layout object, which records the
+ * chunk buckets so a changed list, which would send chunks to the wrong bucket, is refused.
+ */
+var chunkBuckets []*oss.Bucket
+
+// set by getOSSClient from oss.chunkBuckets
+var chunkBucketNames []string
+
+func checkChunkBuckets(names []string) error {
+	seen := make(map[string]bool)
+	for _, name := range names {
+		if name == "" || seen[name] {
+			return errors.New("oss.chunkBuckets should list distinct bucket names")
+		}
+		seen[name] = true
+	}
+	if len(names) > 256 {
+		return errors.New("oss.chunkBuckets lists " + strconv.Itoa(len(names)) + " buckets, at most 256 are supported")
+	}
+	return nil
+}
+
+func openChunkBuckets(client *oss.Client, names []string) error {
+	buckets := make([]*oss.Bucket, 0, len(names))
+	for _, name := range names {
+		bucket, err := client.Bucket(name)
+		if err != nil {
+			return err
+		}
+		buckets = append(buckets, bucket)
+	}
+	chunkBuckets, chunkBucketNames = buckets, names
+	return nil
+}
+
+// the bucket the chunk at key is kept in, bucket itself unless chunks are sharded
+func chunkBucket(bucket *oss.Bucket, key string) *oss.Bucket {
+	if len(chunkBuckets) == 0 {
+		return bucket
+	}
+	digest := strings.TrimPrefix(key, chunkKeyPrefix)
+	if len(digest) < 2 {
+		return chunkBuckets[0]
+	}
+	value, err := strconv.ParseUint(digest[:2], 16, 8)
+	if err != nil {
+		return chunkBuckets[0]
+	}
+	// ranges of the digest, so the buckets get about the same number of chunks
+	return chunkBuckets[int(value)*len(chunkBuckets)/256]
+}
+
+// the bucket of an object key, chunks may be in a chunk bucket
+func chunkBucketOfKey(bucket *oss.Bucket, key string) *oss.Bucket {
+	if strings.HasPrefix(key, chunkKeyPrefix) {
+		return chunkBucket(bucket, key)
+	}
+	return bucket
+}
+
+// list the chunk buckets side by side, fn is called for one chunk at a time
+func listShardedChunkObjects(fn func(key string, object oss.ObjectProperties)) {
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	errs := make([]error, len(chunkBuckets))
+	for i, bucket := range chunkBuckets {
+		wg.Add(1)
+		go func(i int, bucket *oss.Bucket) {
+			defer wg.Done()
+
+			marker := oss.Marker("")
+			for {
+				lsRes, err := bucket.ListObjects(oss.Prefix(objectKey(chunkKeyPrefix)), oss.MaxKeys(1000), marker)
+				if err != nil {
+					errs[i] = err
+					return
+				}
+				marker = oss.Marker(lsRes.NextMarker)
+
+				mutex.Lock()
+				for _, object := range lsRes.Objects {
+					fn(strings.TrimPrefix(object.Key, repositoryPrefix), object)
+				}
+				mutex.Unlock()
+
+				if !lsRes.IsTruncated {
+					return
+				}
+			}
+		}(i, bucket)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		checkErr(err)
+	}
+}
+
+// whether the chunk buckets of the config are the ones the repository was created with
+func sameChunkBuckets(layout repositoryLayout) error {
+	if strings.Join(layout.ChunkBuckets, ",") != strings.Join(chunkBucketNames, ",") {
+		recorded := "none"
+		if len(layout.ChunkBuckets) > 0 {
+			recorded = strings.Join(layout.ChunkBuckets, ", ")
+		}
+		return errors.New("oss.chunkBuckets does not match the chunk buckets of the repository (" + recorded +
+			"), chunks cannot be moved between buckets yet")
+	}
+	return nil
+}
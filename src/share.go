@@ -0,0 +1,111 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+)
+
+/*
+ * fileRootPath may be a network share, connected for each sync with the credentials in share and disconnected after:
+ * \\server\share\dir or //server/share/dir for SMB, server:/export/dir for NFS.
+ * on Windows SMB shares are read by their UNC path, on Linux and macOS shares are mounted below cacheDir,
+ * which needs root. index entries stay relative to fileRootPath, as with snapshots.
+ */
+type shareConfig struct {
+	Username     string // "" connects as the account running the sync, or as guest where mounted
+	Password     string
+	Domain       string
+	MountOptions string // more options of mount on Linux and macOS, like vers=3.0
+}
+
+const (
+	shareSMB = "smb"
+	shareNFS = "nfs"
+)
+
+// a connected share, nil if fileRootPath is local
+type networkShare struct {
+	kind      string
+	remote    string // //server/share for SMB, server:/export/dir for NFS
+	mountPath string // where it is mounted, "" if read by its UNC path
+	connected bool   // by mountShare, so it is disconnected again
+}
+
+var nfsPathPattern = regexp.MustCompile(`^([A-Za-z0-9._-]{2,}|\[[0-9A-Fa-f:]+\]):(/.*)$`)
+
+/*
+ * the kind of share of a network path, the share to connect and the path inside it.
+ * ok is false for local paths, drive letters are never taken for NFS hosts.
+ */
+func parseNetworkPath(rootPath string) (kind string, remote string, subPath string, ok bool) {
+	if strings.HasPrefix(rootPath, `\\`) || strings.HasPrefix(rootPath, "//") {
+		parts := strings.FieldsFunc(rootPath, func(r rune) bool { return r == '/' || r == '\\' })
+		if len(parts) < 2 || parts[0] == "?" || parts[0] == "." {
+			return "", "", "", false
+		}
+		return shareSMB, "//" + parts[0] + "/" + parts[1], strings.Join(parts[2:], "/"), true
+	}
+	if nfsPathPattern.MatchString(rootPath) {
+		return shareNFS, rootPath, "", true
+	}
+	return "", "", "", false
+}
+
+// fileRootPath as recorded in indexes and naming cache files, network paths are kept as they are where Abs would mangle them
+func absFileRootPath(conf *userConfig) string {
+	if kind, _, _, ok := parseNetworkPath(conf.FileRootPath); ok && (kind == shareNFS || runtime.GOOS != "windows") {
+		return conf.FileRootPath
+	}
+	basePath, _ := filepath.Abs(conf.FileRootPath)
+	return basePath
+}
+
+// connect the share of fileRootPath if it is one, files are read from sourceRootPath meanwhile
+func connectShare(conf *userConfig) (*networkShare, error) {
+	kind, remote, subPath, ok := parseNetworkPath(conf.FileRootPath)
+	if !ok {
+		return nil, nil
+	}
+
+	share := &networkShare{kind: kind, remote: remote}
+	fmt.Printf("[Share] Connecting %s\n", remote)
+	if err := mountShare(conf, share); err != nil {
+		return nil, errors.New("share " + remote + " could not be connected: " + err.Error())
+	}
+
+	if share.mountPath != "" {
+		conf.shareRoot = filepath.Join(share.mountPath, filepath.FromSlash(subPath))
+		fmt.Printf("[Share] Mounted at %s\n", share.mountPath)
+	}
+	if err := checkRootDir(sourceRootPath(conf)); err != nil {
+		share.release()
+		return nil, err
+	}
+	return share, nil
+}
+
+// fileRootPath has to be a directory which can be read
+func checkRootDir(rootPath string) error {
+	stat, err := os.Stat(rootPath)
+	if err != nil {
+		return errors.New("fileRootPath '" + rootPath + "' is not available: " + err.Error())
+	}
+	if !stat.IsDir() {
+		return errors.New("fileRootPath '" + rootPath + "' is not a directory")
+	}
+	return nil
+}
+
+func (s *networkShare) release() {
+	if s == nil {
+		return
+	}
+	if err := unmountShare(s); err != nil {
+		fmt.Printf("[Error] Share %s could not be disconnected: %v\n", s.remote, err)
+	}
+}
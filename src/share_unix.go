@@ -0,0 +1,135 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// mount the share read-only below cacheDir, unmounting what a crashed run left there first
+func mountShare(conf *userConfig, share *networkShare) error {
+	mountPath := cacheFilePath(conf, ".share")
+	exec.Command("umount", mountPath).Run()
+	if err := os.MkdirAll(mountPath, 0700); err != nil {
+		return err
+	}
+
+	options := []string{"ro"}
+	if runtime.GOOS == "darwin" {
+		options = []string{"rdonly"}
+	}
+	if conf.Share.MountOptions != "" {
+		options = append(options, conf.Share.MountOptions)
+	}
+
+	var cmd *exec.Cmd
+	switch {
+	case share.kind == shareNFS:
+		cmd = exec.Command("mount", "-t", "nfs", "-o", strings.Join(options, ","), share.remote, mountPath)
+
+	case runtime.GOOS == "darwin" && conf.Share.Username != "":
+		// with -N mount_smbfs takes the password from nsmb.conf below HOME, so it never shows up in a command line
+		remote := strings.TrimPrefix(share.remote, "//")
+		home, err := writeShareNsmbConf(conf, strings.SplitN(remote, "/", 2)[0])
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(home)
+
+		user := url.QueryEscape(conf.Share.Username)
+		if conf.Share.Domain != "" {
+			user = url.QueryEscape(conf.Share.Domain) + ";" + user
+		}
+		cmd = exec.Command("mount_smbfs", "-N", "-o", strings.Join(options, ","), "//"+user+"@"+remote, mountPath)
+		cmd.Env = append(os.Environ(), "HOME="+home)
+
+	case runtime.GOOS == "darwin":
+		cmd = exec.Command("mount_smbfs", "-o", strings.Join(options, ","), "//guest:@"+strings.TrimPrefix(share.remote, "//"), mountPath)
+
+	default:
+		// credentials are handed over in a file, so they never show up in a command line
+		if conf.Share.Username != "" {
+			credentials, err := writeShareCredentials(conf)
+			if err != nil {
+				return err
+			}
+			defer os.Remove(credentials)
+			options = append(options, "credentials="+credentials)
+		} else {
+			options = append(options, "guest")
+		}
+		cmd = exec.Command("mount", "-t", "cifs", "-o", strings.Join(options, ","), share.remote, mountPath)
+	}
+
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%v: %s", err, strings.TrimSpace(string(output)))
+	}
+	share.mountPath = mountPath
+	share.connected = true
+	return nil
+}
+
+// a credentials file of mount.cifs, only readable by us
+func writeShareCredentials(conf *userConfig) (string, error) {
+	f, err := ioutil.TempFile(conf.CacheDir, specialFilePrefix+"credentials")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	content := "username=" + conf.Share.Username + "\npassword=" + conf.Share.Password + "\n"
+	if conf.Share.Domain != "" {
+		content += "domain=" + conf.Share.Domain + "\n"
+	}
+	if _, err := f.WriteString(content); err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+/*
+ * a home directory holding only Library/Preferences/nsmb.conf with the password of server, only readable by us.
+ * mount_smbfs reads the section [SERVER:USER] of it, the caller removes the directory after mounting.
+ */
+func writeShareNsmbConf(conf *userConfig, server string) (string, error) {
+	home, err := ioutil.TempDir(conf.CacheDir, specialFilePrefix+"smbhome")
+	if err != nil {
+		return "", err
+	}
+	preferences := filepath.Join(home, "Library", "Preferences")
+	if err := os.MkdirAll(preferences, 0700); err != nil {
+		os.RemoveAll(home)
+		return "", err
+	}
+
+	content := "[" + strings.ToUpper(server) + ":" + strings.ToUpper(conf.Share.Username) + "]\npassword=" + conf.Share.Password + "\n"
+	if conf.Share.Domain != "" {
+		content += "workgroup=" + conf.Share.Domain + "\n"
+	}
+	if err := ioutil.WriteFile(filepath.Join(preferences, "nsmb.conf"), []byte(content), 0600); err != nil {
+		os.RemoveAll(home)
+		return "", err
+	}
+	return home, nil
+}
+
+func unmountShare(share *networkShare) error {
+	if !share.connected {
+		return nil
+	}
+	if output, err := exec.Command("umount", share.mountPath).CombinedOutput(); err != nil {
+		return errors.New(strings.TrimSpace(string(output)))
+	}
+	os.Remove(share.mountPath)
+	return nil
+}
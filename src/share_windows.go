@@ -0,0 +1,73 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+// NETRESOURCEW
+type netResource struct {
+	Scope       uint32
+	Type        uint32
+	DisplayType uint32
+	Usage       uint32
+	LocalName   *uint16
+	RemoteName  *uint16
+	Comment     *uint16
+	Provider    *uint16
+}
+
+const resourceTypeDisk = 1
+
+var (
+	procWNetAddConnection2    = windows.NewLazySystemDLL("mpr.dll").NewProc("WNetAddConnection2W")
+	procWNetCancelConnection2 = windows.NewLazySystemDLL("mpr.dll").NewProc("WNetCancelConnection2W")
+)
+
+func uncPath(remote string) string {
+	return strings.Replace(remote, "/", `\`, -1)
+}
+
+/*
+ * SMB shares are read by their UNC path, only connected here when credentials are given.
+ * the password is handed to WNetAddConnection2 instead of net use, so it never shows up in a command line.
+ */
+func mountShare(conf *userConfig, share *networkShare) error {
+	if share.kind == shareNFS {
+		return errors.New("mount NFS exports with the Client for NFS and use their UNC path as fileRootPath")
+	}
+	if conf.Share.Username == "" {
+		return nil
+	}
+
+	remoteName, _ := windows.UTF16PtrFromString(uncPath(share.remote))
+	userName := conf.Share.Username
+	if conf.Share.Domain != "" {
+		userName = conf.Share.Domain + `\` + userName
+	}
+	user, _ := windows.UTF16PtrFromString(userName)
+	password, _ := windows.UTF16PtrFromString(conf.Share.Password)
+
+	resource := netResource{Type: resourceTypeDisk, RemoteName: remoteName}
+	if r, _, _ := procWNetAddConnection2.Call(uintptr(unsafe.Pointer(&resource)), uintptr(unsafe.Pointer(password)), uintptr(unsafe.Pointer(user)), 0); r != 0 {
+		return windows.Errno(r)
+	}
+	share.connected = true
+	return nil
+}
+
+// connections made by others, like the user mapping a drive, are kept
+func unmountShare(share *networkShare) error {
+	if !share.connected {
+		return nil
+	}
+	remoteName, _ := windows.UTF16PtrFromString(uncPath(share.remote))
+	// force, the sync has no files open on it anymore
+	if r, _, _ := procWNetCancelConnection2.Call(uintptr(unsafe.Pointer(remoteName)), 0, 1); r != 0 {
+		return windows.Errno(r)
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+)
+
+// exit code of a sync which skipped files it could not read
+const exitFilesSkipped = 3
+
+// files which could not be read by reason, since the last report
+var skippedFiles = make(map[string][]string)
+var skippedFilesMutex sync.Mutex
+
+func recordSkippedFile(path string, err error) {
+	if os.IsNotExist(err) {
+		// deleted since it was listed, nothing to back up
+		return
+	}
+
+	reason := err.Error()
+	if os.IsPermission(err) {
+		reason = "permission denied"
+	} else if isFileLockedError(err) {
+		reason = "locked by another process"
+	} else if errors.Is(err, errUploadFailed) {
+		// the details differ by request and are printed when it happens
+		reason = "upload failed"
+	} else if errors.Is(err, errDiskFull) {
+		reason = "not enough free disk space in " + stagingDir()
+	}
+
+	skippedFilesMutex.Lock()
+	skippedFiles[reason] = append(skippedFiles[reason], path)
+	skippedFilesMutex.Unlock()
+	publishProgress(progressEvent{Kind: progressFileFailed, Path: path, Error: reason})
+}
+
+// list skipped files once, grouped by reason, and return how many there were and the paths by reason
+func reportSkippedFiles() (count int, byReason map[string][]string) {
+	skippedFilesMutex.Lock()
+	defer skippedFilesMutex.Unlock()
+
+	reasons := make([]string, 0, len(skippedFiles))
+	for reason, paths := range skippedFiles {
+		reasons = append(reasons, reason)
+		count += len(paths)
+	}
+	if count == 0 {
+		return 0, nil
+	}
+	sort.Strings(reasons)
+
+	printMsg("filesSkipped", count)
+	for _, reason := range reasons {
+		paths := skippedFiles[reason]
+		sort.Strings(paths)
+
+		fmt.Printf("  %s (%d):\n", reason, len(paths))
+		for _, path := range paths {
+			fmt.Println("    " + path)
+		}
+	}
+
+	byReason = skippedFiles
+	skippedFiles = make(map[string][]string)
+	return count, byReason
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+)
+
+// a snapshot files are read from while syncing, nil if snapshots are not used
+type volumeSnapshot struct {
+	id       string // shadow copy id
+	linkPath string // directory link to the snapshot device in cacheDir
+
+	conf *userConfig // set for snapshots taken by snapshot.createCommand
+}
+
+/*
+ * take a snapshot if configured: by snapshot.createCommand, or a VSS snapshot with useSnapshot on Windows.
+ * index entries stay relative to fileRootPath, so the index looks the same as without a snapshot.
+ */
+func createSnapshot(conf *userConfig) (*volumeSnapshot, error) {
+	if conf.Snapshot.CreateCommand != "" {
+		return createCommandSnapshot(conf)
+	}
+	if conf.UseSnapshot {
+		return createVolumeSnapshot(conf)
+	}
+	return nil, nil
+}
+
+func createCommandSnapshot(conf *userConfig) (*volumeSnapshot, error) {
+	snapshot := &volumeSnapshot{conf: conf}
+
+	fmt.Println("Creating snapshot: " + conf.Snapshot.CreateCommand)
+	if err := runSnapshotCommand(conf, conf.Snapshot.CreateCommand); err != nil {
+		// clean up whatever was created before the failure
+		snapshot.release()
+		return nil, errors.New("snapshot could not be created: " + err.Error())
+	}
+
+	mountPath, _ := filepath.Abs(conf.Snapshot.MountPath)
+	if stat, err := os.Stat(mountPath); err != nil || !stat.IsDir() {
+		snapshot.release()
+		return nil, errors.New("snapshot.mountPath '" + mountPath + "' is not a directory after creating the snapshot")
+	}
+
+	conf.snapshotRoot = mountPath
+	fmt.Println("Reading files from snapshot " + mountPath)
+	return snapshot, nil
+}
+
+func (s *volumeSnapshot) release() {
+	if s == nil {
+		return
+	}
+
+	if s.id != "" {
+		releaseVolumeSnapshot(s)
+		return
+	}
+
+	if s.conf != nil && s.conf.Snapshot.CleanupCommand != "" {
+		fmt.Println("Removing snapshot: " + s.conf.Snapshot.CleanupCommand)
+		if err := runSnapshotCommand(s.conf, s.conf.Snapshot.CleanupCommand); err != nil {
+			fmt.Printf("[Error] Snapshot could not be removed: %v\n", err)
+		}
+	}
+}
+
+// a command line run by the shell
+func shellCommand(command string) *exec.Cmd {
+	if runtime.GOOS == "windows" {
+		return exec.Command("cmd", "/c", command)
+	}
+	return exec.Command("sh", "-c", command)
+}
+
+// run a snapshot command by the shell, OSSBACKUP_ROOT and OSSBACKUP_SNAPSHOT tell it fileRootPath and snapshot.mountPath
+func runSnapshotCommand(conf *userConfig, command string) error {
+	cmd := shellCommand(command)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	rootPath, _ := filepath.Abs(conf.FileRootPath)
+	cmd.Env = append(os.Environ(), "OSSBACKUP_ROOT="+rootPath, "OSSBACKUP_SNAPSHOT="+conf.Snapshot.MountPath)
+
+	return cmd.Run()
+}
+
+// absolute path files are read from: fileRootPath, or the same directory inside the snapshot or mounted share while one is in use
+func sourceRootPath(conf *userConfig) string {
+	if conf.snapshotRoot != "" {
+		return conf.snapshotRoot
+	}
+	if conf.shareRoot != "" {
+		return conf.shareRoot
+	}
+
+	basePath, _ := filepath.Abs(conf.FileRootPath)
+	return basePath
+}
@@ -0,0 +1,12 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import "errors"
+
+func createVolumeSnapshot(conf *userConfig) (*volumeSnapshot, error) {
+	return nil, errors.New("useSnapshot is only supported on Windows, use snapshot.createCommand instead")
+}
+
+func releaseVolumeSnapshot(s *volumeSnapshot) {}
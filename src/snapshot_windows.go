@@ -0,0 +1,68 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+/*
+ * create a shadow copy of the volume of fileRootPath and read files from it, so open and locked files are backed up consistently.
+ * needs administrator rights. the snapshot device is linked into cacheDir, since Go can not walk a GLOBALROOT path directly.
+ */
+func createVolumeSnapshot(conf *userConfig) (*volumeSnapshot, error) {
+	basePath, _ := filepath.Abs(conf.FileRootPath)
+	volume := filepath.VolumeName(basePath)
+	if len(volume) != 2 {
+		return nil, errors.New("snapshots are only supported for local drives, not " + basePath)
+	}
+
+	fmt.Printf("Creating snapshot of %s\n", volume)
+
+	script := fmt.Sprintf(`$r = (Get-WmiObject -List Win32_ShadowCopy).Create('%s\', 'ClientAccessible')
+if ($r.ReturnValue -ne 0) { exit $r.ReturnValue }
+$s = Get-WmiObject Win32_ShadowCopy -Filter "ID='$($r.ShadowID)'"
+Write-Output $s.ID $s.DeviceObject`, volume)
+	output, err := runPowerShell(script)
+	if err != nil {
+		return nil, errors.New("snapshot could not be created: " + err.Error())
+	}
+
+	fields := strings.Fields(output)
+	if len(fields) != 2 {
+		return nil, errors.New("snapshot could not be created: " + output)
+	}
+	snapshot := &volumeSnapshot{id: fields[0], linkPath: cacheFilePath(conf, ".snapshot")}
+
+	// a link left by a crashed run
+	os.Remove(snapshot.linkPath)
+
+	if output, err := exec.Command("cmd", "/c", "mklink", "/d", snapshot.linkPath, fields[1]+`\`).CombinedOutput(); err != nil {
+		releaseVolumeSnapshot(snapshot)
+		return nil, errors.New("snapshot could not be linked: " + strings.TrimSpace(string(output)))
+	}
+
+	conf.snapshotRoot = filepath.Join(snapshot.linkPath, strings.TrimPrefix(basePath, volume))
+	fmt.Printf("Reading files from snapshot %s\n", snapshot.id)
+	return snapshot, nil
+}
+
+func releaseVolumeSnapshot(s *volumeSnapshot) {
+	os.Remove(s.linkPath)
+
+	script := fmt.Sprintf(`Get-WmiObject Win32_ShadowCopy -Filter "ID='%s'" | ForEach-Object { $_.Delete() }`, s.id)
+	if _, err := runPowerShell(script); err != nil {
+		fmt.Printf("[Error] Snapshot %s could not be removed: %v\n", s.id, err)
+	}
+}
+
+func runPowerShell(script string) (string, error) {
+	output, err := exec.Command("powershell", "-NoProfile", "-NonInteractive", "-Command", script).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("%v: %s", err, strings.TrimSpace(string(output)))
+	}
+	return strings.TrimSpace(string(output)), nil
+}
@@ -0,0 +1,488 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aliyun/aliyun-oss-go-sdk/oss"
+)
+
+const indexKeyPrefix = "indexes/"
+
+// separates tags from the time in index names, never part of a time or a tag
+const indexTagSeparator = "~"
+
+/*
+ * a snapshot is one uploaded index, named indexes/<host>/<time>[~tag...].dat.<compression>, see indexKeySuffixes.
+ * indexes of older versions are named indexes/<time>.dat.deflate and have no host.
+ */
+type snapshotInfo struct {
+	Key  string // object key without repositoryPrefix
+	Host string
+	Time string // like 2019-08-02T02_44_44.7450746+08_00, what -t takes
+	Tags []string
+
+	Delta bool // only holds the changes since another snapshot
+}
+
+// first line of an index, entries follow
+type indexHeader struct {
+	Host     string
+	Time     string
+	Tags     []string
+	RootPath string
+	Name     string       `json:",omitempty"` // given by -name, see snapshotNameKeyPrefix
+	Base     string       `json:",omitempty"` // key of the snapshot a delta index is based on
+	Run      *snapshotRun `json:",omitempty"` // how and by what the snapshot was taken, nil for older versions
+}
+
+type indexHeaderLine struct {
+	Header indexHeader
+}
+
+var unsafeNameChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// keep host names and tags usable in object keys and on the command line
+func sanitizeSnapshotName(name string) string {
+	return strings.Trim(unsafeNameChars.ReplaceAllString(name, "_"), "_")
+}
+
+// host name recorded in snapshots, hostname in config or the name of this machine
+func snapshotHost(conf *userConfig) string {
+	host := conf.Hostname
+	if host == "" {
+		host, _ = os.Hostname()
+	}
+	if host = sanitizeSnapshotName(host); host == "" {
+		host = "unknown"
+	}
+	return host
+}
+
+func formatSnapshotTime(t time.Time) string {
+	return strings.Replace(t.Format("2006-01-02T15_04_05.999999999Z07:00"), ":", "_", 1)
+}
+
+func parseSnapshotTime(value string) (time.Time, error) {
+	// the colon of the zone offset is written as "_", a UTC time ends with Z and has none
+	if !strings.HasSuffix(value, "Z") {
+		if i := strings.LastIndex(value, "_"); i >= 0 {
+			value = value[:i] + ":" + value[i+1:]
+		}
+	}
+	return time.Parse("2006-01-02T15_04_05.999999999Z07:00", value)
+}
+
+func newIndexHeader(conf *userConfig) indexHeader {
+	rootPath := absFileRootPath(conf)
+	tags := []string{}
+	for _, tag := range conf.Tags {
+		if tag = sanitizeSnapshotName(tag); tag != "" {
+			tags = append(tags, tag)
+		}
+	}
+
+	return indexHeader{
+		Host:     snapshotHost(conf),
+		Time:     formatSnapshotTime(time.Now()),
+		Tags:     tags,
+		RootPath: rootPath,
+		Name:     snapshotNameFlag,
+	}
+}
+
+func writeIndexHeader(writer *bufio.Writer, header indexHeader) {
+	jsonRow, _ := json.Marshal(indexHeaderLine{Header: header})
+	writer.Write(jsonRow)
+	writer.WriteString("\n")
+}
+
+// tag of snapshots missing files because the sync reached maxUploadBytes
+const partialSnapshotTag = "partial"
+
+// tag of snapshots of the files listed by --files only, see makeFileListIndex
+const filesSnapshotTag = "files"
+
+// add tag to the header of the local JSON lines index at indexPath
+func addIndexTag(indexPath string, tag string) error {
+	return updateIndexHeader(indexPath, func(header *indexHeader) {
+		header.Tags = append(header.Tags, tag)
+	})
+}
+
+// change the header of the local JSON lines index at indexPath by update, rewriting the file
+func updateIndexHeader(indexPath string, update func(header *indexHeader)) error {
+	f, err := os.Open(indexPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	reader := bufio.NewReader(f)
+	firstLine, _ := reader.ReadBytes('\n')
+	var line indexHeaderLine
+	if err := json.Unmarshal(firstLine, &line); err != nil {
+		return errors.New("index has no header: " + indexPath)
+	}
+	update(&line.Header)
+
+	tmpPath := indexPath + ".tmp"
+	out, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(out)
+	writeIndexHeader(writer, line.Header)
+	if _, err := writer.ReadFrom(reader); err != nil {
+		out.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := writer.Flush(); err != nil {
+		out.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	f.Close()
+	return os.Rename(tmpPath, indexPath)
+}
+
+// the header of a local index file, ok is false for indexes of older versions which have none
+func readIndexHeader(path string) (header indexHeader, ok bool) {
+	if isSQLiteIndex(path) {
+		return readSQLiteIndexHeader(path)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return indexHeader{}, false
+	}
+	defer f.Close()
+
+	reader := bufio.NewReader(f)
+	firstLine, _ := reader.ReadBytes('\n')
+
+	var line indexHeaderLine
+	if json.Unmarshal(firstLine, &line) != nil || line.Header.Time == "" {
+		return indexHeader{}, false
+	}
+	return line.Header, true
+}
+
+func (h indexHeader) objectName(compression string) string {
+	name := indexKeyPrefix + h.Host + "/" + h.Time
+	for _, tag := range h.Tags {
+		name += indexTagSeparator + tag
+	}
+	if h.Base != "" {
+		name += deltaIndexSuffix
+	}
+	return name + indexKeySuffixes[compression]
+}
+
+// parse an index key without repositoryPrefix, ok is false for other objects
+func parseSnapshotKey(key string) (snapshot snapshotInfo, ok bool) {
+	if !strings.HasPrefix(key, indexKeyPrefix) {
+		return snapshotInfo{}, false
+	}
+
+	name := ""
+	for _, suffix := range indexKeySuffixes {
+		if strings.HasSuffix(key, suffix) {
+			name = strings.TrimSuffix(strings.TrimPrefix(key, indexKeyPrefix), suffix)
+		}
+	}
+	if name == "" {
+		return snapshotInfo{}, false
+	}
+
+	snapshot.Key = key
+
+	if strings.HasSuffix(name, deltaIndexSuffix) {
+		snapshot.Delta = true
+		name = strings.TrimSuffix(name, deltaIndexSuffix)
+	}
+
+	if i := strings.Index(name, "/"); i >= 0 {
+		snapshot.Host = name[:i]
+		name = name[i+1:]
+	}
+
+	parts := strings.Split(name, indexTagSeparator)
+	snapshot.Time = parts[0]
+	snapshot.Tags = parts[1:]
+	return snapshot, true
+}
+
+// all snapshots in the repository, oldest first
+func listSnapshots(bucket *oss.Bucket) []snapshotInfo {
+	var snapshots []snapshotInfo
+	marker := oss.Marker("")
+
+	for {
+		lsRes, err := bucket.ListObjects(oss.Prefix(objectKey(indexKeyPrefix)), oss.MaxKeys(1000), marker)
+		checkErr(err)
+		marker = oss.Marker(lsRes.NextMarker)
+
+		for _, object := range lsRes.Objects {
+			if snapshot, ok := parseSnapshotKey(strings.TrimPrefix(object.Key, repositoryPrefix)); ok {
+				snapshots = append(snapshots, snapshot)
+			}
+		}
+
+		if !lsRes.IsTruncated {
+			break
+		}
+	}
+
+	sort.SliceStable(snapshots, func(i, j int) bool {
+		a, errA := parseSnapshotTime(snapshots[i].Time)
+		b, errB := parseSnapshotTime(snapshots[j].Time)
+		if errA != nil || errB != nil {
+			return snapshots[i].Time < snapshots[j].Time
+		}
+		return a.Before(b)
+	})
+	return snapshots
+}
+
+func (h indexHeader) hasTag(tag string) bool {
+	for _, t := range h.Tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+func (s snapshotInfo) hasTag(tag string) bool {
+	for _, t := range s.Tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+ * the snapshot taken at snapshotTime, as given to -t, or named so by -name.
+ * if several hosts have one at that time, the one of this host is picked.
+ * a moment instead of the time of a snapshot, like 2023-11-02 or 2023-11-02T18:00:00+08:00, picks the newest snapshot
+ * at or before it, see nearestSnapshot.
+ */
+func findSnapshot(bucket *oss.Bucket, conf *userConfig, snapshotTime string) (snapshotInfo, error) {
+	snapshots := listSnapshots(bucket)
+	var matches []snapshotInfo
+	for _, snapshot := range snapshots {
+		if snapshot.Time == snapshotTime {
+			matches = append(matches, snapshot)
+		}
+	}
+
+	switch len(matches) {
+	case 0:
+		if snapshot, ok := namedSnapshot(bucket, conf, snapshots, snapshotTime); ok {
+			return snapshot, nil
+		}
+		if moment, ok := parseSnapshotMoment(snapshotTime); ok {
+			return nearestSnapshot(snapshots, conf, moment)
+		}
+		return snapshotInfo{}, errors.New("no snapshot at " + snapshotTime + ", see `ossBackup snapshots`")
+	case 1:
+		return matches[0], nil
+	}
+
+	host := snapshotHost(conf)
+	for _, snapshot := range matches {
+		if snapshot.Host == host {
+			return snapshot, nil
+		}
+	}
+	return snapshotInfo{}, errors.New("several hosts have a snapshot at " + snapshotTime)
+}
+
+/*
+ * the moment value names: RFC 3339, or a date and time in local time like 2023-11-02 18:00.
+ * a date alone is the end of that day, so the last snapshot taken that day is picked.
+ */
+func parseSnapshotMoment(value string) (time.Time, bool) {
+	if moment, err := time.Parse(time.RFC3339Nano, value); err == nil {
+		return moment, true
+	}
+	for _, layout := range []string{"2006-01-02T15:04:05", "2006-01-02 15:04:05", "2006-01-02T15:04", "2006-01-02 15:04"} {
+		if moment, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+			return moment, true
+		}
+	}
+	if day, err := time.ParseInLocation("2006-01-02", value, time.Local); err == nil {
+		return day.AddDate(0, 0, 1).Add(-time.Nanosecond), true
+	}
+	return time.Time{}, false
+}
+
+/*
+ * the newest snapshot taken at or before moment, of this host if it has any, otherwise of any host.
+ * snapshots of some files only are passed over, they are picked by their time. snapshots are listed oldest first.
+ */
+func nearestSnapshot(snapshots []snapshotInfo, conf *userConfig, moment time.Time) (snapshotInfo, error) {
+	host := snapshotHost(conf)
+	var nearest, nearestOfHost *snapshotInfo
+	for i := range snapshots {
+		taken, err := parseSnapshotTime(snapshots[i].Time)
+		if err != nil || taken.After(moment) || snapshots[i].hasTag(filesSnapshotTag) {
+			continue
+		}
+		nearest = &snapshots[i]
+		if snapshots[i].Host == host {
+			nearestOfHost = &snapshots[i]
+		}
+	}
+
+	if nearestOfHost != nil {
+		nearest = nearestOfHost
+	}
+	if nearest == nil {
+		return snapshotInfo{}, errors.New("no snapshot at or before " + moment.Format(time.RFC3339) + ", see `ossBackup snapshots`")
+	}
+	// on stderr, like the banner, output of commands like index dump may be piped
+	fmt.Fprintf(os.Stderr, "Using snapshot %s %s, the newest at or before %s\n", nearest.Host, nearest.Time, moment.Format(time.RFC3339))
+	return *nearest, nil
+}
+
+/*
+ * download the full index of a snapshot into a temp file, which the caller removes.
+ * deltas are merged onto the indexes they are based on.
+ */
+func downloadIndex(bucket *oss.Bucket, key string) (indexPath string, size int64, err error) {
+	indexPath, size, err = downloadIndexObject(bucket, key)
+	if err != nil {
+		return indexPath, size, err
+	}
+
+	header, _ := readIndexHeader(indexPath)
+	if header.Base == "" {
+		return indexPath, size, nil
+	}
+	defer os.Remove(indexPath)
+
+	basePath, baseSize, err := downloadIndex(bucket, header.Base)
+	defer os.Remove(basePath)
+	if err != nil {
+		return "", 0, errors.New("base index " + header.Base + " could not be read: " + err.Error())
+	}
+
+	return mergeDeltaIndex(indexPath, basePath), size + baseSize, nil
+}
+
+// the snapshot a delta is based on, "" for full indexes
+func indexBase(bucket *oss.Bucket, key string) (string, error) {
+	indexPath, _, err := downloadIndexObject(bucket, key)
+	defer os.Remove(indexPath)
+	if err != nil {
+		return "", err
+	}
+
+	header, _ := readIndexHeader(indexPath)
+	return header.Base, nil
+}
+
+// download, decompress and verify one index object into a temp file
+func downloadIndexObject(bucket *oss.Bucket, key string) (indexPath string, size int64, err error) {
+	indexFile, err := ioutil.TempFile(tempDir, "ossIndexTmp")
+	if err != nil {
+		return "", 0, err
+	}
+	indexPath = indexFile.Name()
+	indexFile.Close()
+	os.Remove(indexPath)
+
+	if strings.HasSuffix(key, indexKeySuffixes["zstd"]) {
+		size, err = downloadZstdIndex(bucket, key, indexPath)
+	} else {
+		_, size, err = downloadCompressedFile(&downloadFileParams{
+			bucket:        bucket,
+			key:           key,
+			localLocation: indexPath,
+		})
+	}
+	if err != nil {
+		return indexPath, size, err
+	}
+
+	return indexPath, size, verifyIndex(bucket, key, indexPath)
+}
+
+// `ossBackup snapshots`, list snapshots of all hosts sharing the bucket
+func runSnapshots(args []string) {
+	var configFileName string
+	var host string
+	var tag string
+	var name string
+	var withStats bool
+	flags := flag.NewFlagSet("snapshots", flag.ExitOnError)
+	flags.StringVar(&configFileName, "c", "", "the name of config file")
+	flags.StringVar(&host, "host", "", "only list snapshots of this host")
+	flags.StringVar(&tag, "tag", "", "only list snapshots with this tag")
+	flags.StringVar(&name, "name", "", "only list snapshots with this name")
+	flags.BoolVar(&withStats, "stats", false, "also show files, size, new data, dedup savings and errors of each snapshot")
+	flags.Parse(args)
+
+	conf := getConfig(configFileName)
+	_, bucket, err := getOSSClient(&conf)
+	checkErr(err)
+
+	holds := listHolds(bucket)
+	names := listSnapshotNames(bucket, "")
+	var snapshots []snapshotInfo
+	for _, snapshot := range listSnapshots(bucket) {
+		if host != "" && snapshot.Host != host {
+			continue
+		}
+		if tag != "" && !snapshot.hasTag(tag) {
+			continue
+		}
+		if name != "" && !isNamed(names, snapshot, name) {
+			continue
+		}
+		snapshots = append(snapshots, snapshot)
+	}
+
+	var stats map[string]snapshotStats
+	if withStats {
+		stats = fetchSnapshotStats(&conf, bucket, snapshots)
+	}
+
+	for _, snapshot := range snapshots {
+		snapshotHost := snapshot.Host
+		if snapshotHost == "" {
+			snapshotHost = "-"
+		}
+		held := ""
+		if _, ok := holds[holdKey(snapshot)]; ok {
+			held = " (held)"
+		}
+		for _, snapshotName := range names[snapshotID(snapshot)] {
+			held += " @" + snapshotName
+		}
+		fmt.Printf("%-40s %-20s %s%s\n", snapshot.Time, snapshotHost, strings.Join(snapshot.Tags, ","), held)
+		if s, ok := stats[snapshotID(snapshot)]; ok {
+			fmt.Printf("    %s\n", s)
+		}
+	}
+
+	fmt.Printf("%d snapshots\n", len(snapshots))
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sync"
+
+	"github.com/aliyun/aliyun-oss-go-sdk/oss"
+)
+
+/*
+ * a few numbers of each snapshot kept next to its index at snapshot-stats/<host>/<time>.json,
+ * so `snapshots -stats` lists them without downloading indexes of hundreds of MB.
+ * snapshots taken by older versions or by watch have none.
+ */
+const snapshotStatsKeyPrefix = "snapshot-stats/"
+
+type snapshotStats struct {
+	Files        int32
+	Size         int64
+	Chunks       int   // distinct chunks the files use
+	DedupSavings int64 // bytes of files whose content another file of the snapshot has as well
+	NewChunks    int32 // uploaded by the sync taking the snapshot
+	NewBytes     int64 // compressed
+	Deferred     int   // files left for the next sync by maxUploadBytes
+	Errors       int   // files which could not be read
+}
+
+func snapshotStatsKey(snapshot snapshotInfo) string {
+	return snapshotStatsKeyPrefix + snapshotID(snapshot) + ".json"
+}
+
+// the stats of the snapshot with the index at indexPath, taken by run
+func newSnapshotStats(indexPath string, run *snapshotRun) snapshotStats {
+	stats := snapshotStats{Files: run.Files, Size: run.Size, NewChunks: run.Uploaded, NewBytes: run.UploadedBytes,
+		Deferred: run.Deferred, Errors: run.Skipped}
+
+	chunks := make(map[string]bool)
+	var uniqueSize int64
+	scanIndex(indexPath, "", func(line *fileInfo) {
+		if line.ChunkKey == emptyFileChunkKey || chunks[line.ChunkKey] {
+			return
+		}
+		chunks[line.ChunkKey] = true
+		uniqueSize += line.Size
+	})
+	stats.Chunks = len(chunks)
+	stats.DedupSavings = stats.Size - uniqueSize
+	return stats
+}
+
+// upload the stats of the snapshot with header, a failure is only warned about since the index is uploaded already
+func uploadSnapshotStats(bucket *oss.Bucket, header indexHeader, stats snapshotStats) {
+	key := snapshotStatsKey(snapshotInfo{Host: header.Host, Time: header.Time})
+	content, _ := json.Marshal(stats)
+	if err := bucket.PutObject(objectKey(key), bytes.NewReader(content), appendOnlyOptions(nil)...); err != nil {
+		fmt.Printf("[Stats] Could not upload %s: %v\n", key, err)
+	}
+}
+
+// the stats of snapshots by snapshotID, fetched a few at a time, snapshots without stats are left out
+func fetchSnapshotStats(conf *userConfig, bucket *oss.Bucket, snapshots []snapshotInfo) map[string]snapshotStats {
+	result := make(map[string]snapshotStats)
+	var mutex sync.Mutex
+	queue := make(chan snapshotInfo)
+	var wg sync.WaitGroup
+	for i := 0; i < conf.Concurrency.Download; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for snapshot := range queue {
+				body, err := bucket.GetObject(objectKey(snapshotStatsKey(snapshot)))
+				if err != nil {
+					continue
+				}
+				content, err := ioutil.ReadAll(body)
+				body.Close()
+
+				var stats snapshotStats
+				if err == nil && json.Unmarshal(content, &stats) == nil {
+					mutex.Lock()
+					result[snapshotID(snapshot)] = stats
+					mutex.Unlock()
+				}
+			}
+		}()
+	}
+
+	for _, snapshot := range snapshots {
+		queue <- snapshot
+	}
+	close(queue)
+	wg.Wait()
+	return result
+}
+
+func (s snapshotStats) String() string {
+	text := fmt.Sprintf("%d files, %s, %s new, %s deduplicated", s.Files, formatFileSize(s.Size), formatFileSize(s.NewBytes), formatFileSize(s.DedupSavings))
+	if s.Errors > 0 {
+		text += fmt.Sprintf(", %d errors", s.Errors)
+	}
+	return text
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+/*
+ * special files are recorded in the index with their type instead of being read, a FIFO would block the scan,
+ * and restored by creating them again where the platform allows it. their ChunkKey is emptyFileChunkKey,
+ * so versions not knowing Type restore them as empty files and nothing else treats them differently.
+ */
+const (
+	specialFileFIFO     = "fifo"
+	specialFileSocket   = "socket"
+	specialFileCharDev  = "chardev"
+	specialFileBlockDev = "blockdev"
+)
+
+// special files restore leaves out on purpose, like sockets, which only the program listening on them can create
+var errSpecialFileSkipped = errors.New("not recreated")
+
+// the Type of a file with mode, "" for regular files
+func specialFileType(mode os.FileMode) string {
+	switch {
+	case mode&os.ModeNamedPipe != 0:
+		return specialFileFIFO
+	case mode&os.ModeSocket != 0:
+		return specialFileSocket
+	case mode&os.ModeCharDevice != 0:
+		return specialFileCharDev
+	case mode&os.ModeDevice != 0:
+		return specialFileBlockDev
+	}
+	return ""
+}
+
+// create the special file of info at fullPath, with its mtime
+func restoreSpecialFile(fullPath string, info *fileInfo) error {
+	if info.Type == specialFileSocket || info.Type == specialFilePlaceholder {
+		return errSpecialFileSkipped
+	}
+
+	os.MkdirAll(longPath(filepath.Dir(fullPath)), 0755)
+	if _, err := os.Lstat(longPath(fullPath)); err == nil {
+		return &os.PathError{Op: "restore", Path: fullPath, Err: os.ErrExist}
+	}
+	if err := createSpecialFile(longPath(fullPath), info); err != nil {
+		return err
+	}
+
+	modTime := time.Unix(0, info.ModTime)
+	os.Chtimes(longPath(fullPath), modTime, modTime)
+	return nil
+}
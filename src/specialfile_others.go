@@ -0,0 +1,15 @@
+//go:build !linux && !darwin
+// +build !linux,!darwin
+
+package main
+
+import "os"
+
+func getDeviceNumber(stat os.FileInfo) uint64 {
+	return 0
+}
+
+// special files of other systems are not recreated here
+func createSpecialFile(path string, info *fileInfo) error {
+	return errSpecialFileSkipped
+}
@@ -0,0 +1,30 @@
+//go:build linux || darwin
+// +build linux darwin
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// the device number of device files, 0 for others
+func getDeviceNumber(stat os.FileInfo) uint64 {
+	if sys, ok := stat.Sys().(*syscall.Stat_t); ok {
+		return uint64(sys.Rdev)
+	}
+	return 0
+}
+
+// device files can only be created by root
+func createSpecialFile(path string, info *fileInfo) error {
+	switch info.Type {
+	case specialFileFIFO:
+		return syscall.Mkfifo(path, 0644)
+	case specialFileCharDev:
+		return syscall.Mknod(path, syscall.S_IFCHR|0644, int(info.Device))
+	case specialFileBlockDev:
+		return syscall.Mknod(path, syscall.S_IFBLK|0644, int(info.Device))
+	}
+	return errSpecialFileSkipped
+}
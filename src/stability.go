@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// times a file is read again when it changes while being hashed or compressed
+const maxReadRetries = 3
+
+// files which never stopped changing while being read, since the last report
+var unstableFiles = make(map[string]bool)
+var unstableFilesMutex sync.Mutex
+
+func recordUnstableFile(path string) {
+	unstableFilesMutex.Lock()
+	unstableFiles[path] = true
+	unstableFilesMutex.Unlock()
+}
+
+func reportUnstableFiles() {
+	unstableFilesMutex.Lock()
+	defer unstableFilesMutex.Unlock()
+
+	if len(unstableFiles) == 0 {
+		return
+	}
+
+	paths := make([]string, 0, len(unstableFiles))
+	for path := range unstableFiles {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	printMsg("unstableFiles", len(paths))
+	for _, path := range paths {
+		fmt.Println("  " + path)
+	}
+	unstableFiles = make(map[string]bool)
+}
+
+/*
+ * hash a file and make sure its size and mtime did not change meanwhile, hashing it again if they did.
+ * info is updated to the last stat, stable is false if the file was still changing after maxReadRetries.
+ */
+func hashStableFile(fullPath string, info *fileInfo) (chunkKey string, stable bool, err error) {
+	for attempt := 0; ; attempt++ {
+		chunkKey, err = hashFileContent(fullPath)
+		if err != nil {
+			return "", false, err
+		}
+
+		current, err := statFileInfo(fullPath, info.Path)
+		if err != nil {
+			return "", false, err
+		}
+		if current.Size == info.Size && current.ModTime == info.ModTime {
+			return chunkKey, true, nil
+		}
+
+		*info = current
+		if attempt >= maxReadRetries {
+			return chunkKey, false, nil
+		}
+		time.Sleep(time.Second)
+	}
+}
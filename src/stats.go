@@ -0,0 +1,174 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+)
+
+type extensionStats struct {
+	ext            string
+	files          int64
+	rawSize        int64
+	compressedSize int64 // or the size after dedup, for snapshots
+}
+
+// the lower case extension of a path, "(none)" for files without one
+func fileExtension(filePath string) string {
+	ext := strings.ToLower(path.Ext(filePath))
+	if ext == "" {
+		return "(none)"
+	}
+	return ext
+}
+
+// compression of the chunks uploaded by one run, per extension
+type compressionStats struct {
+	mutex sync.Mutex
+	byExt map[string]*extensionStats
+}
+
+func (s *compressionStats) add(filePath string, rawSize int64, compressedSize int64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.byExt == nil {
+		s.byExt = make(map[string]*extensionStats)
+	}
+	ext := fileExtension(filePath)
+	stats, ok := s.byExt[ext]
+	if !ok {
+		stats = &extensionStats{ext: ext}
+		s.byExt[ext] = stats
+	}
+	stats.files++
+	stats.rawSize += rawSize
+	stats.compressedSize += compressedSize
+}
+
+// add to the totals kept in the cache
+func (s *compressionStats) save() {
+	if cacheDB == nil || len(s.byExt) == 0 {
+		return
+	}
+
+	trx, err := cacheDB.Begin()
+	checkErr(err)
+	for _, stats := range s.byExt {
+		_, err := trx.Exec(`INSERT INTO compression_stats (ext, files, rawSize, compressedSize) VALUES (?, ?, ?, ?)
+			ON CONFLICT (ext) DO UPDATE SET files = files + excluded.files, rawSize = rawSize + excluded.rawSize,
+			compressedSize = compressedSize + excluded.compressedSize`,
+			stats.ext, stats.files, stats.rawSize, stats.compressedSize)
+		checkErr(err)
+	}
+	checkErr(trx.Commit())
+}
+
+func printExtensionStats(stats []*extensionStats, sizeTitle string, limit int) {
+	sort.Slice(stats, func(i, j int) bool { return stats[i].rawSize > stats[j].rawSize })
+
+	var total extensionStats
+	fmt.Printf("%-12s %10s %10s %10s %7s\n", "extension", "files", "size", sizeTitle, "saved")
+	for i, s := range stats {
+		total.files += s.files
+		total.rawSize += s.rawSize
+		total.compressedSize += s.compressedSize
+		if limit <= 0 || i < limit {
+			fmt.Printf("%-12s %10d %10s %10s %6.1f%%\n", s.ext, s.files, formatFileSize(s.rawSize), formatFileSize(s.compressedSize), savedPercent(s))
+		}
+	}
+	if limit > 0 && len(stats) > limit {
+		fmt.Printf("... and %d more extensions\n", len(stats)-limit)
+	}
+	fmt.Printf("%-12s %10d %10s %10s %6.1f%%\n", "total", total.files, formatFileSize(total.rawSize), formatFileSize(total.compressedSize), savedPercent(&total))
+}
+
+func savedPercent(s *extensionStats) float64 {
+	if s.rawSize == 0 {
+		return 0
+	}
+	return float64(s.rawSize-s.compressedSize) / float64(s.rawSize) * 100
+}
+
+/*
+ * `ossBackup stats`, how well files of each extension compressed when their chunks were uploaded from this machine.
+ * extensions saving next to nothing are candidates for not compressing.
+ * with -t, how much space dedup saves per extension in a snapshot, counting every chunk of an extension once.
+ */
+func runStats(args []string) {
+	var configFileName string
+	var snapshotTime string
+	var limit int
+	flags := flag.NewFlagSet("stats", flag.ExitOnError)
+	flags.StringVar(&configFileName, "c", "", "the name of config file")
+	flags.StringVar(&snapshotTime, "t", "", "show dedup of this snapshot (like 2019-08-02T02_44_44.7450746+08_00)")
+	flags.IntVar(&limit, "limit", 30, "how many extensions to list, 0 lists all")
+	flags.Parse(args)
+
+	conf := getConfig(configFileName)
+	initCache(&conf)
+
+	rows, err := cacheDB.Query("SELECT ext, files, rawSize, compressedSize FROM compression_stats")
+	checkErr(err)
+	var compression []*extensionStats
+	for rows.Next() {
+		s := &extensionStats{}
+		checkErr(rows.Scan(&s.ext, &s.files, &s.rawSize, &s.compressedSize))
+		compression = append(compression, s)
+	}
+	checkErr(rows.Err())
+	rows.Close()
+
+	if size, ok := repositorySize(); ok {
+		fmt.Printf("[Stats] Repository size: %s", formatFileSize(size))
+		if conf.Quota.Size > 0 {
+			fmt.Printf(" of a quota of %s", formatFileSize(quotaBytes(&conf.Quota)))
+		}
+		fmt.Println()
+	}
+	checkQuota(&conf)
+
+	fmt.Println("[Stats] Compression of uploaded chunks")
+	printExtensionStats(compression, "compressed", limit)
+
+	if snapshotTime == "" {
+		return
+	}
+
+	_, bucket, err := getOSSClient(&conf)
+	checkErr(err)
+	applyBandwidthLimits(&conf)
+
+	indexPath := fetchSnapshotIndex(&conf, bucket, snapshotTime)
+	defer os.Remove(indexPath)
+
+	byExt := make(map[string]*extensionStats)
+	seen := make(map[string]bool) // extension and chunk key
+	scanIndex(indexPath, "", func(line *fileInfo) {
+		ext := fileExtension(line.Path)
+		stats, ok := byExt[ext]
+		if !ok {
+			stats = &extensionStats{ext: ext}
+			byExt[ext] = stats
+		}
+		stats.files++
+		stats.rawSize += line.Size
+		if key := ext + " " + line.ChunkKey; !seen[key] {
+			seen[key] = true
+			stats.compressedSize += line.Size
+		}
+	})
+
+	dedup := make([]*extensionStats, 0, len(byExt))
+	for _, stats := range byExt {
+		dedup = append(dedup, stats)
+	}
+
+	fmt.Println()
+	fmt.Printf("[Stats] Dedup in snapshot %s\n", snapshotTime)
+	printExtensionStats(dedup, "unique", limit)
+}
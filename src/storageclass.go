@@ -0,0 +1,74 @@
+package main
+
+import (
+	"errors"
+	"path"
+	"strings"
+
+	"github.com/aliyun/aliyun-oss-go-sdk/oss"
+)
+
+// chunks of files matching Pattern are uploaded in storage class Class
+type storageClassRule struct {
+	Pattern string // relative to fileRootPath, like "photos/**" or "**/*.mp4"
+	Class   string // Standard, IA, Archive or ColdArchive
+}
+
+var storageClassNames = []oss.StorageClassType{oss.StorageStandard, oss.StorageIA, oss.StorageArchive, oss.StorageColdArchive}
+
+func checkStorageClassRules(rules []storageClassRule) error {
+	for _, rule := range rules {
+		if _, err := matchPathPattern(rule.Pattern, ""); err != nil || rule.Pattern == "" {
+			return errors.New("storage class pattern '" + rule.Pattern + "' is invalid")
+		}
+
+		valid := false
+		for _, name := range storageClassNames {
+			valid = valid || rule.Class == string(name)
+		}
+		if !valid {
+			return errors.New("storage class '" + rule.Class + "' is invalid, should be Standard, IA, Archive or ColdArchive")
+		}
+	}
+	return nil
+}
+
+// whether path matches pattern, segments are matched by path.Match and "**" matches any number of them
+func matchPathPattern(pattern string, filePath string) (bool, error) {
+	return matchPathSegments(strings.Split(pattern, "/"), strings.Split(filePath, "/"))
+}
+
+func matchPathSegments(pattern []string, parts []string) (bool, error) {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := 0; i <= len(parts); i++ {
+				if ok, err := matchPathSegments(pattern[1:], parts[i:]); ok || err != nil {
+					return ok, err
+				}
+			}
+			return false, nil
+		}
+
+		if len(parts) == 0 {
+			return false, nil
+		}
+		if ok, err := path.Match(pattern[0], parts[0]); !ok || err != nil {
+			return false, err
+		}
+		pattern, parts = pattern[1:], parts[1:]
+	}
+	return len(parts) == 0, nil
+}
+
+/*
+ * the storage class of the first rule matching filePath, "" for the default class of the bucket.
+ * a chunk is stored once for all files with its content, in the class of the file which uploaded it first.
+ */
+func storageClassFor(conf *userConfig, filePath string) string {
+	for _, rule := range conf.StorageClasses {
+		if ok, _ := matchPathPattern(rule.Pattern, filePath); ok {
+			return rule.Class
+		}
+	}
+	return ""
+}
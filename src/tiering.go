@@ -0,0 +1,126 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aliyun/aliyun-oss-go-sdk/oss"
+)
+
+type tieringConfig struct {
+	KeepRecent int           // chunks used by this many newest snapshots of each host stay where they are
+	Class      string        // storage class the other chunks are moved to: Archive or ColdArchive
+	MinAge     time.Duration // younger chunks are not moved, Standard and IA charge for removing them early
+}
+
+func checkTieringConfig(conf *tieringConfig) error {
+	if conf.KeepRecent < 1 {
+		return errors.New("tiering.keepRecent should be at least 1")
+	}
+	if conf.Class != string(oss.StorageArchive) && conf.Class != string(oss.StorageColdArchive) {
+		return errors.New("tiering.class '" + conf.Class + "' is invalid, should be Archive or ColdArchive")
+	}
+	return nil
+}
+
+// the newest n snapshots of each host, snapshots are listed oldest first
+func newestSnapshotsOfHosts(snapshots []snapshotInfo, n int) []snapshotInfo {
+	var newest []snapshotInfo
+	countOfHost := make(map[string]int)
+	for i := len(snapshots) - 1; i >= 0; i-- {
+		if countOfHost[snapshots[i].Host] < n {
+			countOfHost[snapshots[i].Host]++
+			newest = append(newest, snapshots[i])
+		}
+	}
+	return newest
+}
+
+/*
+ * `ossBackup tier`, move chunks only old snapshots use to tiering.class, so recent data stays quick to restore
+ * while history is kept cheaply. chunks are copied onto themselves with the new storage class.
+ * chunks of recent snapshots already in Archive storage are only counted, moving them back needs a restore.
+ */
+func runTier(args []string) {
+	var configFileName string
+	var dryRun bool
+	flags := flag.NewFlagSet("tier", flag.ExitOnError)
+	flags.StringVar(&configFileName, "c", "", "the name of config file")
+	flags.BoolVar(&dryRun, "dry-run", false, "only report how many chunks would be moved")
+	flags.Parse(args)
+
+	conf := getConfig(configFileName)
+	if !dryRun {
+		refuseInAppendOnlyMode("tier")
+		refuseInReadOnlyMode("tier")
+	}
+	_, bucket, err := getOSSClient(&conf)
+	checkErr(err)
+	checkErr(checkRepositoryLayout(bucket, false))
+	applyBandwidthLimits(&conf)
+	applyTempBudget(&conf)
+
+	recent := newestSnapshotsOfHosts(listSnapshots(bucket), conf.Tiering.KeepRecent)
+	fmt.Printf("[Tier] Reading the indexes of %d recent snapshots\n", len(recent))
+	hot := referencedChunks(bucket, recent)
+
+	cutoff := time.Now().Add(-conf.Tiering.MinAge)
+	var cold []string
+	var coldSize int64
+	var recentArchived int
+	listOnlineChunkObjects(bucket, func(key string, object oss.ObjectProperties) {
+		archived := object.StorageClass == string(oss.StorageArchive) || object.StorageClass == string(oss.StorageColdArchive)
+		if hot.contains(key) {
+			if archived {
+				recentArchived++
+			}
+			return
+		}
+		if !archived && object.LastModified.Before(cutoff) {
+			cold = append(cold, key)
+			coldSize += object.Size
+		}
+	})
+
+	if recentArchived > 0 {
+		fmt.Printf("[Tier] %d chunks of recent snapshots are in Archive storage\n", recentArchived)
+	}
+	if dryRun {
+		fmt.Printf("[Tier] %d chunks (%s) would be moved to %s\n", len(cold), formatFileSize(coldSize), conf.Tiering.Class)
+		return
+	}
+
+	var moved, failed int64
+	queue := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < conf.Concurrency.Upload; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for key := range queue {
+				_, err := chunkBucket(bucket, key).CopyObject(objectKey(key), objectKey(key), oss.ObjectStorageClass(oss.StorageClassType(conf.Tiering.Class)))
+				if err != nil {
+					// like a chunk removed by a prune meanwhile
+					fmt.Printf("[Tier] Chunk %s could not be moved: %v\n", key, err)
+					atomic.AddInt64(&failed, 1)
+					continue
+				}
+				if done := atomic.AddInt64(&moved, 1); done%1000 == 0 {
+					fmt.Printf("[Tier] %d / %d chunks moved\n", done, len(cold))
+				}
+			}
+		}()
+	}
+
+	for _, key := range cold {
+		queue <- key
+	}
+	close(queue)
+	wg.Wait()
+
+	fmt.Printf("[Tier] %d of %d chunks (%s) moved to %s, %d failed\n", moved, len(cold), formatFileSize(coldSize), conf.Tiering.Class, failed)
+}
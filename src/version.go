@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"runtime"
+	"sort"
+	"strings"
+)
+
+// what a build supports, for bug reports and for checking it can work with a repository
+type versionInfo struct {
+	Version           string
+	GitCommit         string
+	BuildDate         string
+	GoVersion         string
+	Platform          string
+	Backends          []string
+	IndexFormats      []string
+	IndexCompressions []string
+	LayoutVersion     int // of the objects in the bucket, see migrate-layout
+	CacheVersion      int // of the local cache schema
+}
+
+func currentVersionInfo() versionInfo {
+	var compressions []string
+	for name := range indexKeySuffixes {
+		compressions = append(compressions, name)
+	}
+	sort.Strings(compressions)
+
+	return versionInfo{
+		Version:           version,
+		GitCommit:         gitCommit,
+		BuildDate:         buildDate,
+		GoVersion:         runtime.Version(),
+		Platform:          runtime.GOOS + "/" + runtime.GOARCH,
+		Backends:          []string{"oss"},
+		IndexFormats:      []string{"jsonl", "sqlite"},
+		IndexCompressions: compressions,
+		LayoutVersion:     repositoryLayoutVersion,
+		CacheVersion:      cacheSchemaVersion,
+	}
+}
+
+// `ossBackup version`
+func runVersion(args []string) {
+	var asJSON bool
+	flags := flag.NewFlagSet("version", flag.ExitOnError)
+	flags.BoolVar(&asJSON, "json", false, "print as JSON")
+	flags.Parse(args)
+
+	info := currentVersionInfo()
+	if asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		checkErr(encoder.Encode(info))
+		return
+	}
+
+	fmt.Printf("Version:            %s\n", info.Version)
+	fmt.Printf("Git commit:         %s\n", info.GitCommit)
+	fmt.Printf("Build date:         %s\n", info.BuildDate)
+	fmt.Printf("Go version:         %s\n", info.GoVersion)
+	fmt.Printf("Platform:           %s\n", info.Platform)
+	fmt.Printf("Backends:           %s\n", strings.Join(info.Backends, ", "))
+	fmt.Printf("Index formats:      %s\n", strings.Join(info.IndexFormats, ", "))
+	fmt.Printf("Index compressions: %s\n", strings.Join(info.IndexCompressions, ", "))
+	fmt.Printf("Repository layout:  %d\n", info.LayoutVersion)
+	fmt.Printf("Cache schema:       %d\n", info.CacheVersion)
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aliyun/aliyun-oss-go-sdk/oss"
+)
+
+// a version of an object, or the delete marker left when it was deleted in a versioned bucket
+type objectVersion struct {
+	Key       string // without repositoryPrefix, like the keys in the index
+	VersionId string
+	Time      time.Time
+	Size      int64
+	Latest    bool
+	Deleted   bool // a delete marker
+}
+
+// `ossBackup versions <action>`
+func runVersionsCommand(args []string) {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "Usage: ossBackup versions list [-c config] [-prefix indexes/] [-deleted]\n"+
+			"       ossBackup versions restore [-c config] [-prefix indexes/] [-since time] [-dry-run]\n"+
+			"       ossBackup versions restore [-c config] -key key -version versionId")
+		os.Exit(2)
+	}
+
+	switch args[0] {
+	case "list":
+		runVersionsList(args[1:])
+	case "restore":
+		runVersionsRestore(args[1:])
+	default:
+		fmt.Fprintln(os.Stderr, "Unknown versions action: "+args[0])
+		os.Exit(2)
+	}
+}
+
+// stop unless versioning is enabled, or has been, for the bucket of conf, nothing older than the latest versions is kept otherwise
+func checkBucketVersioning(conf *userConfig, client *oss.Client) {
+	names := append([]string{conf.Oss.BucketName}, conf.Oss.ChunkBuckets...)
+	for _, name := range names {
+		result, err := client.GetBucketVersioning(name)
+		checkErr(err)
+		switch result.Status {
+		case "Enabled":
+		case "Suspended":
+			fmt.Printf("[Versions] Versioning of bucket %s is suspended, objects changed since then have no older versions\n", name)
+		default:
+			checkErr(errors.New("versioning is not enabled for bucket " + name + ", there are no older versions to recover"))
+		}
+	}
+}
+
+// the buckets objects below prefix may be in, the chunk buckets too if chunks are sharded
+func bucketsOfPrefix(conf *userConfig, bucket *oss.Bucket, prefix string) []*oss.Bucket {
+	buckets := []*oss.Bucket{bucket}
+	if strings.HasPrefix(chunkKeyPrefix, prefix) || strings.HasPrefix(prefix, chunkKeyPrefix) {
+		for i, name := range chunkBucketNames {
+			if name != conf.Oss.BucketName {
+				buckets = append(buckets, chunkBuckets[i])
+			}
+		}
+	}
+	return buckets
+}
+
+// call fn for every version and delete marker below prefix, newest first for each key
+func listObjectVersions(bucket *oss.Bucket, prefix string, fn func(version objectVersion)) {
+	keyMarker, versionIdMarker := "", ""
+	for {
+		result, err := bucket.ListObjectVersions(oss.Prefix(objectKey(prefix)), oss.MaxKeys(1000),
+			oss.KeyMarker(keyMarker), oss.VersionIdMarker(versionIdMarker))
+		checkErr(err)
+
+		var versions []objectVersion
+		for _, object := range result.ObjectVersions {
+			versions = append(versions, objectVersion{Key: strings.TrimPrefix(object.Key, repositoryPrefix), VersionId: object.VersionId,
+				Time: object.LastModified, Size: object.Size, Latest: object.IsLatest})
+		}
+		for _, marker := range result.ObjectDeleteMarkers {
+			versions = append(versions, objectVersion{Key: strings.TrimPrefix(marker.Key, repositoryPrefix), VersionId: marker.VersionId,
+				Time: marker.LastModified, Latest: marker.IsLatest, Deleted: true})
+		}
+		// versions and delete markers come in separate lists
+		sort.SliceStable(versions, func(i, j int) bool {
+			if versions[i].Key != versions[j].Key {
+				return versions[i].Key < versions[j].Key
+			}
+			return versions[i].Time.After(versions[j].Time)
+		})
+		for _, version := range versions {
+			fn(version)
+		}
+
+		if !result.IsTruncated {
+			return
+		}
+		keyMarker, versionIdMarker = result.NextKeyMarker, result.NextVersionIdMarker
+	}
+}
+
+/*
+ * the newest version of each object below prefix deleted since since, which copying back brings it back.
+ * objects deleted by a prune or by anyone with access to the bucket leave a delete marker as their latest version.
+ */
+func deletedObjects(bucket *oss.Bucket, prefix string, since time.Time) []objectVersion {
+	var restorable []objectVersion
+	var key string
+	var deleted bool // the latest version of key is a delete marker, and the version before it is not found yet
+	listObjectVersions(bucket, prefix, func(version objectVersion) {
+		if version.Key != key {
+			key = version.Key
+			deleted = version.Latest && version.Deleted && !version.Time.Before(since)
+			return
+		}
+		if deleted && !version.Deleted {
+			restorable = append(restorable, version)
+			deleted = false
+		}
+	})
+	return restorable
+}
+
+// `ossBackup versions list`, the versions of the objects of the repository, with -deleted only of deleted ones
+func runVersionsList(args []string) {
+	var configFileName string
+	var prefix string
+	var deleted bool
+	flags := flag.NewFlagSet("versions list", flag.ExitOnError)
+	flags.StringVar(&configFileName, "c", "", "the name of config file")
+	flags.StringVar(&prefix, "prefix", "", "only objects below this key, like indexes/ or chunk/")
+	flags.BoolVar(&deleted, "deleted", false, "only deleted objects, with the version a restore brings back")
+	flags.Parse(args)
+
+	conf := getConfig(configFileName)
+	client, bucket, err := getOSSClient(&conf)
+	checkErr(err)
+	checkBucketVersioning(&conf, client)
+
+	for _, listed := range bucketsOfPrefix(&conf, bucket, prefix) {
+		if deleted {
+			for _, version := range deletedObjects(listed, prefix, time.Time{}) {
+				fmt.Printf("%s  %s  %s  %s\n", version.Key, version.VersionId, version.Time.Local().Format(time.RFC3339), formatFileSize(version.Size))
+			}
+			continue
+		}
+
+		listObjectVersions(listed, prefix, func(version objectVersion) {
+			state := ""
+			if version.Deleted {
+				state = "  deleted"
+			} else if version.Latest {
+				state = "  latest"
+			}
+			fmt.Printf("%s  %s  %s  %s%s\n", version.Key, version.VersionId, version.Time.Local().Format(time.RFC3339), formatFileSize(version.Size), state)
+		})
+	}
+}
+
+/*
+ * `ossBackup versions restore`, bring back the objects below -prefix deleted since -since, like the indexes and
+ * chunks a prune or someone with access to the bucket removed, or a single version of an object with -key and -version.
+ * versions are copied onto their key, the versions in between are kept. in append-only mode only deleted objects are restored.
+ */
+func runVersionsRestore(args []string) {
+	var configFileName string
+	var prefix string
+	var since string
+	var key string
+	var versionId string
+	var dryRun bool
+	flags := flag.NewFlagSet("versions restore", flag.ExitOnError)
+	flags.StringVar(&configFileName, "c", "", "the name of config file")
+	flags.StringVar(&prefix, "prefix", "", "only objects below this key, like indexes/ or chunk/")
+	flags.StringVar(&since, "since", "", "only objects deleted at or after this time, RFC 3339 like 2024-05-01T00:00:00+08:00")
+	flags.StringVar(&key, "key", "", "restore one object, with -version")
+	flags.StringVar(&versionId, "version", "", "the version of -key to restore")
+	flags.BoolVar(&dryRun, "dry-run", false, "only list the objects which would be restored")
+	flags.Parse(args)
+
+	if (key == "") != (versionId == "") {
+		fmt.Fprintln(os.Stderr, "-key and -version go together")
+		os.Exit(2)
+	}
+
+	var sinceTime time.Time
+	if since != "" {
+		var err error
+		sinceTime, err = time.Parse(time.RFC3339, since)
+		checkErr(err)
+	}
+
+	conf := getConfig(configFileName)
+	if !dryRun {
+		refuseInReadOnlyMode("versions restore")
+	}
+	client, bucket, err := getOSSClient(&conf)
+	checkErr(err)
+	checkBucketVersioning(&conf, client)
+
+	type restoreJob struct {
+		bucket  *oss.Bucket
+		version objectVersion
+	}
+	var jobs []restoreJob
+	if key != "" {
+		jobs = append(jobs, restoreJob{chunkBucketOfKey(bucket, key), objectVersion{Key: key, VersionId: versionId}})
+	} else {
+		for _, listed := range bucketsOfPrefix(&conf, bucket, prefix) {
+			for _, version := range deletedObjects(listed, prefix, sinceTime) {
+				jobs = append(jobs, restoreJob{listed, version})
+			}
+		}
+	}
+
+	var restored, failed int
+	for _, job := range jobs {
+		if dryRun {
+			fmt.Printf("[Versions] Would restore %s (%s)\n", job.version.Key, job.version.VersionId)
+			continue
+		}
+		_, err := job.bucket.CopyObject(objectKey(job.version.Key), objectKey(job.version.Key), append(appendOnlyOptions(nil), oss.VersionId(job.version.VersionId))...)
+		if err != nil {
+			fmt.Printf("[Versions] %s could not be restored: %v\n", job.version.Key, err)
+			failed++
+			continue
+		}
+		fmt.Printf("[Versions] Restored %s (%s)\n", job.version.Key, job.version.VersionId)
+		restored++
+	}
+
+	if dryRun {
+		fmt.Printf("[Versions] %d objects would be restored\n", len(jobs))
+		return
+	}
+	fmt.Printf("[Versions] %d objects restored, %d failed\n", restored, failed)
+}
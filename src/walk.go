@@ -0,0 +1,214 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/karrick/godirwalk"
+)
+
+/*
+ * walk.maxDepth and walk.skipDirs, checked before a directory is read so whole trees like
+ * node_modules forests or recursive symlink farms are never enumerated.
+ */
+type walkLimits struct {
+	basePath  string // fileRootPath, depths and paths are relative to it
+	maxDepth  int
+	skipNames map[string]bool
+	skipPaths map[string]bool
+	tooDeep   int64 // directories not read because of maxDepth
+}
+
+func newWalkLimits(conf *userConfig, basePath string) *walkLimits {
+	l := &walkLimits{
+		basePath:  basePath,
+		maxDepth:  conf.Walk.MaxDepth,
+		skipNames: make(map[string]bool),
+		skipPaths: make(map[string]bool),
+	}
+	for _, dir := range conf.Walk.SkipDirs {
+		if strings.Contains(dir, "/") {
+			l.skipPaths[dir] = true
+		} else {
+			l.skipNames[dir] = true
+		}
+	}
+	return l
+}
+
+// whether the directory at relativePath, whose parent is read, is left out
+func (l *walkLimits) skipDir(relativePath string) bool {
+	if l == nil || relativePath == "." {
+		return false
+	}
+	return l.skipNames[path.Base(relativePath)] || l.skipPaths[relativePath] || l.tooDeepDir(relativePath)
+}
+
+// files in the directory would be one level deeper than the directory itself
+func (l *walkLimits) tooDeepDir(relativePath string) bool {
+	return l.maxDepth > 0 && strings.Count(relativePath, "/")+1 >= l.maxDepth
+}
+
+// whether files directly in the directory at relativePath are left out, because it or a parent of it is skipped
+func (l *walkLimits) excludes(relativePath string) bool {
+	for dir := relativePath; dir != "." && dir != "/" && dir != ""; dir = path.Dir(dir) {
+		if l.skipDir(dir) {
+			return true
+		}
+	}
+	return false
+}
+
+func (l *walkLimits) skipFullPath(fullPath string) bool {
+	if l == nil {
+		return false
+	}
+	relativePath := relativeSlashPath(l.basePath, fullPath)
+	if !l.skipDir(relativePath) {
+		return false
+	}
+	if l.tooDeepDir(relativePath) {
+		atomic.AddInt64(&l.tooDeep, 1)
+	}
+	return true
+}
+
+func (l *walkLimits) report() {
+	if l != nil && l.tooDeep > 0 {
+		fmt.Printf("[Walk] %d directories deeper than walk.maxDepth %d were not read\n", l.tooDeep, l.maxDepth)
+	}
+}
+
+/*
+ * call fn for every non-directory entry below root, always from the calling goroutine.
+ * directories below root skipped by limits are not read, root itself always is. limits may be nil.
+ * directories below root which cannot be read are recorded as skipped files and left out, only an error reading
+ * root itself is returned, a walk finding nothing must not pass for an empty directory.
+ * with more than one worker, up to that many directories are read at the same time, and files come in no particular order.
+ */
+func walkFiles(root string, workers int, limits *walkLimits, fn func(fullPath string)) error {
+	basePath := root
+	if limits != nil {
+		basePath = limits.basePath
+	}
+	skipUnreadable := func(fullPath string, err error) {
+		recordSkippedFile(relativeSlashPath(basePath, fullPath), err)
+	}
+
+	if workers <= 1 {
+		return godirwalk.Walk(root, &godirwalk.Options{
+			ErrorCallback: func(fullPath string, err error) godirwalk.ErrorAction {
+				if fullPath == root {
+					return godirwalk.Halt
+				}
+				skipUnreadable(fullPath, err)
+				return godirwalk.SkipNode
+			},
+			Callback: func(fullPath string, f *godirwalk.Dirent) error {
+				if !f.IsDir() {
+					fn(fullPath)
+				} else if fullPath != root && limits.skipFullPath(fullPath) {
+					return godirwalk.SkipThis
+				} else {
+					// about to be read
+					waitScanOp()
+				}
+				return nil
+			},
+		})
+	}
+
+	w := &parallelWalker{
+		root:   root,
+		dirs:   []string{root},
+		files:  make(chan string, 1024),
+		limits: limits,
+		skip:   skipUnreadable,
+	}
+	w.cond = sync.NewCond(&w.mutex)
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w.work()
+		}()
+	}
+
+	go func() {
+		wg.Wait()
+		close(w.files)
+	}()
+
+	for fullPath := range w.files {
+		fn(fullPath)
+	}
+
+	return w.rootErr
+}
+
+// a shared stack of directories to read, workers stop when it is empty and nobody is reading
+type parallelWalker struct {
+	mutex   sync.Mutex
+	cond    *sync.Cond
+	root    string
+	rootErr error // set once root could not be read, before any file is sent
+	dirs    []string
+	active  int
+	files   chan string
+	limits  *walkLimits
+	skip    func(fullPath string, err error)
+}
+
+func (w *parallelWalker) work() {
+	scratch := make([]byte, godirwalk.MinimumScratchBufferSize)
+
+	for {
+		w.mutex.Lock()
+		for len(w.dirs) == 0 && w.active > 0 {
+			w.cond.Wait()
+		}
+		if len(w.dirs) == 0 {
+			// all done, wake up the others so they can stop too
+			w.mutex.Unlock()
+			w.cond.Broadcast()
+			return
+		}
+
+		dir := w.dirs[len(w.dirs)-1]
+		w.dirs = w.dirs[:len(w.dirs)-1]
+		w.active++
+		w.mutex.Unlock()
+
+		var subDirs []string
+		waitScanOp()
+		entries, err := godirwalk.ReadDirents(dir, scratch)
+		if err != nil && dir == w.root {
+			w.rootErr = err
+		} else if err != nil {
+			w.skip(dir, err)
+		}
+
+		for _, entry := range entries {
+			fullPath := filepath.Join(dir, entry.Name())
+			if entry.IsDir() {
+				if !w.limits.skipFullPath(fullPath) {
+					subDirs = append(subDirs, fullPath)
+				}
+			} else {
+				w.files <- fullPath
+			}
+		}
+
+		w.mutex.Lock()
+		w.dirs = append(w.dirs, subDirs...)
+		w.active--
+		w.mutex.Unlock()
+		w.cond.Broadcast()
+	}
+}
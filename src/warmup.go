@@ -0,0 +1,157 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aliyun/aliyun-oss-go-sdk/oss"
+)
+
+// how often warmup -wait checks the chunks still thawing
+const warmupPollInterval = 10 * time.Minute
+
+const (
+	chunkReady = iota
+	chunkThawing
+	chunkRequested
+	chunkFailed
+)
+
+/*
+ * make a chunk readable, asking OSS to restore it if it is in Archive or ColdArchive storage.
+ * the tier only applies to ColdArchive, Archive objects are always restored within about a minute to an hour.
+ */
+func warmUpChunk(bucket *oss.Bucket, key string, days int, tier string) (int, error) {
+	bucket = chunkBucket(bucket, key)
+	meta, err := bucket.GetObjectDetailedMeta(objectKey(key))
+	if err != nil {
+		return chunkFailed, err
+	}
+
+	storageClass := meta.Get("X-Oss-Storage-Class")
+	if storageClass != string(oss.StorageArchive) && storageClass != string(oss.StorageColdArchive) {
+		return chunkReady, nil
+	}
+
+	// like ongoing-request="false", expiry-date="Sun, 16 Apr 2017 08:12:33 GMT" once restored
+	restore := meta.Get("X-Oss-Restore")
+	if strings.Contains(restore, `ongoing-request="true"`) {
+		return chunkThawing, nil
+	}
+	if strings.Contains(restore, `ongoing-request="false"`) {
+		return chunkReady, nil
+	}
+
+	config := oss.RestoreConfiguration{Days: int32(days)}
+	if storageClass == string(oss.StorageColdArchive) {
+		config.Tier = tier
+	}
+	if err := bucket.RestoreObjectDetail(objectKey(key), config); err != nil {
+		if serviceErr, ok := err.(oss.ServiceError); ok && serviceErr.Code == "RestoreAlreadyInProgress" {
+			return chunkThawing, nil
+		}
+		return chunkFailed, err
+	}
+	return chunkRequested, nil
+}
+
+// warm up keys, returning the ones not readable yet
+func warmUpChunks(conf *userConfig, bucket *oss.Bucket, keys []string, days int, tier string) []string {
+	var counts [4]int
+	var pending []string
+	var mutex sync.Mutex
+
+	queue := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < conf.Concurrency.Download; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for key := range queue {
+				state, err := warmUpChunk(bucket, key, days, tier)
+
+				mutex.Lock()
+				counts[state]++
+				if state != chunkReady {
+					pending = append(pending, key)
+				}
+				if err != nil {
+					fmt.Printf("[Warmup] Chunk %s could not be restored: %v\n", key, err)
+				}
+				if checked := counts[0] + counts[1] + counts[2] + counts[3]; checked%1000 == 0 {
+					fmt.Printf("[Warmup] %d / %d chunks checked\n", checked, len(keys))
+				}
+				mutex.Unlock()
+			}
+		}()
+	}
+
+	for _, key := range keys {
+		queue <- key
+	}
+	close(queue)
+	wg.Wait()
+
+	fmt.Printf("[Warmup] %d chunks ready, %d thawing, %d restores requested, %d failed\n",
+		counts[chunkReady], counts[chunkThawing], counts[chunkRequested], counts[chunkFailed])
+	return pending
+}
+
+/*
+ * `ossBackup warmup -t <snapshot>`, ask OSS to restore all chunks of a snapshot kept in Archive or ColdArchive storage,
+ * so a planned restore can download them right away. with -wait it checks until every chunk is readable.
+ */
+func runWarmup(args []string) {
+	var configFileName string
+	var snapshotTime string
+	var only string
+	var days int
+	var tier string
+	var wait bool
+	flags := flag.NewFlagSet("warmup", flag.ExitOnError)
+	flags.StringVar(&configFileName, "c", "", "the name of config file")
+	flags.StringVar(&snapshotTime, "t", "", "the timestamp of the snapshot (like 2019-08-02T02_44_44.7450746+08_00)")
+	flags.StringVar(&only, "only", "", "only warm up files below this path in the snapshot")
+	flags.IntVar(&days, "days", 3, "how many days restored chunks stay readable")
+	flags.StringVar(&tier, "tier", "Standard", "how fast ColdArchive chunks are restored: Expedited, Standard or Bulk")
+	flags.BoolVar(&wait, "wait", false, "wait until every chunk is readable")
+	flags.Parse(args)
+
+	if snapshotTime == "" || days < 1 || (tier != "Expedited" && tier != "Standard" && tier != "Bulk") {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	conf := getConfig(configFileName)
+	_, bucket, err := getOSSClient(&conf)
+	checkErr(err)
+	applyBandwidthLimits(&conf)
+
+	indexPath := fetchSnapshotIndex(&conf, bucket, snapshotTime)
+	defer os.Remove(indexPath)
+
+	seen := newChunkSet()
+	var keys []string
+	scanIndex(indexPath, only, func(line *fileInfo) {
+		if line.ChunkKey != emptyFileChunkKey && !seen.contains(line.ChunkKey) {
+			seen.add(line.ChunkKey)
+			keys = append(keys, line.ChunkKey)
+		}
+	})
+	fmt.Printf("[Warmup] %d chunks are needed\n", len(keys))
+
+	pending := warmUpChunks(&conf, bucket, keys, days, tier)
+	for wait && len(pending) > 0 {
+		fmt.Printf("[Warmup] Checking again at %s\n", time.Now().Add(warmupPollInterval).Format("15:04"))
+		time.Sleep(warmupPollInterval)
+		pending = warmUpChunks(&conf, bucket, pending, days, tier)
+	}
+
+	if len(pending) == 0 {
+		fmt.Printf("[Warmup] Snapshot %s is ready to restore, within %d days\n", snapshotTime, days)
+	}
+}
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/aliyun/aliyun-oss-go-sdk/oss"
+	"github.com/fsnotify/fsnotify"
+	"github.com/karrick/godirwalk"
+)
+
+/*
+ * keep watching fileRootPath and sync changed directories every watch.interval.
+ * only the directories touched since the last run are re-scanned, other entries are copied from the previous index.
+ */
+func runWatch(args []string) {
+	var configFileName string
+	var forceUnlock bool
+	flags := flag.NewFlagSet("watch", flag.ExitOnError)
+	flags.StringVar(&configFileName, "c", "", "the name of config file")
+	flags.BoolVar(&forceUnlock, "force-unlock", false, "remove locks left by another sync before watching")
+	flags.IntVar(&limitUploadFlag, "limit-upload", 0, "max upload speed in KB/s (overrides config)")
+	flags.IntVar(&limitScanOpsFlag, "limit-scan-ops", 0, "max file system operations per second while scanning, to spare a file server (overrides config)")
+	flags.BoolVar(&trustLocalStateFlag, "trust-local-state", false, "use chunks recorded locally instead of listing the bucket")
+	flags.BoolVar(&lowPriorityFlag, "low-priority", false, "run with low CPU and disk I/O priority")
+	flags.IntVar(&uploadConcurrencyFlag, "concurrency-upload", 0, "number of files uploaded at the same time (overrides config)")
+	flags.StringVar(&tagsFlag, "tags", "", "comma separated tags recorded in snapshots (overrides config)")
+	flags.Int64Var(&maxUploadBytesFlag, "max-upload-bytes", 0, "stop uploading new files after this many bytes in each run, the snapshot is tagged partial (overrides config)")
+	flags.Parse(args)
+
+	conf := getConfig(configFileName)
+	refuseInReadOnlyMode("watch")
+	_, bucket, err := getOSSClient(&conf)
+	checkErr(err)
+
+	// hold the lock as long as watching
+	lock, err := acquireSyncLock(&conf, bucket, forceUnlock)
+	checkErr(err)
+	defer lock.release()
+	checkErr(checkRepositoryLayout(bucket, true))
+
+	applyBandwidthLimits(&conf)
+	applyPriority(&conf)
+	applyMemoryBudget(&conf)
+	applyTempBudget(&conf)
+
+	// mounted as long as watching
+	share, err := connectShare(&conf)
+	checkErr(err)
+	defer share.release()
+	basePath := sourceRootPath(&conf)
+
+	watcher, err := fsnotify.NewWatcher()
+	checkErr(err)
+	defer watcher.Close()
+
+	// watch before the first scan, so changes made during it are not lost
+	dirtyDirs := make(map[string]bool)
+	limits := newWalkLimits(&conf, basePath)
+	addWatchRecursive(watcher, limits, basePath, dirtyDirs)
+	dirtyDirs = make(map[string]bool)
+
+	startTime := time.Now()
+	lastSweep := waitForSweep(bucket)
+	refreshOnlineChunkList(&conf, bucket)
+	pipeline := newWatchPipeline(&conf, bucket)
+	indexPath := makeDirIndex(&conf, pipeline)
+	scanEnd := time.Now()
+	failedFiles := finishWatchPipeline(pipeline, indexPath)
+	changes := reportIndexChanges(&conf, indexPath)
+	uploadWatchSnapshot(&conf, bucket, lock, pipeline, indexPath, changes, startTime, scanEnd)
+	markFailedDirty(failedFiles, dirtyDirs)
+	markFailedDirty(recheckChunksAfterSweep(&conf, bucket, indexPath, lastSweep), dirtyDirs)
+
+	printMsg("watching", basePath, conf.Watch.Interval)
+
+	fullRescan := false
+	ticker := time.NewTicker(conf.Watch.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case event := <-watcher.Events:
+			markDirty(watcher, limits, event, dirtyDirs)
+
+		case err := <-watcher.Errors:
+			fmt.Printf("[Watch] %v\n", err)
+			if errors.Is(err, fsnotify.ErrEventOverflow) {
+				// some events are lost, only a full scan can be trusted now
+				fullRescan = true
+			}
+
+		case <-ticker.C:
+			if len(dirtyDirs) == 0 && !fullRescan {
+				continue
+			}
+
+			var newIndexPath string
+			var unreadable []string
+			startTime := time.Now()
+			// chunks in the list made when watching started may have been removed since
+			if latest := waitForSweep(bucket); latest != lastSweep {
+				refreshOnlineChunkList(&conf, bucket)
+				lastSweep = latest
+			}
+			pipeline := newWatchPipeline(&conf, bucket)
+			if fullRescan {
+				newIndexPath = makeDirIndex(&conf, pipeline)
+			} else {
+				newIndexPath, unreadable = makePartialDirIndex(&conf, indexPath, dirtyDirs, pipeline)
+			}
+			scanEnd := time.Now()
+			failedFiles := finishWatchPipeline(pipeline, newIndexPath)
+
+			changes := reportIndexChanges(&conf, newIndexPath)
+			uploadWatchSnapshot(&conf, bucket, lock, pipeline, newIndexPath, changes, startTime, scanEnd)
+
+			os.Remove(indexPath)
+			indexPath = newIndexPath
+			dirtyDirs = make(map[string]bool)
+			for _, dir := range unreadable {
+				dirtyDirs[dir] = true
+			}
+			markFailedDirty(failedFiles, dirtyDirs)
+			markFailedDirty(recheckChunksAfterSweep(&conf, bucket, newIndexPath, lastSweep), dirtyDirs)
+			fullRescan = false
+		}
+	}
+}
+
+// a pipeline for one watch run, limited by --max-upload-bytes and the quota like the one of fullSync
+func newWatchPipeline(conf *userConfig, bucket *oss.Bucket) *syncPipeline {
+	checkQuota(conf)
+	pipeline := newSyncPipeline(conf, bucket)
+	if conf.MaxUploadBytes > 0 {
+		pipeline.limitUploads(conf.MaxUploadBytes, "--max-upload-bytes")
+	}
+	if remaining, ok := quotaRemaining(conf); ok {
+		pipeline.limitUploads(remaining, "quota.refuse")
+	}
+	return pipeline
+}
+
+/*
+ * wait for the uploads of a watch run and settle its index like fullSync does.
+ * returns the files to scan again next time, those not uploaded and those left out by the upload limits.
+ */
+func finishWatchPipeline(pipeline *syncPipeline, indexPath string) (rescan []string) {
+	pipeline.wait()
+	if size, ok := repositorySize(); ok && pipeline.uploadedBytes > 0 {
+		setRepositorySize(size + pipeline.uploadedBytes)
+		checkQuota(pipeline.conf)
+	}
+
+	pipeline.restoreDeferredEntries(indexPath)
+	rescan = pipeline.dropFailedEntries(indexPath)
+	if pipeline.deferred > 0 {
+		checkErr(addIndexTag(indexPath, partialSnapshotTag))
+	}
+	return append(rescan, pipeline.deferredPaths...)
+}
+
+// upload the index of a watch run with its run metadata, stats and report, like fullSync does
+func uploadWatchSnapshot(conf *userConfig, bucket *oss.Bucket, lock *syncLock, pipeline *syncPipeline, indexPath string,
+	changes *indexChanges, startTime time.Time, scanEnd time.Time) {
+	run := newSnapshotRun(conf, pipeline, indexPath, startTime, scanEnd)
+	checkErr(updateIndexHeader(indexPath, func(header *indexHeader) {
+		header.Run = run
+	}))
+
+	checkErr(lock.check())
+	uploadIndexFile(conf, indexPath, bucket)
+	header, _ := readIndexHeader(indexPath)
+	uploadSnapshotStats(bucket, header, newSnapshotStats(indexPath, run))
+
+	report := &syncReport{Start: startTime, End: time.Now(), Uploaded: pipeline.uploaded, UploadedBytes: pipeline.uploadedBytes,
+		Deferred: pipeline.deferred, DeferredBytes: pipeline.deferredBytes, Changes: changes, Skipped: pipeline.skippedFiles}
+	report.Header = header
+	report.Files, report.Size = run.Files, run.Size
+	writeSyncReport(conf, bucket, report)
+}
+
+// scan the directories of files whose chunk could not be uploaded again next time
+func markFailedDirty(failedFiles []string, dirtyDirs map[string]bool) {
+	for _, failed := range failedFiles {
+		dirtyDirs[path.Dir(failed)] = true
+	}
+}
+
+// watch dir and all its sub directories not skipped by limits, marking each of them dirty
+func addWatchRecursive(watcher *fsnotify.Watcher, limits *walkLimits, dir string, dirtyDirs map[string]bool) {
+	basePath := limits.basePath
+	godirwalk.Walk(dir, &godirwalk.Options{
+		Callback: func(fullPath string, f *godirwalk.Dirent) error {
+			if !f.IsDir() {
+				return nil
+			}
+			if limits.skipFullPath(fullPath) {
+				return godirwalk.SkipThis
+			}
+
+			if err := watcher.Add(fullPath); err != nil {
+				fmt.Printf("[Watch] Could not watch %s: %v\n", fullPath, err)
+			}
+
+			dirtyDirs[relativeSlashPath(basePath, fullPath)] = true
+			return nil
+		},
+		ErrorCallback: func(fullPath string, err error) godirwalk.ErrorAction {
+			return godirwalk.SkipNode
+		},
+	})
+}
+
+func markDirty(watcher *fsnotify.Watcher, limits *walkLimits, event fsnotify.Event, dirtyDirs map[string]bool) {
+	basePath := limits.basePath
+	// ignore our own cache files
+	if strings.HasPrefix(filepath.Base(event.Name), specialFilePrefix) {
+		return
+	}
+
+	relativePath := relativeSlashPath(basePath, event.Name)
+	dirtyDirs[path.Dir(relativePath)] = true
+
+	if stat, err := os.Stat(event.Name); err != nil {
+		// removed or renamed, entries below it must be dropped as well
+		dirtyDirs[relativePath] = true
+	} else if stat.IsDir() && event.Op&fsnotify.Create == fsnotify.Create {
+		if !limits.excludes(relativePath) {
+			addWatchRecursive(watcher, limits, event.Name, dirtyDirs)
+		}
+	}
+}
+
+func relativeSlashPath(basePath string, fullPath string) string {
+	relativePath, _ := filepath.Rel(basePath, fullPath)
+	return filepath.ToSlash(relativePath)
+}
+
+/*
+ * build a new index from the previous one, re-scanning only the files directly inside dirtyDirs.
+ * dirty directories which do not exist anymore drop everything below them.
+ * those which cannot be read keep their previous entries, are reported as skipped and returned as unreadable.
+ */
+func makePartialDirIndex(conf *userConfig, prevIndexPath string, dirtyDirs map[string]bool, pipeline *syncPipeline) (indexFilePath string, unreadable []string) {
+	initCache(conf)
+	basePath := sourceRootPath(conf)
+	startTime := time.Now()
+
+	printMsg("indexingChanged", len(dirtyDirs), basePath)
+
+	limits := newWalkLimits(conf, basePath)
+
+	// dirtyDirs are named as on disk, index entries are NFC
+	changedDirs := make(map[string]bool)
+	goneDirs := make(map[string]bool)
+	for dir := range dirtyDirs {
+		changedDirs[normalizePath(dir)] = true
+		if _, err := os.Stat(longPath(filepath.Join(basePath, filepath.FromSlash(dir)))); err != nil {
+			goneDirs[normalizePath(dir)] = true
+		}
+	}
+
+	// read before dropping any entries, a directory busy or not readable right now keeps its old ones
+	dirEntries := make(map[string][]os.FileInfo)
+	for dir := range dirtyDirs {
+		if goneDirs[normalizePath(dir)] || limits.excludes(dir) {
+			continue
+		}
+
+		waitScanOp()
+		entries, err := ioutil.ReadDir(longPath(filepath.Join(basePath, filepath.FromSlash(dir))))
+		if err != nil {
+			recordSkippedFile(normalizePath(dir), err)
+			delete(changedDirs, normalizePath(dir))
+			unreadable = append(unreadable, dir)
+			continue
+		}
+		dirEntries[dir] = entries
+	}
+
+	indexFile, err := ioutil.TempFile(tempDir, "ossIndexTmp")
+	checkErr(err)
+	indexFilePath = indexFile.Name()
+	defer indexFile.Close()
+	writer := bufio.NewWriterSize(indexFile, 4096)
+
+	writeIndexHeader(writer, newIndexHeader(conf))
+
+	// keep unchanged entries
+	scanFileJSONLines(prevIndexPath, func(line *fileInfo) {
+		// indexes of older versions may have NFD entries
+		line.Path = normalizePath(line.Path)
+
+		dir := path.Dir(line.Path)
+		if changedDirs[dir] {
+			return
+		}
+		for ; dir != "." && dir != "/"; dir = path.Dir(dir) {
+			if goneDirs[dir] {
+				return
+			}
+		}
+
+		jsonRow, _ := json.Marshal(line)
+		writer.Write(jsonRow)
+		writer.WriteString("\n")
+	})
+
+	scanner := newIndexScanner(conf, writer, pipeline)
+
+	// re-scan files in changed directories
+	for dir, entries := range dirEntries {
+		fullDir := filepath.Join(basePath, filepath.FromSlash(dir))
+		for _, entry := range entries {
+			if !entry.IsDir() {
+				scanner.processFile(filepath.Join(fullDir, entry.Name()))
+			}
+		}
+	}
+
+	scanner.finish()
+
+	printMsg("indexingDone", time.Since(startTime).String())
+	return
+}